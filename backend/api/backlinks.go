@@ -2,6 +2,8 @@ package api
 
 type BackLinkList struct {
 	Items []BackLink `json:"items"`
+	// NextPageToken is passed as pageToken to get the next page; it is empty on the last page.
+	NextPageToken string `json:"nextPageToken,omitempty"`
 }
 
 // TODO(jeremy): Don't think this is the right data structure. What's the proper way to return BackLinks?
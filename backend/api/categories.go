@@ -0,0 +1,27 @@
+package api
+
+// CategoryList is a list of content categories.
+type CategoryList struct {
+	Items []Category `json:"items"`
+}
+
+// Category is a content category assigned to documents by the Natural Language API
+// e.g. "/Computers & Electronics/Software".
+type Category struct {
+	Name string `json:"name"`
+	// Documents is the number of documents in the category.
+	Documents int64 `json:"documents"`
+}
+
+// CategoryDocumentList is a list of documents in a category.
+type CategoryDocumentList struct {
+	Items []CategoryDocument `json:"items"`
+}
+
+// CategoryDocument is a document assigned to a category.
+type CategoryDocument struct {
+	DocId    string `json:"docId"`
+	Category string `json:"category"`
+	// Confidence of the classifier that the category represents the document in the range [0, 1].
+	Confidence float32 `json:"confidence"`
+}
@@ -0,0 +1,17 @@
+package api
+
+// DocumentList is a page of indexed documents.
+type DocumentList struct {
+	Items []Document `json:"items"`
+	// NextPageToken is passed as pageToken to get the next page; it is empty on the last page.
+	NextPageToken string `json:"nextPageToken,omitempty"`
+}
+
+// Document is an indexed document.
+type Document struct {
+	DocId    string `json:"docId"`
+	Name     string `json:"name"`
+	MimeType string `json:"mimeType"`
+	// ModifiedTime is the time the document was last modified in RFC 3339 format; empty if unknown.
+	ModifiedTime string `json:"modifiedTime,omitempty"`
+}
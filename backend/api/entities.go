@@ -0,0 +1,95 @@
+package api
+
+// EntityList is a page of entities.
+type EntityList struct {
+	Items []Entity `json:"items"`
+	// NextPageToken is passed as pageToken to get the next page; it is empty on the last page.
+	NextPageToken string `json:"nextPageToken,omitempty"`
+}
+
+// Entity is an entity found in the documents.
+type Entity struct {
+	Id           string `json:"id"`
+	Name         string `json:"name"`
+	Type         string `json:"type"`
+	WikipediaUrl string `json:"wikipediaUrl,omitempty"`
+}
+
+// EntityMentionList is a page of the mentions of entities in a document.
+type EntityMentionList struct {
+	Items []EntityMention `json:"items"`
+	// NextPageToken is passed as pageToken to get the next page; it is empty on the last page.
+	NextPageToken string `json:"nextPageToken,omitempty"`
+}
+
+// EntityMention is the mention of an entity in a document.
+type EntityMention struct {
+	EntityId   string `json:"entityId"`
+	Text       string `json:"text"`
+	StartIndex int64  `json:"startIndex"`
+	EndIndex   int64  `json:"endIndex"`
+	// Type of the mention; PROPER or COMMON.
+	Type string `json:"type"`
+	// Salience of the entity in the doc in the range [0, 1].
+	Salience float32 `json:"salience"`
+	// Sentence is the 1 based number of the sentence containing the mention; 0 if unknown.
+	Sentence int64 `json:"sentence"`
+}
+
+// EntityDocumentList is a list of the documents mentioning an entity.
+type EntityDocumentList struct {
+	Items []EntityDocument `json:"items"`
+}
+
+// EntityDocument summarizes the mentions of an entity in a document.
+type EntityDocument struct {
+	DocId string `json:"docId"`
+	// Salience of the entity in the doc; higher values mean the entity is more central to the doc.
+	Salience float32 `json:"salience"`
+	// Mentions is the number of times the entity is mentioned in the doc.
+	Mentions int64 `json:"mentions"`
+	// SentimentScore is the average sentiment of the mentions in the range [-1, 1].
+	SentimentScore float32 `json:"sentimentScore"`
+	// SentimentMagnitude is the total strength of the sentiment of the mentions.
+	SentimentMagnitude float32 `json:"sentimentMagnitude"`
+}
+
+// RelatedEntityList is a list of the entities mentioned together with an entity.
+type RelatedEntityList struct {
+	Items []RelatedEntity `json:"items"`
+}
+
+// RelatedEntity is an entity mentioned together with some other entity.
+type RelatedEntity struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Documents is the number of documents mentioning both entities.
+	Documents int64 `json:"documents"`
+	// Sentences is the number of sentences mentioning both entities.
+	Sentences int64 `json:"sentences"`
+}
+
+// EntityTimeline is the number of mentions of an entity over time.
+type EntityTimeline struct {
+	// Interval is the length of each period; either week or month.
+	Interval string           `json:"interval"`
+	Items    []TimelineBucket `json:"items"`
+}
+
+// TimelineBucket is the number of mentions of an entity in documents last modified in a period.
+type TimelineBucket struct {
+	// Start is the first day of the period in the form YYYY-MM-DD.
+	Start     string             `json:"start"`
+	Mentions  int64              `json:"mentions"`
+	Documents []TimelineDocument `json:"documents"`
+}
+
+// TimelineDocument is a document contributing mentions to a TimelineBucket.
+type TimelineDocument struct {
+	DocId string `json:"docId"`
+	Name  string `json:"name"`
+	// ModifiedTime is the time the document was last modified in RFC 3339 format.
+	ModifiedTime string `json:"modifiedTime"`
+	Mentions     int64  `json:"mentions"`
+}
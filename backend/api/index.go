@@ -0,0 +1,49 @@
+package api
+
+// IndexRequest is the request to start indexing. Exactly one of Drive and File must be set.
+type IndexRequest struct {
+	// Drive is the id of the drive to index.
+	Drive string `json:"drive,omitempty"`
+	// File is the id of a single file to index.
+	File string `json:"file,omitempty"`
+}
+
+// IndexJobList is a list of index jobs starting with the most recent.
+type IndexJobList struct {
+	Items []IndexJob `json:"items"`
+}
+
+// IndexJob is a run of the indexer.
+type IndexJob struct {
+	Id    string `json:"id"`
+	Drive string `json:"drive,omitempty"`
+	File  string `json:"file,omitempty"`
+	// State is one of pending, running, succeeded, failed or cancelled.
+	State string `json:"state"`
+	// Caller is the email of the user who started the job if known.
+	Caller string `json:"caller,omitempty"`
+	// DocsTotal is the number of docs that need to be processed.
+	DocsTotal int64 `json:"docsTotal"`
+	// DocsProcessed is the number of docs processed so far.
+	DocsProcessed int64  `json:"docsProcessed"`
+	Error         string `json:"error,omitempty"`
+	// StartTime is in RFC3339 format.
+	StartTime string `json:"startTime"`
+	// EndTime is in RFC3339 format. It is empty if the job hasn't finished.
+	EndTime string `json:"endTime,omitempty"`
+}
+
+// IndexEvent reports the progress of an index job. It is the data of the events streamed by the server.
+type IndexEvent struct {
+	// Type is one of docStarted, linksFound, entitiesFound, docFailed or runFinished.
+	Type string `json:"type"`
+	// Time is in RFC3339 format.
+	Time        string `json:"time"`
+	JobId       string `json:"jobId,omitempty"`
+	DocId       string `json:"docId,omitempty"`
+	Name        string `json:"name,omitempty"`
+	NumLinks    int    `json:"numLinks,omitempty"`
+	NumEntities int    `json:"numEntities,omitempty"`
+	NumDocs     int    `json:"numDocs,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
@@ -0,0 +1,29 @@
+package api
+
+// KeyphraseList is a list of keyphrases.
+type KeyphraseList struct {
+	Items []Keyphrase `json:"items"`
+}
+
+// Keyphrase is a noun phrase e.g. "feature store" extracted from documents.
+type Keyphrase struct {
+	Phrase string `json:"phrase"`
+	// Documents is the number of documents mentioning the keyphrase.
+	Documents int64 `json:"documents"`
+}
+
+// KeyphraseDocumentList is a list of documents matching a keyphrase search.
+type KeyphraseDocumentList struct {
+	Items []KeyphraseDocument `json:"items"`
+}
+
+// KeyphraseDocument is a document mentioning a keyphrase.
+type KeyphraseDocument struct {
+	DocId  string `json:"docId"`
+	Phrase string `json:"phrase"`
+	// Mentions is the number of times the keyphrase is mentioned in the doc.
+	Mentions int64 `json:"mentions"`
+	// Weight is the TF-IDF weight of the keyphrase in the doc; higher values mean the keyphrase is more specific
+	// to the doc.
+	Weight float64 `json:"weight"`
+}
@@ -0,0 +1,15 @@
+package api
+
+// PersonDocumentList is a list of the documents a person is related to.
+type PersonDocumentList struct {
+	// EntityId is the id of the person entity. It can be used to look up the documents mentioning the person.
+	EntityId string           `json:"entityId"`
+	Items    []PersonDocument `json:"items"`
+}
+
+// PersonDocument is the relationship between a person and a document.
+type PersonDocument struct {
+	DocId string `json:"docId"`
+	// Role is one of owner, lastModifier or a Drive permission role e.g. writer.
+	Role string `json:"role"`
+}
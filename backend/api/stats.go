@@ -0,0 +1,54 @@
+package api
+
+// Stats summarizes the index.
+type Stats struct {
+	Docs  DocStats  `json:"docs"`
+	Links LinkStats `json:"links"`
+	// TopEntities are the entities with the most mentions.
+	TopEntities []EntityCount `json:"topEntities"`
+	// TopLinkedDocs are the documents with the most links from other documents.
+	TopLinkedDocs []LinkedDoc `json:"topLinkedDocs"`
+	// Unlinked are documents which no other document links to.
+	Unlinked []LinkedDoc `json:"unlinked"`
+}
+
+// DocStats counts the documents.
+type DocStats struct {
+	Total int64 `json:"total"`
+	// ByMimeType is the number of documents of each MIME type.
+	ByMimeType map[string]int64 `json:"byMimeType"`
+	// ByState is the number of documents in each index state; pending, stale or indexed.
+	ByState map[string]int64 `json:"byState"`
+	// Unlinked is the number of documents which no other document links to.
+	Unlinked int64 `json:"unlinked"`
+}
+
+// LinkStats counts the links in the documents.
+type LinkStats struct {
+	Total int64 `json:"total"`
+	// Internal links point to Google Drive files. External links point to anything else.
+	Internal int64 `json:"internal"`
+	External int64 `json:"external"`
+	// Resolved internal links point to indexed documents. Dangling ones point to files which aren't indexed.
+	Resolved int64 `json:"resolved"`
+	Dangling int64 `json:"dangling"`
+}
+
+// EntityCount is the number of mentions of an entity.
+type EntityCount struct {
+	Id        string `json:"id"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Mentions  int64  `json:"mentions"`
+	Documents int64  `json:"documents"`
+}
+
+// LinkedDoc is a document and the number of links to it.
+type LinkedDoc struct {
+	DocId string `json:"docId"`
+	Name  string `json:"name"`
+	// Links is the number of links to the document from other documents.
+	Links int64 `json:"links,omitempty"`
+	// Sources is the number of documents linking to it.
+	Sources int64 `json:"sources,omitempty"`
+}
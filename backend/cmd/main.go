@@ -24,7 +24,9 @@ import (
 	"github.com/go-logr/logr"
 	"github.com/jlewi/p22h/backend/pkg/datastore"
 	"github.com/jlewi/p22h/backend/pkg/gdocs"
+	"github.com/jlewi/p22h/backend/pkg/glanguage"
 	"github.com/jlewi/p22h/backend/pkg/logging"
+	"github.com/jlewi/p22h/backend/pkg/oidctesting"
 	"github.com/jlewi/p22h/backend/pkg/output"
 	"github.com/jlewi/p22h/backend/pkg/server"
 	kfGcp "github.com/kubeflow/internal-acls/google_groups/pkg/gcp"
@@ -37,15 +39,24 @@ import (
 	languagepb "google.golang.org/genproto/googleapis/cloud/language/v1"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"os/user"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 )
 
 type globalOptions struct {
-	level string
-	debug bool
+	level   string
+	debug   bool
+	keyFile string
+	keyring string
 }
 
 type runOptions struct {
@@ -60,6 +71,165 @@ type gcpOptions struct {
 	secret          string
 }
 
+// entityFilterOptions are the flags used to configure the gdocs.EntityFilter.
+type entityFilterOptions struct {
+	file          string
+	types         []string
+	minSalience   float32
+	mentionPolicy string
+	stopList      []string
+}
+
+func (o *entityFilterOptions) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&o.file, "entity-filter", "", "", "Optional YAML or JSON file containing the policy used to select entities. Other --entity-* flags override values in the file.")
+	cmd.Flags().StringSliceVarP(&o.types, "entity-types", "", []string{}, "The entity types to keep e.g. PERSON,ORGANIZATION. It can't be empty.")
+	cmd.Flags().Float32VarP(&o.minSalience, "entity-min-salience", "", 0, "The minimum salience an entity must have to be kept.")
+	cmd.Flags().StringVarP(&o.mentionPolicy, "entity-mention-policy", "", gdocs.MentionPolicyProperOrLinked, fmt.Sprintf("Which entities to keep based on their mentions; one of %v, %v, %v", gdocs.MentionPolicyAny, gdocs.MentionPolicyProper, gdocs.MentionPolicyProperOrLinked))
+	cmd.Flags().StringSliceVarP(&o.stopList, "entity-stop-list", "", []string{}, "Names of entities to always drop.")
+}
+
+// build creates the filter from the file (if any) and any flags explicitly set on the command line.
+func (o *entityFilterOptions) build(cmd *cobra.Command) (*gdocs.EntityFilter, error) {
+	filter := gdocs.DefaultEntityFilter()
+	if o.file != "" {
+		f, err := gdocs.ReadEntityFilter(o.file)
+		if err != nil {
+			return nil, err
+		}
+		filter = f
+	}
+
+	if cmd.Flags().Changed("entity-types") {
+		filter.AllowedTypes = o.types
+	}
+	if cmd.Flags().Changed("entity-min-salience") {
+		filter.MinSalience = o.minSalience
+	}
+	if cmd.Flags().Changed("entity-mention-policy") {
+		filter.MentionPolicy = o.mentionPolicy
+	}
+	if cmd.Flags().Changed("entity-stop-list") {
+		filter.StopList = o.stopList
+	}
+
+	if err := filter.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "Invalid entity filter")
+	}
+	return filter, nil
+}
+
+// shutdownTimeout is how long the server waits for in flight requests when shutting down.
+const shutdownTimeout = 30 * time.Second
+
+// databaseHelp is the help for the --database flag. See datastore.Open.
+const databaseHelp = "The path of the sqlite database to use or the URL of a Postgres database e.g. postgres://user@host/p22h"
+
+// openStore opens the database with the encryption key configured by the global flags or environment, if any.
+func openStore(dbFile string, opts ...datastore.DatastoreOption) (datastore.Store, error) {
+	key, err := datastore.LoadEncryptionKey(datastore.KeySource{File: gOpts.keyFile, Keyring: gOpts.keyring, Env: datastore.EncryptionKeyEnv})
+	if err != nil {
+		return nil, err
+	}
+	return datastore.Open(dbFile, log, append(opts, datastore.DatastoreWithEncryptionKey(key))...)
+}
+
+// authOptions are the flags used to configure how the server authenticates callers.
+type authOptions struct {
+	aclFilter    bool
+	callerHeader string
+	groupsFile   string
+
+	oidcIssuer           string
+	oidcClientID         string
+	oidcClientSecretFile string
+	oidcRedirectURL      string
+	oidcAudiences        []string
+	allowEmails          []string
+	allowDomains         []string
+	sessionKeyFile       string
+	sessionTTL           time.Duration
+}
+
+func (o *authOptions) addFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVarP(&o.aclFilter, "acl-filter", "", false, "Only return documents the caller can read according to the Drive permissions stored by index --acls. Requires --caller-header or --oidc-issuer.")
+	cmd.Flags().StringVarP(&o.callerHeader, "caller-header", "", "", "Header containing the email of the caller set by an authenticating proxy e.g. X-Goog-Authenticated-User-Email. Only use this if the server can't be reached without going through the proxy.")
+	cmd.Flags().StringVarP(&o.groupsFile, "groups-file", "", "", "Optional YAML or JSON file listing the members of groups; used to match permissions granted to groups.")
+	cmd.Flags().StringVarP(&o.oidcIssuer, "oidc-issuer", "", "", "URL of the OpenID Connect provider users log in with e.g. https://accounts.google.com. If set every request except /healthz must be authenticated.")
+	cmd.Flags().StringVarP(&o.oidcClientID, "oidc-client-id", "", "", "The OAuth client id registered with the OIDC provider.")
+	cmd.Flags().StringVarP(&o.oidcClientSecretFile, "oidc-client-secret-file", "", "", "File containing the OAuth client secret.")
+	cmd.Flags().StringVarP(&o.oidcRedirectURL, "oidc-redirect-url", "", "", "The URL the provider redirects to after login e.g. https://p22h.example.com/auth/callback. It must be registered with the provider.")
+	cmd.Flags().StringSliceVarP(&o.oidcAudiences, "oidc-audiences", "", []string{}, "Additional audiences accepted in bearer ID tokens e.g. the client id of a CLI.")
+	cmd.Flags().StringSliceVarP(&o.allowEmails, "allow-emails", "", []string{}, "Emails of users allowed to log in.")
+	cmd.Flags().StringSliceVarP(&o.allowDomains, "allow-domains", "", []string{}, "Domains whose users are allowed to log in e.g. example.com.")
+	cmd.Flags().StringVarP(&o.sessionKeyFile, "session-key-file", "", "", "File containing the key (at least 32 bytes) used to sign session cookies. If not set a random key is used and sessions don't survive restarts.")
+	cmd.Flags().DurationVarP(&o.sessionTTL, "session-ttl", "", 24*time.Hour, "How long sessions last before users have to log in again.")
+}
+
+// build creates the server options for authentication.
+func (o *authOptions) build(ctx context.Context) ([]server.ServerOption, error) {
+	if o.callerHeader != "" && o.oidcIssuer != "" {
+		return nil, errors.New("Only one of --caller-header and --oidc-issuer can be set")
+	}
+
+	opts := []server.ServerOption{server.ServerWithACLFilter(o.aclFilter)}
+
+	var groups server.GroupResolver
+	if o.groupsFile != "" {
+		g, err := server.ReadStaticGroups(o.groupsFile)
+		if err != nil {
+			return nil, err
+		}
+		groups = g
+	}
+
+	if o.callerHeader != "" {
+		opts = append(opts, server.ServerWithAuthenticator(&server.HeaderAuthenticator{Header: o.callerHeader, Groups: groups}))
+	}
+
+	if o.oidcIssuer == "" {
+		return opts, nil
+	}
+
+	config := server.OIDCConfig{
+		Issuer:      o.oidcIssuer,
+		ClientID:    o.oidcClientID,
+		RedirectURL: o.oidcRedirectURL,
+		Audiences:   o.oidcAudiences,
+	}
+
+	if o.oidcClientSecretFile != "" {
+		b, err := ioutil.ReadFile(o.oidcClientSecretFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to read client secret from file: %v", o.oidcClientSecretFile)
+		}
+		config.ClientSecret = strings.TrimSpace(string(b))
+	}
+
+	var key []byte
+	var err error
+	if o.sessionKeyFile != "" {
+		key, err = server.ReadSessionKey(o.sessionKeyFile)
+	} else {
+		log.Info("--session-key-file isn't set; using a random key so sessions won't survive restarts")
+		key, err = server.NewSessionKey()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sessions, err := server.NewSessions(key, o.sessionTTL, strings.HasPrefix(o.oidcRedirectURL, "https://"))
+	if err != nil {
+		return nil, err
+	}
+
+	allowlist := &server.Allowlist{Emails: o.allowEmails, Domains: o.allowDomains}
+	a, err := server.NewOIDCAuthenticator(ctx, config, sessions, allowlist, groups, log)
+	if err != nil {
+		return nil, err
+	}
+	return append(opts, server.ServerWithOIDC(a)), nil
+}
+
 var (
 	log     logr.Logger
 	gOpts   globalOptions
@@ -137,6 +307,11 @@ func newRunCmd() *cobra.Command {
 	var staticPath string
 	var port int
 	var dbFile string
+	var indexJobs bool
+	var indexInterval time.Duration
+	var drives []string
+	authOpts := &authOptions{}
+	indexerOpts := &indexerOptions{}
 	runCmd := &cobra.Command{
 		Use:   "run",
 		Short: "run the server.",
@@ -146,18 +321,83 @@ func newRunCmd() *cobra.Command {
 				if err != nil {
 					return errors.Wrapf(err, "Failed to listen on port %v", rOpts.port)
 				}
-				store, err := datastore.New(dbFile, log)
+				store, err := openStore(dbFile)
 
 				if err != nil {
 					return err
 				}
-				s, err := server.NewServer(staticPath, listener, store, log)
+				opts, err := authOpts.build(context.Background())
+				if err != nil {
+					return err
+				}
+
+				if indexInterval > 0 && len(drives) == 0 {
+					return errors.New("--drive must be set when --index-interval is set")
+				}
+
+				var jobs *gdocs.JobManager
+				if indexJobs || indexInterval > 0 {
+					newIndexer, err := indexerOpts.newIndexerFactory(cmd, store)
+					if err != nil {
+						return err
+					}
+
+					hub := gdocs.NewEventHub()
+					jobs, err = gdocs.NewJobManager(store, newIndexer, log, gdocs.JobManagerWithObserver(hub))
+					if err != nil {
+						return err
+					}
+					opts = append(opts, server.ServerWithEvents(hub))
+				}
+
+				if indexJobs {
+					opts = append(opts, server.ServerWithIndexJobs(jobs))
+				}
+
+				s, err := server.NewServer(staticPath, listener, store, log, opts...)
 
 				if err != nil {
 					return errors.Wrapf(err, "Failed to create new server")
 				}
 
+				ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+				defer stop()
+
+				schedulerDone := make(chan struct{})
+				if indexInterval > 0 {
+					scheduler, err := gdocs.NewScheduler(jobs, drives, indexInterval, log)
+					if err != nil {
+						return err
+					}
+					go func() {
+						scheduler.Run(ctx)
+						close(schedulerDone)
+					}()
+				} else {
+					close(schedulerDone)
+				}
+
+				go func() {
+					<-ctx.Done()
+					log.Info("Shutting down")
+					shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+					defer cancel()
+					if err := s.Shutdown(shutdownCtx); err != nil {
+						log.Error(err, "Failed to shut down the server")
+					}
+				}()
+
 				err = s.StartAndBlock()
+				// Stop the scheduler if the server exited for some other reason.
+				stop()
+
+				// Stop any running index job; it is marked cancelled and the docs it didn't process are picked up by
+				// the next run.
+				if jobs != nil {
+					jobs.Shutdown()
+				}
+				<-schedulerDone
+
 				if err != nil {
 					return errors.Wrapf(err, "Server exited abnormally")
 				}
@@ -174,7 +414,12 @@ func newRunCmd() *cobra.Command {
 	runCmd.Flags().IntVarP(&port, "port", "p", 8080, "Port to serve on")
 
 	dbDefault := getDbDefault()
-	runCmd.Flags().StringVarP(&dbFile, "database", "", dbDefault, "The path of the sqllite database to use")
+	runCmd.Flags().StringVarP(&dbFile, "database", "", dbDefault, databaseHelp)
+	authOpts.addFlags(runCmd)
+	runCmd.Flags().BoolVarP(&indexJobs, "index-jobs", "", false, "Serve the API to start and monitor index jobs. The indexing flags e.g. --credentials-file configure the jobs. Requires authentication i.e. --oidc-issuer or --caller-header since jobs spend the Natural Language API budget.")
+	runCmd.Flags().DurationVarP(&indexInterval, "index-interval", "", 0, "If set the drives in --drive are incrementally indexed every interval e.g. 15m. The interval is randomly varied by up to 10%. 0 disables scheduled indexing.")
+	runCmd.Flags().StringSliceVarP(&drives, "drive", "", []string{}, "The IDs of the drives to index on the schedule set by --index-interval.")
+	indexerOpts.addFlags(runCmd)
 
 	return runCmd
 }
@@ -276,7 +521,7 @@ func newGetEntitiesCmd() *cobra.Command {
 				client, err := language.NewClient(ctx)
 
 				if err != nil {
-					return errors.Wrapf(err, "failed to create Google Cloud Language Client; error %v")
+					return errors.Wrapf(err, "failed to create Google Cloud Language Client")
 				}
 
 				resp, err := client.AnalyzeEntities(ctx, &languagepb.AnalyzeEntitiesRequest{
@@ -326,10 +571,152 @@ func newGetEntitiesCmd() *cobra.Command {
 	return cmd
 }
 
+// indexerOptions are the flags used to configure the gdocs.Indexer.
+type indexerOptions struct {
+	nlpCache        bool
+	redact          bool
+	entitySentiment bool
+	classify        bool
+	keyphrases      bool
+	people          bool
+	acls            bool
+	redactionConfig string
+	budget          gdocs.UsageBudget
+	filterOpts      entityFilterOptions
+}
+
+func (o *indexerOptions) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&gcpOpts.credentialsFile, "credentials-file", "", "", "JSON File containing OAuth2Client credentials as downloaded from APIConsole. Can be a GCS file.")
+	cmd.Flags().Int64VarP(&o.budget.MaxUnits, "nlp-budget", "", 0, "The maximum number of Natural Language API units (1000 characters) to use in each budget period. Once exceeded entities aren't processed but links are still indexed. 0 means unlimited.")
+	cmd.Flags().StringVarP(&o.budget.Period, "nlp-budget-period", "", gdocs.BudgetPeriodMonth, fmt.Sprintf("The period the budget applies to; one of %v, %v, %v", gdocs.BudgetPeriodRun, gdocs.BudgetPeriodDay, gdocs.BudgetPeriodMonth))
+	cmd.Flags().BoolVarP(&o.entitySentiment, "entity-sentiment", "", false, "Use AnalyzeEntitySentiment to compute the sentiment of entity mentions. This costs more than AnalyzeEntities.")
+	cmd.Flags().BoolVarP(&o.classify, "classify", "", false, "Use ClassifyText to assign content categories to documents.")
+	cmd.Flags().BoolVarP(&o.keyphrases, "keyphrases", "", false, "Use AnalyzeSyntax to extract keyphrases (noun phrases such as \"feature store\") that aren't recognized as entities. Keyphrases aren't encrypted so this can't be used with an encrypted database.")
+	cmd.Flags().BoolVarP(&o.people, "people", "", false, "Fetch the owners and collaborators of files from Drive, store them as person entities keyed by email and link PERSON mentions to them by name. Emails aren't encrypted so this can't be used with an encrypted database.")
+	cmd.Flags().BoolVarP(&o.acls, "acls", "", false, "Fetch the permissions of files from Drive so the server can filter responses with --acl-filter. Permissions aren't encrypted so this can't be used with an encrypted database.")
+	cmd.Flags().BoolVarP(&o.redact, "redact", "", false, "Mask emails and phone numbers before sending text to the Natural Language API.")
+	cmd.Flags().StringVarP(&o.redactionConfig, "redaction-config", "", "", "Optional YAML or JSON file containing the patterns to mask before sending text to the Natural Language API. Implies --redact.")
+	cmd.Flags().BoolVarP(&o.nlpCache, "nlp-cache", "", true, "Cache responses from the Natural Language API in the database so reindexing unchanged text doesn't call the API.")
+	o.filterOpts.addFlags(cmd)
+}
+
+// checkEncrypted returns an error if the flags extract data which can't be encrypted. Keyphrases, the emails of
+// people and the principals of ACLs are IDs so they would be stored in plain text in an encrypted database.
+func (o *indexerOptions) checkEncrypted() error {
+	disallowed := []string{}
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{{name: "--keyphrases", set: o.keyphrases}, {name: "--people", set: o.people}, {name: "--acls", set: o.acls}} {
+		if f.set {
+			disallowed = append(disallowed, f.name)
+		}
+	}
+	if len(disallowed) > 0 {
+		return errors.Errorf("The database is encrypted but %v would store keyphrases, emails or ACLs in plain text; index without them", strings.Join(disallowed, ", "))
+	}
+	return nil
+}
+
+// newIndexerFactory creates the clients needed to index Google Drive and returns a factory creating indexers
+// configured by the flags. Each indexer gets its own UsageMeter so usage is reported per run; it is returned by
+// the indexer's UsageMeter method.
+func (o *indexerOptions) newIndexerFactory(cmd *cobra.Command, store datastore.Store) (gdocs.IndexerFactory, error) {
+	filter, err := o.filterOpts.build(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	if db, ok := store.(*datastore.Datastore); ok && db.Encrypted() {
+		if err := o.checkEncrypted(); err != nil {
+			return nil, err
+		}
+	}
+
+	opts := []gdocs.IndexerOption{gdocs.IndexerWithEntityFilter(filter), gdocs.IndexerWithEntitySentiment(o.entitySentiment), gdocs.IndexerWithClassification(o.classify), gdocs.IndexerWithKeyphrases(o.keyphrases), gdocs.IndexerWithPeople(o.people), gdocs.IndexerWithACLs(o.acls)}
+
+	if o.redactionConfig != "" {
+		redactor, err := gdocs.ReadPatternRedactor(o.redactionConfig)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, gdocs.IndexerWithRedactor(redactor))
+	} else if o.redact {
+		redactor, err := gdocs.NewPatternRedactor(gdocs.DefaultRedactionRules(), "")
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, gdocs.IndexerWithRedactor(redactor))
+	}
+	// Create gdocs client
+	helper := getWebFlowLocal()
+	if helper == nil {
+		return nil, errors.New("Unable to create gcp credential helper")
+	}
+	ts, err := helper.GetTokenSource(context.Background())
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get token source")
+	}
+
+	client := oauth2.NewClient(context.Background(), ts)
+
+	gClient, err := gdocs.NewClient(client, log)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create docs client service")
+	}
+
+	docsService, err := docs.NewService(context.Background(), option.WithHTTPClient(client))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create docs service")
+	}
+
+	lClient, err := language.NewClient(context.Background())
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create Google Cloud Language Client")
+	}
+
+	opts = append(opts, gdocs.IndexerWithHTTPClient(client))
+
+	factory := func(extra ...gdocs.IndexerOption) (*gdocs.Indexer, error) {
+		m, err := gdocs.NewUsageMeter(store, o.budget, log)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to create usage meter")
+		}
+
+		var nlpClient glanguage.Client
+		nlpClient, err = glanguage.NewMeteredClient(lClient, m, log)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to create metered Google Cloud Language Client")
+		}
+
+		if o.nlpCache {
+			nlpClient, err = glanguage.NewCachedClient(nlpClient, store, log)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Failed to create cached Google Cloud Language Client")
+			}
+		}
+
+		// Copy opts since factory is called concurrently by jobs; appending to opts could share its backing array.
+		indexerOpts := make([]gdocs.IndexerOption, 0, len(opts)+len(extra)+1)
+		indexerOpts = append(indexerOpts, opts...)
+		indexerOpts = append(indexerOpts, gdocs.IndexerWithUsageMeter(m))
+		indexerOpts = append(indexerOpts, extra...)
+		indexer, err := gdocs.NewIndexer(gClient, docsService, store, nlpClient, log, indexerOpts...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to create drive indexer")
+		}
+		return indexer, nil
+	}
+	return factory, nil
+}
+
 func newIndexCmd() *cobra.Command {
 	var dbFile string
 	var drive string
 	var file string
+	indexerOpts := &indexerOptions{}
 	cmd := &cobra.Command{
 		Use:   "index",
 		Short: "Index Google Drive.",
@@ -338,74 +725,993 @@ func newIndexCmd() *cobra.Command {
 				if file == "" && drive == "" {
 					return errors.Errorf("One of --file and --drive must be set")
 				}
-				// Create gdocs client
-				helper := getWebFlowLocal()
-				if helper == nil {
-					return errors.New("Unable to create gcp credential helper")
+
+				store, err := openStore(dbFile)
+
+				if err != nil {
+					return err
 				}
-				ts, err := helper.GetTokenSource(context.Background())
 
+				newIndexer, err := indexerOpts.newIndexerFactory(cmd, store)
 				if err != nil {
-					return errors.Wrap(err, "Failed to get token source")
+					return err
 				}
 
-				client := oauth2.NewClient(context.Background(), ts)
+				indexer, err := newIndexer(gdocs.IndexerWithObserver(gdocs.ObserverFunc(logIndexEvent)))
+				if err != nil {
+					return err
+				}
+
+				if file != "" {
+					if err := indexer.IndexDocument(context.Background(), file); err != nil {
+						return errors.Wrapf(err, "Failed to index drive %v", drive)
+					}
+				}
+
+				if drive != "" {
+					if err := indexer.Index(context.Background(), drive); err != nil {
+						return errors.Wrapf(err, "Failed to index drive %v", drive)
+					}
+				}
+
+				usage := indexer.UsageMeter().RunUsage()
+				log.Info("Natural Language API usage for this run", "runId", usage.RunID, "requests", usage.Requests, "numCharacters", usage.NumCharacters, "units", usage.Units)
+				return nil
+			}()
+
+			if err != nil {
+				log.Error(err, fmt.Sprintf("Failed to index Google Drive: %+v", err))
+			}
+		},
+	}
+
+	dbDefault := getDbDefault()
+	cmd.Flags().StringVarP(&dbFile, "database", "", dbDefault, databaseHelp)
+
+	cmd.Flags().StringVarP(&drive, "drive", "d", "", "The ID of the drive to index")
+	cmd.Flags().StringVarP(&file, "file", "f", "", "The ID of a specific file to index")
+	indexerOpts.addFlags(cmd)
+	return cmd
+}
+
+// logIndexEvent reports the progress of the index command. Per doc events are only logged at debug level
+// since the indexer already logs the docs it processes.
+func logIndexEvent(e gdocs.IndexEvent) {
+	switch e.Type {
+	case gdocs.EventDocFailed:
+		log.Info("Failed to index doc", "docId", e.DocID, "name", e.Name, "error", e.Error)
+	case gdocs.EventRunFinished:
+		log.Info("Indexing finished", "numDocs", e.NumDocs, "error", e.Error)
+	default:
+		log.V(logging.Debug).Info("Index event", "type", e.Type, "docId", e.DocID, "name", e.Name, "numLinks", e.NumLinks, "numEntities", e.NumEntities)
+	}
+}
+
+func newCacheCmd() *cobra.Command {
+	var dbFile string
+	cmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the cache of Natural Language API responses.",
+	}
+
+	statsCmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Print statistics about the cache.",
+		Run: func(cmd *cobra.Command, args []string) {
+			err := func() error {
+				store, err := openStore(dbFile)
+				if err != nil {
+					return err
+				}
 
-				gClient, err := gdocs.NewClient(client, log)
+				stats, err := store.GetNLPCacheStats()
 				if err != nil {
-					return errors.Wrapf(err, "Failed to create docs client service")
+					return err
+				}
+
+				fmt.Printf("Results:\n%v\n", output.PrettyString(stats))
+				return nil
+			}()
+
+			if err != nil {
+				log.Error(err, "Failed to get cache stats")
+			}
+		},
+	}
+
+	var method string
+	var olderThan time.Duration
+	purgeCmd := &cobra.Command{
+		Use:   "purge",
+		Short: "Delete cached responses.",
+		Run: func(cmd *cobra.Command, args []string) {
+			err := func() error {
+				store, err := openStore(dbFile)
+				if err != nil {
+					return err
 				}
 
-				store, err := datastore.New(dbFile, log)
+				cutoff := time.Time{}
+				if olderThan > 0 {
+					cutoff = time.Now().Add(-olderThan)
+				}
 
+				num, err := store.PurgeNLPCache(method, cutoff)
 				if err != nil {
 					return err
 				}
 
-				docsService, err := docs.NewService(context.Background(), option.WithHTTPClient(client))
+				fmt.Printf("Deleted %v cached responses\n", num)
+				return nil
+			}()
+
+			if err != nil {
+				log.Error(err, "Failed to purge cache")
+			}
+		},
+	}
+
+	purgeCmd.Flags().StringVarP(&method, "method", "", "", "Optional only delete responses for this method e.g. AnalyzeEntities.")
+	purgeCmd.Flags().DurationVarP(&olderThan, "older-than", "", 0, "Optional only delete responses older than this duration e.g. 720h.")
+
+	dbDefault := getDbDefault()
+	cmd.PersistentFlags().StringVarP(&dbFile, "database", "", dbDefault, databaseHelp)
+
+	cmd.AddCommand(statsCmd)
+	cmd.AddCommand(purgeCmd)
+	return cmd
+}
+
+func newDbCmd() *cobra.Command {
+	var dbFile string
+	cmd := &cobra.Command{
+		Use:   "db",
+		Short: "Manage the schema, backups and encryption of the database.",
+	}
+
+	// open opens the database without applying pending migrations.
+	open := func() (*datastore.Datastore, error) {
+		store, err := datastore.Open(dbFile, log, datastore.DatastoreWithoutMigrations())
+		if err != nil {
+			return nil, err
+		}
+		db, ok := store.(*datastore.Datastore)
+		if !ok {
+			return nil, errors.Errorf("Database %v doesn't have a schema; it must be SQLite or Postgres", dbFile)
+		}
+		return db, nil
+	}
+
+	var migrateTo int
+	migrateCmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Apply pending migrations.",
+		Run: func(cmd *cobra.Command, args []string) {
+			err := func() error {
+				db, err := open()
 				if err != nil {
-					return errors.Wrapf(err, "failed to create docs service; error %v")
+					return err
 				}
+				defer db.Close()
 
-				nlpClient, err := language.NewClient(context.Background())
+				if err := db.Migrate(migrateTo); err != nil {
+					return err
+				}
 
+				version, err := db.SchemaVersion()
 				if err != nil {
-					return errors.Wrapf(err, "failed to create Google Cloud Language Client; error %v")
+					return err
 				}
+				fmt.Printf("Database is at schema version %v\n", version)
+				return nil
+			}()
+
+			if err != nil {
+				log.Error(err, "Failed to migrate the database")
+			}
+		},
+	}
 
-				indexer, err := gdocs.NewIndexer(gClient, docsService, store, nlpClient, log, gdocs.IndexerWithHTTPClient(client))
+	statusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Print the status of the migrations.",
+		Run: func(cmd *cobra.Command, args []string) {
+			err := func() error {
+				db, err := open()
+				if err != nil {
+					return err
+				}
+				defer db.Close()
 
+				status, err := db.MigrationStatus()
 				if err != nil {
-					return errors.Wrapf(err, "Failed to create drive indexer")
+					return err
 				}
 
-				if file != "" {
-					if err := indexer.IndexDocument(file); err != nil {
-						return errors.Wrapf(err, "Failed to index drive %v", drive)
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintf(w, "VERSION\tNAME\tSTATUS\tAPPLIED AT\n")
+				for _, m := range status {
+					state := "pending"
+					appliedAt := ""
+					if m.Applied {
+						state = "applied"
+						appliedAt = m.AppliedAt.Format(time.RFC3339)
+					}
+					if m.Unknown {
+						state = "unknown"
 					}
+					fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", m.Version, m.Name, state, appliedAt)
 				}
+				return w.Flush()
+			}()
 
-				if drive != "" {
-					if err := indexer.Index(drive); err != nil {
-						return errors.Wrapf(err, "Failed to index drive %v", drive)
+			if err != nil {
+				log.Error(err, "Failed to get the migration status")
+			}
+		},
+	}
+
+	var rollbackTo int
+	rollbackCmd := &cobra.Command{
+		Use:   "rollback",
+		Short: "Revert applied migrations.",
+		Run: func(cmd *cobra.Command, args []string) {
+			err := func() error {
+				db, err := open()
+				if err != nil {
+					return err
+				}
+				defer db.Close()
+
+				target := rollbackTo
+				if target < 0 {
+					version, err := db.SchemaVersion()
+					if err != nil {
+						return err
+					}
+					if version == 0 {
+						return errors.New("There are no migrations to roll back")
 					}
+					target = version - 1
 				}
+
+				if err := db.Rollback(target); err != nil {
+					return err
+				}
+				fmt.Printf("Database is at schema version %v\n", target)
 				return nil
 			}()
 
 			if err != nil {
-				log.Error(err, fmt.Sprintf("Failed to index Google Drive: %+v", err))
+				log.Error(err, "Failed to roll back the database")
 			}
 		},
 	}
 
-	cmd.Flags().StringVarP(&gcpOpts.credentialsFile, "credentials-file", "", "", "JSON File containing OAuth2Client credentials as downloaded from APIConsole. Can be a GCS file.")
+	var backupTo string
+	var keep int
+	backupCmd := &cobra.Command{
+		Use:   "backup",
+		Short: "Back up the database.",
+		Long: `Back up the SQLite database using the online backup API.
 
-	dbDefault := getDbDefault()
-	cmd.Flags().StringVarP(&dbFile, "database", "", dbDefault, "The path of the sqllite database to use")
+It is safe to run while the server is running. Each backup is a timestamped
+copy of the database in the backup directory; older backups are deleted so
+that at most --keep backups are kept.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := func() error {
+				db, err := open()
+				if err != nil {
+					return err
+				}
+				defer db.Close()
 
-	cmd.Flags().StringVarP(&drive, "drive", "d", "", "The ID of the drive to index")
-	cmd.Flags().StringVarP(&file, "file", "f", "", "The ID of a specific file to index")
+				dir := backupTo
+				if dir == "" {
+					dir = filepath.Join(filepath.Dir(dbFile), "backups")
+				}
+
+				dest := datastore.BackupPath(dir, dbFile, time.Now())
+				if err := db.Backup(dest); err != nil {
+					return err
+				}
+				fmt.Printf("Backed up %v to %v\n", dbFile, dest)
+
+				deleted, err := datastore.RotateBackups(dir, dbFile, keep)
+				for _, f := range deleted {
+					fmt.Printf("Deleted old backup %v\n", f)
+				}
+				return err
+			}()
+
+			if err != nil {
+				log.Error(err, "Failed to back up the database")
+			}
+		},
+	}
+
+	var restoreFrom string
+	restoreCmd := &cobra.Command{
+		Use:   "restore",
+		Short: "Restore the database from a backup.",
+		Long: `Restore the database from a backup created by the backup command.
+
+The backup is checked with PRAGMA integrity_check before it is restored and
+the current database is saved to <database>.pre-restore. If --from is a
+directory the newest backup in it is restored.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := func() error {
+				from := restoreFrom
+				if info, err := os.Stat(from); err == nil && info.IsDir() {
+					backups, err := datastore.ListBackups(from, dbFile)
+					if err != nil {
+						return err
+					}
+					if len(backups) == 0 {
+						return errors.Errorf("There are no backups of %v in %v", dbFile, from)
+					}
+					from = backups[len(backups)-1]
+				}
+
+				if err := datastore.Restore(from, dbFile, log); err != nil {
+					return err
+				}
+				fmt.Printf("Restored %v from %v\n", dbFile, from)
+				return nil
+			}()
+
+			if err != nil {
+				log.Error(err, "Failed to restore the database")
+			}
+		},
+	}
+
+	var keyOut string
+	var keyAccount string
+	genkeyCmd := &cobra.Command{
+		Use:   "genkey",
+		Short: "Generate a key to encrypt the database with.",
+		Long: fmt.Sprintf(`Generate a key to encrypt the database with.
+
+The key is written to --out, stored in the OS keyring under the account
+--keyring or printed. Encrypt the database with it using db rekey; then pass
+it to other commands with --db-key-file, --db-keyring or the environment
+variable %v.`, datastore.EncryptionKeyEnv),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := func() error {
+				key, err := datastore.GenerateEncryptionKey()
+				if err != nil {
+					return err
+				}
+
+				switch {
+				case keyOut != "":
+					if err := ioutil.WriteFile(keyOut, []byte(key+"\n"), 0600); err != nil {
+						return errors.Wrapf(err, "Failed to write the key to %v", keyOut)
+					}
+					fmt.Printf("Wrote key to %v\n", keyOut)
+				case keyAccount != "":
+					if err := datastore.StoreKeyInKeyring(keyAccount, key); err != nil {
+						return err
+					}
+					fmt.Printf("Stored key in the keyring under account %v\n", keyAccount)
+				default:
+					fmt.Println(key)
+				}
+				return nil
+			}()
+
+			if err != nil {
+				log.Error(err, "Failed to generate a key")
+			}
+		},
+	}
+
+	var newKeyFile string
+	var newKeyring string
+	var newKeyEnv string
+	var decrypt bool
+	rekeyCmd := &cobra.Command{
+		Use:   "rekey",
+		Short: "Encrypt the database, change its key or decrypt it.",
+		Long: `Encrypt the database, change its key or decrypt it.
+
+The current key is read from --db-key-file, --db-keyring or the environment
+as for other commands; none is needed if the database isn't encrypted. The
+new key is read from --new-key-file, --new-keyring or --new-key-env. Pass
+--decrypt to remove the encryption. Back up the database first; if the new
+key is lost the encrypted columns can't be recovered.
+
+The encrypted columns are doc titles, link text, entity names, the text of
+entity and keyphrase mentions and the cached Natural Language API responses.
+IDs aren't encrypted so the following are stored in plain text:
+  - Drive file ids.
+  - Keyphrases, which are searched with LIKE.
+  - The emails, groups and domains docs are shared with.
+  - The emails of the owners and editors of docs.
+Once the database is encrypted index refuses to run with --keyphrases, --people
+or --acls so no more of them are stored. Rows stored before aren't removed.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := func() error {
+				newSrc := datastore.KeySource{File: newKeyFile, Keyring: newKeyring, Env: newKeyEnv}
+				newKey, err := datastore.LoadEncryptionKey(newSrc)
+				if err != nil {
+					return err
+				}
+				if newKey == nil && !decrypt {
+					return errors.New("Set one of --new-key-file, --new-keyring or --new-key-env or pass --decrypt")
+				}
+				if newKey != nil && decrypt {
+					return errors.New("--decrypt can't be used with a new key")
+				}
+
+				store, err := openStore(dbFile, datastore.DatastoreWithoutMigrations())
+				if err != nil {
+					return err
+				}
+				defer store.Close()
+				db, ok := store.(*datastore.Datastore)
+				if !ok {
+					return errors.Errorf("Database %v can't be encrypted; it must be SQLite or Postgres", dbFile)
+				}
+
+				if err := db.Migrate(0); err != nil {
+					return err
+				}
+				if err := db.Rekey(newKey); err != nil {
+					return err
+				}
+
+				if decrypt {
+					fmt.Printf("Decrypted %v\n", dbFile)
+				} else {
+					fmt.Printf("Encrypted %v with the new key\n", dbFile)
+				}
+				return nil
+			}()
+
+			if err != nil {
+				log.Error(err, "Failed to rekey the database")
+			}
+		},
+	}
+
+	migrateCmd.Flags().IntVarP(&migrateTo, "to", "", 0, "Optional version to migrate to. Defaults to the latest version.")
+	rollbackCmd.Flags().IntVarP(&rollbackTo, "to", "", -1, "Optional version to roll back to; the baseline (version 1) can't be rolled back. Defaults to reverting the last migration.")
+	backupCmd.Flags().StringVarP(&backupTo, "to", "", "", "The directory to write the backup to. Defaults to the directory backups next to the database.")
+	backupCmd.Flags().IntVarP(&keep, "keep", "", 7, "The number of backups to keep; older backups are deleted. 0 keeps all backups.")
+	restoreCmd.Flags().StringVarP(&restoreFrom, "from", "", "", "The backup to restore or a directory of backups to restore the newest one from.")
+	restoreCmd.MarkFlagRequired("from")
+	genkeyCmd.Flags().StringVarP(&keyOut, "out", "", "", "Optional file to write the key to.")
+	genkeyCmd.Flags().StringVarP(&keyAccount, "keyring", "", "", "Optional account to store the key under in the OS keyring.")
+	rekeyCmd.Flags().StringVarP(&newKeyFile, "new-key-file", "", "", "File containing the new key.")
+	rekeyCmd.Flags().StringVarP(&newKeyring, "new-keyring", "", "", "Account in the OS keyring the new key is stored under.")
+	rekeyCmd.Flags().StringVarP(&newKeyEnv, "new-key-env", "", "", "Environment variable containing the new key.")
+	rekeyCmd.Flags().BoolVarP(&decrypt, "decrypt", "", false, "Decrypt the database instead of encrypting it with a new key.")
+
+	dbDefault := getDbDefault()
+	cmd.PersistentFlags().StringVarP(&dbFile, "database", "", dbDefault, databaseHelp)
+
+	cmd.AddCommand(migrateCmd)
+	cmd.AddCommand(statusCmd)
+	cmd.AddCommand(rollbackCmd)
+	cmd.AddCommand(backupCmd)
+	cmd.AddCommand(restoreCmd)
+	cmd.AddCommand(genkeyCmd)
+	cmd.AddCommand(rekeyCmd)
+	return cmd
+}
+
+func newExportCmd() *cobra.Command {
+	var dbFile string
+	var out string
+	var allowPlaintext bool
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export the index as JSONL.",
+		Long: `Export the index as JSONL.
+
+The export is written in plain text. Exporting an encrypted database requires
+--allow-plaintext since the export contains the decrypted doc titles, entity
+names and text of mentions.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := func() error {
+				store, err := openStore(dbFile)
+				if err != nil {
+					return err
+				}
+				defer store.Close()
+
+				if db, ok := store.(*datastore.Datastore); ok && db.Encrypted() && !allowPlaintext {
+					return errors.New("The database is encrypted but the export would be written in plain text; pass --allow-plaintext to export it anyway")
+				}
+
+				w := os.Stdout
+				if out != "-" {
+					f, err := os.Create(out)
+					if err != nil {
+						return errors.Wrapf(err, "Failed to create file %v", out)
+					}
+					defer f.Close()
+					w = f
+				}
+
+				stats, err := datastore.Export(store, w)
+				if err != nil {
+					return err
+				}
+				// Print to stderr so the summary doesn't end up in the export when writing to stdout.
+				fmt.Fprintf(os.Stderr, "Exported format version %v\n%v", stats.Version, stats)
+				return nil
+			}()
+
+			if err != nil {
+				log.Error(err, "Failed to export the database")
+			}
+		},
+	}
+
+	dbDefault := getDbDefault()
+	cmd.Flags().StringVarP(&dbFile, "database", "", dbDefault, databaseHelp)
+	cmd.Flags().StringVarP(&out, "out", "", "-", "The file to write the export to; - means stdout.")
+	cmd.Flags().BoolVarP(&allowPlaintext, "allow-plaintext", "", false, "Export an encrypted database. The export contains the decrypted values in plain text.")
+	return cmd
+}
+
+func newImportCmd() *cobra.Command {
+	var dbFile string
+	var in string
+	var merge string
+	cmd := &cobra.Command{
+		Use:   "import",
+		Short: "Import an export created by the export command.",
+		Long: `Import an export created by the export command.
+
+IDs are preserved so importing the same export more than once is safe. By default
+rows which already exist are only replaced if the imported row was updated more
+recently so importing someone else's index doesn't overwrite newer rows in yours.
+Use --merge=replace to overwrite them.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := func() error {
+				policy, err := datastore.ParseMergePolicy(merge)
+				if err != nil {
+					return err
+				}
+
+				store, err := openStore(dbFile)
+				if err != nil {
+					return err
+				}
+				defer store.Close()
+
+				r := os.Stdin
+				if in != "-" {
+					f, err := os.Open(in)
+					if err != nil {
+						return errors.Wrapf(err, "Failed to open file %v", in)
+					}
+					defer f.Close()
+					r = f
+				}
+
+				stats, err := datastore.Import(store, r, policy)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Imported format version %v exported at %v\n%v", stats.Version, stats.ExportedAt.Format(time.RFC3339), stats)
+				return nil
+			}()
+
+			if err != nil {
+				log.Error(err, "Failed to import")
+			}
+		},
+	}
+
+	dbDefault := getDbDefault()
+	cmd.Flags().StringVarP(&dbFile, "database", "", dbDefault, databaseHelp)
+	cmd.Flags().StringVarP(&in, "in", "", "-", "The file to import; - means stdin.")
+	cmd.Flags().StringVarP(&merge, "merge", "", string(datastore.MergeNewer), "What to do with rows which already exist; one of replace, keep or newer. newer keeps whichever row was updated most recently.")
+	return cmd
+}
+
+func newUsageCmd() *cobra.Command {
+	var dbFile string
+	var groupBy []string
+	var since string
+	cmd := &cobra.Command{
+		Use:   "usage",
+		Short: "Report usage of the Natural Language API.",
+		Run: func(cmd *cobra.Command, args []string) {
+			err := func() error {
+				store, err := openStore(dbFile)
+				if err != nil {
+					return err
+				}
+
+				usage, err := store.ReportNLPUsage(groupBy, since)
+				if err != nil {
+					return err
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintf(w, "%v\tREQUESTS\tCHARACTERS\tUNITS\n", strings.ToUpper(strings.Join(groupBy, "\t")))
+				for _, u := range usage {
+					row := make([]string, 0, len(groupBy))
+					for _, g := range groupBy {
+						switch strings.ToLower(g) {
+						case "run":
+							row = append(row, u.RunID)
+						case "day":
+							row = append(row, u.Day)
+						case "drive":
+							row = append(row, u.DriveID)
+						case "method":
+							row = append(row, u.Method)
+						}
+					}
+					fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", strings.Join(row, "\t"), u.Requests, u.NumCharacters, u.Units)
+				}
+				return w.Flush()
+			}()
+
+			if err != nil {
+				log.Error(err, "Failed to report usage")
+			}
+		},
+	}
+
+	dbDefault := getDbDefault()
+	cmd.Flags().StringVarP(&dbFile, "database", "", dbDefault, databaseHelp)
+	cmd.Flags().StringSliceVarP(&groupBy, "group-by", "", []string{"day", "drive"}, "The fields to break usage down by; any of run, day, drive, method.")
+	cmd.Flags().StringVarP(&since, "since", "", "", "Optional only include usage on or after this UTC date (YYYY-MM-DD).")
+	return cmd
+}
+
+func newCategoriesCmd() *cobra.Command {
+	var dbFile string
+	var docId string
+	var category string
+	cmd := &cobra.Command{
+		Use:   "categories",
+		Short: "List documents by content category.",
+		Long:  "List the content categories and the number of documents in each. If --category or --doc is set list the matching documents instead.",
+		Run: func(cmd *cobra.Command, args []string) {
+			err := func() error {
+				store, err := openStore(dbFile)
+				if err != nil {
+					return err
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				if category == "" && docId == "" {
+					counts, err := store.CountDocCategories()
+					if err != nil {
+						return err
+					}
+
+					fmt.Fprintf(w, "CATEGORY\tDOCUMENTS\n")
+					for _, c := range counts {
+						fmt.Fprintf(w, "%v\t%v\n", c.Category, c.NumDocuments)
+					}
+					return w.Flush()
+				}
+
+				cats, err := store.ListDocCategories(docId, category)
+				if err != nil {
+					return err
+				}
+
+				fmt.Fprintf(w, "DOC\tCATEGORY\tCONFIDENCE\n")
+				for _, c := range cats {
+					fmt.Fprintf(w, "%v\t%v\t%.2f\n", c.DocID, c.Category, c.Confidence)
+				}
+				return w.Flush()
+			}()
+
+			if err != nil {
+				log.Error(err, "Failed to list categories")
+			}
+		},
+	}
+
+	dbDefault := getDbDefault()
+	cmd.Flags().StringVarP(&dbFile, "database", "", dbDefault, databaseHelp)
+	cmd.Flags().StringVarP(&category, "category", "c", "", "Optional only list documents in this category or categories nested under it e.g. /Science.")
+	cmd.Flags().StringVarP(&docId, "doc", "", "", "Optional only list the categories of this document.")
+	return cmd
+}
+
+func newKeyphrasesCmd() *cobra.Command {
+	var dbFile string
+	var query string
+	var limit int
+	cmd := &cobra.Command{
+		Use:   "keyphrases",
+		Short: "List or search keyphrases.",
+		Long:  "List the keyphrases mentioned in the most documents. If --query is set list the documents mentioning matching keyphrases ranked by TF-IDF weight instead.",
+		Run: func(cmd *cobra.Command, args []string) {
+			err := func() error {
+				store, err := openStore(dbFile)
+				if err != nil {
+					return err
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				if query == "" {
+					phrases, err := store.ListKeyphrases(limit)
+					if err != nil {
+						return err
+					}
+
+					fmt.Fprintf(w, "KEYPHRASE\tDOCUMENTS\n")
+					for _, p := range phrases {
+						fmt.Fprintf(w, "%v\t%v\n", p.ID, p.DocumentFrequency)
+					}
+					return w.Flush()
+				}
+
+				results, err := store.SearchKeyphrases(query, limit)
+				if err != nil {
+					return err
+				}
+
+				fmt.Fprintf(w, "DOC\tKEYPHRASE\tMENTIONS\tWEIGHT\n")
+				for _, r := range results {
+					fmt.Fprintf(w, "%v\t%v\t%v\t%.3f\n", r.DocID, r.KeyphraseID, r.NumMentions, r.Weight)
+				}
+				return w.Flush()
+			}()
+
+			if err != nil {
+				log.Error(err, "Failed to list keyphrases")
+			}
+		},
+	}
+
+	dbDefault := getDbDefault()
+	cmd.Flags().StringVarP(&dbFile, "database", "", dbDefault, databaseHelp)
+	cmd.Flags().StringVarP(&query, "query", "q", "", "Optional list documents mentioning keyphrases containing this text.")
+	cmd.Flags().IntVarP(&limit, "limit", "", 50, "The maximum number of results to list. 0 means no limit.")
+	return cmd
+}
+
+func newFakeOIDCCmd() *cobra.Command {
+	var port int
+	var email string
+	cmd := &cobra.Command{
+		Use:   "fake-oidc",
+		Short: "Run a fake OpenID Connect provider to test login locally.",
+		Long:  "Run a fake OpenID Connect provider to test login locally. It logs everyone in as --email without asking for credentials so never use it to protect a real server.",
+		Run: func(cmd *cobra.Command, args []string) {
+			err := func() error {
+				listener, err := net.Listen("tcp", fmt.Sprintf(":%v", port))
+				if err != nil {
+					return errors.Wrapf(err, "Failed to listen on port %v", port)
+				}
+
+				issuer := fmt.Sprintf("http://localhost:%v", listener.Addr().(*net.TCPAddr).Port)
+				p, err := oidctesting.NewProvider(issuer, email)
+				if err != nil {
+					return err
+				}
+
+				log.Info("Fake OIDC provider is running", "issuer", issuer, "email", email)
+				return http.Serve(listener, p)
+			}()
+
+			if err != nil {
+				log.Error(err, "Fake OIDC provider exited abnormally")
+			}
+		},
+	}
+
+	cmd.Flags().IntVarP(&port, "port", "p", 9090, "Port to serve on")
+	cmd.Flags().StringVarP(&email, "email", "", "dev@example.com", "The email of the user to log in as.")
+	return cmd
+}
+
+func newRelatedCmd() *cobra.Command {
+	var dbFile string
+	var limit int
+	var refresh bool
+	cmd := &cobra.Command{
+		Use:   "related <entityId>",
+		Short: "List the entities mentioned together with an entity.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := func() error {
+				store, err := openStore(dbFile)
+				if err != nil {
+					return err
+				}
+
+				if refresh {
+					if err := store.UpdateEntityCooccurrences(); err != nil {
+						return err
+					}
+				}
+
+				related, err := store.ListRelatedEntities(args[0], limit)
+				if err != nil {
+					return err
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintf(w, "ID\tNAME\tTYPE\tDOCUMENTS\tSENTENCES\n")
+				for _, e := range related {
+					fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", e.EntityID, e.Name, e.Type, e.NumDocuments, e.NumSentences)
+				}
+				return w.Flush()
+			}()
+
+			if err != nil {
+				log.Error(err, "Failed to list related entities")
+			}
+		},
+	}
+
+	dbDefault := getDbDefault()
+	cmd.Flags().StringVarP(&dbFile, "database", "", dbDefault, databaseHelp)
+	cmd.Flags().IntVarP(&limit, "limit", "", 50, "The maximum number of entities to list. 0 means no limit.")
+	cmd.Flags().BoolVarP(&refresh, "refresh", "", false, "Recompute the co-occurrence counts before listing. They are normally recomputed at the end of each indexing run.")
+	return cmd
+}
+
+func newStatsCmd() *cobra.Command {
+	var dbFile string
+	var limit int
+	var asJson bool
+	cmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Print statistics about the index e.g. docs by type and state, link health and the top entities and docs.",
+		Run: func(cmd *cobra.Command, args []string) {
+			err := func() error {
+				store, err := openStore(dbFile)
+				if err != nil {
+					return err
+				}
+
+				stats, err := store.IndexStats(datastore.StatsQuery{Limit: limit})
+				if err != nil {
+					return err
+				}
+
+				if asJson {
+					b, err := json.MarshalIndent(stats, "", "  ")
+					if err != nil {
+						return errors.Wrapf(err, "Failed to marshal stats")
+					}
+					fmt.Println(string(b))
+					return nil
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintf(w, "DOCS\t%v\n", stats.Docs.Total)
+				for _, state := range []string{datastore.DocStateIndexed, datastore.DocStateStale, datastore.DocStatePending} {
+					fmt.Fprintf(w, "  %v\t%v\n", state, stats.Docs.ByState[state])
+				}
+				mimeTypes := make([]string, 0, len(stats.Docs.ByMimeType))
+				for m := range stats.Docs.ByMimeType {
+					mimeTypes = append(mimeTypes, m)
+				}
+				sort.Strings(mimeTypes)
+				for _, m := range mimeTypes {
+					fmt.Fprintf(w, "  %v\t%v\n", m, stats.Docs.ByMimeType[m])
+				}
+				fmt.Fprintf(w, "  no inbound links\t%v\n", stats.Docs.NumUnlinked)
+
+				l := stats.Links
+				fmt.Fprintf(w, "\nLINKS\t%v\n", l.Total)
+				fmt.Fprintf(w, "  internal\t%v\n  external\t%v\n  resolved\t%v\n  dangling\t%v\n", l.Internal, l.External, l.Resolved, l.Dangling)
+
+				fmt.Fprintf(w, "\nTOP ENTITIES\tTYPE\tMENTIONS\tDOCUMENTS\n")
+				for _, e := range stats.TopEntities {
+					fmt.Fprintf(w, "  %v (%v)\t%v\t%v\t%v\n", e.Name, e.EntityID, e.Type, e.NumMentions, e.NumDocuments)
+				}
+
+				fmt.Fprintf(w, "\nTOP LINKED DOCS\tLINKS\tSOURCES\n")
+				for _, d := range stats.TopLinkedDocs {
+					fmt.Fprintf(w, "  %v (%v)\t%v\t%v\n", d.Name, d.DocID, d.NumLinks, d.NumSources)
+				}
+
+				fmt.Fprintf(w, "\nDOCS WITH NO INBOUND LINKS\n")
+				for _, d := range stats.Unlinked {
+					fmt.Fprintf(w, "  %v (%v)\n", d.Name, d.DocID)
+				}
+				return w.Flush()
+			}()
+
+			if err != nil {
+				log.Error(err, "Failed to compute stats")
+			}
+		},
+	}
+
+	dbDefault := getDbDefault()
+	cmd.Flags().StringVarP(&dbFile, "database", "", dbDefault, databaseHelp)
+	cmd.Flags().IntVarP(&limit, "limit", "", 10, "The maximum number of entities and docs in each list. 0 means no limit.")
+	cmd.Flags().BoolVarP(&asJson, "json", "", false, "Print the stats as JSON.")
+	return cmd
+}
+
+func newLinksCmd() *cobra.Command {
+	var dbFile string
+	var source string
+	var offline bool
+	var asJson bool
+	cmd := &cobra.Command{
+		Use:   "links",
+		Short: "Report broken links i.e. links to files which were deleted, can't be read or don't have the linked heading.",
+		Run: func(cmd *cobra.Command, args []string) {
+			err := func() error {
+				store, err := openStore(dbFile)
+				if err != nil {
+					return err
+				}
+
+				var client *http.Client
+				if !offline {
+					helper := getWebFlowLocal()
+					if helper == nil {
+						return errors.New("Unable to create gcp credential helper")
+					}
+					ts, err := helper.GetTokenSource(context.Background())
+					if err != nil {
+						return errors.Wrap(err, "Failed to get token source")
+					}
+					client = oauth2.NewClient(context.Background(), ts)
+				}
+
+				checker, err := gdocs.NewLinkChecker(store, client, log)
+				if err != nil {
+					return err
+				}
+
+				sourceId := ""
+				if source != "" {
+					sourceId = datastore.DriveKey(source)
+				}
+				report, err := checker.Check(context.Background(), sourceId)
+				if err != nil {
+					return err
+				}
+
+				if asJson {
+					b, err := json.MarshalIndent(report, "", "  ")
+					if err != nil {
+						return errors.Wrapf(err, "Failed to marshal link report")
+					}
+					fmt.Println(string(b))
+					return nil
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				for _, d := range report.Docs {
+					fmt.Fprintf(w, "%v (%v)", d.Name, d.DocID)
+					if len(d.Owners) > 0 {
+						fmt.Fprintf(w, " owners: %v", strings.Join(d.Owners, ", "))
+					}
+					fmt.Fprintf(w, "\n")
+					for _, l := range d.Links {
+						fmt.Fprintf(w, "  %v\t%q\t%v\t%v\n", l.Problem, l.Text, l.URI, l.Error)
+					}
+				}
+				fmt.Fprintf(w, "%v of %v links to Google Drive are broken\n", report.NumBroken, report.NumLinks)
+				return w.Flush()
+			}()
+
+			if err != nil {
+				log.Error(err, "Failed to check links")
+			}
+		},
+	}
+
+	dbDefault := getDbDefault()
+	cmd.Flags().StringVarP(&dbFile, "database", "", dbDefault, databaseHelp)
+	cmd.Flags().StringVarP(&source, "source", "", "", "The Drive ID of the doc whose links to check. By default the links in all docs are checked.")
+	cmd.Flags().BoolVarP(&offline, "offline", "", false, "Don't call Drive; only check links against the indexed docs. Links to docs which aren't indexed are reported as dangling and headings aren't checked.")
+	cmd.Flags().BoolVarP(&asJson, "json", "", false, "Print the report as JSON.")
 	return cmd
 }
 
@@ -425,8 +1731,21 @@ func init() {
 	rootCmd.AddCommand(newFetchDocCmd())
 	rootCmd.AddCommand(newIndexCmd())
 	rootCmd.AddCommand(newGetEntitiesCmd())
+	rootCmd.AddCommand(newCacheCmd())
+	rootCmd.AddCommand(newDbCmd())
+	rootCmd.AddCommand(newExportCmd())
+	rootCmd.AddCommand(newImportCmd())
+	rootCmd.AddCommand(newUsageCmd())
+	rootCmd.AddCommand(newCategoriesCmd())
+	rootCmd.AddCommand(newKeyphrasesCmd())
+	rootCmd.AddCommand(newRelatedCmd())
+	rootCmd.AddCommand(newStatsCmd())
+	rootCmd.AddCommand(newLinksCmd())
+	rootCmd.AddCommand(newFakeOIDCCmd())
 	rootCmd.PersistentFlags().StringVarP(&gOpts.level, "level", "", "info", "The logging level.")
 	rootCmd.PersistentFlags().BoolVarP(&gOpts.debug, "debug", "", false, "Enable debug mode for logs.")
+	rootCmd.PersistentFlags().StringVarP(&gOpts.keyFile, "db-key-file", "", "", fmt.Sprintf("Optional file containing the key the database is encrypted with. Defaults to the environment variable %v.", datastore.EncryptionKeyEnv))
+	rootCmd.PersistentFlags().StringVarP(&gOpts.keyring, "db-keyring", "", "", "Optional account in the OS keyring the database encryption key is stored under; see db genkey.")
 
 	searchCmd.Flags().StringVarP(&gcpOpts.credentialsFile, "credentials-file", "", "", "JSON File containing OAuth2Client credentials as downloaded from APIConsole. Can be a GCS file.")
 	searchCmd.Flags().StringVarP(&gcpOpts.secret, "secret", "", "", "The name of a secret in GCP secret manager where the OAuth2 token should be cached. Should be in the form {project}/{secret}")
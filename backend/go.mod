@@ -10,7 +10,8 @@ require (
 	github.com/go-logr/zapr v1.2.2
 	github.com/golang/protobuf v1.5.2
 	github.com/google/go-cmp v0.5.7
-	github.com/google/uuid v1.3.0 // indirect
+	github.com/google/uuid v1.3.0
+	github.com/googleapis/gax-go/v2 v2.1.1
 	github.com/gorilla/mux v1.8.0
 	github.com/kubeflow/internal-acls/google_groups v0.0.0-20211220174139-11405888dbb5
 	github.com/mattn/go-sqlite3 v1.14.12
@@ -21,6 +22,9 @@ require (
 	google.golang.org/api v0.70.0
 	google.golang.org/genproto v0.0.0-20220222213610-43724f9ea8cf
 	google.golang.org/grpc v1.44.0
+	google.golang.org/protobuf v1.27.1
+	gorm.io/driver/postgres v1.3.5
 	gorm.io/driver/sqlite v1.3.2
 	gorm.io/gorm v1.23.5
+	sigs.k8s.io/yaml v1.2.0
 )
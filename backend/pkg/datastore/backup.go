@@ -0,0 +1,254 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// backupTimeFormat is the format of the timestamp in the names of backups. It sorts chronologically.
+	backupTimeFormat = "20060102T150405.000Z"
+
+	// sqliteDriver is the name the SQLite driver is registered under.
+	sqliteDriver = "sqlite3"
+)
+
+// Backup copies the database to dest using the SQLite online backup API so it is safe to call while other
+// processes e.g. the server are reading and writing the database. The backup is written to a temporary file,
+// checked with PRAGMA integrity_check and then renamed to dest so dest is never a partial backup.
+func (d *Datastore) Backup(dest string) error {
+	if name := d.db.Dialector.Name(); name != "sqlite" {
+		return errors.Errorf("Backup is only supported for SQLite; the database is %v. Use pg_dump to back up Postgres", name)
+	}
+
+	src, err := d.db.DB()
+	if err != nil {
+		return errors.Wrapf(err, "Failed to get the database connection")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return errors.Wrapf(err, "Failed to create directory %v", filepath.Dir(dest))
+	}
+
+	tmp := dest + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Failed to remove stale temporary file %v", tmp)
+	}
+
+	if err := copySQLite(src, tmp); err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "Failed to back up database %v to %v", d.dbFile, dest)
+	}
+
+	if err := CheckIntegrity(tmp); err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "Backup of database %v is corrupt", d.dbFile)
+	}
+
+	if err := os.Rename(tmp, dest); err != nil {
+		return errors.Wrapf(err, "Failed to rename %v to %v", tmp, dest)
+	}
+	d.log.Info("Backed up database", "dbFile", d.dbFile, "backup", dest)
+	return nil
+}
+
+// Restore replaces the contents of the SQLite database dbFile with the backup in from. The backup is checked with
+// PRAGMA integrity_check before anything is changed. If dbFile exists it is first backed up to dbFile.pre-restore
+// so the restore can be undone.
+//
+// The backup API is used to copy the data so processes with the database open see the restored data. Restore fails
+// if another process is in the middle of a transaction. The restored database may have an older schema; it is
+// migrated the next time it is opened.
+func Restore(from string, dbFile string, log logr.Logger) error {
+	if _, err := os.Stat(from); err != nil {
+		return errors.Wrapf(err, "Backup %v doesn't exist", from)
+	}
+
+	if err := CheckIntegrity(from); err != nil {
+		return errors.Wrapf(err, "Refusing to restore backup %v", from)
+	}
+
+	if _, err := os.Stat(dbFile); err == nil {
+		pre := dbFile + ".pre-restore"
+		current, err := New(dbFile, log, DatastoreWithoutMigrations())
+		if err != nil {
+			return err
+		}
+		err = current.Backup(pre)
+		current.Close()
+		if err != nil {
+			return errors.Wrapf(err, "Failed to back up the current database before restoring")
+		}
+	}
+
+	src, err := sql.Open(sqliteDriver, from)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to open backup %v", from)
+	}
+	defer src.Close()
+
+	if err := copySQLite(src, dbFile); err != nil {
+		return errors.Wrapf(err, "Failed to restore backup %v to %v", from, dbFile)
+	}
+
+	if err := CheckIntegrity(dbFile); err != nil {
+		return errors.Wrapf(err, "Restored database %v is corrupt", dbFile)
+	}
+	log.Info("Restored database", "dbFile", dbFile, "backup", from)
+	return nil
+}
+
+// CheckIntegrity runs PRAGMA integrity_check on the SQLite database in dbFile. An error listing the problems is
+// returned if the database is corrupt.
+func CheckIntegrity(dbFile string) error {
+	db, err := sql.Open(sqliteDriver, dbFile)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to open database %v", dbFile)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return errors.Wrapf(err, "Failed to check the integrity of database %v", dbFile)
+	}
+	defer rows.Close()
+
+	problems := []string{}
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return errors.Wrapf(err, "Failed to read the result of the integrity check")
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrapf(err, "Failed to check the integrity of database %v", dbFile)
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf("Database %v failed the integrity check: %v", dbFile, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// BackupPath returns the path of a backup of dbFile taken at time t in the directory dir.
+func BackupPath(dir string, dbFile string, t time.Time) string {
+	return filepath.Join(dir, fmt.Sprintf("%v-%v.db", backupPrefix(dbFile), t.UTC().Format(backupTimeFormat)))
+}
+
+// ListBackups lists the backups of dbFile in dir created with BackupPath from oldest to newest.
+func ListBackups(dir string, dbFile string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, errors.Wrapf(err, "Failed to list directory %v", dir)
+	}
+
+	prefix := backupPrefix(dbFile) + "-"
+	backups := []string{}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".db") {
+			continue
+		}
+		if _, err := time.Parse(backupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".db")); err != nil {
+			continue
+		}
+		backups = append(backups, filepath.Join(dir, name))
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// RotateBackups deletes all but the newest keep backups of dbFile in dir. If keep is <= 0 nothing is deleted.
+// The deleted backups are returned.
+func RotateBackups(dir string, dbFile string, keep int) ([]string, error) {
+	if keep <= 0 {
+		return []string{}, nil
+	}
+
+	backups, err := ListBackups(dir, dbFile)
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := []string{}
+	for len(backups) > keep {
+		if err := os.Remove(backups[0]); err != nil {
+			return deleted, errors.Wrapf(err, "Failed to delete backup %v", backups[0])
+		}
+		deleted = append(deleted, backups[0])
+		backups = backups[1:]
+	}
+	return deleted, nil
+}
+
+// backupPrefix is the prefix of the names of backups of dbFile e.g. "database" for ~/.feed/database.db.
+func backupPrefix(dbFile string) string {
+	return strings.TrimSuffix(filepath.Base(dbFile), filepath.Ext(dbFile))
+}
+
+// copySQLite copies the database src to the SQLite database dest using the online backup API. dest is created if
+// it doesn't exist; otherwise its contents are replaced.
+func copySQLite(src *sql.DB, dest string) error {
+	ctx := context.Background()
+
+	destDb, err := sql.Open(sqliteDriver, dest)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to open database %v", dest)
+	}
+	defer destDb.Close()
+
+	destConn, err := destDb.Conn(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to connect to database %v", dest)
+	}
+	defer destConn.Close()
+
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to get a connection to the source database")
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(destDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			d, ok := destDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errors.Errorf("Destination connection has type %T; want *sqlite3.SQLiteConn", destDriverConn)
+			}
+			s, ok := srcDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errors.Errorf("Source connection has type %T; want *sqlite3.SQLiteConn", srcDriverConn)
+			}
+
+			backup, err := d.Backup("main", s, "main")
+			if err != nil {
+				return errors.Wrapf(err, "Failed to start the backup")
+			}
+
+			// Copy all the pages in one step. Copying incrementally would hold the read lock for less time but the
+			// backup restarts whenever another connection writes to the source so it might never finish while
+			// the server is indexing.
+			if _, err := backup.Step(-1); err != nil {
+				backup.Finish()
+				return errors.Wrapf(err, "Failed to copy the database")
+			}
+			return backup.Finish()
+		})
+	})
+}
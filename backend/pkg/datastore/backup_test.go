@@ -0,0 +1,111 @@
+package datastore
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func Test_BackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testBackup")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	log, err := logging.InitLogger("info", true)
+	if err != nil {
+		t.Fatalf("Failed to initialize logger; %v", err)
+	}
+
+	dbFile := path.Join(dir, "database.db")
+	db, err := New(dbFile, *log)
+	if err != nil {
+		t.Fatalf("Failed to create datastore; error %v", err)
+	}
+	defer db.Close()
+
+	if err := db.UpdateDocReference(&DocReference{DriveId: "doc1", Name: "Doc 1"}); err != nil {
+		t.Fatalf("Failed to create doc; error %v", err)
+	}
+
+	backupDir := path.Join(dir, "backups")
+	start := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	expected := []string{}
+	for i := 0; i < 3; i++ {
+		dest := BackupPath(backupDir, dbFile, start.Add(time.Duration(i)*time.Hour))
+		if err := db.Backup(dest); err != nil {
+			t.Fatalf("Failed to back up the database; error %v", err)
+		}
+		expected = append(expected, dest)
+	}
+
+	// Files which aren't backups of the database must be ignored.
+	for _, name := range []string{"other-20220501T120000.000Z.db", "database-notatime.db"} {
+		if err := ioutil.WriteFile(path.Join(backupDir, name), []byte{}, 0600); err != nil {
+			t.Fatalf("Failed to write file; error %v", err)
+		}
+	}
+
+	backups, err := ListBackups(backupDir, dbFile)
+	if err != nil {
+		t.Fatalf("Failed to list backups; error %v", err)
+	}
+	if d := cmp.Diff(expected, backups); d != "" {
+		t.Errorf("Unexpected backups; diff:\n%v", d)
+	}
+
+	deleted, err := RotateBackups(backupDir, dbFile, 2)
+	if err != nil {
+		t.Fatalf("Failed to rotate backups; error %v", err)
+	}
+	if d := cmp.Diff(expected[:1], deleted); d != "" {
+		t.Errorf("Unexpected deleted backups; diff:\n%v", d)
+	}
+	if backups, err := ListBackups(backupDir, dbFile); err != nil || len(backups) != 2 {
+		t.Errorf("ListBackups returned %v, %v; want 2 backups", backups, err)
+	}
+
+	// Changes made after the backup are undone by restoring it.
+	if err := db.UpdateDocReference(&DocReference{DriveId: "doc2", Name: "Doc 2"}); err != nil {
+		t.Fatalf("Failed to create doc; error %v", err)
+	}
+	if err := Restore(expected[2], dbFile, *log); err != nil {
+		t.Fatalf("Failed to restore; error %v", err)
+	}
+
+	// The open datastore sees the restored data.
+	docs, err := db.ListDocReferences()
+	if err != nil {
+		t.Fatalf("Failed to list docs; error %v", err)
+	}
+	if len(docs) != 1 || docs[0].Name != "Doc 1" {
+		t.Errorf("Restore didn't restore the docs; got %+v", docs)
+	}
+
+	// The database before the restore is kept.
+	pre, err := New(dbFile+".pre-restore", *log)
+	if err != nil {
+		t.Fatalf("Failed to open the pre-restore backup; error %v", err)
+	}
+	defer pre.Close()
+	if docs, err := pre.ListDocReferences(); err != nil || len(docs) != 2 {
+		t.Errorf("Pre-restore backup has docs %v, %v; want 2 docs", docs, err)
+	}
+
+	// Corrupt backups are rejected.
+	corrupt := path.Join(dir, "corrupt.db")
+	if err := ioutil.WriteFile(corrupt, []byte("this isn't a database"), 0600); err != nil {
+		t.Fatalf("Failed to write file; error %v", err)
+	}
+	if err := Restore(corrupt, dbFile, *log); err == nil {
+		t.Errorf("Restoring a corrupt backup succeeded; want error")
+	}
+	if err := Restore(path.Join(dir, "missing.db"), dbFile, *log); err == nil {
+		t.Errorf("Restoring a missing backup succeeded; want error")
+	}
+}
@@ -0,0 +1,90 @@
+package datastore
+
+import (
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"strings"
+)
+
+// CategoryCount is the number of documents in a category.
+type CategoryCount struct {
+	Category     string
+	NumDocuments int64
+}
+
+// ReplaceDocCategories replaces the categories of the doc with the supplied categories.
+// Categories previously assigned to the doc which aren't in categories are deleted.
+func (d *Datastore) ReplaceDocCategories(docId string, categories []*DocCategory) error {
+	if docId == "" {
+		return errors.New("docId must be set")
+	}
+
+	log := d.log.WithValues("docId", docId)
+
+	for _, c := range categories {
+		if c.DocID != docId {
+			return errors.Errorf("Category %v has DocID %v; want %v", c.Category, c.DocID, docId)
+		}
+
+		expectedId := DocCategoryKey(*c)
+		if c.ID != "" && c.ID != expectedId {
+			return errors.Errorf("ID and DocCategory are inconsistent; ID should be empty or %v", expectedId)
+		}
+		c.ID = expectedId
+	}
+
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		// Use Unscoped so the old categories are actually deleted and their primary keys can be reused.
+		if result := tx.Unscoped().Where("doc_id = ?", docId).Delete(&DocCategory{}); result.Error != nil {
+			return errors.Wrapf(result.Error, "Failed to delete categories for doc: %v", docId)
+		}
+
+		for _, c := range categories {
+			log.V(logging.Debug).Info("Creating record", "id", c.ID)
+			if result := tx.Create(c); result.Error != nil {
+				return errors.Wrapf(result.Error, "Failed to create DocCategory ID: %v", c.ID)
+			}
+		}
+		return nil
+	})
+}
+
+// ListDocCategories lists the categories.
+// docId is optional if supplied list the categories for the provided doc.
+// category is optional if supplied only list categories equal to or nested under category;
+// e.g. "/Computers & Electronics" matches "/Computers & Electronics/Software".
+func (d *Datastore) ListDocCategories(docId string, category string) ([]*DocCategory, error) {
+	db := d.db
+	categories := make([]*DocCategory, 0, 0)
+
+	if docId != "" {
+		db = db.Where("doc_id = ? ", docId)
+	}
+
+	if category != "" {
+		category = strings.TrimSuffix(category, "/")
+		db = db.Where("category = ? or substr(category, 1, ?) = ?", category, len(category)+1, category+"/")
+	}
+
+	if result := db.Order("confidence desc, doc_id").Find(&categories); result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to find doc categories")
+	}
+
+	return categories, nil
+}
+
+// CountDocCategories returns the number of documents in each category.
+func (d *Datastore) CountDocCategories() ([]*CategoryCount, error) {
+	counts := make([]*CategoryCount, 0, 0)
+	result := d.db.Model(&DocCategory{}).
+		Select("category, count(distinct doc_id) as num_documents").
+		Group("category").
+		Order("category").
+		Scan(&counts)
+
+	if result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to count doc categories")
+	}
+	return counts, nil
+}
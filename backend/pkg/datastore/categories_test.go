@@ -0,0 +1,112 @@
+package datastore
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func Test_DocCategories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testDatabase")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+
+	dbFile := path.Join(dir, "database.db")
+
+	log, _ := logging.InitLogger("info", true)
+	db, err := New(dbFile, *log)
+
+	if err != nil {
+		t.Fatalf("Failed to create database; error %v", err)
+	}
+
+	docs := map[string][]*DocCategory{
+		"doc1": {
+			{DocID: "doc1", Category: "/Computers & Electronics/Software", Confidence: 0.9},
+			{DocID: "doc1", Category: "/Science", Confidence: 0.6},
+		},
+		"doc2": {
+			{DocID: "doc2", Category: "/Computers & Electronics", Confidence: 0.8},
+		},
+		"doc3": {
+			{DocID: "doc3", Category: "/Computers & Electronics Stores", Confidence: 0.7},
+		},
+	}
+
+	for docId, cats := range docs {
+		if err := db.ReplaceDocCategories(docId, cats); err != nil {
+			t.Fatalf("Failed to replace categories; error %v", err)
+		}
+	}
+
+	// Replacing the categories of doc1 should remove /Science.
+	if err := db.ReplaceDocCategories("doc1", []*DocCategory{{DocID: "doc1", Category: "/Computers & Electronics/Software", Confidence: 0.9}}); err != nil {
+		t.Fatalf("Failed to replace categories; error %v", err)
+	}
+
+	type testCase struct {
+		name     string
+		docId    string
+		category string
+		expected []string
+	}
+
+	cases := []testCase{
+		{
+			name:     "prefix",
+			category: "/Computers & Electronics",
+			expected: []string{"doc1", "doc2"},
+		},
+		{
+			name:     "trailing-slash",
+			category: "/Computers & Electronics/",
+			expected: []string{"doc1", "doc2"},
+		},
+		{
+			name:     "replaced",
+			category: "/Science",
+			expected: []string{},
+		},
+		{
+			name:     "doc",
+			docId:    "doc3",
+			expected: []string{"doc3"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			actual, err := db.ListDocCategories(c.docId, c.category)
+			if err != nil {
+				t.Fatalf("Failed to list categories; error %v", err)
+			}
+
+			ids := make([]string, 0, len(actual))
+			for _, a := range actual {
+				ids = append(ids, a.DocID)
+			}
+
+			if d := cmp.Diff(c.expected, ids); d != "" {
+				t.Errorf("Did not get expected docs; diff:\n%v", d)
+			}
+		})
+	}
+
+	counts, err := db.CountDocCategories()
+	if err != nil {
+		t.Fatalf("Failed to count categories; error %v", err)
+	}
+
+	expected := []*CategoryCount{
+		{Category: "/Computers & Electronics", NumDocuments: 1},
+		{Category: "/Computers & Electronics Stores", NumDocuments: 1},
+		{Category: "/Computers & Electronics/Software", NumDocuments: 1},
+	}
+
+	if d := cmp.Diff(expected, counts); d != "" {
+		t.Errorf("Did not get expected counts; diff:\n%v", d)
+	}
+}
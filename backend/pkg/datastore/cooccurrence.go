@@ -0,0 +1,186 @@
+package datastore
+
+import (
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+const (
+	cooccurrenceBatchSize = 500
+)
+
+// RelatedEntity is an entity mentioned together with some other entity.
+type RelatedEntity struct {
+	EntityID     string
+	Name         string
+	Type         string
+	NumDocuments int64
+	NumSentences int64
+}
+
+// UpdateEntityCooccurrences recomputes the co-occurrence counts of all pairs of entities from the EntityMentions.
+func (d *Datastore) UpdateEntityCooccurrences() error {
+	pairs := make([]*EntityCooccurrence, 0, 0)
+	result := d.db.Table("entity_mentions as a").
+		Select("a.entity_id as entity_id, b.entity_id as related_id, " +
+			"count(distinct a.doc_id) as num_documents, " +
+			"count(distinct case when a.sentence > 0 and a.sentence = b.sentence then a.doc_id || ':' || a.sentence end) as num_sentences").
+		Joins("join entity_mentions as b on a.doc_id = b.doc_id and a.entity_id != b.entity_id").
+		Where("a.deleted_at is null and b.deleted_at is null").
+		Group("a.entity_id, b.entity_id").
+		Scan(&pairs)
+
+	if result.Error != nil {
+		return errors.Wrapf(result.Error, "Failed to compute entity co-occurrences")
+	}
+
+	for _, p := range pairs {
+		p.ID = EntityCooccurrenceKey(*p)
+	}
+
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		if result := tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(&EntityCooccurrence{}); result.Error != nil {
+			return errors.Wrapf(result.Error, "Failed to delete entity co-occurrences")
+		}
+
+		if len(pairs) == 0 {
+			return nil
+		}
+
+		if result := tx.CreateInBatches(pairs, cooccurrenceBatchSize); result.Error != nil {
+			return errors.Wrapf(result.Error, "Failed to create entity co-occurrences")
+		}
+		return nil
+	})
+}
+
+// UpdateEntityCooccurrencesOf recomputes the co-occurrence counts of the pairs of entities that include one of
+// entityIds. Use it to update the counts after the mentions of some docs change; entityIds must include the entities
+// mentioned in those docs before and after the change. Only the mentions of docs mentioning those entities are read.
+func (d *Datastore) UpdateEntityCooccurrencesOf(entityIds []string) error {
+	ids := map[string]bool{}
+	for _, id := range entityIds {
+		ids[id] = true
+	}
+
+	pairs := make([]*EntityCooccurrence, 0, 0)
+	// Batch the ids to stay below SQLite's limit on the number of bind variables.
+	for start := 0; start < len(entityIds); start += cooccurrenceBatchSize {
+		end := start + cooccurrenceBatchSize
+		if end > len(entityIds) {
+			end = len(entityIds)
+		}
+
+		batch := make([]*EntityCooccurrence, 0, 0)
+		result := d.db.Table("entity_mentions as a").
+			Select("a.entity_id as entity_id, b.entity_id as related_id, "+
+				"count(distinct a.doc_id) as num_documents, "+
+				"count(distinct case when a.sentence > 0 and a.sentence = b.sentence then a.doc_id || ':' || a.sentence end) as num_sentences").
+			Joins("join entity_mentions as b on a.doc_id = b.doc_id and a.entity_id != b.entity_id").
+			Where("a.deleted_at is null and b.deleted_at is null and a.entity_id in ?", entityIds[start:end]).
+			Group("a.entity_id, b.entity_id").
+			Scan(&batch)
+		if result.Error != nil {
+			return errors.Wrapf(result.Error, "Failed to compute entity co-occurrences")
+		}
+		pairs = append(pairs, batch...)
+	}
+
+	// Pairs are stored in both directions; the reverse of pairs whose related entity isn't being updated has to be
+	// added since the query only returns pairs starting with one of the entities.
+	rows := make([]*EntityCooccurrence, 0, 2*len(pairs))
+	for _, p := range pairs {
+		rows = append(rows, p)
+		if !ids[p.RelatedID] {
+			rows = append(rows, &EntityCooccurrence{EntityID: p.RelatedID, RelatedID: p.EntityID, NumDocuments: p.NumDocuments, NumSentences: p.NumSentences})
+		}
+	}
+	for _, r := range rows {
+		r.ID = EntityCooccurrenceKey(*r)
+	}
+
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		for start := 0; start < len(entityIds); start += cooccurrenceBatchSize {
+			end := start + cooccurrenceBatchSize
+			if end > len(entityIds) {
+				end = len(entityIds)
+			}
+			batch := entityIds[start:end]
+			if result := tx.Unscoped().Where("entity_id in ? or related_id in ?", batch, batch).Delete(&EntityCooccurrence{}); result.Error != nil {
+				return errors.Wrapf(result.Error, "Failed to delete entity co-occurrences")
+			}
+		}
+
+		if len(rows) == 0 {
+			return nil
+		}
+
+		if result := tx.CreateInBatches(rows, cooccurrenceBatchSize); result.Error != nil {
+			return errors.Wrapf(result.Error, "Failed to create entity co-occurrences")
+		}
+		return nil
+	})
+}
+
+// ListRelatedEntities lists the entities mentioned together with entityId ordered by the number of docs and then
+// sentences in which they are mentioned together.
+// limit is optional; if > 0 at most limit entities are returned.
+func (d *Datastore) ListRelatedEntities(entityId string, limit int) ([]*RelatedEntity, error) {
+	if entityId == "" {
+		return nil, errors.New("entityId must be set")
+	}
+
+	db := d.db.Table("entity_cooccurrences as c").
+		Select("c.related_id as entity_id, e.name as name, e.type as type, c.num_documents as num_documents, c.num_sentences as num_sentences").
+		Joins("left join entities as e on e.id = c.related_id").
+		Where("c.entity_id = ? and c.deleted_at is null", entityId).
+		Order("c.num_documents desc, c.num_sentences desc, c.related_id")
+
+	if limit > 0 {
+		db = db.Limit(limit)
+	}
+
+	related := make([]*RelatedEntity, 0, 0)
+	if result := db.Scan(&related); result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to list entities related to %v", entityId)
+	}
+	if err := d.decryptRows(related); err != nil {
+		return nil, err
+	}
+	return related, nil
+}
+
+// ListRelatedEntitiesInDocs is like ListRelatedEntities but only counts co-occurrences in the given docs. The counts
+// are computed from the EntityMentions rather than read from the precomputed EntityCooccurrences.
+func (d *Datastore) ListRelatedEntitiesInDocs(entityId string, docIds []string, limit int) ([]*RelatedEntity, error) {
+	if entityId == "" {
+		return nil, errors.New("entityId must be set")
+	}
+
+	related := make([]*RelatedEntity, 0, 0)
+	if len(docIds) == 0 {
+		return related, nil
+	}
+
+	db := d.db.Table("entity_mentions as a").
+		Select("b.entity_id as entity_id, e.name as name, e.type as type, "+
+			"count(distinct a.doc_id) as num_documents, "+
+			"count(distinct case when a.sentence > 0 and a.sentence = b.sentence then a.doc_id || ':' || a.sentence end) as num_sentences").
+		Joins("join entity_mentions as b on a.doc_id = b.doc_id and a.entity_id != b.entity_id").
+		Joins("left join entities as e on e.id = b.entity_id").
+		Where("a.entity_id = ? and a.doc_id in ? and a.deleted_at is null and b.deleted_at is null", entityId, docIds).
+		Group("b.entity_id, e.name, e.type").
+		Order("num_documents desc, num_sentences desc, b.entity_id")
+
+	if limit > 0 {
+		db = db.Limit(limit)
+	}
+
+	if result := db.Scan(&related); result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to list entities related to %v", entityId)
+	}
+	if err := d.decryptRows(related); err != nil {
+		return nil, err
+	}
+	return related, nil
+}
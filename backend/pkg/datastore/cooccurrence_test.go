@@ -0,0 +1,89 @@
+package datastore
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func Test_EntityCooccurrences(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testDatabase")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+
+	dbFile := path.Join(dir, "database.db")
+
+	log, _ := logging.InitLogger("info", true)
+	db, err := New(dbFile, *log)
+
+	if err != nil {
+		t.Fatalf("Failed to create database; error %v", err)
+	}
+
+	entities := []*Entity{
+		{ID: "projectx", Name: "Project X", Type: "OTHER"},
+		{ID: "kafka", Name: "Kafka", Type: "CONSUMER_GOOD"},
+		{ID: "spark", Name: "Spark", Type: "CONSUMER_GOOD"},
+	}
+
+	for _, e := range entities {
+		if err := db.UpdateEntity(e); err != nil {
+			t.Fatalf("Failed to add entity; error %v", err)
+		}
+	}
+
+	mentions := []*EntityMention{
+		{DocID: "doc1", EntityID: "projectx", StartIndex: 0, EndIndex: 9, Sentence: 1},
+		{DocID: "doc1", EntityID: "kafka", StartIndex: 15, EndIndex: 20, Sentence: 1},
+		{DocID: "doc1", EntityID: "spark", StartIndex: 40, EndIndex: 45, Sentence: 2},
+		{DocID: "doc2", EntityID: "projectx", StartIndex: 0, EndIndex: 9, Sentence: 1},
+		{DocID: "doc2", EntityID: "kafka", StartIndex: 30, EndIndex: 35, Sentence: 3},
+		// Sentence 0 means the sentence isn't known so it shouldn't count as a co-mention.
+		{DocID: "doc3", EntityID: "projectx", StartIndex: 0, EndIndex: 9},
+		{DocID: "doc3", EntityID: "spark", StartIndex: 20, EndIndex: 25},
+	}
+
+	for _, m := range mentions {
+		if err := db.UpdateEntityMention(m); err != nil {
+			t.Fatalf("Failed to add mention; error %v", err)
+		}
+	}
+
+	// Run twice to make sure the table is replaced rather than appended to.
+	for i := 0; i < 2; i++ {
+		if err := db.UpdateEntityCooccurrences(); err != nil {
+			t.Fatalf("Failed to update co-occurrences; error %v", err)
+		}
+	}
+
+	actual, err := db.ListRelatedEntities("projectx", 0)
+	if err != nil {
+		t.Fatalf("Failed to list related entities; error %v", err)
+	}
+
+	expected := []*RelatedEntity{
+		{EntityID: "kafka", Name: "Kafka", Type: "CONSUMER_GOOD", NumDocuments: 2, NumSentences: 1},
+		{EntityID: "spark", Name: "Spark", Type: "CONSUMER_GOOD", NumDocuments: 2, NumSentences: 0},
+	}
+
+	if d := cmp.Diff(expected, actual); d != "" {
+		t.Errorf("Did not get expected related entities; diff:\n%v", d)
+	}
+
+	// Restricting to doc2 should only count the co-occurrence with kafka in doc2.
+	inDocs, err := db.ListRelatedEntitiesInDocs("projectx", []string{"doc2"}, 0)
+	if err != nil {
+		t.Fatalf("Failed to list related entities; error %v", err)
+	}
+
+	expectedInDocs := []*RelatedEntity{
+		{EntityID: "kafka", Name: "Kafka", Type: "CONSUMER_GOOD", NumDocuments: 1, NumSentences: 0},
+	}
+
+	if d := cmp.Diff(expectedInDocs, inDocs); d != "" {
+		t.Errorf("Did not get expected related entities in docs; diff:\n%v", d)
+	}
+}
@@ -7,16 +7,50 @@ import (
 	"github.com/pkg/errors"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"strings"
 )
 
 const (
-	driveNamespace = "gdrive"
+	driveNamespace  = "gdrive"
+	personNamespace = "person"
 )
 
+// Datastore is the Store backed by a SQL database; either SQLite or Postgres.
 type Datastore struct {
-	log    logr.Logger
+	log logr.Logger
+	// dbFile is the SQLite database file or the redacted URL of the Postgres database.
 	dbFile string
 	db     *gorm.DB
+	// autoMigrate is true if pending migrations are applied when the database is opened.
+	autoMigrate bool
+	// inTx is true if db is a transaction; see WithTx.
+	inTx bool
+	// encryptionKey is the key used to encrypt the sensitive columns; nil if they aren't encrypted.
+	encryptionKey []byte
+	// cipher encrypts the sensitive columns; nil if they aren't encrypted.
+	cipher *fieldCipher
+}
+
+// DatastoreOption is an option for the Datastore.
+type DatastoreOption func(d *Datastore)
+
+// DatastoreWithoutMigrations opens the database without applying pending migrations. It is used to inspect or
+// migrate the schema e.g. by the db command.
+func DatastoreWithoutMigrations() DatastoreOption {
+	return func(d *Datastore) {
+		d.autoMigrate = false
+	}
+}
+
+// DatastoreWithEncryptionKey encrypts the sensitive columns, e.g. doc titles and entity names, with key; see
+// encryptedFields. key is typically read with LoadEncryptionKey; if it is nil the columns aren't encrypted.
+//
+// An encrypted database can only be opened with its key. A new database is encrypted when it is first opened with
+// a key; an existing database must be encrypted with Rekey.
+func DatastoreWithEncryptionKey(key []byte) DatastoreOption {
+	return func(d *Datastore) {
+		d.encryptionKey = key
+	}
 }
 
 // DriveKey generates the primary key for the given Google Drive file
@@ -40,81 +74,133 @@ func EntityMentionKey(m EntityMention) string {
 	return fmt.Sprintf("%v-%v-%v-%v", m.DocID, m.EntityID, m.StartIndex, m.EndIndex)
 }
 
-// New creates a new datastore.
-func New(dbFile string, logger logr.Logger) (*Datastore, error) {
+// RedactionKey generates the primary key for the given Redaction.
+// WARNING: Changing this code will break existing databases since existing data will not have
+// compatible keys.
+func RedactionKey(r Redaction) string {
+	return fmt.Sprintf("%v-%v-%v", r.DocID, r.StartIndex, r.EndIndex)
+}
+
+// DocCategoryKey generates the primary key for the given DocCategory.
+// WARNING: Changing this code will break existing databases since existing data will not have
+// compatible keys.
+func DocCategoryKey(c DocCategory) string {
+	return fmt.Sprintf("%v-%v", c.DocID, c.Category)
+}
+
+// KeyphraseKey generates the primary key for the keyphrase with the given normalized phrase.
+// WARNING: Changing this code will break existing databases since existing data will not have
+// compatible keys.
+func KeyphraseKey(phrase string) string {
+	return strings.ToLower(strings.Join(strings.Fields(phrase), " "))
+}
+
+// KeyphraseMentionKey generates the primary key for the given KeyphraseMention.
+// WARNING: Changing this code will break existing databases since existing data will not have
+// compatible keys.
+func KeyphraseMentionKey(m KeyphraseMention) string {
+	return fmt.Sprintf("%v-%v-%v", m.DocID, m.KeyphraseID, m.StartIndex)
+}
+
+// DocKeyphraseKey generates the primary key for the given DocKeyphrase.
+// WARNING: Changing this code will break existing databases since existing data will not have
+// compatible keys.
+func DocKeyphraseKey(k DocKeyphrase) string {
+	return fmt.Sprintf("%v-%v", k.DocID, k.KeyphraseID)
+}
+
+// EntityCooccurrenceKey generates the primary key for the given EntityCooccurrence.
+// WARNING: Changing this code will break existing databases since existing data will not have
+// compatible keys.
+func EntityCooccurrenceKey(c EntityCooccurrence) string {
+	return fmt.Sprintf("%v-%v", c.EntityID, c.RelatedID)
+}
+
+// PersonKey generates the primary key for the person entity with the given email.
+// WARNING: Changing this code will break existing databases since existing data will not have
+// compatible keys.
+func PersonKey(email string) string {
+	return fmt.Sprintf("%v.%v", personNamespace, strings.ToLower(email))
+}
+
+// DocPersonKey generates the primary key for the given DocPerson.
+// WARNING: Changing this code will break existing databases since existing data will not have
+// compatible keys.
+func DocPersonKey(p DocPerson) string {
+	return fmt.Sprintf("%v-%v-%v", p.DocID, p.EntityID, p.Role)
+}
+
+// DocPermissionKey generates the primary key for the given DocPermission.
+// WARNING: Changing this code will break existing databases since existing data will not have
+// compatible keys.
+func DocPermissionKey(p DocPermission) string {
+	return fmt.Sprintf("%v-%v-%v", p.DocID, p.Type, p.Principal)
+}
+
+// NLPUsageKey generates the primary key for the given NLPUsage.
+func NLPUsageKey(u NLPUsage) string {
+	return fmt.Sprintf("%v.%v.%v.%v", u.RunID, u.Day, u.DriveID, u.Method)
+}
+
+// New creates a new datastore backed by the SQLite database in dbFile. Pending migrations are applied unless
+// DatastoreWithoutMigrations is passed.
+func New(dbFile string, logger logr.Logger, opts ...DatastoreOption) (*Datastore, error) {
 	if dbFile == "" {
 		return nil, errors.New("dbFile is required")
 	}
 
+	logger.Info("Opening database", "dbFile", dbFile)
+	return open(sqlite.Open(dbFile), dbFile, logger, opts...)
+}
+
+// open opens the database and applies pending migrations. name identifies the database in errors.
+func open(dialector gorm.Dialector, name string, logger logr.Logger, opts ...DatastoreOption) (*Datastore, error) {
 	db := &Datastore{
-		log:    logger,
-		dbFile: dbFile,
+		log:         logger,
+		dbFile:      name,
+		autoMigrate: true,
 	}
 
-	logger.Info("Opening database", "dbFile", dbFile)
-	sqlDb, err := gorm.Open(sqlite.Open(dbFile), &gorm.Config{})
-	if err != nil {
-		return nil, errors.Wrapf(err, "Failed to open database: %v", dbFile)
+	for _, o := range opts {
+		o(db)
 	}
 
-	db.db = sqlDb
-
-	err = db.updateSchema()
+	sqlDb, err := gorm.Open(dialector, &gorm.Config{})
 	if err != nil {
-		return nil, errors.Wrapf(err, "CreateTables failed")
+		return nil, errors.Wrapf(err, "Failed to open database: %v", name)
 	}
 
-	return db, nil
-}
+	db.db = sqlDb
 
-// updateSchema automatically updates the schema
-func (d *Datastore) updateSchema() error {
-	log := d.log
-	log.Info("Automigrating the schema")
-	// Migrate the schema
-	if err := d.db.AutoMigrate(&DocReference{}); err != nil {
-		return errors.Wrapf(err, "Failed to automigrate the schema for DocReference")
-	}
-	if err := d.db.AutoMigrate(&DocLink{}); err != nil {
-		return errors.Wrapf(err, "Failed to automigrate the schema for DocLink")
-	}
-	if err := d.db.AutoMigrate(&Entity{}); err != nil {
-		return errors.Wrapf(err, "Failed to automigrate the schema for Entity")
+	if db.encryptionKey != nil {
+		c, err := newFieldCipher(db.encryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := registerEncryptionCallbacks(sqlDb, c); err != nil {
+			return nil, errors.Wrapf(err, "Failed to register the encryption callbacks")
+		}
+		db.cipher = c
 	}
-	if err := d.db.AutoMigrate(&EntityMention{}); err != nil {
-		return errors.Wrapf(err, "Failed to automigrate the schema for EntityMention")
-	}
-	return nil
-}
 
-// UpdateDocReference updates or creates the DocReference
-func (d *Datastore) UpdateDocReference(r *DocReference) error {
-	if r.ID != "" && r.ID != DriveKey(r.DriveId) {
-		return errors.Errorf("ID and DriveID are inconsistent ID should be empty or %v", DriveKey(r.DriveId))
+	if !db.autoMigrate {
+		return db, nil
 	}
 
-	r.ID = DriveKey(r.DriveId)
-
-	log := d.log.WithValues("DriveId", r.DriveId)
-	db := d.db
-	current := &DocReference{
-		ID: DriveKey(r.DriveId),
+	if err := db.Migrate(0); err != nil {
+		return nil, errors.Wrapf(err, "Failed to migrate the schema of database: %v", name)
 	}
-	result := db.First(current)
 
-	if result.RowsAffected == 0 {
-		log.V(logging.Debug).Info("Record not found; it will be created")
-	} else {
-		log.V(logging.Debug).Info("Record found", "id", current.ID)
-		r.ID = current.ID
+	if err := db.checkEncryptionKey(); err != nil {
+		return nil, err
 	}
 
-	log.V(logging.Debug).Info("Updating record")
-	if result := db.Save(r); result.Error != nil {
-		return errors.Wrapf(result.Error, "Failed to update DocReference DriveId: %v", r.DriveId)
-	}
+	return db, nil
+}
 
-	return nil
+// UpdateDocReference updates or creates the DocReference
+func (d *Datastore) UpdateDocReference(r *DocReference) error {
+	return d.UpsertDocReferences([]*DocReference{r})
 }
 
 // DocReferenceIter is an iterator over DocReferences
@@ -122,75 +208,104 @@ type DocReferenceIter func(r *DocReference) error
 
 // ListDocReferences lists all the docreferences.
 func (d *Datastore) ListDocReferences() ([]*DocReference, error) {
-	db := d.db
-	// TODO(jeremy): Should we introduce some form of pagination? See
-	// https://gorm.io/docs/scopes.html#pagination
-	references := make([]*DocReference, 0, 0)
-	if result := db.Find(&references); result.Error != nil {
-		return nil, errors.Wrapf(result.Error, "Failed to find all doc references")
-	}
-
-	return references, nil
+	references, _, err := d.QueryDocReferences(DocReferenceQuery{})
+	return references, err
 }
 
-// UpdateDocLink updates or creates the DocLink
+// DocReferenceQuery selects the DocReferences to list. Empty fields match all docs.
 //
-// TODO(jeremy): These function needs to be updated to allow for a given link to appear multiple times in a doc.
-// In that case we want to have multiple entries in the doc.
-func (d *Datastore) UpdateDocLink(l *DocLink) error {
-	// DestID isn't required because not all links point ot Google Docs.
-	if l.SourceID == "" {
-		return errors.New("SourceID must be set")
-	}
+// Results can be sorted by id, name, mimeType, modifiedTime and fileCreatedTime.
+type DocReferenceQuery struct {
+	// IDs restricts the results to these docs.
+	IDs      []string `json:"ids"`
+	MimeType string   `json:"mimeType"`
+	ListOptions
+}
 
-	// TODO(jeremy): Should we be using hooks https://gorm.io/docs/hooks.html to achieve this
-	expectedId := DocLinkKey(*l)
-	if l.ID != "" && l.ID != expectedId {
-		return errors.Errorf("ID and DockLink are inconsistent ID should be empty or %v", expectedId)
+// QueryDocReferences lists a page of the DocReferences matching the query. The token for the next page is returned;
+// it is empty if this is the last page.
+func (d *Datastore) QueryDocReferences(q DocReferenceQuery) ([]*DocReference, string, error) {
+	p, err := newPager(q.ListOptions, q, docReferenceSortFields, &DocReference{})
+	if err != nil {
+		return nil, "", err
+	}
+	if err := d.checkSortable(p, &DocReference{}); err != nil {
+		return nil, "", err
 	}
 
-	l.ID = expectedId
-
-	log := d.log.WithValues("source", l.SourceID, "dest", l.DestID, "id", l.ID)
 	db := d.db
-
-	current := &DocLink{
-		ID: l.ID,
+	if len(q.IDs) > 0 {
+		db = db.Where("id in ?", q.IDs)
+	}
+	if q.MimeType != "" {
+		db = db.Where("mime_type = ?", q.MimeType)
 	}
-	result := db.First(current)
 
-	if result.RowsAffected == 0 {
-		log.V(logging.Debug).Info("Record not found; it will be created")
-	} else {
-		log.V(logging.Debug).Info("Record found", "id", current.ID)
-		l.ID = current.ID
+	references := make([]*DocReference, 0, 0)
+	if result := p.apply(db).Find(&references); result.Error != nil {
+		return nil, "", errors.Wrapf(result.Error, "Failed to find doc references")
 	}
 
-	log.V(logging.Debug).Info("Updating record")
-	if result := db.Save(l); result.Error != nil {
-		return errors.Wrapf(result.Error, "Failed to update Doclink Source: %v, Dest: %v", l.SourceID, l.DestID)
+	n, token, err := p.page(len(references), func(i int) interface{} { return references[i] })
+	if err != nil {
+		return nil, "", err
 	}
+	return references[:n], token, nil
+}
 
-	return nil
+// UpdateDocLink updates or creates the DocLink
+//
+// TODO(jeremy): These function needs to be updated to allow for a given link to appear multiple times in a doc.
+// In that case we want to have multiple entries in the doc.
+func (d *Datastore) UpdateDocLink(l *DocLink) error {
+	return d.UpsertDocLinks([]*DocLink{l})
 }
 
 // ListDocLinks lists all the doc links.
 // destId optional if supplied list all the links pointing at this destination id
 func (d *Datastore) ListDocLinks(destId string) ([]*DocLink, error) {
-	db := d.db
-	// TODO(jeremy): Should we introduce some form of pagination? See
-	// https://gorm.io/docs/scopes.html#pagination
-	links := make([]*DocLink, 0, 0)
+	links, _, err := d.QueryDocLinks(DocLinkQuery{DestID: destId})
+	return links, err
+}
+
+// DocLinkQuery selects the DocLinks to list. Empty fields match all links.
+//
+// Results can be sorted by id, sourceId, destId, text and startIndex.
+type DocLinkQuery struct {
+	SourceID string `json:"sourceId"`
+	DestID   string `json:"destId"`
+	ListOptions
+}
 
-	if destId != "" {
-		db = db.Where("dest_id = ? ", destId)
+// QueryDocLinks lists a page of the DocLinks matching the query. The token for the next page is returned; it is
+// empty if this is the last page.
+func (d *Datastore) QueryDocLinks(q DocLinkQuery) ([]*DocLink, string, error) {
+	p, err := newPager(q.ListOptions, q, docLinkSortFields, &DocLink{})
+	if err != nil {
+		return nil, "", err
+	}
+	if err := d.checkSortable(p, &DocLink{}); err != nil {
+		return nil, "", err
+	}
+
+	db := d.db
+	if q.SourceID != "" {
+		db = db.Where("source_id = ?", q.SourceID)
+	}
+	if q.DestID != "" {
+		db = db.Where("dest_id = ?", q.DestID)
 	}
 
-	if result := db.Find(&links); result.Error != nil {
-		return nil, errors.Wrapf(result.Error, "Failed to find all doc links")
+	links := make([]*DocLink, 0, 0)
+	if result := p.apply(db).Find(&links); result.Error != nil {
+		return nil, "", errors.Wrapf(result.Error, "Failed to find doc links")
 	}
 
-	return links, nil
+	n, token, err := p.page(len(links), func(i int) interface{} { return links[i] })
+	if err != nil {
+		return nil, "", err
+	}
+	return links[:n], token, nil
 }
 
 // UpdateEntity updates or creates the Entity
@@ -234,16 +349,53 @@ func (d *Datastore) UpdateEntity(m *Entity) error {
 
 // ListEntities lists all the entities.
 func (d *Datastore) ListEntities() ([]*Entity, error) {
+	entities, _, err := d.QueryEntities(EntityListQuery{})
+	return entities, err
+}
+
+// EntityListQuery selects the entities to list. Empty fields match all entities.
+//
+// Results can be sorted by id, name and type.
+type EntityListQuery struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// DocIDs restricts the results to entities mentioned in these docs.
+	DocIDs []string `json:"docIds"`
+	ListOptions
+}
+
+// QueryEntities lists a page of the entities matching the query. The token for the next page is returned; it is
+// empty if this is the last page.
+func (d *Datastore) QueryEntities(q EntityListQuery) ([]*Entity, string, error) {
+	p, err := newPager(q.ListOptions, q, entitySortFields, &Entity{})
+	if err != nil {
+		return nil, "", err
+	}
+	if err := d.checkSortable(p, &Entity{}); err != nil {
+		return nil, "", err
+	}
+
 	db := d.db
-	// TODO(jeremy): Should we introduce some form of pagination? See
-	// https://gorm.io/docs/scopes.html#pagination
-	entities := make([]*Entity, 0, 0)
+	if q.Name != "" {
+		db = db.Where("name = ?", d.encryptArg(q.Name))
+	}
+	if q.Type != "" {
+		db = db.Where("type = ?", q.Type)
+	}
+	if len(q.DocIDs) > 0 {
+		db = db.Where("id in (select entity_id from entity_mentions where doc_id in ? and deleted_at is null)", q.DocIDs)
+	}
 
-	if result := db.Find(&entities); result.Error != nil {
-		return nil, errors.Wrapf(result.Error, "Failed to find all entities")
+	entities := make([]*Entity, 0, 0)
+	if result := p.apply(db).Find(&entities); result.Error != nil {
+		return nil, "", errors.Wrapf(result.Error, "Failed to find entities")
 	}
 
-	return entities, nil
+	n, token, err := p.page(len(entities), func(i int) interface{} { return entities[i] })
+	if err != nil {
+		return nil, "", err
+	}
+	return entities[:n], token, nil
 }
 
 type EntityQuery struct {
@@ -262,7 +414,7 @@ func (d *Datastore) FindEntity(q EntityQuery) ([]*Entity, error) {
 	entities := make([]*Entity, 0, 0)
 
 	if q.Name != "" {
-		db = db.Or("name = ?", q.Name)
+		db = db.Or("name = ?", d.encryptArg(q.Name))
 	}
 
 	if q.WikipediaURL != "" {
@@ -283,23 +435,79 @@ func (d *Datastore) FindEntity(q EntityQuery) ([]*Entity, error) {
 // UpdateEntityMention updates or creates the EntityMention
 //
 func (d *Datastore) UpdateEntityMention(m *EntityMention) error {
-	if m.DocID == "" {
+	return d.UpsertEntityMentions([]*EntityMention{m})
+}
+
+// ListEntityMentions lists all the entity mentions.
+// docId is optional if supplied list all the mentions for the provided doc.
+func (d *Datastore) ListEntityMentions(docId string) ([]*EntityMention, error) {
+	mentions, _, err := d.QueryEntityMentions(EntityMentionQuery{DocID: docId})
+	return mentions, err
+}
+
+// EntityMentionQuery selects the EntityMentions to list. Empty fields match all mentions.
+//
+// Results can be sorted by id, entityId, startIndex, salience and sentence.
+type EntityMentionQuery struct {
+	DocID    string `json:"docId"`
+	EntityID string `json:"entityId"`
+	// Type of the mention; PROPER or COMMON.
+	Type string `json:"type"`
+	ListOptions
+}
+
+// QueryEntityMentions lists a page of the EntityMentions matching the query. The token for the next page is
+// returned; it is empty if this is the last page.
+func (d *Datastore) QueryEntityMentions(q EntityMentionQuery) ([]*EntityMention, string, error) {
+	p, err := newPager(q.ListOptions, q, entityMentionSortFields, &EntityMention{})
+	if err != nil {
+		return nil, "", err
+	}
+	if err := d.checkSortable(p, &EntityMention{}); err != nil {
+		return nil, "", err
+	}
+
+	db := d.db
+	if q.DocID != "" {
+		db = db.Where("doc_id = ?", q.DocID)
+	}
+	if q.EntityID != "" {
+		db = db.Where("entity_id = ?", q.EntityID)
+	}
+	if q.Type != "" {
+		db = db.Where("type = ?", q.Type)
+	}
+
+	mentions := make([]*EntityMention, 0, 0)
+	if result := p.apply(db).Find(&mentions); result.Error != nil {
+		return nil, "", errors.Wrapf(result.Error, "Failed to find entity mentions")
+	}
+
+	n, token, err := p.page(len(mentions), func(i int) interface{} { return mentions[i] })
+	if err != nil {
+		return nil, "", err
+	}
+	return mentions[:n], token, nil
+}
+
+// UpdateRedaction updates or creates the Redaction
+func (d *Datastore) UpdateRedaction(r *Redaction) error {
+	if r.DocID == "" {
 		return errors.New("DocID must be set")
 	}
 
-	// TODO(jeremy): Should we be using hooks https://gorm.io/docs/hooks.html to achieve this
-	expectedId := EntityMentionKey(*m)
-	if m.ID != "" && m.ID != expectedId {
-		return errors.Errorf("ID and EntityMention are inconsistent; ID should be empty or %v", expectedId)
+	expectedId := RedactionKey(*r)
+	if r.ID != "" && r.ID != expectedId {
+		return errors.Errorf("ID and Redaction are inconsistent; ID should be empty or %v", expectedId)
 	}
 
-	m.ID = expectedId
+	r.ID = expectedId
 
-	log := d.log.WithValues("docId", m.DocID, "id", m.ID)
+	log := d.log.WithValues("docId", r.DocID, "id", r.ID)
 	db := d.db
 
-	current := &EntityMention{
-		ID: m.ID,
+	current := &Redaction{
+		ID: r.ID,
 	}
 	result := db.First(current)
 
@@ -307,34 +515,63 @@ func (d *Datastore) UpdateEntityMention(m *EntityMention) error {
 		log.V(logging.Debug).Info("Record not found; it will be created")
 	} else {
 		log.V(logging.Debug).Info("Record found", "id", current.ID)
-		m.ID = current.ID
+		r.CreatedAt = current.CreatedAt
 	}
 
 	log.V(logging.Debug).Info("Updating record")
-	if result := db.Save(m); result.Error != nil {
-		return errors.Wrapf(result.Error, "Failed to update EntityMention ID: %v", m.ID)
+	if result := db.Save(r); result.Error != nil {
+		return errors.Wrapf(result.Error, "Failed to update Redaction ID: %v", r.ID)
 	}
 
 	return nil
 }
 
-// ListEntityMentions lists all the entity mentions.
-// docId is optional if supplied list all the mentions for the provided doc.
-func (d *Datastore) ListEntityMentions(docId string) ([]*EntityMention, error) {
+// ListRedactions lists the redactions.
+// docId is optional if supplied list all the redactions for the provided doc.
+func (d *Datastore) ListRedactions(docId string) ([]*Redaction, error) {
 	db := d.db
-	// TODO(jeremy): Should we introduce some form of pagination? See
-	// https://gorm.io/docs/scopes.html#pagination
-	links := make([]*EntityMention, 0, 0)
+	redactions := make([]*Redaction, 0, 0)
 
 	if docId != "" {
 		db = db.Where("doc_id = ? ", docId)
 	}
 
-	if result := db.Find(&links); result.Error != nil {
-		return nil, errors.Wrapf(result.Error, "Failed to find all entitymentions")
+	if result := db.Find(&redactions); result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to find all redactions")
 	}
 
-	return links, nil
+	return redactions, nil
+}
+
+// EntityDocument summarizes the mentions of an entity in a document.
+type EntityDocument struct {
+	DocID string
+	// Salience of the entity in the doc.
+	Salience float32
+	// NumMentions is the number of times the entity is mentioned in the doc.
+	NumMentions int64
+	// SentimentScore is the average score of the mentions.
+	SentimentScore float32
+	// SentimentMagnitude is the total magnitude of the mentions.
+	SentimentMagnitude float32
+}
+
+// ListEntityDocuments lists the documents which mention the given entity.
+// Documents are ranked so that documents where the entity is central (i.e. has a higher salience) come before
+// documents that only mention it in passing.
+func (d *Datastore) ListEntityDocuments(entityId string) ([]*EntityDocument, error) {
+	docs := make([]*EntityDocument, 0, 0)
+	result := d.db.Model(&EntityMention{}).
+		Select("doc_id, max(salience) as salience, count(*) as num_mentions, avg(sentiment_score) as sentiment_score, sum(sentiment_magnitude) as sentiment_magnitude").
+		Where("entity_id = ?", entityId).
+		Group("doc_id").
+		Order("salience desc, num_mentions desc, doc_id").
+		Scan(&docs)
+
+	if result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to list documents for entity: %v", entityId)
+	}
+	return docs, nil
 }
 
 // ToBeIndexed returns a list of DocReferences that need to be indexed.
@@ -352,6 +589,12 @@ func (d *Datastore) ToBeIndexed() ([]*DocReference, error) {
 }
 
 func (d *Datastore) Close() error {
-	// Currently a null op.
-	return nil
+	if d.inTx {
+		return errors.New("Close can't be called on the Datastore passed to WithTx")
+	}
+	sqlDb, err := d.db.DB()
+	if err != nil {
+		return errors.Wrapf(err, "Failed to get the database connection")
+	}
+	return sqlDb.Close()
 }
@@ -496,3 +496,46 @@ func Test_FindEntities(t *testing.T) {
 		})
 	}
 }
+
+func Test_ListEntityDocuments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testDatabase")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+
+	dbFile := path.Join(dir, "database.db")
+
+	log, _ := logging.InitLogger("info", true)
+	db, err := New(dbFile, *log)
+
+	if err != nil {
+		t.Fatalf("Failed to create database; error %v", err)
+	}
+
+	mentions := []*EntityMention{
+		{DocID: "passing", EntityID: "kubeflow", StartIndex: 0, EndIndex: 8, Salience: 0.01, SentimentScore: -0.5, SentimentMagnitude: 0.5},
+		{DocID: "central", EntityID: "kubeflow", StartIndex: 0, EndIndex: 8, Salience: 0.8, SentimentScore: 0.5, SentimentMagnitude: 1},
+		{DocID: "central", EntityID: "kubeflow", StartIndex: 20, EndIndex: 28, Salience: 0.8, SentimentScore: 1, SentimentMagnitude: 1},
+		{DocID: "central", EntityID: "other", StartIndex: 40, EndIndex: 45, Salience: 0.1},
+	}
+
+	for _, m := range mentions {
+		if err := db.UpdateEntityMention(m); err != nil {
+			t.Fatalf("Failed to add mention; error %v", err)
+		}
+	}
+
+	actual, err := db.ListEntityDocuments("kubeflow")
+	if err != nil {
+		t.Fatalf("Failed to list entity documents; error %v", err)
+	}
+
+	expected := []*EntityDocument{
+		{DocID: "central", Salience: 0.8, NumMentions: 2, SentimentScore: 0.75, SentimentMagnitude: 2},
+		{DocID: "passing", Salience: 0.01, NumMentions: 1, SentimentScore: -0.5, SentimentMagnitude: 0.5},
+	}
+
+	if d := cmp.Diff(expected, actual); d != "" {
+		t.Errorf("Did not get expected documents; diff:\n%v", d)
+	}
+}
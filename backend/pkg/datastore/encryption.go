@@ -0,0 +1,445 @@
+package datastore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+)
+
+const (
+	// EncryptionKeyEnv is the environment variable the encryption key is read from if no other source is set.
+	EncryptionKeyEnv = "P22H_DB_KEY"
+
+	// encryptionKeySize is the size of encryption keys in bytes.
+	encryptionKeySize = 32
+
+	// encryptedPrefix marks encrypted values. The version allows the scheme to be changed later.
+	encryptedPrefix = "enc1:"
+
+	// encryptionKeyID is the ID of the row in the encryption_keys table.
+	encryptionKeyID = "default"
+	// encryptionCheck is the value encrypted in EncryptionKey.Check.
+	encryptionCheck = "p22h encryption check"
+)
+
+// encryptedField is a field whose value is encrypted when a Datastore is opened with an encryption key.
+type encryptedField struct {
+	// model is the struct containing the field.
+	model reflect.Type
+	// field is the name of the field. It must be a string or []byte.
+	field string
+	// table and column identify the column in the database. They are empty for the results of joins.
+	table  string
+	column string
+}
+
+// encryptedFields are the sensitive fields i.e. doc titles, link text, entity names, the text of entity and
+// keyphrase mentions and the cached Natural Language API responses which contain the text of docs.
+//
+// Keys such as IDs aren't encrypted. Neither are
+//   - keyphrases since they are searched with LIKE and are the IDs of Keyphrases.
+//   - the principals of DocPermissions since they are part of the IDs; see DocPermissionKey.
+//   - the emails of people known to Drive since they are part of the IDs of their entities; see PersonKey.
+//
+// The exclusions are listed in the help of the db rekey command; keep it in sync. Since they would be stored in plain
+// text the index command refuses to extract keyphrases, people or ACLs when the database is encrypted.
+var encryptedFields = []encryptedField{
+	{model: reflect.TypeOf(DocReference{}), field: "Name", table: "doc_references", column: "name"},
+	{model: reflect.TypeOf(DocLink{}), field: "Text", table: "doc_links", column: "text"},
+	{model: reflect.TypeOf(Entity{}), field: "Name", table: "entities", column: "name"},
+	{model: reflect.TypeOf(EntityMention{}), field: "Text", table: "entity_mentions", column: "text"},
+	{model: reflect.TypeOf(KeyphraseMention{}), field: "Text", table: "keyphrase_mentions", column: "text"},
+	{model: reflect.TypeOf(NLPResponse{}), field: "Response", table: "nlp_responses", column: "response"},
+	{model: reflect.TypeOf(RelatedEntity{}), field: "Name"},
+	{model: reflect.TypeOf(TimelineDoc{}), field: "Name"},
+	{model: reflect.TypeOf(EntityCount{}), field: "Name"},
+	{model: reflect.TypeOf(LinkedDoc{}), field: "Name"},
+}
+
+// fieldCipher encrypts and decrypts the values of encrypted fields.
+//
+// Encryption is deterministic; the nonce is derived from the plaintext with HMAC-SHA256 (a synthetic IV) so equal
+// values have equal ciphertexts. This reveals which rows have the same value but lets the datastore look up
+// entities by name. Ciphertexts don't preserve order so encrypted fields can't be sorted.
+type fieldCipher struct {
+	aead  cipher.AEAD
+	ivKey []byte
+	// fields are the names of the encrypted fields of each model.
+	fields map[reflect.Type][]string
+}
+
+// newFieldCipher creates a cipher for the key. The AES-256-GCM key and the HMAC key are derived from it.
+func newFieldCipher(key []byte) (*fieldCipher, error) {
+	if len(key) != encryptionKeySize {
+		return nil, errors.Errorf("Encryption key has %v bytes; it must have %v", len(key), encryptionKeySize)
+	}
+
+	block, err := aes.NewCipher(deriveKey(key, "p22h aes-gcm"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create the block cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create the AEAD")
+	}
+
+	c := &fieldCipher{
+		aead:   aead,
+		ivKey:  deriveKey(key, "p22h synthetic iv"),
+		fields: map[reflect.Type][]string{},
+	}
+	for _, f := range encryptedFields {
+		c.fields[f.model] = append(c.fields[f.model], f.field)
+	}
+	return c, nil
+}
+
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// encrypt encrypts the value. Empty values aren't encrypted so checks for empty values still work.
+func (c *fieldCipher) encrypt(plaintext string) string {
+	if plaintext == "" || strings.HasPrefix(plaintext, encryptedPrefix) {
+		return plaintext
+	}
+
+	mac := hmac.New(sha256.New, c.ivKey)
+	mac.Write([]byte(plaintext))
+	nonce := mac.Sum(nil)[:c.aead.NonceSize()]
+
+	sealed := c.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return encryptedPrefix + base64.RawStdEncoding.EncodeToString(sealed)
+}
+
+// decrypt decrypts a value returned by encrypt. Values which aren't encrypted are returned as is.
+func (c *fieldCipher) decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return "", errors.New("Encrypted value is malformed")
+	}
+
+	n := c.aead.NonceSize()
+	plaintext, err := c.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return "", errors.New("Failed to decrypt value; the encryption key is wrong or the data is corrupt")
+	}
+	return string(plaintext), nil
+}
+
+// apply calls fn with the value of each encrypted field in value. value is a model, a pointer to a model or a
+// slice or array of them; anything else is ignored. fn returns the new value of the field.
+func (c *fieldCipher) apply(value reflect.Value, fn func(string) (string, error)) error {
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if value.IsNil() {
+			return nil
+		}
+		return c.apply(value.Elem(), fn)
+	case reflect.Slice, reflect.Array:
+		if value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.Uint8 {
+			return nil
+		}
+		for i := 0; i < value.Len(); i++ {
+			if err := c.apply(value.Index(i), fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Struct:
+		for _, name := range c.fields[value.Type()] {
+			f := value.FieldByName(name)
+			if !f.CanSet() {
+				continue
+			}
+			switch f.Kind() {
+			case reflect.String:
+				v, err := fn(f.String())
+				if err != nil {
+					return errors.Wrapf(err, "Failed to process %v.%v", value.Type().Name(), name)
+				}
+				f.SetString(v)
+			case reflect.Slice:
+				v, err := fn(string(f.Bytes()))
+				if err != nil {
+					return errors.Wrapf(err, "Failed to process %v.%v", value.Type().Name(), name)
+				}
+				if v == "" {
+					f.SetBytes(nil)
+				} else {
+					f.SetBytes([]byte(v))
+				}
+			}
+		}
+		return nil
+	default:
+		return nil
+	}
+}
+
+// decryptRows decrypts the encrypted fields of rows in place.
+func (c *fieldCipher) decryptRows(rows interface{}) error {
+	return c.apply(reflect.ValueOf(rows), c.decrypt)
+}
+
+// registerEncryptionCallbacks registers gorm callbacks which encrypt the fields of models before they are
+// written and decrypt them after they are written or read so callers only see plaintext. Results of Scan aren't
+// decrypted by the callbacks; use decryptRows.
+func registerEncryptionCallbacks(db *gorm.DB, c *fieldCipher) error {
+	encrypt := func(tx *gorm.DB) {
+		if tx.Statement.ReflectValue.IsValid() {
+			tx.AddError(c.apply(tx.Statement.ReflectValue, func(v string) (string, error) { return c.encrypt(v), nil }))
+		}
+	}
+	decrypt := func(tx *gorm.DB) {
+		// Decrypt even if the statement failed since the caller's struct was encrypted in place.
+		if tx.Statement.ReflectValue.IsValid() {
+			tx.AddError(c.apply(tx.Statement.ReflectValue, c.decrypt))
+		}
+	}
+
+	callbacks := db.Callback()
+	if err := callbacks.Create().Before("gorm:create").Register("p22h:encrypt", encrypt); err != nil {
+		return err
+	}
+	if err := callbacks.Create().After("gorm:create").Register("p22h:decrypt", decrypt); err != nil {
+		return err
+	}
+	if err := callbacks.Update().Before("gorm:update").Register("p22h:encrypt", encrypt); err != nil {
+		return err
+	}
+	if err := callbacks.Update().After("gorm:update").Register("p22h:decrypt", decrypt); err != nil {
+		return err
+	}
+	return callbacks.Query().After("gorm:query").Register("p22h:decrypt", decrypt)
+}
+
+// Encrypted returns true if the sensitive columns are encrypted.
+func (d *Datastore) Encrypted() bool {
+	return d.cipher != nil
+}
+
+// encryptArg encrypts a value compared with an encrypted column in a query. It is a no-op if the datastore isn't
+// encrypted.
+func (d *Datastore) encryptArg(value string) string {
+	if d.cipher == nil {
+		return value
+	}
+	return d.cipher.encrypt(value)
+}
+
+// decryptRows decrypts the results of a Scan. It is a no-op if the datastore isn't encrypted.
+func (d *Datastore) decryptRows(rows interface{}) error {
+	if d.cipher == nil {
+		return nil
+	}
+	return d.cipher.decryptRows(rows)
+}
+
+// checkSortable returns an error if the rows of model are sorted by an encrypted field.
+func (d *Datastore) checkSortable(p *pager, model interface{}) error {
+	if d.cipher == nil {
+		return nil
+	}
+	field := strings.ToUpper(p.field[:1]) + p.field[1:]
+	for _, f := range d.cipher.fields[reflect.TypeOf(model).Elem()] {
+		if f == field {
+			return errors.Wrapf(ErrInvalidArgument, "Can't sort by %v because it is encrypted", p.field)
+		}
+	}
+	return nil
+}
+
+// checkEncryptionKey verifies the datastore is being opened with the key it was encrypted with. A new database
+// opened with a key is marked as encrypted. An existing database which isn't encrypted must be encrypted with
+// Rekey rather than opened with a key.
+func (d *Datastore) checkEncryptionKey() error {
+	row := &EncryptionKey{}
+	result := d.db.Limit(1).Find(row, "id = ?", encryptionKeyID)
+	if result.Error != nil {
+		return errors.Wrapf(result.Error, "Failed to read the encryption key check")
+	}
+	encrypted := result.RowsAffected > 0
+
+	switch {
+	case encrypted && d.cipher == nil:
+		return errors.Errorf("Database %v is encrypted; set %v or pass the encryption key", d.dbFile, EncryptionKeyEnv)
+	case encrypted:
+		v, err := d.cipher.decrypt(row.Check)
+		if err != nil || v != encryptionCheck {
+			return errors.Errorf("Database %v is encrypted with a different key", d.dbFile)
+		}
+		return nil
+	case d.cipher == nil:
+		return nil
+	}
+
+	for _, f := range encryptedFields {
+		if f.table == "" {
+			continue
+		}
+		var count int64
+		if err := d.db.Table(f.table).Count(&count).Error; err != nil {
+			return errors.Wrapf(err, "Failed to count the rows in %v", f.table)
+		}
+		if count > 0 {
+			return errors.Errorf("Database %v isn't encrypted; encrypt it with the rekey command before opening it with a key", d.dbFile)
+		}
+	}
+
+	return d.db.Create(&EncryptionKey{ID: encryptionKeyID, Check: d.cipher.encrypt(encryptionCheck)}).Error
+}
+
+// Rekey re-encrypts the sensitive columns with newKey. The datastore must have been opened with its current key
+// or without a key if it isn't encrypted. If newKey is nil the columns are decrypted. Everything is re-encrypted
+// in a single transaction; afterwards the datastore must be closed and opened with the new key.
+func (d *Datastore) Rekey(newKey []byte) error {
+	if err := d.checkEncryptionKey(); err != nil {
+		return err
+	}
+
+	var next *fieldCipher
+	if newKey != nil {
+		c, err := newFieldCipher(newKey)
+		if err != nil {
+			return err
+		}
+		next = c
+	}
+
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		for _, f := range encryptedFields {
+			if f.table == "" {
+				continue
+			}
+			if err := rekeyColumn(tx, f, d.cipher, next); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Where("id = ?", encryptionKeyID).Delete(&EncryptionKey{}).Error; err != nil {
+			return errors.Wrapf(err, "Failed to delete the encryption key check")
+		}
+		if next == nil {
+			return nil
+		}
+		return tx.Create(&EncryptionKey{ID: encryptionKeyID, Check: next.encrypt(encryptionCheck)}).Error
+	})
+}
+
+// rekeyColumn re-encrypts the values of the column. current is nil if the values aren't encrypted; next is nil
+// if they should be decrypted. The table is read and written without models so the callbacks don't apply.
+func rekeyColumn(tx *gorm.DB, f encryptedField, current *fieldCipher, next *fieldCipher) error {
+	type row struct {
+		ID    string
+		Value []byte
+	}
+	rows := []*row{}
+	if err := tx.Table(f.table).Select("id, " + f.column + " as value").Scan(&rows).Error; err != nil {
+		return errors.Wrapf(err, "Failed to read %v.%v", f.table, f.column)
+	}
+
+	for _, r := range rows {
+		v := string(r.Value)
+		if strings.HasPrefix(v, encryptedPrefix) {
+			if current == nil {
+				return errors.Errorf("%v.%v of row %v is encrypted but the database isn't", f.table, f.column, r.ID)
+			}
+			plaintext, err := current.decrypt(v)
+			if err != nil {
+				return errors.Wrapf(err, "Failed to decrypt %v.%v of row %v", f.table, f.column, r.ID)
+			}
+			v = plaintext
+		}
+		if next != nil {
+			v = next.encrypt(v)
+		}
+		if v == string(r.Value) {
+			continue
+		}
+
+		var value interface{} = v
+		if field, _ := f.model.FieldByName(f.field); field.Type.Kind() == reflect.Slice {
+			value = []byte(v)
+		}
+		if err := tx.Exec("update "+f.table+" set "+f.column+" = ? where id = ?", value, r.ID).Error; err != nil {
+			return errors.Wrapf(err, "Failed to update %v.%v of row %v", f.table, f.column, r.ID)
+		}
+	}
+	return nil
+}
+
+// GenerateEncryptionKey returns a new random key encoded as base64.
+func GenerateEncryptionKey() (string, error) {
+	key := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", errors.Wrapf(err, "Failed to generate a key")
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ParseEncryptionKey decodes a key returned by GenerateEncryptionKey.
+func ParseEncryptionKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Encryption key isn't valid base64")
+	}
+	if len(key) != encryptionKeySize {
+		return nil, errors.Errorf("Encryption key has %v bytes; it must have %v", len(key), encryptionKeySize)
+	}
+	return key, nil
+}
+
+// KeySource is where to read the encryption key from. At most one of File and Keyring should be set; if neither
+// is set the key is read from the environment variable Env.
+type KeySource struct {
+	// File is a file containing the key.
+	File string
+	// Keyring is the account the key is stored under in the OS keyring; see StoreKeyInKeyring.
+	Keyring string
+	// Env is the environment variable containing the key. Typically EncryptionKeyEnv.
+	Env string
+}
+
+// LoadEncryptionKey reads the key from the source. It returns nil if no key is configured i.e. the database
+// isn't encrypted.
+func LoadEncryptionKey(src KeySource) ([]byte, error) {
+	switch {
+	case src.File != "" && src.Keyring != "":
+		return nil, errors.New("The encryption key can be read from a file or the keyring but not both")
+	case src.File != "":
+		b, err := ioutil.ReadFile(src.File)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to read the encryption key from %v", src.File)
+		}
+		return ParseEncryptionKey(string(b))
+	case src.Keyring != "":
+		encoded, err := keyringGet(src.Keyring)
+		if err != nil {
+			return nil, err
+		}
+		return ParseEncryptionKey(encoded)
+	case src.Env != "":
+		encoded := os.Getenv(src.Env)
+		if encoded == "" {
+			return nil, nil
+		}
+		return ParseEncryptionKey(encoded)
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,229 @@
+package datastore
+
+import (
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func newTestKey(t *testing.T) []byte {
+	encoded, err := GenerateEncryptionKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key; error %v", err)
+	}
+	key, err := ParseEncryptionKey(encoded)
+	if err != nil {
+		t.Fatalf("Failed to parse key; error %v", err)
+	}
+	return key
+}
+
+// Test_EncryptedStore runs the conformance tests which don't sort by encrypted fields or depend on their size
+// against an encrypted database.
+func Test_EncryptedStore(t *testing.T) {
+	tests := map[string]func(t *testing.T, s Store){
+		"docs":     testStoreDocs,
+		"entities": testStoreEntities,
+		"mentions": testStoreMentions,
+		"people":   testStorePeople,
+		"upserts":  testStoreUpserts,
+		"withTx":   testStoreWithTx,
+		"stats":    testStoreStats,
+	}
+
+	log, _ := logging.InitLogger("info", true)
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "testDatabase")
+			if err != nil {
+				t.Fatalf("Failed to create temporary directory; error %v", err)
+			}
+			s, err := New(path.Join(dir, "database.db"), *log, DatastoreWithEncryptionKey(newTestKey(t)))
+			if err != nil {
+				t.Fatalf("Failed to create database; error %v", err)
+			}
+			defer s.Close()
+			test(t, s)
+		})
+	}
+}
+
+func Test_Encryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testEncryption")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+
+	log, err := logging.InitLogger("info", true)
+	if err != nil {
+		t.Fatalf("Failed to initialize logger; %v", err)
+	}
+
+	key := newTestKey(t)
+	dbFile := path.Join(dir, "database.db")
+	db, err := New(dbFile, *log, DatastoreWithEncryptionKey(key))
+	if err != nil {
+		t.Fatalf("Failed to create datastore; error %v", err)
+	}
+	if !db.Encrypted() {
+		t.Errorf("Encrypted returned false for a datastore opened with a key")
+	}
+
+	doc := &DocReference{DriveId: "doc1", Name: "Secret plans"}
+	if err := db.UpdateDocReference(doc); err != nil {
+		t.Fatalf("Failed to create doc; error %v", err)
+	}
+	if doc.Name != "Secret plans" {
+		t.Errorf("UpdateDocReference changed the caller's doc; got name %v", doc.Name)
+	}
+	if err := db.UpdateEntity(&Entity{ID: "e1", Name: "Project X", Type: "OTHER"}); err != nil {
+		t.Fatalf("Failed to create entity; error %v", err)
+	}
+	if err := db.UpdateDocLink(&DocLink{SourceID: DriveKey("doc1"), DestID: DriveKey("doc2"), Text: "Secret link"}); err != nil {
+		t.Fatalf("Failed to create link; error %v", err)
+	}
+	if err := db.ReplaceKeyphraseMentions(DriveKey("doc1"), []*KeyphraseMention{{DocID: DriveKey("doc1"), KeyphraseID: "secret plans", Text: "Secret plans"}}); err != nil {
+		t.Fatalf("Failed to create keyphrase mention; error %v", err)
+	}
+	if mentions, err := db.ListKeyphraseMentions(DriveKey("doc1")); err != nil || len(mentions) != 1 || mentions[0].Text != "Secret plans" {
+		t.Errorf("ListKeyphraseMentions returned %v, %v; want the decrypted mention", mentions, err)
+	}
+
+	if err := db.PutNLPResponse("key1", "AnalyzeEntities", 10, []byte("Secret response")); err != nil {
+		t.Fatalf("Failed to cache response; error %v", err)
+	}
+	if r, err := db.GetNLPResponse("key1"); err != nil || string(r) != "Secret response" {
+		t.Errorf("GetNLPResponse returned %v, %v; want the decrypted response", string(r), err)
+	}
+
+	// The values are encrypted in the database.
+	raw := func(table string, column string) []string {
+		values := []string{}
+		if err := db.db.Table(table).Select(column).Scan(&values).Error; err != nil {
+			t.Fatalf("Failed to read %v.%v; error %v", table, column, err)
+		}
+		return values
+	}
+	values := raw("doc_references", "name")
+	values = append(values, raw("entities", "name")...)
+	values = append(values, raw("doc_links", "text")...)
+	values = append(values, raw("keyphrase_mentions", "text")...)
+	values = append(values, raw("nlp_responses", "response")...)
+	for _, v := range values {
+		if !strings.HasPrefix(v, encryptedPrefix) || strings.Contains(v, "Secret") || strings.Contains(v, "Project") {
+			t.Errorf("Value %v isn't encrypted", v)
+		}
+	}
+
+	// Lookups by name still work.
+	if entities, err := db.FindEntity(EntityQuery{Name: "Project X"}); err != nil || len(entities) != 1 || entities[0].Name != "Project X" {
+		t.Errorf("FindEntity returned %v, %v; want Project X", entities, err)
+	}
+	if entities, _, err := db.QueryEntities(EntityListQuery{Name: "Project X"}); err != nil || len(entities) != 1 {
+		t.Errorf("QueryEntities returned %v, %v; want Project X", entities, err)
+	}
+
+	// Encrypted fields can't be sorted.
+	if _, _, err := db.QueryDocReferences(DocReferenceQuery{ListOptions: ListOptions{OrderBy: "name"}}); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("Sorting by an encrypted field returned %v; want ErrInvalidArgument", err)
+	}
+	db.Close()
+
+	// The database can only be opened with the right key.
+	if _, err := New(dbFile, *log); err == nil {
+		t.Errorf("Opening an encrypted database without a key succeeded; want error")
+	}
+	if _, err := New(dbFile, *log, DatastoreWithEncryptionKey(newTestKey(t))); err == nil {
+		t.Errorf("Opening an encrypted database with the wrong key succeeded; want error")
+	}
+
+	// Rekey with a new key.
+	db, err = New(dbFile, *log, DatastoreWithEncryptionKey(key), DatastoreWithoutMigrations())
+	if err != nil {
+		t.Fatalf("Failed to open datastore; error %v", err)
+	}
+	newKey := newTestKey(t)
+	if err := db.Rekey(newKey); err != nil {
+		t.Fatalf("Failed to rekey; error %v", err)
+	}
+	db.Close()
+
+	if _, err := New(dbFile, *log, DatastoreWithEncryptionKey(key)); err == nil {
+		t.Errorf("Opening the database with the old key succeeded; want error")
+	}
+	db, err = New(dbFile, *log, DatastoreWithEncryptionKey(newKey))
+	if err != nil {
+		t.Fatalf("Failed to open the database with the new key; error %v", err)
+	}
+	docs, err := db.ListDocReferences()
+	if err != nil || len(docs) != 1 || docs[0].Name != "Secret plans" {
+		t.Errorf("ListDocReferences returned %v, %v; want the decrypted doc", docs, err)
+	}
+
+	// Remove the encryption.
+	if err := db.Rekey(nil); err != nil {
+		t.Fatalf("Failed to decrypt; error %v", err)
+	}
+	db.Close()
+
+	db, err = New(dbFile, *log)
+	if err != nil {
+		t.Fatalf("Failed to open the decrypted database; error %v", err)
+	}
+	defer db.Close()
+	if db.Encrypted() {
+		t.Errorf("Encrypted returned true for a datastore opened without a key")
+	}
+	if names := raw("doc_references", "name"); len(names) != 1 || names[0] != "Secret plans" {
+		t.Errorf("Names weren't decrypted; got %v", names)
+	}
+
+	// An existing database with data must be encrypted with Rekey.
+	if _, err := New(dbFile, *log, DatastoreWithEncryptionKey(key)); err == nil {
+		t.Errorf("Opening an unencrypted database with a key succeeded; want error")
+	}
+	if err := db.Rekey(key); err != nil {
+		t.Fatalf("Failed to encrypt; error %v", err)
+	}
+	if names := raw("doc_references", "name"); len(names) != 1 || !strings.HasPrefix(names[0], encryptedPrefix) {
+		t.Errorf("Names weren't encrypted; got %v", names)
+	}
+}
+
+func Test_LoadEncryptionKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testEncryption")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+
+	encoded, err := GenerateEncryptionKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key; error %v", err)
+	}
+
+	keyFile := path.Join(dir, "key")
+	if err := ioutil.WriteFile(keyFile, []byte(encoded+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write key; error %v", err)
+	}
+	if key, err := LoadEncryptionKey(KeySource{File: keyFile, Env: EncryptionKeyEnv}); err != nil || len(key) != encryptionKeySize {
+		t.Errorf("LoadEncryptionKey returned %v, %v; want a key", key, err)
+	}
+
+	env := "P22H_TEST_DB_KEY"
+	if key, err := LoadEncryptionKey(KeySource{Env: env}); err != nil || key != nil {
+		t.Errorf("LoadEncryptionKey returned %v, %v; want nil", key, err)
+	}
+	os.Setenv(env, encoded)
+	defer os.Unsetenv(env)
+	if key, err := LoadEncryptionKey(KeySource{Env: env}); err != nil || len(key) != encryptionKeySize {
+		t.Errorf("LoadEncryptionKey returned %v, %v; want a key", key, err)
+	}
+	os.Setenv(env, "tooshort")
+	if _, err := LoadEncryptionKey(KeySource{Env: env}); err == nil {
+		t.Errorf("LoadEncryptionKey accepted an invalid key; want error")
+	}
+}
@@ -0,0 +1,615 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"reflect"
+	"time"
+)
+
+const (
+	// ExportFormatVersion is the version of the format written by Export. It must be incremented whenever a change
+	// to the format or the models would prevent older binaries from importing the export correctly.
+	ExportFormatVersion = 2
+
+	// headerKind is the kind of the first record of an export.
+	headerKind = "header"
+
+	// exportPageSize is the number of rows Export reads at a time.
+	exportPageSize = 500
+	// importBatchSize is the number of rows of a kind Import buffers before writing them.
+	importBatchSize = 500
+)
+
+// MergePolicy determines what Import does when a row in the export already exists in the store.
+type MergePolicy string
+
+const (
+	// MergeReplace overwrites existing rows with the imported rows.
+	MergeReplace MergePolicy = "replace"
+	// MergeKeep keeps existing rows and only imports new ones.
+	MergeKeep MergePolicy = "keep"
+	// MergeNewer keeps whichever row was updated most recently. Use it to merge two people's indexes.
+	MergeNewer MergePolicy = "newer"
+)
+
+// ParseMergePolicy parses the name of a MergePolicy.
+func ParseMergePolicy(name string) (MergePolicy, error) {
+	switch p := MergePolicy(name); p {
+	case MergeReplace, MergeKeep, MergeNewer:
+		return p, nil
+	default:
+		return "", errors.Errorf("Unknown merge policy %q; it must be one of %v, %v or %v", name, MergeReplace, MergeKeep, MergeNewer)
+	}
+}
+
+// exportRecord is a line of an export. The first line is a header with Kind set to headerKind; every other line is
+// a row of the table identified by Kind.
+type exportRecord struct {
+	Kind       string          `json:"kind"`
+	Version    int             `json:"version,omitempty"`
+	ExportedAt *time.Time      `json:"exportedAt,omitempty"`
+	Data       json.RawMessage `json:"data,omitempty"`
+}
+
+// ExportStats are the number of rows of each kind that were exported or imported.
+type ExportStats struct {
+	Version    int
+	Rows       map[string]int
+	Skipped    map[string]int
+	ExportedAt time.Time
+}
+
+// exportTable describes how to export and import the rows of a table.
+type exportTable struct {
+	// kind is the name of the model.
+	kind string
+	// model is a pointer to the model; it determines the table.
+	model interface{}
+	// export calls emit with every row in the store.
+	export func(s Store, emit func(row interface{}) error) error
+	// decode decodes a row returning it along with its ID and the time it was last updated.
+	decode func(data json.RawMessage) (interface{}, string, time.Time, error)
+	// updated returns the time each existing row was last updated keyed by ID.
+	updated func(s Store) (map[string]time.Time, error)
+	// write creates or updates the rows.
+	write func(s Store, rows []interface{}) error
+	// resolve is optional. It is called on each imported row before the merge policy is applied and can change
+	// the row and its ID e.g. to match it with an existing row. It returns the ID of the row.
+	resolve func(r *importResolver, row interface{}) (string, error)
+}
+
+// unexportedTables are the tables deliberately left out of exports keyed by table name. Every other table must be
+// in exportTables; TestExportTables fails if a table created by the migrations is in neither.
+var unexportedTables = map[string]string{
+	"nlp_responses":        "The NL API cache can be rebuilt by indexing.",
+	"entity_cooccurrences": "Cooccurrences are derived from the mentions by UpdateEntityCooccurrences.",
+	"schema_version":       "The schema version belongs to the database.",
+	"encryption_keys":      "Encryption keys belong to the database.",
+}
+
+// exportTables are the tables included in exports in the order they are written. To include a new table in
+// exports add it here; older binaries will refuse to import exports containing kinds they don't know about.
+var exportTables = []exportTable{
+	{
+		kind:  "DocReference",
+		model: &DocReference{},
+		export: func(s Store, emit func(row interface{}) error) error {
+			q := DocReferenceQuery{ListOptions: ListOptions{PageSize: exportPageSize}}
+			for {
+				rows, token, err := s.QueryDocReferences(q)
+				if err != nil {
+					return err
+				}
+				for _, r := range rows {
+					if err := emit(r); err != nil {
+						return err
+					}
+				}
+				if token == "" {
+					return nil
+				}
+				q.PageToken = token
+			}
+		},
+		decode: func(data json.RawMessage) (interface{}, string, time.Time, error) {
+			r := &DocReference{}
+			err := json.Unmarshal(data, r)
+			return r, r.ID, r.UpdatedAt, err
+		},
+		updated: func(s Store) (map[string]time.Time, error) {
+			rows, err := s.ListDocReferences()
+			if err != nil {
+				return nil, err
+			}
+			updated := map[string]time.Time{}
+			for _, r := range rows {
+				updated[r.ID] = r.UpdatedAt
+			}
+			return updated, nil
+		},
+		write: func(s Store, rows []interface{}) error {
+			refs := make([]*DocReference, 0, len(rows))
+			for _, r := range rows {
+				refs = append(refs, r.(*DocReference))
+			}
+			return s.UpsertDocReferences(refs)
+		},
+	},
+	{
+		kind:  "DocLink",
+		model: &DocLink{},
+		export: func(s Store, emit func(row interface{}) error) error {
+			q := DocLinkQuery{ListOptions: ListOptions{PageSize: exportPageSize}}
+			for {
+				rows, token, err := s.QueryDocLinks(q)
+				if err != nil {
+					return err
+				}
+				for _, r := range rows {
+					if err := emit(r); err != nil {
+						return err
+					}
+				}
+				if token == "" {
+					return nil
+				}
+				q.PageToken = token
+			}
+		},
+		decode: func(data json.RawMessage) (interface{}, string, time.Time, error) {
+			l := &DocLink{}
+			err := json.Unmarshal(data, l)
+			return l, l.ID, l.UpdatedAt, err
+		},
+		updated: func(s Store) (map[string]time.Time, error) {
+			rows, _, err := s.QueryDocLinks(DocLinkQuery{})
+			if err != nil {
+				return nil, err
+			}
+			updated := map[string]time.Time{}
+			for _, r := range rows {
+				updated[r.ID] = r.UpdatedAt
+			}
+			return updated, nil
+		},
+		write: func(s Store, rows []interface{}) error {
+			links := make([]*DocLink, 0, len(rows))
+			for _, r := range rows {
+				links = append(links, r.(*DocLink))
+			}
+			return s.UpsertDocLinks(links)
+		},
+	},
+	{
+		kind:  "Entity",
+		model: &Entity{},
+		export: func(s Store, emit func(row interface{}) error) error {
+			q := EntityListQuery{ListOptions: ListOptions{PageSize: exportPageSize}}
+			for {
+				rows, token, err := s.QueryEntities(q)
+				if err != nil {
+					return err
+				}
+				for _, r := range rows {
+					if err := emit(r); err != nil {
+						return err
+					}
+				}
+				if token == "" {
+					return nil
+				}
+				q.PageToken = token
+			}
+		},
+		decode: func(data json.RawMessage) (interface{}, string, time.Time, error) {
+			e := &Entity{}
+			err := json.Unmarshal(data, e)
+			return e, e.ID, e.UpdatedAt, err
+		},
+		resolve: func(r *importResolver, row interface{}) (string, error) {
+			return r.resolveEntity(row.(*Entity))
+		},
+		updated: func(s Store) (map[string]time.Time, error) {
+			rows, err := s.ListEntities()
+			if err != nil {
+				return nil, err
+			}
+			updated := map[string]time.Time{}
+			for _, r := range rows {
+				updated[r.ID] = r.UpdatedAt
+			}
+			return updated, nil
+		},
+		write: func(s Store, rows []interface{}) error {
+			// There is no bulk upsert for entities because they are written one at a time by the indexer.
+			for _, r := range rows {
+				if err := s.UpdateEntity(r.(*Entity)); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		kind:  "EntityMention",
+		model: &EntityMention{},
+		export: func(s Store, emit func(row interface{}) error) error {
+			q := EntityMentionQuery{ListOptions: ListOptions{PageSize: exportPageSize}}
+			for {
+				rows, token, err := s.QueryEntityMentions(q)
+				if err != nil {
+					return err
+				}
+				for _, r := range rows {
+					if err := emit(r); err != nil {
+						return err
+					}
+				}
+				if token == "" {
+					return nil
+				}
+				q.PageToken = token
+			}
+		},
+		decode: func(data json.RawMessage) (interface{}, string, time.Time, error) {
+			m := &EntityMention{}
+			err := json.Unmarshal(data, m)
+			return m, m.ID, m.UpdatedAt, err
+		},
+		resolve: func(r *importResolver, row interface{}) (string, error) {
+			m := row.(*EntityMention)
+			m.EntityID = r.entityID(m.EntityID)
+			m.ID = EntityMentionKey(*m)
+			return m.ID, nil
+		},
+		updated: func(s Store) (map[string]time.Time, error) {
+			rows, _, err := s.QueryEntityMentions(EntityMentionQuery{})
+			if err != nil {
+				return nil, err
+			}
+			updated := map[string]time.Time{}
+			for _, r := range rows {
+				updated[r.ID] = r.UpdatedAt
+			}
+			return updated, nil
+		},
+		write: func(s Store, rows []interface{}) error {
+			mentions := make([]*EntityMention, 0, len(rows))
+			for _, r := range rows {
+				mentions = append(mentions, r.(*EntityMention))
+			}
+			return s.UpsertEntityMentions(mentions)
+		},
+	},
+	rowsTable(&DocPerson{}, func(r *importResolver, row interface{}) (string, error) {
+		p := row.(*DocPerson)
+		p.EntityID = r.entityID(p.EntityID)
+		p.ID = DocPersonKey(*p)
+		return p.ID, nil
+	}),
+	rowsTable(&DocPermission{}, nil),
+	rowsTable(&DocCategory{}, nil),
+	rowsTable(&Redaction{}, nil),
+	rowsTable(&Keyphrase{}, nil),
+	rowsTable(&KeyphraseMention{}, nil),
+	rowsTable(&DocKeyphrase{}, nil),
+	rowsTable(&NLPUsage{}, nil),
+	rowsTable(&IndexJob{}, nil),
+}
+
+// rowsTable returns the exportTable for a model without a paged query or bulk upsert; the rows are read with
+// ListRows and written with UpsertRows. model is a pointer to the model; its kind is the name of its type. resolve
+// is optional.
+func rowsTable(model interface{}, resolve func(r *importResolver, row interface{}) (string, error)) exportTable {
+	t := reflect.TypeOf(model)
+	list := func(s Store) (reflect.Value, error) {
+		rows := reflect.New(reflect.SliceOf(t))
+		if err := s.ListRows(rows.Interface()); err != nil {
+			return reflect.Value{}, err
+		}
+		return rows.Elem(), nil
+	}
+
+	return exportTable{
+		kind:    t.Elem().Name(),
+		model:   model,
+		resolve: resolve,
+		export: func(s Store, emit func(row interface{}) error) error {
+			rows, err := list(s)
+			if err != nil {
+				return err
+			}
+			for i := 0; i < rows.Len(); i++ {
+				if err := emit(rows.Index(i).Interface()); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		decode: func(data json.RawMessage) (interface{}, string, time.Time, error) {
+			r := reflect.New(t.Elem())
+			err := json.Unmarshal(data, r.Interface())
+			return r.Interface(), r.Elem().FieldByName("ID").String(), r.Elem().FieldByName("UpdatedAt").Interface().(time.Time), err
+		},
+		updated: func(s Store) (map[string]time.Time, error) {
+			rows, err := list(s)
+			if err != nil {
+				return nil, err
+			}
+			updated := map[string]time.Time{}
+			for i := 0; i < rows.Len(); i++ {
+				r := rows.Index(i).Elem()
+				updated[r.FieldByName("ID").String()] = r.FieldByName("UpdatedAt").Interface().(time.Time)
+			}
+			return updated, nil
+		},
+		write: func(s Store, rows []interface{}) error {
+			typed := reflect.MakeSlice(reflect.SliceOf(t), 0, len(rows))
+			for _, r := range rows {
+				typed = reflect.Append(typed, reflect.ValueOf(r))
+			}
+			return s.UpsertRows(typed.Interface())
+		},
+	}
+}
+
+// Export writes the rows of the tables in exportTables to w as JSONL. The first line is a header
+// with the format version; each following line is a row. Rows are written in a deterministic order so exports of
+// the same data can be diffed.
+func Export(s Store, w io.Writer) (*ExportStats, error) {
+	now := time.Now().UTC()
+	stats := &ExportStats{
+		Version:    ExportFormatVersion,
+		Rows:       map[string]int{},
+		Skipped:    map[string]int{},
+		ExportedAt: now,
+	}
+
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(&exportRecord{Kind: headerKind, Version: ExportFormatVersion, ExportedAt: &now}); err != nil {
+		return stats, errors.Wrapf(err, "Failed to write the export header")
+	}
+
+	for _, t := range exportTables {
+		err := t.export(s, func(row interface{}) error {
+			data, err := json.Marshal(row)
+			if err != nil {
+				return errors.Wrapf(err, "Failed to serialize %v", t.kind)
+			}
+			if err := encoder.Encode(&exportRecord{Kind: t.kind, Data: data}); err != nil {
+				return errors.Wrapf(err, "Failed to write %v", t.kind)
+			}
+			stats.Rows[t.kind]++
+			return nil
+		})
+		if err != nil {
+			return stats, errors.Wrapf(err, "Failed to export %v rows", t.kind)
+		}
+	}
+	return stats, nil
+}
+
+// Import reads an export written by Export and stores the rows in s. IDs are preserved so importing the same
+// export again is a no-op and rows from different exports of the same doc are merged. Entity IDs are random so
+// imported entities are matched with existing ones by MID, or by name and type, and their mentions are rewritten
+// to use the existing IDs. policy determines what
+// happens to rows which already exist. Entity co-occurrences and keyphrase weights are recomputed once the rows
+// are written. Everything is imported in a single transaction; if there is an error nothing is imported.
+func Import(s Store, r io.Reader, policy MergePolicy) (*ExportStats, error) {
+	if _, err := ParseMergePolicy(string(policy)); err != nil {
+		return nil, err
+	}
+
+	tables := map[string]exportTable{}
+	for _, t := range exportTables {
+		tables[t.kind] = t
+	}
+
+	stats := &ExportStats{
+		Rows:    map[string]int{},
+		Skipped: map[string]int{},
+	}
+
+	err := s.WithTx(func(tx Store) error {
+		decoder := json.NewDecoder(r)
+
+		header := &exportRecord{}
+		if err := decoder.Decode(header); err != nil {
+			return errors.Wrapf(err, "Failed to read the export header")
+		}
+		if header.Kind != headerKind {
+			return errors.Errorf("The first record has kind %q; want %q. Is this an export?", header.Kind, headerKind)
+		}
+		if header.Version < 1 || header.Version > ExportFormatVersion {
+			return errors.Errorf("Export has format version %v; this binary supports versions up to %v", header.Version, ExportFormatVersion)
+		}
+		stats.Version = header.Version
+		if header.ExportedAt != nil {
+			stats.ExportedAt = *header.ExportedAt
+		}
+
+		resolver := &importResolver{store: tx, entityIDs: map[string]string{}}
+
+		// updated is the time existing rows were updated keyed by kind. It is only loaded if the policy needs it.
+		updated := map[string]map[string]time.Time{}
+		pending := map[string][]interface{}{}
+
+		flush := func(kind string) error {
+			rows := pending[kind]
+			if len(rows) == 0 {
+				return nil
+			}
+			if err := tables[kind].write(tx, rows); err != nil {
+				return errors.Wrapf(err, "Failed to import %v rows", kind)
+			}
+			stats.Rows[kind] += len(rows)
+			pending[kind] = nil
+			return nil
+		}
+
+		for n := 2; ; n++ {
+			record := &exportRecord{}
+			err := decoder.Decode(record)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return errors.Wrapf(err, "Failed to read record %v", n)
+			}
+
+			t, ok := tables[record.Kind]
+			if !ok {
+				return errors.Errorf("Record %v has unknown kind %q", n, record.Kind)
+			}
+
+			row, id, rowUpdated, err := t.decode(record.Data)
+			if err != nil {
+				return errors.Wrapf(err, "Failed to decode record %v", n)
+			}
+			if id == "" {
+				return errors.Errorf("Record %v is a %v without an ID", n, record.Kind)
+			}
+			if t.resolve != nil {
+				id, err = t.resolve(resolver, row)
+				if err != nil {
+					return errors.Wrapf(err, "Failed to resolve record %v", n)
+				}
+			}
+
+			if policy != MergeReplace {
+				if _, ok := updated[t.kind]; !ok {
+					u, err := t.updated(tx)
+					if err != nil {
+						return errors.Wrapf(err, "Failed to list existing %v rows", t.kind)
+					}
+					updated[t.kind] = u
+				}
+				if current, exists := updated[t.kind][id]; exists {
+					if policy == MergeKeep || !rowUpdated.After(current) {
+						stats.Skipped[t.kind]++
+						continue
+					}
+				}
+			}
+
+			pending[t.kind] = append(pending[t.kind], row)
+			if len(pending[t.kind]) >= importBatchSize {
+				if err := flush(t.kind); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, t := range exportTables {
+			if err := flush(t.kind); err != nil {
+				return err
+			}
+		}
+
+		// Co-occurrences and keyphrase weights are derived from the mentions so they are recomputed now that the
+		// imported mentions are merged with the existing ones.
+		if err := tx.UpdateEntityCooccurrences(); err != nil {
+			return errors.Wrapf(err, "Failed to update entity co-occurrences")
+		}
+		if err := tx.UpdateKeyphraseWeights(); err != nil {
+			return errors.Wrapf(err, "Failed to update keyphrase weights")
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// importResolver matches imported rows with the rows in the store.
+type importResolver struct {
+	store Store
+	// entityIDs maps the IDs of imported entities to the IDs of the matching entities in the store.
+	entityIDs map[string]string
+
+	// entities are the known entities keyed by ID, MID and name and type. They are loaded on first use.
+	entities       map[string]*Entity
+	entitiesByMID  map[string]*Entity
+	entitiesByName map[string]*Entity
+}
+
+// resolveEntity matches the imported entity with an entity in the store or an entity imported earlier. If there is
+// a match the entity's ID is changed to the ID of the match. People known to Drive aren't matched since their IDs
+// are derived from their email.
+func (r *importResolver) resolveEntity(e *Entity) (string, error) {
+	if r.entities == nil {
+		existing, err := r.store.ListEntities()
+		if err != nil {
+			return "", errors.Wrapf(err, "Failed to list entities")
+		}
+		r.entities = map[string]*Entity{}
+		r.entitiesByMID = map[string]*Entity{}
+		r.entitiesByName = map[string]*Entity{}
+		for _, x := range existing {
+			r.addEntity(x)
+		}
+	}
+
+	if _, ok := r.entities[e.ID]; ok || e.Email != "" {
+		return e.ID, nil
+	}
+
+	match := r.entitiesByMID[e.MID]
+	if match == nil {
+		match = r.entitiesByName[entityNameKey(e)]
+		// Entities with different MIDs are different even if they have the same name.
+		if match != nil && e.MID != "" && match.MID != "" {
+			match = nil
+		}
+	}
+
+	if match != nil {
+		r.entityIDs[e.ID] = match.ID
+		e.ID = match.ID
+		return e.ID, nil
+	}
+
+	r.addEntity(e)
+	return e.ID, nil
+}
+
+func (r *importResolver) addEntity(e *Entity) {
+	r.entities[e.ID] = e
+	if e.Email != "" {
+		return
+	}
+	if e.MID != "" {
+		if _, ok := r.entitiesByMID[e.MID]; !ok {
+			r.entitiesByMID[e.MID] = e
+		}
+	}
+	if _, ok := r.entitiesByName[entityNameKey(e)]; !ok {
+		r.entitiesByName[entityNameKey(e)] = e
+	}
+}
+
+// entityID returns the ID in the store of the imported entity with the given ID.
+func (r *importResolver) entityID(id string) string {
+	if mapped, ok := r.entityIDs[id]; ok {
+		return mapped
+	}
+	return id
+}
+
+func entityNameKey(e *Entity) string {
+	return e.Type + "/" + e.Name
+}
+
+// String summarizes the stats e.g. for printing at the end of an export or import.
+func (s *ExportStats) String() string {
+	summary := ""
+	for _, t := range exportTables {
+		summary += fmt.Sprintf("%v: %v", t.kind, s.Rows[t.kind])
+		if s.Skipped[t.kind] > 0 {
+			summary += fmt.Sprintf(" (%v skipped)", s.Skipped[t.kind])
+		}
+		summary += "\n"
+	}
+	return summary
+}
@@ -0,0 +1,306 @@
+package datastore
+
+import (
+	"bytes"
+	"github.com/google/go-cmp/cmp"
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"gorm.io/gorm"
+	"strings"
+	"testing"
+)
+
+func testStoreExportImport(t *testing.T, s Store) {
+	if err := s.UpsertDocReferences([]*DocReference{{DriveId: "doc1", Name: "Doc 1"}, {DriveId: "doc2", Name: "Doc 2"}}); err != nil {
+		t.Fatalf("Failed to create docs; error %v", err)
+	}
+	if err := s.UpsertDocLinks([]*DocLink{{SourceID: DriveKey("doc1"), DestID: DriveKey("doc2"), Text: "link", StartIndex: 1, EndIndex: 5}}); err != nil {
+		t.Fatalf("Failed to create links; error %v", err)
+	}
+	for _, e := range []*Entity{{ID: "e1", Name: "Kubeflow", Type: "ORGANIZATION"}, {ID: "e2", Name: "Jeremy", Type: "PERSON"}} {
+		if err := s.UpdateEntity(e); err != nil {
+			t.Fatalf("Failed to create entity; error %v", err)
+		}
+	}
+	mentions := []*EntityMention{
+		{DocID: DriveKey("doc1"), EntityID: "e1", Text: "Kubeflow", StartIndex: 1, EndIndex: 9, Salience: 0.5},
+		{DocID: DriveKey("doc2"), EntityID: "e2", Text: "Jeremy", StartIndex: 3, EndIndex: 9, Salience: 0.25},
+	}
+	if err := s.UpsertEntityMentions(mentions); err != nil {
+		t.Fatalf("Failed to create mentions; error %v", err)
+	}
+	if err := s.ReplaceDocPermissions(DriveKey("doc1"), []*DocPermission{{DocID: DriveKey("doc1"), Type: PrincipalUser, Principal: "jeremy@example.com", Role: "owner"}}); err != nil {
+		t.Fatalf("Failed to create permissions; error %v", err)
+	}
+	if err := s.ReplaceKeyphraseMentions(DriveKey("doc1"), []*KeyphraseMention{{DocID: DriveKey("doc1"), KeyphraseID: "kubeflow", Text: "Kubeflow", StartIndex: 1, EndIndex: 9}}); err != nil {
+		t.Fatalf("Failed to create keyphrase mentions; error %v", err)
+	}
+
+	var export bytes.Buffer
+	stats, err := Export(s, &export)
+	if err != nil {
+		t.Fatalf("Failed to export; error %v", err)
+	}
+	expectedRows := map[string]int{"DocReference": 2, "DocLink": 1, "Entity": 2, "EntityMention": 2, "DocPermission": 1, "Keyphrase": 1, "KeyphraseMention": 1}
+	if d := cmp.Diff(expectedRows, stats.Rows); d != "" {
+		t.Errorf("Unexpected export stats; diff:\n%v", d)
+	}
+	if lines := strings.Count(export.String(), "\n"); lines != 11 {
+		t.Errorf("Export has %v lines; want 11", lines)
+	}
+
+	log, _ := logging.InitLogger("info", true)
+
+	// Importing into an empty store reproduces the data with the same IDs.
+	copied := NewMemoryStore(*log)
+	if _, err := Import(copied, bytes.NewReader(export.Bytes()), MergeReplace); err != nil {
+		t.Fatalf("Failed to import; error %v", err)
+	}
+	compareStores(t, s, copied)
+
+	// Importing again is a no-op.
+	stats, err = Import(s, bytes.NewReader(export.Bytes()), MergeReplace)
+	if err != nil {
+		t.Fatalf("Failed to import; error %v", err)
+	}
+	if d := cmp.Diff(expectedRows, stats.Rows); d != "" {
+		t.Errorf("Unexpected import stats; diff:\n%v", d)
+	}
+	compareStores(t, copied, s)
+
+	// Merge another person's index which renamed doc1 and has doc3.
+	other := NewMemoryStore(*log)
+	if err := other.UpsertDocReferences([]*DocReference{{DriveId: "doc1", Name: "Doc 1 renamed"}, {DriveId: "doc3", Name: "Doc 3"}}); err != nil {
+		t.Fatalf("Failed to create docs; error %v", err)
+	}
+	var otherExport bytes.Buffer
+	if _, err := Export(other, &otherExport); err != nil {
+		t.Fatalf("Failed to export; error %v", err)
+	}
+
+	names := func() map[string]string {
+		docs, err := s.ListDocReferences()
+		if err != nil {
+			t.Fatalf("Failed to list docs; error %v", err)
+		}
+		n := map[string]string{}
+		for _, d := range docs {
+			n[d.DriveId] = d.Name
+		}
+		return n
+	}
+
+	stats, err = Import(s, bytes.NewReader(otherExport.Bytes()), MergeKeep)
+	if err != nil {
+		t.Fatalf("Failed to import; error %v", err)
+	}
+	if stats.Rows["DocReference"] != 1 || stats.Skipped["DocReference"] != 1 {
+		t.Errorf("Import with %v imported %v and skipped %v docs; want 1 and 1", MergeKeep, stats.Rows["DocReference"], stats.Skipped["DocReference"])
+	}
+	if d := cmp.Diff(map[string]string{"doc1": "Doc 1", "doc2": "Doc 2", "doc3": "Doc 3"}, names()); d != "" {
+		t.Errorf("Unexpected docs after merging with %v; diff:\n%v", MergeKeep, d)
+	}
+
+	// The other index's doc1 was updated after ours so it wins.
+	if _, err := Import(s, bytes.NewReader(otherExport.Bytes()), MergeNewer); err != nil {
+		t.Fatalf("Failed to import; error %v", err)
+	}
+	if d := cmp.Diff(map[string]string{"doc1": "Doc 1 renamed", "doc2": "Doc 2", "doc3": "Doc 3"}, names()); d != "" {
+		t.Errorf("Unexpected docs after merging with %v; diff:\n%v", MergeNewer, d)
+	}
+
+	doc := `{"kind":"DocReference","data":{"ID":"drive.doc4","DriveId":"doc4","Name":"Doc 4"}}`
+	invalid := map[string]string{
+		"noHeader":     doc + "\n",
+		"newerVersion": `{"kind":"header","version":1000}` + "\n" + doc + "\n",
+		// The doc must not be imported because the import fails.
+		"unknownKind":    `{"kind":"header","version":1}` + "\n" + doc + "\n" + `{"kind":"Unknown","data":{}}` + "\n",
+		"inconsistentId": `{"kind":"header","version":1}` + "\n" + `{"kind":"DocReference","data":{"ID":"drive.other","DriveId":"doc4"}}` + "\n",
+		"truncated":      `{"kind":"header","version":1}` + "\n" + `{"kind":"DocRef`,
+	}
+	for name, data := range invalid {
+		if _, err := Import(s, strings.NewReader(data), MergeReplace); err == nil {
+			t.Errorf("Import of %v succeeded; want error", name)
+		}
+	}
+	if _, ok := names()["doc4"]; ok {
+		t.Errorf("A failed import stored doc4")
+	}
+
+	if _, err := Import(s, bytes.NewReader(export.Bytes()), MergePolicy("theirs")); err == nil {
+		t.Errorf("Import with an unknown merge policy succeeded; want error")
+	}
+}
+
+// testStoreImportEntities merges two exports of the same doc indexed separately. Entity IDs are random so the
+// indexes have different IDs for the same entities.
+func testStoreImportEntities(t *testing.T, s Store) {
+	log, _ := logging.InitLogger("info", true)
+
+	// index creates an index of doc1 using the given entity IDs.
+	index := func(kubeflowId string, jeremyId string) []byte {
+		i := NewMemoryStore(*log)
+		if err := i.UpsertDocReferences([]*DocReference{{DriveId: "doc1", Name: "Doc 1"}}); err != nil {
+			t.Fatalf("Failed to create docs; error %v", err)
+		}
+		for _, e := range []*Entity{{ID: kubeflowId, Name: "Kubeflow", Type: "ORGANIZATION", MID: "/m/kubeflow"}, {ID: jeremyId, Name: "Jeremy", Type: "PERSON"}} {
+			if err := i.UpdateEntity(e); err != nil {
+				t.Fatalf("Failed to create entity; error %v", err)
+			}
+		}
+		mentions := []*EntityMention{
+			{DocID: DriveKey("doc1"), EntityID: kubeflowId, Text: "Kubeflow", StartIndex: 1, EndIndex: 9, Sentence: 1},
+			{DocID: DriveKey("doc1"), EntityID: jeremyId, Text: "Jeremy", StartIndex: 12, EndIndex: 18, Sentence: 1},
+		}
+		if err := i.UpsertEntityMentions(mentions); err != nil {
+			t.Fatalf("Failed to create mentions; error %v", err)
+		}
+
+		var export bytes.Buffer
+		if _, err := Export(i, &export); err != nil {
+			t.Fatalf("Failed to export; error %v", err)
+		}
+		return export.Bytes()
+	}
+
+	if _, err := Import(s, bytes.NewReader(index("a1", "a2")), MergeNewer); err != nil {
+		t.Fatalf("Failed to import; error %v", err)
+	}
+	if _, err := Import(s, bytes.NewReader(index("b1", "b2")), MergeNewer); err != nil {
+		t.Fatalf("Failed to import; error %v", err)
+	}
+
+	entities, err := s.ListEntities()
+	if err != nil {
+		t.Fatalf("Failed to list entities; error %v", err)
+	}
+	ids := []string{}
+	for _, e := range entities {
+		ids = append(ids, e.ID)
+	}
+	if d := cmp.Diff([]string{"a1", "a2"}, ids); d != "" {
+		t.Errorf("Unexpected entities; diff:\n%v", d)
+	}
+
+	mentions, err := s.ListEntityMentions(DriveKey("doc1"))
+	if err != nil {
+		t.Fatalf("Failed to list mentions; error %v", err)
+	}
+	mentionIds := []string{}
+	for _, m := range mentions {
+		mentionIds = append(mentionIds, m.ID)
+	}
+	expected := []string{
+		EntityMentionKey(EntityMention{DocID: DriveKey("doc1"), EntityID: "a1", StartIndex: 1, EndIndex: 9}),
+		EntityMentionKey(EntityMention{DocID: DriveKey("doc1"), EntityID: "a2", StartIndex: 12, EndIndex: 18}),
+	}
+	if d := cmp.Diff(expected, mentionIds); d != "" {
+		t.Errorf("Unexpected mentions; diff:\n%v", d)
+	}
+
+	// Co-occurrences are recomputed from the merged mentions.
+	related, err := s.ListRelatedEntities("a1", 10)
+	if err != nil {
+		t.Fatalf("Failed to list related entities; error %v", err)
+	}
+	expectedRelated := []*RelatedEntity{{EntityID: "a2", Name: "Jeremy", Type: "PERSON", NumDocuments: 1, NumSentences: 1}}
+	if d := cmp.Diff(expectedRelated, related); d != "" {
+		t.Errorf("Unexpected related entities; diff:\n%v", d)
+	}
+}
+
+// compareStores verifies the stores contain the same docs, links, entities and mentions ignoring timestamps.
+func compareStores(t *testing.T, expected Store, actual Store) {
+	expectedDocs, err := expected.ListDocReferences()
+	if err != nil {
+		t.Fatalf("Failed to list docs; error %v", err)
+	}
+	actualDocs, err := actual.ListDocReferences()
+	if err != nil {
+		t.Fatalf("Failed to list docs; error %v", err)
+	}
+	if d := cmp.Diff(expectedDocs, actualDocs, ignoreTimestamps(DocReference{})); d != "" {
+		t.Errorf("Unexpected docs; diff:\n%v", d)
+	}
+
+	expectedLinks, _, err := expected.QueryDocLinks(DocLinkQuery{})
+	if err != nil {
+		t.Fatalf("Failed to list links; error %v", err)
+	}
+	actualLinks, _, err := actual.QueryDocLinks(DocLinkQuery{})
+	if err != nil {
+		t.Fatalf("Failed to list links; error %v", err)
+	}
+	if d := cmp.Diff(expectedLinks, actualLinks, ignoreTimestamps(DocLink{})); d != "" {
+		t.Errorf("Unexpected links; diff:\n%v", d)
+	}
+
+	expectedEntities, err := expected.ListEntities()
+	if err != nil {
+		t.Fatalf("Failed to list entities; error %v", err)
+	}
+	actualEntities, err := actual.ListEntities()
+	if err != nil {
+		t.Fatalf("Failed to list entities; error %v", err)
+	}
+	if d := cmp.Diff(expectedEntities, actualEntities, ignoreTimestamps(Entity{})); d != "" {
+		t.Errorf("Unexpected entities; diff:\n%v", d)
+	}
+
+	expectedMentions, _, err := expected.QueryEntityMentions(EntityMentionQuery{})
+	if err != nil {
+		t.Fatalf("Failed to list mentions; error %v", err)
+	}
+	actualMentions, _, err := actual.QueryEntityMentions(EntityMentionQuery{})
+	if err != nil {
+		t.Fatalf("Failed to list mentions; error %v", err)
+	}
+	if d := cmp.Diff(expectedMentions, actualMentions, ignoreTimestamps(EntityMention{}), approx); d != "" {
+		t.Errorf("Unexpected mentions; diff:\n%v", d)
+	}
+	for _, rows := range []struct {
+		expected interface{}
+		actual   interface{}
+		model    interface{}
+	}{
+		{expected: &[]*DocPermission{}, actual: &[]*DocPermission{}, model: DocPermission{}},
+		{expected: &[]*KeyphraseMention{}, actual: &[]*KeyphraseMention{}, model: KeyphraseMention{}},
+	} {
+		if err := expected.ListRows(rows.expected); err != nil {
+			t.Fatalf("Failed to list rows; error %v", err)
+		}
+		if err := actual.ListRows(rows.actual); err != nil {
+			t.Fatalf("Failed to list rows; error %v", err)
+		}
+		if d := cmp.Diff(rows.expected, rows.actual, ignoreTimestamps(rows.model)); d != "" {
+			t.Errorf("Unexpected %T; diff:\n%v", rows.model, d)
+		}
+	}
+}
+
+// TestExportTables verifies every table created by the migrations is either exported or deliberately left out.
+func TestExportTables(t *testing.T) {
+	d := newSQLiteStore(t).(*Datastore)
+	defer d.Close()
+
+	exported := map[string]bool{}
+	for _, e := range exportTables {
+		stmt := &gorm.Statement{DB: d.db}
+		if err := stmt.Parse(e.model); err != nil {
+			t.Fatalf("Failed to parse the model for %v; error %v", e.kind, err)
+		}
+		exported[stmt.Schema.Table] = true
+	}
+
+	tables, err := d.db.Migrator().GetTables()
+	if err != nil {
+		t.Fatalf("Failed to list tables; error %v", err)
+	}
+	for _, table := range tables {
+		if strings.HasPrefix(table, "sqlite_") {
+			continue
+		}
+		if _, ok := unexportedTables[table]; !ok && !exported[table] {
+			t.Errorf("Table %v isn't exported; add it to exportTables or unexportedTables", table)
+		}
+	}
+}
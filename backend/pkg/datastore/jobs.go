@@ -0,0 +1,82 @@
+package datastore
+
+import (
+	"github.com/pkg/errors"
+	"time"
+)
+
+const (
+	// JobPending is the state of a job that hasn't started.
+	JobPending = "pending"
+	// JobRunning is the state of a job that is running.
+	JobRunning = "running"
+	// JobSucceeded is the state of a job that finished successfully.
+	JobSucceeded = "succeeded"
+	// JobFailed is the state of a job that failed.
+	JobFailed = "failed"
+	// JobCancelled is the state of a job that was cancelled.
+	JobCancelled = "cancelled"
+)
+
+// unfinishedJobMessage is the error of jobs which were running when the server stopped.
+const unfinishedJobMessage = "Server restarted before the job finished"
+
+// ErrNotFound is returned when a record doesn't exist.
+var ErrNotFound = errors.New("Not found")
+
+// UpdateIndexJob updates or creates the IndexJob.
+func (d *Datastore) UpdateIndexJob(j *IndexJob) error {
+	if j.ID == "" {
+		return errors.New("ID must be set")
+	}
+
+	if result := d.db.Save(j); result.Error != nil {
+		return errors.Wrapf(result.Error, "Failed to update IndexJob ID: %v", j.ID)
+	}
+	return nil
+}
+
+// GetIndexJob returns the job with the given id. ErrNotFound is returned if the job doesn't exist.
+func (d *Datastore) GetIndexJob(id string) (*IndexJob, error) {
+	j := &IndexJob{}
+	result := d.db.Where("id = ?", id).Limit(1).Find(j)
+	if result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to get IndexJob ID: %v", id)
+	}
+
+	if result.RowsAffected == 0 {
+		return nil, errors.Wrapf(ErrNotFound, "IndexJob ID: %v", id)
+	}
+	return j, nil
+}
+
+// ListIndexJobs lists the jobs starting with the most recent.
+// limit is optional; if > 0 at most limit jobs are returned.
+func (d *Datastore) ListIndexJobs(limit int) ([]*IndexJob, error) {
+	db := d.db.Order("created_at desc, id")
+	if limit > 0 {
+		db = db.Limit(limit)
+	}
+
+	jobs := make([]*IndexJob, 0, 0)
+	if result := db.Find(&jobs); result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to list index jobs")
+	}
+	return jobs, nil
+}
+
+// FailUnfinishedIndexJobs marks jobs which are still pending or running as failed. It is called on startup since
+// jobs don't survive restarts.
+func (d *Datastore) FailUnfinishedIndexJobs() error {
+	updates := map[string]interface{}{
+		"state":    JobFailed,
+		"error":    unfinishedJobMessage,
+		"end_time": time.Now(),
+	}
+
+	result := d.db.Model(&IndexJob{}).Where("state in ?", []string{JobPending, JobRunning}).Updates(updates)
+	if result.Error != nil {
+		return errors.Wrapf(result.Error, "Failed to fail unfinished index jobs")
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package datastore
+
+import (
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"math"
+	"strings"
+)
+
+// likeEscaper escapes the wildcards in a string matched with like.
+var likeEscaper = strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_")
+
+// ReplaceKeyphraseMentions replaces the keyphrase mentions of the doc with the supplied mentions.
+// Keyphrases that don't exist yet are created. Weights aren't updated; call UpdateKeyphraseWeights once all
+// docs have been processed.
+func (d *Datastore) ReplaceKeyphraseMentions(docId string, mentions []*KeyphraseMention) error {
+	if docId == "" {
+		return errors.New("docId must be set")
+	}
+
+	log := d.log.WithValues("docId", docId)
+
+	for _, m := range mentions {
+		if m.DocID != docId {
+			return errors.Errorf("Mention of %v has DocID %v; want %v", m.KeyphraseID, m.DocID, docId)
+		}
+
+		if m.KeyphraseID == "" {
+			return errors.New("KeyphraseID must be set")
+		}
+		m.KeyphraseID = KeyphraseKey(m.KeyphraseID)
+
+		expectedId := KeyphraseMentionKey(*m)
+		if m.ID != "" && m.ID != expectedId {
+			return errors.Errorf("ID and KeyphraseMention are inconsistent; ID should be empty or %v", expectedId)
+		}
+		m.ID = expectedId
+	}
+
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		// Use Unscoped so the old mentions are actually deleted and their primary keys can be reused.
+		if result := tx.Unscoped().Where("doc_id = ?", docId).Delete(&KeyphraseMention{}); result.Error != nil {
+			return errors.Wrapf(result.Error, "Failed to delete keyphrase mentions for doc: %v", docId)
+		}
+
+		for _, m := range mentions {
+			k := &Keyphrase{ID: m.KeyphraseID}
+			if result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(k); result.Error != nil {
+				return errors.Wrapf(result.Error, "Failed to create Keyphrase ID: %v", k.ID)
+			}
+
+			log.V(logging.Debug).Info("Creating record", "id", m.ID)
+			if result := tx.Create(m); result.Error != nil {
+				return errors.Wrapf(result.Error, "Failed to create KeyphraseMention ID: %v", m.ID)
+			}
+		}
+		return nil
+	})
+}
+
+// ListKeyphraseMentions lists the keyphrase mentions.
+// docId is optional if supplied list the mentions in the provided doc.
+func (d *Datastore) ListKeyphraseMentions(docId string) ([]*KeyphraseMention, error) {
+	db := d.db
+	mentions := make([]*KeyphraseMention, 0, 0)
+
+	if docId != "" {
+		db = db.Where("doc_id = ? ", docId)
+	}
+
+	if result := db.Order("doc_id, start_index").Find(&mentions); result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to find keyphrase mentions")
+	}
+
+	return mentions, nil
+}
+
+// docKeyphraseCount is the number of mentions of a keyphrase in a doc.
+type docKeyphraseCount struct {
+	DocID       string
+	KeyphraseID string
+	NumMentions int64
+}
+
+// UpdateKeyphraseWeights recomputes the document frequency of every keyphrase and the TF-IDF weight of the
+// keyphrases in every doc.
+//
+// The term frequency is the number of mentions of the keyphrase in the doc divided by the number of keyphrase
+// mentions in the doc. The inverse document frequency is the smoothed idf log((1+N)/(1+df)) + 1 where N is the
+// number of docs with keyphrases and df the number of docs mentioning the keyphrase.
+//
+// Keyphrases which are no longer mentioned in any doc are deleted.
+func (d *Datastore) UpdateKeyphraseWeights() error {
+	counts := make([]*docKeyphraseCount, 0, 0)
+	result := d.db.Model(&KeyphraseMention{}).
+		Select("doc_id, keyphrase_id, count(*) as num_mentions").
+		Group("doc_id, keyphrase_id").
+		Scan(&counts)
+	if result.Error != nil {
+		return errors.Wrapf(result.Error, "Failed to count keyphrase mentions")
+	}
+
+	docTotals := map[string]int64{}
+	docFrequency := map[string]int64{}
+	for _, c := range counts {
+		docTotals[c.DocID] = docTotals[c.DocID] + c.NumMentions
+		docFrequency[c.KeyphraseID] = docFrequency[c.KeyphraseID] + 1
+	}
+
+	numDocs := float64(len(docTotals))
+	idf := map[string]float64{}
+	for k, df := range docFrequency {
+		idf[k] = math.Log((1+numDocs)/(1+float64(df))) + 1
+	}
+
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		if result := tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(&DocKeyphrase{}); result.Error != nil {
+			return errors.Wrapf(result.Error, "Failed to delete keyphrase weights")
+		}
+
+		if result := tx.Unscoped().Where("id not in (?)", tx.Model(&KeyphraseMention{}).Select("keyphrase_id")).Delete(&Keyphrase{}); result.Error != nil {
+			return errors.Wrapf(result.Error, "Failed to delete unused keyphrases")
+		}
+
+		for k, df := range docFrequency {
+			updates := map[string]interface{}{
+				"document_frequency":         df,
+				"inverse_document_frequency": idf[k],
+			}
+			if result := tx.Model(&Keyphrase{ID: k}).Updates(updates); result.Error != nil {
+				return errors.Wrapf(result.Error, "Failed to update Keyphrase ID: %v", k)
+			}
+		}
+
+		for _, c := range counts {
+			w := &DocKeyphrase{
+				DocID:       c.DocID,
+				KeyphraseID: c.KeyphraseID,
+				NumMentions: c.NumMentions,
+				Weight:      float64(c.NumMentions) / float64(docTotals[c.DocID]) * idf[c.KeyphraseID],
+			}
+			w.ID = DocKeyphraseKey(*w)
+			if result := tx.Create(w); result.Error != nil {
+				return errors.Wrapf(result.Error, "Failed to create DocKeyphrase ID: %v", w.ID)
+			}
+		}
+		return nil
+	})
+}
+
+// ListKeyphrases lists the keyphrases ordered by the number of documents mentioning them.
+// limit is optional; if > 0 at most limit keyphrases are returned.
+func (d *Datastore) ListKeyphrases(limit int) ([]*Keyphrase, error) {
+	db := d.db.Order("document_frequency desc, id")
+	if limit > 0 {
+		db = db.Limit(limit)
+	}
+
+	phrases := make([]*Keyphrase, 0, 0)
+	if result := db.Find(&phrases); result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to list keyphrases")
+	}
+	return phrases, nil
+}
+
+// SearchKeyphrases returns the docs mentioning keyphrases containing query ranked by the TF-IDF weight of the
+// keyphrase in the doc.
+// limit is optional; if > 0 at most limit results are returned.
+func (d *Datastore) SearchKeyphrases(query string, limit int) ([]*DocKeyphrase, error) {
+	query = KeyphraseKey(query)
+	if query == "" {
+		return nil, errors.New("query must be set")
+	}
+
+	// Use like rather than a function such as instr so the query works in both SQLite and Postgres.
+	// Keyphrase ids are lower case so like being case insensitive in SQLite doesn't matter.
+	db := d.db.Where("keyphrase_id like ? escape '\\'", "%"+likeEscaper.Replace(query)+"%").Order("weight desc, doc_id")
+	if limit > 0 {
+		db = db.Limit(limit)
+	}
+
+	results := make([]*DocKeyphrase, 0, 0)
+	if result := db.Find(&results); result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to search keyphrases")
+	}
+	return results, nil
+}
+
+// ListDocKeyphrases lists the weights of the keyphrases.
+// docId is optional if supplied list the keyphrases in the provided doc.
+func (d *Datastore) ListDocKeyphrases(docId string) ([]*DocKeyphrase, error) {
+	db := d.db
+	results := make([]*DocKeyphrase, 0, 0)
+
+	if docId != "" {
+		db = db.Where("doc_id = ? ", docId)
+	}
+
+	if result := db.Order("doc_id, weight desc").Find(&results); result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to list doc keyphrases")
+	}
+	return results, nil
+}
@@ -0,0 +1,98 @@
+package datastore
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"io/ioutil"
+	"math"
+	"path"
+	"testing"
+)
+
+func Test_Keyphrases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testDatabase")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+
+	dbFile := path.Join(dir, "database.db")
+
+	log, _ := logging.InitLogger("info", true)
+	db, err := New(dbFile, *log)
+
+	if err != nil {
+		t.Fatalf("Failed to create database; error %v", err)
+	}
+
+	docs := map[string][]*KeyphraseMention{
+		"doc1": {
+			{DocID: "doc1", KeyphraseID: "feature store", StartIndex: 0, EndIndex: 13},
+			{DocID: "doc1", KeyphraseID: "feature store", StartIndex: 20, EndIndex: 33},
+			{DocID: "doc1", KeyphraseID: "canary rollout", StartIndex: 40, EndIndex: 54},
+		},
+		"doc2": {
+			{DocID: "doc2", KeyphraseID: "Canary  Rollout", StartIndex: 0, EndIndex: 14},
+		},
+		"doc3": {
+			{DocID: "doc3", KeyphraseID: "stale phrase", StartIndex: 0, EndIndex: 12},
+		},
+	}
+
+	for docId, mentions := range docs {
+		if err := db.ReplaceKeyphraseMentions(docId, mentions); err != nil {
+			t.Fatalf("Failed to replace mentions; error %v", err)
+		}
+	}
+
+	// Reindexing doc3 should remove stale phrase.
+	if err := db.ReplaceKeyphraseMentions("doc3", []*KeyphraseMention{}); err != nil {
+		t.Fatalf("Failed to replace mentions; error %v", err)
+	}
+
+	if err := db.UpdateKeyphraseWeights(); err != nil {
+		t.Fatalf("Failed to update weights; error %v", err)
+	}
+
+	phrases, err := db.ListKeyphrases(0)
+	if err != nil {
+		t.Fatalf("Failed to list keyphrases; error %v", err)
+	}
+
+	actualDf := map[string]int64{}
+	for _, p := range phrases {
+		actualDf[p.ID] = p.DocumentFrequency
+	}
+
+	expectedDf := map[string]int64{
+		"canary rollout": 2,
+		"feature store":  1,
+	}
+
+	if d := cmp.Diff(expectedDf, actualDf); d != "" {
+		t.Errorf("Did not get expected document frequencies; diff:\n%v", d)
+	}
+
+	results, err := db.SearchKeyphrases("Canary", 0)
+	if err != nil {
+		t.Fatalf("Failed to search keyphrases; error %v", err)
+	}
+
+	// canary rollout is the only keyphrase in doc2 so it has a higher term frequency.
+	idf := math.Log(3.0/3.0) + 1
+	expected := []*DocKeyphrase{
+		{ID: "doc2-canary rollout", DocID: "doc2", KeyphraseID: "canary rollout", NumMentions: 1, Weight: idf},
+		{ID: "doc1-canary rollout", DocID: "doc1", KeyphraseID: "canary rollout", NumMentions: 1, Weight: idf / 3},
+	}
+
+	opts := cmp.FilterPath(func(p cmp.Path) bool {
+		switch p.Last().String() {
+		case ".CreatedAt", ".UpdatedAt", ".DeletedAt":
+			return true
+		}
+		return false
+	}, cmp.Ignore())
+
+	if d := cmp.Diff(expected, results, opts); d != "" {
+		t.Errorf("Did not get expected search results; diff:\n%v", d)
+	}
+}
@@ -0,0 +1,75 @@
+package datastore
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+const (
+	// keyringService is the service the encryption key is stored under in the OS keyring.
+	keyringService = "p22h"
+)
+
+// StoreKeyInKeyring stores the encryption key in the OS keyring under the given account. On macOS it uses the
+// login keychain via the security command and on Linux the Secret Service via secret-tool (libsecret).
+func StoreKeyInKeyring(account string, key string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		// The command is read from stdin by security's interactive mode so the key isn't in the arguments of a
+		// process where other users could see it. -U updates the key if it already exists.
+		if strings.ContainsAny(account+key, "\"\\\n") {
+			return errors.Errorf("The account and key can't contain quotes, backslashes or newlines")
+		}
+		cmd = exec.Command("security", "-i")
+		cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s %q -a %q -w %q\n", keyringService, account, key))
+	case "linux":
+		cmd = exec.Command("secret-tool", "store", "--label=p22h database key", "service", keyringService, "account", account)
+		cmd.Stdin = strings.NewReader(key)
+	default:
+		return errors.Errorf("The OS keyring isn't supported on %v; use a key file or %v", runtime.GOOS, EncryptionKeyEnv)
+	}
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "Failed to store the key in the keyring; %v", strings.TrimSpace(string(out)))
+	}
+
+	// security's interactive mode exits 0 even if the command fails so check the key was stored.
+	stored, err := keyringGet(account)
+	if err != nil {
+		return err
+	}
+	if stored != key {
+		return errors.Errorf("The key read back from the keyring for account %v doesn't match the key that was stored", account)
+	}
+	return nil
+}
+
+// keyringGet reads the encryption key stored by StoreKeyInKeyring.
+func keyringGet(account string) (string, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", keyringService, "-a", account, "-w")
+	case "linux":
+		cmd = exec.Command("secret-tool", "lookup", "service", keyringService, "account", account)
+	default:
+		return "", errors.Errorf("The OS keyring isn't supported on %v; use a key file or %v", runtime.GOOS, EncryptionKeyEnv)
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to read the key for account %v from the keyring; %v", account, strings.TrimSpace(stderr.String()))
+	}
+	key := strings.TrimSpace(string(out))
+	if key == "" {
+		return "", errors.Errorf("There is no key for account %v in the keyring", account)
+	}
+	return key, nil
+}
@@ -0,0 +1,1947 @@
+package datastore
+
+import (
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store which keeps the data in memory. It is intended for tests; the data is lost when the
+// process exits.
+//
+// Records are copied in and out of the store so callers can't modify stored records without calling the store.
+// MemoryStore is safe for concurrent use.
+type MemoryStore struct {
+	log logr.Logger
+
+	mu                sync.Mutex
+	docReferences     map[string]*DocReference
+	docLinks          map[string]*DocLink
+	entities          map[string]*Entity
+	entityMentions    map[string]*EntityMention
+	nlpResponses      map[string]*NLPResponse
+	nlpUsage          map[string]*NLPUsage
+	redactions        map[string]*Redaction
+	docCategories     map[string]*DocCategory
+	keyphrases        map[string]*Keyphrase
+	keyphraseMentions map[string]*KeyphraseMention
+	docKeyphrases     map[string]*DocKeyphrase
+	cooccurrences     map[string]*EntityCooccurrence
+	docPeople         map[string]*DocPerson
+	docPermissions    map[string]*DocPermission
+	indexJobs         map[string]*IndexJob
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore(log logr.Logger) *MemoryStore {
+	return &MemoryStore{
+		log:               log,
+		docReferences:     map[string]*DocReference{},
+		docLinks:          map[string]*DocLink{},
+		entities:          map[string]*Entity{},
+		entityMentions:    map[string]*EntityMention{},
+		nlpResponses:      map[string]*NLPResponse{},
+		nlpUsage:          map[string]*NLPUsage{},
+		redactions:        map[string]*Redaction{},
+		docCategories:     map[string]*DocCategory{},
+		keyphrases:        map[string]*Keyphrase{},
+		keyphraseMentions: map[string]*KeyphraseMention{},
+		docKeyphrases:     map[string]*DocKeyphrase{},
+		cooccurrences:     map[string]*EntityCooccurrence{},
+		docPeople:         map[string]*DocPerson{},
+		docPermissions:    map[string]*DocPermission{},
+		indexJobs:         map[string]*IndexJob{},
+	}
+}
+
+// setTimestamps sets the timestamps of a record being saved the way gorm does. existing is the CreatedAt of the
+// stored record if there is one.
+func setTimestamps(createdAt *time.Time, updatedAt *time.Time, existing *time.Time) {
+	now := time.Now()
+	if existing != nil && createdAt.IsZero() {
+		*createdAt = *existing
+	}
+	if createdAt.IsZero() {
+		*createdAt = now
+	}
+	*updatedAt = now
+}
+
+// UpdateDocReference updates or creates the DocReference
+func (m *MemoryStore) UpdateDocReference(r *DocReference) error {
+	return m.UpsertDocReferences([]*DocReference{r})
+}
+
+// ListDocReferences lists all the docreferences.
+func (m *MemoryStore) ListDocReferences() ([]*DocReference, error) {
+	references, _, err := m.QueryDocReferences(DocReferenceQuery{})
+	return references, err
+}
+
+// QueryDocReferences lists a page of the DocReferences matching the query. The token for the next page is returned;
+// it is empty if this is the last page.
+func (m *MemoryStore) QueryDocReferences(q DocReferenceQuery) ([]*DocReference, string, error) {
+	p, err := newPager(q.ListOptions, q, docReferenceSortFields, &DocReference{})
+	if err != nil {
+		return nil, "", err
+	}
+
+	ids := map[string]bool{}
+	for _, id := range q.IDs {
+		ids[id] = true
+	}
+
+	references := m.findDocReferences(func(r *DocReference) bool {
+		return (len(ids) == 0 || ids[r.ID]) && (q.MimeType == "" || r.MimeType == q.MimeType) && p.include(r)
+	})
+
+	sort.Slice(references, func(i, j int) bool {
+		return p.less(references[i], references[j])
+	})
+
+	n, token, err := p.page(len(references), func(i int) interface{} { return references[i] })
+	if err != nil {
+		return nil, "", err
+	}
+	return references[:n], token, nil
+}
+
+// ToBeIndexed returns a list of DocReferences that need to be indexed.
+func (m *MemoryStore) ToBeIndexed() ([]*DocReference, error) {
+	return m.findDocReferences(func(r *DocReference) bool {
+		return r.LastIndexedMd5Checksum == "" || r.Md5Checksum != r.LastIndexedMd5Checksum
+	}), nil
+}
+
+func (m *MemoryStore) findDocReferences(match func(r *DocReference) bool) []*DocReference {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	references := make([]*DocReference, 0, len(m.docReferences))
+	for _, r := range m.docReferences {
+		if match(r) {
+			c := *r
+			references = append(references, &c)
+		}
+	}
+
+	sort.Slice(references, func(i, j int) bool {
+		return references[i].ID < references[j].ID
+	})
+	return references
+}
+
+// UpdateDocLink updates or creates the DocLink
+func (m *MemoryStore) UpdateDocLink(l *DocLink) error {
+	return m.UpsertDocLinks([]*DocLink{l})
+}
+
+// ListDocLinks lists all the doc links.
+// destId optional if supplied list all the links pointing at this destination id
+func (m *MemoryStore) ListDocLinks(destId string) ([]*DocLink, error) {
+	links, _, err := m.QueryDocLinks(DocLinkQuery{DestID: destId})
+	return links, err
+}
+
+// QueryDocLinks lists a page of the DocLinks matching the query. The token for the next page is returned; it is
+// empty if this is the last page.
+func (m *MemoryStore) QueryDocLinks(q DocLinkQuery) ([]*DocLink, string, error) {
+	p, err := newPager(q.ListOptions, q, docLinkSortFields, &DocLink{})
+	if err != nil {
+		return nil, "", err
+	}
+
+	m.mu.Lock()
+	links := make([]*DocLink, 0, len(m.docLinks))
+	for _, l := range m.docLinks {
+		if q.SourceID != "" && l.SourceID != q.SourceID {
+			continue
+		}
+		if q.DestID != "" && l.DestID != q.DestID {
+			continue
+		}
+		if !p.include(l) {
+			continue
+		}
+		c := *l
+		links = append(links, &c)
+	}
+	m.mu.Unlock()
+
+	sort.Slice(links, func(i, j int) bool {
+		return p.less(links[i], links[j])
+	})
+
+	n, token, err := p.page(len(links), func(i int) interface{} { return links[i] })
+	if err != nil {
+		return nil, "", err
+	}
+	return links[:n], token, nil
+}
+
+// UpdateEntity updates or creates the Entity
+func (m *MemoryStore) UpdateEntity(e *Entity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.updateEntity(e)
+}
+
+// updateEntity updates or creates the Entity. m.mu must be held.
+func (m *MemoryStore) updateEntity(e *Entity) error {
+	if e.Name == "" {
+		return fmt.Errorf("Name is required")
+	}
+
+	// Default ID to Name
+	if e.ID == "" {
+		e.ID = e.Name
+	}
+
+	var existing *time.Time
+	if current, ok := m.entities[e.ID]; ok {
+		existing = &current.CreatedAt
+	}
+	setTimestamps(&e.CreatedAt, &e.UpdatedAt, existing)
+
+	c := *e
+	m.entities[e.ID] = &c
+	return nil
+}
+
+// ListEntities lists all the entities.
+func (m *MemoryStore) ListEntities() ([]*Entity, error) {
+	entities, _, err := m.QueryEntities(EntityListQuery{})
+	return entities, err
+}
+
+// QueryEntities lists a page of the entities matching the query. The token for the next page is returned; it is
+// empty if this is the last page.
+func (m *MemoryStore) QueryEntities(q EntityListQuery) ([]*Entity, string, error) {
+	p, err := newPager(q.ListOptions, q, entitySortFields, &Entity{})
+	if err != nil {
+		return nil, "", err
+	}
+
+	mentioned := map[string]bool{}
+	if len(q.DocIDs) > 0 {
+		docs := map[string]bool{}
+		for _, id := range q.DocIDs {
+			docs[id] = true
+		}
+
+		m.mu.Lock()
+		for _, e := range m.entityMentions {
+			if docs[e.DocID] {
+				mentioned[e.EntityID] = true
+			}
+		}
+		m.mu.Unlock()
+	}
+
+	entities := m.findEntities(func(e *Entity) bool {
+		return (q.Name == "" || e.Name == q.Name) && (q.Type == "" || e.Type == q.Type) &&
+			(len(q.DocIDs) == 0 || mentioned[e.ID]) && p.include(e)
+	})
+
+	sort.Slice(entities, func(i, j int) bool {
+		return p.less(entities[i], entities[j])
+	})
+
+	n, token, err := p.page(len(entities), func(i int) interface{} { return entities[i] })
+	if err != nil {
+		return nil, "", err
+	}
+	return entities[:n], token, nil
+}
+
+// FindEntity is a primitive form of entity linking. Entities matching any of the fields in the query are
+// returned. If the query is empty all entities are returned.
+func (m *MemoryStore) FindEntity(q EntityQuery) ([]*Entity, error) {
+	if q.Name == "" && q.WikipediaURL == "" && q.MID == "" {
+		return m.ListEntities()
+	}
+
+	return m.findEntities(func(e *Entity) bool {
+		return (q.Name != "" && e.Name == q.Name) ||
+			(q.WikipediaURL != "" && e.WikipediaUrl == q.WikipediaURL) ||
+			(q.MID != "" && e.MID == q.MID)
+	}), nil
+}
+
+func (m *MemoryStore) findEntities(match func(e *Entity) bool) []*Entity {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entities := make([]*Entity, 0, len(m.entities))
+	for _, e := range m.entities {
+		if match(e) {
+			c := *e
+			entities = append(entities, &c)
+		}
+	}
+
+	sort.Slice(entities, func(i, j int) bool {
+		return entities[i].ID < entities[j].ID
+	})
+	return entities
+}
+
+// UpdateEntityMention updates or creates the EntityMention
+func (m *MemoryStore) UpdateEntityMention(e *EntityMention) error {
+	return m.UpsertEntityMentions([]*EntityMention{e})
+}
+
+// ListEntityMentions lists all the entity mentions.
+// docId is optional if supplied list all the mentions for the provided doc.
+func (m *MemoryStore) ListEntityMentions(docId string) ([]*EntityMention, error) {
+	mentions, _, err := m.QueryEntityMentions(EntityMentionQuery{DocID: docId})
+	return mentions, err
+}
+
+// QueryEntityMentions lists a page of the EntityMentions matching the query. The token for the next page is
+// returned; it is empty if this is the last page.
+func (m *MemoryStore) QueryEntityMentions(q EntityMentionQuery) ([]*EntityMention, string, error) {
+	p, err := newPager(q.ListOptions, q, entityMentionSortFields, &EntityMention{})
+	if err != nil {
+		return nil, "", err
+	}
+
+	m.mu.Lock()
+	mentions := make([]*EntityMention, 0, len(m.entityMentions))
+	for _, e := range m.entityMentions {
+		if q.DocID != "" && e.DocID != q.DocID {
+			continue
+		}
+		if q.EntityID != "" && e.EntityID != q.EntityID {
+			continue
+		}
+		if q.Type != "" && e.Type != q.Type {
+			continue
+		}
+		if !p.include(e) {
+			continue
+		}
+		c := *e
+		mentions = append(mentions, &c)
+	}
+	m.mu.Unlock()
+
+	sort.Slice(mentions, func(i, j int) bool {
+		return p.less(mentions[i], mentions[j])
+	})
+
+	n, token, err := p.page(len(mentions), func(i int) interface{} { return mentions[i] })
+	if err != nil {
+		return nil, "", err
+	}
+	return mentions[:n], token, nil
+}
+
+// ListEntityDocuments lists the documents which mention the given entity ranked by salience and then the
+// number of mentions.
+func (m *MemoryStore) ListEntityDocuments(entityId string) ([]*EntityDocument, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	byDoc := map[string]*EntityDocument{}
+	scores := map[string]float64{}
+	for _, e := range m.entityMentions {
+		if e.EntityID != entityId {
+			continue
+		}
+
+		doc, ok := byDoc[e.DocID]
+		if !ok {
+			doc = &EntityDocument{DocID: e.DocID, Salience: e.Salience}
+			byDoc[e.DocID] = doc
+		}
+
+		if e.Salience > doc.Salience {
+			doc.Salience = e.Salience
+		}
+		doc.NumMentions++
+		doc.SentimentMagnitude += e.SentimentMagnitude
+		scores[e.DocID] += float64(e.SentimentScore)
+	}
+
+	docs := make([]*EntityDocument, 0, len(byDoc))
+	for id, doc := range byDoc {
+		doc.SentimentScore = float32(scores[id] / float64(doc.NumMentions))
+		docs = append(docs, doc)
+	}
+
+	sort.Slice(docs, func(i, j int) bool {
+		if docs[i].Salience != docs[j].Salience {
+			return docs[i].Salience > docs[j].Salience
+		}
+		if docs[i].NumMentions != docs[j].NumMentions {
+			return docs[i].NumMentions > docs[j].NumMentions
+		}
+		return docs[i].DocID < docs[j].DocID
+	})
+	return docs, nil
+}
+
+// EntityTimeline returns the number of mentions of the entity grouped by the week or month in which the docs
+// mentioning it were last modified.
+func (m *MemoryStore) EntityTimeline(entityId string, interval string) ([]*TimelineBucket, error) {
+	if err := validateTimeline(entityId, interval); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	byDoc := map[string]*TimelineDoc{}
+	for _, e := range m.entityMentions {
+		if e.EntityID != entityId {
+			continue
+		}
+
+		// Mentions in docs without a DocReference are excluded like in the join used by Datastore.
+		r, ok := m.docReferences[e.DocID]
+		if !ok {
+			continue
+		}
+
+		doc, ok := byDoc[e.DocID]
+		if !ok {
+			doc = &TimelineDoc{DocID: e.DocID, Name: r.Name, ModifiedTime: r.ModifiedTime}
+			byDoc[e.DocID] = doc
+		}
+		doc.NumMentions++
+	}
+	m.mu.Unlock()
+
+	docs := make([]*TimelineDoc, 0, len(byDoc))
+	for _, doc := range byDoc {
+		docs = append(docs, doc)
+	}
+
+	sort.Slice(docs, func(i, j int) bool {
+		if !docs[i].ModifiedTime.Equal(docs[j].ModifiedTime) {
+			return docs[i].ModifiedTime.Before(docs[j].ModifiedTime)
+		}
+		return docs[i].DocID < docs[j].DocID
+	})
+	return timelineBuckets(docs, interval), nil
+}
+
+// entityPair identifies a pair of entities mentioned together.
+type entityPair struct {
+	entityId  string
+	relatedId string
+}
+
+// countCooccurrences counts the docs and sentences in which pairs of entities are mentioned together.
+// If include is supplied only mentions of the first entity in the pair for which it returns true are counted.
+// m.mu must be held.
+func (m *MemoryStore) countCooccurrences(include func(e *EntityMention) bool) map[entityPair]*EntityCooccurrence {
+	byDoc := map[string][]*EntityMention{}
+	for _, e := range m.entityMentions {
+		byDoc[e.DocID] = append(byDoc[e.DocID], e)
+	}
+
+	docs := map[entityPair]map[string]bool{}
+	sentences := map[entityPair]map[string]bool{}
+	for docId, mentions := range byDoc {
+		for _, a := range mentions {
+			if include != nil && !include(a) {
+				continue
+			}
+			for _, b := range mentions {
+				if a.EntityID == b.EntityID {
+					continue
+				}
+
+				p := entityPair{entityId: a.EntityID, relatedId: b.EntityID}
+				if docs[p] == nil {
+					docs[p] = map[string]bool{}
+					sentences[p] = map[string]bool{}
+				}
+				docs[p][docId] = true
+				if a.Sentence > 0 && a.Sentence == b.Sentence {
+					sentences[p][fmt.Sprintf("%v:%v", docId, a.Sentence)] = true
+				}
+			}
+		}
+	}
+
+	counts := make(map[entityPair]*EntityCooccurrence, len(docs))
+	for p, d := range docs {
+		counts[p] = &EntityCooccurrence{
+			EntityID:     p.entityId,
+			RelatedID:    p.relatedId,
+			NumDocuments: int64(len(d)),
+			NumSentences: int64(len(sentences[p])),
+		}
+	}
+	return counts
+}
+
+// UpdateEntityCooccurrences recomputes the co-occurrence counts of all pairs of entities from the EntityMentions.
+func (m *MemoryStore) UpdateEntityCooccurrences() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts := m.countCooccurrences(nil)
+	m.cooccurrences = make(map[string]*EntityCooccurrence, len(counts))
+	for _, c := range counts {
+		c.ID = EntityCooccurrenceKey(*c)
+		setTimestamps(&c.CreatedAt, &c.UpdatedAt, nil)
+		m.cooccurrences[c.ID] = c
+	}
+	return nil
+}
+
+// UpdateEntityCooccurrencesOf recomputes the co-occurrence counts of the pairs of entities that include one of
+// entityIds.
+func (m *MemoryStore) UpdateEntityCooccurrencesOf(entityIds []string) error {
+	ids := map[string]bool{}
+	for _, id := range entityIds {
+		ids[id] = true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for k, c := range m.cooccurrences {
+		if ids[c.EntityID] || ids[c.RelatedID] {
+			delete(m.cooccurrences, k)
+		}
+	}
+
+	counts := m.countCooccurrences(func(e *EntityMention) bool { return ids[e.EntityID] })
+	for _, c := range counts {
+		rows := []*EntityCooccurrence{c}
+		if !ids[c.RelatedID] {
+			rows = append(rows, &EntityCooccurrence{EntityID: c.RelatedID, RelatedID: c.EntityID, NumDocuments: c.NumDocuments, NumSentences: c.NumSentences})
+		}
+		for _, r := range rows {
+			r.ID = EntityCooccurrenceKey(*r)
+			setTimestamps(&r.CreatedAt, &r.UpdatedAt, nil)
+			m.cooccurrences[r.ID] = r
+		}
+	}
+	return nil
+}
+
+// ListRelatedEntities lists the entities mentioned together with entityId ordered by the number of docs and then
+// sentences in which they are mentioned together.
+// limit is optional; if > 0 at most limit entities are returned.
+func (m *MemoryStore) ListRelatedEntities(entityId string, limit int) ([]*RelatedEntity, error) {
+	if entityId == "" {
+		return nil, errors.New("entityId must be set")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	related := make([]*RelatedEntity, 0, 10)
+	for _, c := range m.cooccurrences {
+		if c.EntityID == entityId {
+			related = append(related, m.relatedEntity(c))
+		}
+	}
+	return sortRelated(related, limit), nil
+}
+
+// ListRelatedEntitiesInDocs is like ListRelatedEntities but only counts co-occurrences in the given docs.
+func (m *MemoryStore) ListRelatedEntitiesInDocs(entityId string, docIds []string, limit int) ([]*RelatedEntity, error) {
+	if entityId == "" {
+		return nil, errors.New("entityId must be set")
+	}
+
+	inDocs := make(map[string]bool, len(docIds))
+	for _, id := range docIds {
+		inDocs[id] = true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts := m.countCooccurrences(func(e *EntityMention) bool {
+		return e.EntityID == entityId && inDocs[e.DocID]
+	})
+
+	related := make([]*RelatedEntity, 0, len(counts))
+	for _, c := range counts {
+		related = append(related, m.relatedEntity(c))
+	}
+	return sortRelated(related, limit), nil
+}
+
+// relatedEntity converts the co-occurrence to the related entity. m.mu must be held.
+func (m *MemoryStore) relatedEntity(c *EntityCooccurrence) *RelatedEntity {
+	r := &RelatedEntity{
+		EntityID:     c.RelatedID,
+		NumDocuments: c.NumDocuments,
+		NumSentences: c.NumSentences,
+	}
+	if e, ok := m.entities[c.RelatedID]; ok {
+		r.Name = e.Name
+		r.Type = e.Type
+	}
+	return r
+}
+
+func sortRelated(related []*RelatedEntity, limit int) []*RelatedEntity {
+	sort.Slice(related, func(i, j int) bool {
+		if related[i].NumDocuments != related[j].NumDocuments {
+			return related[i].NumDocuments > related[j].NumDocuments
+		}
+		if related[i].NumSentences != related[j].NumSentences {
+			return related[i].NumSentences > related[j].NumSentences
+		}
+		return related[i].EntityID < related[j].EntityID
+	})
+
+	if limit > 0 && len(related) > limit {
+		related = related[:limit]
+	}
+	return related
+}
+
+// UpdatePerson creates or updates the person entity with the given email.
+// name is the display name of the person; if it is empty the existing name is kept or the email is used.
+func (m *MemoryStore) UpdatePerson(email string, name string) (*Entity, error) {
+	if email == "" {
+		return nil, errors.New("email must be set")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := &Entity{
+		ID: PersonKey(email),
+	}
+	if current, ok := m.entities[p.ID]; ok {
+		*p = *current
+	}
+
+	p.Email = strings.ToLower(email)
+	p.Type = PersonType
+	if name != "" {
+		p.Name = name
+	}
+	if p.Name == "" {
+		p.Name = p.Email
+	}
+
+	if err := m.updateEntity(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// FindPeople returns the person entities whose name matches name ignoring case.
+func (m *MemoryStore) FindPeople(name string) ([]*Entity, error) {
+	if name == "" {
+		return make([]*Entity, 0, 0), nil
+	}
+
+	return m.findEntities(func(e *Entity) bool {
+		return e.Email != "" && strings.ToLower(e.Name) == strings.ToLower(name)
+	}), nil
+}
+
+// ReplaceDocPeople replaces the people related to the doc with the supplied people.
+func (m *MemoryStore) ReplaceDocPeople(docId string, people []*DocPerson) error {
+	if docId == "" {
+		return errors.New("docId must be set")
+	}
+
+	ids := map[string]bool{}
+	for _, p := range people {
+		if p.DocID != docId {
+			return errors.Errorf("Person %v has DocID %v; want %v", p.EntityID, p.DocID, docId)
+		}
+
+		expectedId := DocPersonKey(*p)
+		if p.ID != "" && p.ID != expectedId {
+			return errors.Errorf("ID and DocPerson are inconsistent; ID should be empty or %v", expectedId)
+		}
+		p.ID = expectedId
+
+		if ids[p.ID] {
+			return errors.Errorf("Failed to create DocPerson ID: %v; it is duplicated", p.ID)
+		}
+		ids[p.ID] = true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, p := range m.docPeople {
+		if p.DocID == docId {
+			delete(m.docPeople, id)
+		}
+	}
+
+	for _, p := range people {
+		setTimestamps(&p.CreatedAt, &p.UpdatedAt, nil)
+		c := *p
+		m.docPeople[p.ID] = &c
+	}
+	return nil
+}
+
+// ListDocPeople lists the relationships between docs and people.
+// docId is optional if supplied only list the people related to the doc.
+// entityId is optional if supplied only list the docs related to the person.
+func (m *MemoryStore) ListDocPeople(docId string, entityId string) ([]*DocPerson, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	people := make([]*DocPerson, 0, 10)
+	for _, p := range m.docPeople {
+		if (docId != "" && p.DocID != docId) || (entityId != "" && p.EntityID != entityId) {
+			continue
+		}
+		c := *p
+		people = append(people, &c)
+	}
+
+	sort.Slice(people, func(i, j int) bool {
+		if people[i].DocID != people[j].DocID {
+			return people[i].DocID < people[j].DocID
+		}
+		if people[i].EntityID != people[j].EntityID {
+			return people[i].EntityID < people[j].EntityID
+		}
+		return people[i].Role < people[j].Role
+	})
+	return people, nil
+}
+
+// ReplaceDocPermissions replaces the ACL of the doc with the supplied permissions.
+// Principals are normalized to lower case.
+func (m *MemoryStore) ReplaceDocPermissions(docId string, permissions []*DocPermission) error {
+	if docId == "" {
+		return errors.New("docId must be set")
+	}
+
+	ids := map[string]bool{}
+	for _, p := range permissions {
+		if p.DocID != docId {
+			return errors.Errorf("Permission for %v has DocID %v; want %v", p.Principal, p.DocID, docId)
+		}
+
+		switch p.Type {
+		case PrincipalUser, PrincipalGroup, PrincipalDomain, PrincipalAnyone:
+		default:
+			return errors.Errorf("Permission for %v has invalid type %v", p.Principal, p.Type)
+		}
+
+		p.Principal = strings.ToLower(p.Principal)
+		expectedId := DocPermissionKey(*p)
+		if p.ID != "" && p.ID != expectedId {
+			return errors.Errorf("ID and DocPermission are inconsistent; ID should be empty or %v", expectedId)
+		}
+		p.ID = expectedId
+
+		if ids[p.ID] {
+			return errors.Errorf("Failed to create DocPermission ID: %v; it is duplicated", p.ID)
+		}
+		ids[p.ID] = true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, p := range m.docPermissions {
+		if p.DocID == docId {
+			delete(m.docPermissions, id)
+		}
+	}
+
+	for _, p := range permissions {
+		setTimestamps(&p.CreatedAt, &p.UpdatedAt, nil)
+		c := *p
+		m.docPermissions[p.ID] = &c
+	}
+	return nil
+}
+
+// ListDocPermissions lists the ACL of the doc.
+func (m *MemoryStore) ListDocPermissions(docId string) ([]*DocPermission, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	permissions := make([]*DocPermission, 0, 10)
+	for _, p := range m.docPermissions {
+		if p.DocID == docId {
+			c := *p
+			permissions = append(permissions, &c)
+		}
+	}
+
+	sort.Slice(permissions, func(i, j int) bool {
+		if permissions[i].Type != permissions[j].Type {
+			return permissions[i].Type < permissions[j].Type
+		}
+		return permissions[i].Principal < permissions[j].Principal
+	})
+	return permissions, nil
+}
+
+// ListVisibleDocs returns the ids of the docs the principals can read according to the stored ACLs.
+// Docs without any stored permissions aren't visible to anyone.
+func (m *MemoryStore) ListVisibleDocs(p Principals) (map[string]bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	visible := map[string]bool{}
+	for _, perm := range m.docPermissions {
+		if p.Grants(perm) {
+			visible[perm.DocID] = true
+		}
+	}
+	return visible, nil
+}
+
+// UpdateRedaction updates or creates the Redaction
+func (m *MemoryStore) UpdateRedaction(r *Redaction) error {
+	if r.DocID == "" {
+		return errors.New("DocID must be set")
+	}
+
+	expectedId := RedactionKey(*r)
+	if r.ID != "" && r.ID != expectedId {
+		return errors.Errorf("ID and Redaction are inconsistent; ID should be empty or %v", expectedId)
+	}
+
+	r.ID = expectedId
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var existing *time.Time
+	if current, ok := m.redactions[r.ID]; ok {
+		existing = &current.CreatedAt
+	}
+	setTimestamps(&r.CreatedAt, &r.UpdatedAt, existing)
+
+	c := *r
+	m.redactions[r.ID] = &c
+	return nil
+}
+
+// ListRedactions lists the redactions.
+// docId is optional if supplied list all the redactions for the provided doc.
+func (m *MemoryStore) ListRedactions(docId string) ([]*Redaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	redactions := make([]*Redaction, 0, len(m.redactions))
+	for _, r := range m.redactions {
+		if docId != "" && r.DocID != docId {
+			continue
+		}
+		c := *r
+		redactions = append(redactions, &c)
+	}
+
+	sort.Slice(redactions, func(i, j int) bool {
+		return redactions[i].ID < redactions[j].ID
+	})
+	return redactions, nil
+}
+
+// ReplaceDocCategories replaces the categories of the doc with the supplied categories.
+func (m *MemoryStore) ReplaceDocCategories(docId string, categories []*DocCategory) error {
+	if docId == "" {
+		return errors.New("docId must be set")
+	}
+
+	ids := map[string]bool{}
+	for _, c := range categories {
+		if c.DocID != docId {
+			return errors.Errorf("Category %v has DocID %v; want %v", c.Category, c.DocID, docId)
+		}
+
+		expectedId := DocCategoryKey(*c)
+		if c.ID != "" && c.ID != expectedId {
+			return errors.Errorf("ID and DocCategory are inconsistent; ID should be empty or %v", expectedId)
+		}
+		c.ID = expectedId
+
+		if ids[c.ID] {
+			return errors.Errorf("Failed to create DocCategory ID: %v; it is duplicated", c.ID)
+		}
+		ids[c.ID] = true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, c := range m.docCategories {
+		if c.DocID == docId {
+			delete(m.docCategories, id)
+		}
+	}
+
+	for _, c := range categories {
+		setTimestamps(&c.CreatedAt, &c.UpdatedAt, nil)
+		cp := *c
+		m.docCategories[c.ID] = &cp
+	}
+	return nil
+}
+
+// ListDocCategories lists the categories ordered by confidence.
+// docId is optional if supplied list the categories for the provided doc.
+// category is optional if supplied only list categories equal to or nested under category.
+func (m *MemoryStore) ListDocCategories(docId string, category string) ([]*DocCategory, error) {
+	category = strings.TrimSuffix(category, "/")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	categories := make([]*DocCategory, 0, 10)
+	for _, c := range m.docCategories {
+		if docId != "" && c.DocID != docId {
+			continue
+		}
+		if category != "" && c.Category != category && !strings.HasPrefix(c.Category, category+"/") {
+			continue
+		}
+		cp := *c
+		categories = append(categories, &cp)
+	}
+
+	sort.Slice(categories, func(i, j int) bool {
+		if categories[i].Confidence != categories[j].Confidence {
+			return categories[i].Confidence > categories[j].Confidence
+		}
+		if categories[i].DocID != categories[j].DocID {
+			return categories[i].DocID < categories[j].DocID
+		}
+		return categories[i].Category < categories[j].Category
+	})
+	return categories, nil
+}
+
+// CountDocCategories returns the number of documents in each category.
+func (m *MemoryStore) CountDocCategories() ([]*CategoryCount, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	docs := map[string]map[string]bool{}
+	for _, c := range m.docCategories {
+		if docs[c.Category] == nil {
+			docs[c.Category] = map[string]bool{}
+		}
+		docs[c.Category][c.DocID] = true
+	}
+
+	counts := make([]*CategoryCount, 0, len(docs))
+	for category, d := range docs {
+		counts = append(counts, &CategoryCount{Category: category, NumDocuments: int64(len(d))})
+	}
+
+	sort.Slice(counts, func(i, j int) bool {
+		return counts[i].Category < counts[j].Category
+	})
+	return counts, nil
+}
+
+// ReplaceKeyphraseMentions replaces the keyphrase mentions of the doc with the supplied mentions.
+// Keyphrases that don't exist yet are created.
+func (m *MemoryStore) ReplaceKeyphraseMentions(docId string, mentions []*KeyphraseMention) error {
+	if docId == "" {
+		return errors.New("docId must be set")
+	}
+
+	ids := map[string]bool{}
+	for _, k := range mentions {
+		if k.DocID != docId {
+			return errors.Errorf("Mention of %v has DocID %v; want %v", k.KeyphraseID, k.DocID, docId)
+		}
+
+		if k.KeyphraseID == "" {
+			return errors.New("KeyphraseID must be set")
+		}
+		k.KeyphraseID = KeyphraseKey(k.KeyphraseID)
+
+		expectedId := KeyphraseMentionKey(*k)
+		if k.ID != "" && k.ID != expectedId {
+			return errors.Errorf("ID and KeyphraseMention are inconsistent; ID should be empty or %v", expectedId)
+		}
+		k.ID = expectedId
+
+		if ids[k.ID] {
+			return errors.Errorf("Failed to create KeyphraseMention ID: %v; it is duplicated", k.ID)
+		}
+		ids[k.ID] = true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, k := range m.keyphraseMentions {
+		if k.DocID == docId {
+			delete(m.keyphraseMentions, id)
+		}
+	}
+
+	for _, k := range mentions {
+		if _, ok := m.keyphrases[k.KeyphraseID]; !ok {
+			p := &Keyphrase{ID: k.KeyphraseID}
+			setTimestamps(&p.CreatedAt, &p.UpdatedAt, nil)
+			m.keyphrases[p.ID] = p
+		}
+
+		setTimestamps(&k.CreatedAt, &k.UpdatedAt, nil)
+		c := *k
+		m.keyphraseMentions[k.ID] = &c
+	}
+	return nil
+}
+
+// ListKeyphraseMentions lists the keyphrase mentions ordered by doc and position.
+// docId is optional if supplied list the mentions in the provided doc.
+func (m *MemoryStore) ListKeyphraseMentions(docId string) ([]*KeyphraseMention, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mentions := make([]*KeyphraseMention, 0, len(m.keyphraseMentions))
+	for _, k := range m.keyphraseMentions {
+		if docId != "" && k.DocID != docId {
+			continue
+		}
+		c := *k
+		mentions = append(mentions, &c)
+	}
+
+	sort.Slice(mentions, func(i, j int) bool {
+		if mentions[i].DocID != mentions[j].DocID {
+			return mentions[i].DocID < mentions[j].DocID
+		}
+		if mentions[i].StartIndex != mentions[j].StartIndex {
+			return mentions[i].StartIndex < mentions[j].StartIndex
+		}
+		return mentions[i].ID < mentions[j].ID
+	})
+	return mentions, nil
+}
+
+// UpdateKeyphraseWeights recomputes the document frequency of every keyphrase and the TF-IDF weight of the
+// keyphrases in every doc. See Datastore.UpdateKeyphraseWeights for the formula.
+func (m *MemoryStore) UpdateKeyphraseWeights() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Count the mentions of each keyphrase in each doc; NumMentions is unused in the key.
+	counts := map[docKeyphraseCount]int64{}
+	for _, k := range m.keyphraseMentions {
+		counts[docKeyphraseCount{DocID: k.DocID, KeyphraseID: k.KeyphraseID}]++
+	}
+
+	docTotals := map[string]int64{}
+	docFrequency := map[string]int64{}
+	for c, n := range counts {
+		docTotals[c.DocID] = docTotals[c.DocID] + n
+		docFrequency[c.KeyphraseID] = docFrequency[c.KeyphraseID] + 1
+	}
+
+	numDocs := float64(len(docTotals))
+	idf := map[string]float64{}
+	for k, df := range docFrequency {
+		idf[k] = math.Log((1+numDocs)/(1+float64(df))) + 1
+	}
+
+	for id, k := range m.keyphrases {
+		df, ok := docFrequency[id]
+		if !ok {
+			delete(m.keyphrases, id)
+			continue
+		}
+		k.DocumentFrequency = df
+		k.InverseDocumentFrequency = idf[id]
+		k.UpdatedAt = time.Now()
+	}
+
+	m.docKeyphrases = make(map[string]*DocKeyphrase, len(counts))
+	for c, n := range counts {
+		w := &DocKeyphrase{
+			DocID:       c.DocID,
+			KeyphraseID: c.KeyphraseID,
+			NumMentions: n,
+			Weight:      float64(n) / float64(docTotals[c.DocID]) * idf[c.KeyphraseID],
+		}
+		w.ID = DocKeyphraseKey(*w)
+		setTimestamps(&w.CreatedAt, &w.UpdatedAt, nil)
+		m.docKeyphrases[w.ID] = w
+	}
+	return nil
+}
+
+// ListKeyphrases lists the keyphrases ordered by the number of documents mentioning them.
+// limit is optional; if > 0 at most limit keyphrases are returned.
+func (m *MemoryStore) ListKeyphrases(limit int) ([]*Keyphrase, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	phrases := make([]*Keyphrase, 0, len(m.keyphrases))
+	for _, k := range m.keyphrases {
+		c := *k
+		phrases = append(phrases, &c)
+	}
+
+	sort.Slice(phrases, func(i, j int) bool {
+		if phrases[i].DocumentFrequency != phrases[j].DocumentFrequency {
+			return phrases[i].DocumentFrequency > phrases[j].DocumentFrequency
+		}
+		return phrases[i].ID < phrases[j].ID
+	})
+
+	if limit > 0 && len(phrases) > limit {
+		phrases = phrases[:limit]
+	}
+	return phrases, nil
+}
+
+// SearchKeyphrases returns the docs mentioning keyphrases containing query ranked by the TF-IDF weight of the
+// keyphrase in the doc.
+// limit is optional; if > 0 at most limit results are returned.
+func (m *MemoryStore) SearchKeyphrases(query string, limit int) ([]*DocKeyphrase, error) {
+	query = KeyphraseKey(query)
+	if query == "" {
+		return nil, errors.New("query must be set")
+	}
+
+	results := m.findDocKeyphrases(func(k *DocKeyphrase) bool {
+		return strings.Contains(k.KeyphraseID, query)
+	})
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Weight != results[j].Weight {
+			return results[i].Weight > results[j].Weight
+		}
+		if results[i].DocID != results[j].DocID {
+			return results[i].DocID < results[j].DocID
+		}
+		return results[i].KeyphraseID < results[j].KeyphraseID
+	})
+
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// ListDocKeyphrases lists the weights of the keyphrases ordered by doc and then weight.
+// docId is optional if supplied list the keyphrases in the provided doc.
+func (m *MemoryStore) ListDocKeyphrases(docId string) ([]*DocKeyphrase, error) {
+	results := m.findDocKeyphrases(func(k *DocKeyphrase) bool {
+		return docId == "" || k.DocID == docId
+	})
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].DocID != results[j].DocID {
+			return results[i].DocID < results[j].DocID
+		}
+		if results[i].Weight != results[j].Weight {
+			return results[i].Weight > results[j].Weight
+		}
+		return results[i].KeyphraseID < results[j].KeyphraseID
+	})
+	return results, nil
+}
+
+func (m *MemoryStore) findDocKeyphrases(match func(k *DocKeyphrase) bool) []*DocKeyphrase {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := make([]*DocKeyphrase, 0, 10)
+	for _, k := range m.docKeyphrases {
+		if match(k) {
+			c := *k
+			results = append(results, &c)
+		}
+	}
+	return results
+}
+
+// GetNLPResponse returns the cached response with the given key. It returns nil if there is no cached response.
+// Each call that finds a response increments the number of hits for that response.
+func (m *MemoryStore) GetNLPResponse(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.nlpResponses[key]
+	if !ok {
+		return nil, nil
+	}
+
+	r.Hits++
+	return append([]byte{}, r.Response...), nil
+}
+
+// PutNLPResponse updates or creates the cached response.
+func (m *MemoryStore) PutNLPResponse(key string, method string, numCharacters int64, response []byte) error {
+	if key == "" {
+		return errors.New("key must be set")
+	}
+
+	r := &NLPResponse{
+		ID:            key,
+		Method:        method,
+		Response:      append([]byte{}, response...),
+		NumCharacters: numCharacters,
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var existing *time.Time
+	if current, ok := m.nlpResponses[key]; ok {
+		existing = &current.CreatedAt
+	}
+	setTimestamps(&r.CreatedAt, &r.UpdatedAt, existing)
+	m.nlpResponses[key] = r
+	return nil
+}
+
+// GetNLPCacheStats returns statistics about the cache broken down by method.
+func (m *MemoryStore) GetNLPCacheStats() ([]*NLPCacheStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	byMethod := map[string]*NLPCacheStats{}
+	for _, r := range m.nlpResponses {
+		s, ok := byMethod[r.Method]
+		if !ok {
+			s = &NLPCacheStats{Method: r.Method}
+			byMethod[r.Method] = s
+		}
+		s.Count++
+		s.Bytes += int64(len(r.Response))
+		s.NumCharacters += r.NumCharacters
+		s.Hits += r.Hits
+	}
+
+	stats := make([]*NLPCacheStats, 0, len(byMethod))
+	for _, s := range byMethod {
+		stats = append(stats, s)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Method < stats[j].Method
+	})
+	return stats, nil
+}
+
+// PurgeNLPCache deletes cached responses. It returns the number of responses deleted.
+// method is optional; if supplied only responses for that method are deleted.
+// olderThan is optional; if supplied only responses last updated before that time are deleted.
+func (m *MemoryStore) PurgeNLPCache(method string, olderThan time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int64
+	for key, r := range m.nlpResponses {
+		if method != "" && r.Method != method {
+			continue
+		}
+		if !olderThan.IsZero() && !r.UpdatedAt.Before(olderThan) {
+			continue
+		}
+		delete(m.nlpResponses, key)
+		n++
+	}
+	return n, nil
+}
+
+// AddNLPUsage adds the counters in u to the counters already stored for the same run, day, drive and method.
+func (m *MemoryStore) AddNLPUsage(u *NLPUsage) error {
+	if u.RunID == "" {
+		return errors.New("RunID must be set")
+	}
+
+	if u.Day == "" {
+		return errors.New("Day must be set")
+	}
+
+	expectedId := NLPUsageKey(*u)
+	if u.ID != "" && u.ID != expectedId {
+		return errors.Errorf("ID and NLPUsage are inconsistent; ID should be empty or %v", expectedId)
+	}
+
+	u.ID = expectedId
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, ok := m.nlpUsage[u.ID]
+	if !ok {
+		setTimestamps(&u.CreatedAt, &u.UpdatedAt, nil)
+		c := *u
+		m.nlpUsage[u.ID] = &c
+		return nil
+	}
+
+	current.Requests += u.Requests
+	current.NumCharacters += u.NumCharacters
+	current.Units += u.Units
+	return nil
+}
+
+// SumNLPUnits returns the total number of units used since the given day (inclusive).
+// since is a UTC date in the form YYYY-MM-DD; if empty all usage is included.
+func (m *MemoryStore) SumNLPUnits(since string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var total int64
+	for _, u := range m.nlpUsage {
+		if u.Day >= since {
+			total += u.Units
+		}
+	}
+	return total, nil
+}
+
+// ReportNLPUsage returns the usage summed over the fields not in groupBy.
+//
+// groupBy is a list of fields; allowed values are run, day, drive and method. Fields not in groupBy are left
+// empty in the results.
+// since is optional; it is a UTC date in the form YYYY-MM-DD. If supplied only usage on or after that day is
+// included.
+func (m *MemoryStore) ReportNLPUsage(groupBy []string, since string) ([]*NLPUsage, error) {
+	fields := map[string]bool{}
+	for _, g := range groupBy {
+		if _, ok := usageColumns[strings.ToLower(g)]; !ok {
+			return nil, errors.Errorf("Can't group usage by %v; allowed values are run, day, drive, method", g)
+		}
+		fields[strings.ToLower(g)] = true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	groups := map[NLPUsage]*NLPUsage{}
+	for _, u := range m.nlpUsage {
+		if u.Day < since {
+			continue
+		}
+
+		key := NLPUsage{}
+		if fields["run"] {
+			key.RunID = u.RunID
+		}
+		if fields["day"] {
+			key.Day = u.Day
+		}
+		if fields["drive"] {
+			key.DriveID = u.DriveID
+		}
+		if fields["method"] {
+			key.Method = u.Method
+		}
+
+		g, ok := groups[key]
+		if !ok {
+			g = &NLPUsage{RunID: key.RunID, Day: key.Day, DriveID: key.DriveID, Method: key.Method}
+			groups[key] = g
+		}
+		g.Requests += u.Requests
+		g.NumCharacters += u.NumCharacters
+		g.Units += u.Units
+	}
+
+	// Like a SQL aggregate without a group by, there is always one row if usage isn't grouped.
+	if len(groupBy) == 0 && len(groups) == 0 {
+		groups[NLPUsage{}] = &NLPUsage{}
+	}
+
+	usage := make([]*NLPUsage, 0, len(groups))
+	for _, g := range groups {
+		usage = append(usage, g)
+	}
+
+	// Sort by the grouped fields in the order they were supplied.
+	sort.Slice(usage, func(i, j int) bool {
+		for _, g := range groupBy {
+			a, b := usageField(usage[i], g), usageField(usage[j], g)
+			if a != b {
+				return a < b
+			}
+		}
+		return false
+	})
+	return usage, nil
+}
+
+// usageField returns the value of the NLPUsage field with the given groupBy name.
+func usageField(u *NLPUsage, field string) string {
+	switch strings.ToLower(field) {
+	case "run":
+		return u.RunID
+	case "day":
+		return u.Day
+	case "drive":
+		return u.DriveID
+	default:
+		return u.Method
+	}
+}
+
+// UpdateIndexJob updates or creates the IndexJob.
+func (m *MemoryStore) UpdateIndexJob(j *IndexJob) error {
+	if j.ID == "" {
+		return errors.New("ID must be set")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var existing *time.Time
+	if current, ok := m.indexJobs[j.ID]; ok {
+		existing = &current.CreatedAt
+	}
+	setTimestamps(&j.CreatedAt, &j.UpdatedAt, existing)
+
+	c := *j
+	m.indexJobs[j.ID] = &c
+	return nil
+}
+
+// GetIndexJob returns the job with the given id. ErrNotFound is returned if the job doesn't exist.
+func (m *MemoryStore) GetIndexJob(id string) (*IndexJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	j, ok := m.indexJobs[id]
+	if !ok {
+		return nil, errors.Wrapf(ErrNotFound, "IndexJob ID: %v", id)
+	}
+	c := *j
+	return &c, nil
+}
+
+// ListIndexJobs lists the jobs starting with the most recent.
+// limit is optional; if > 0 at most limit jobs are returned.
+func (m *MemoryStore) ListIndexJobs(limit int) ([]*IndexJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	jobs := make([]*IndexJob, 0, len(m.indexJobs))
+	for _, j := range m.indexJobs {
+		c := *j
+		jobs = append(jobs, &c)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		if !jobs[i].CreatedAt.Equal(jobs[j].CreatedAt) {
+			return jobs[i].CreatedAt.After(jobs[j].CreatedAt)
+		}
+		return jobs[i].ID < jobs[j].ID
+	})
+
+	if limit > 0 && len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+	return jobs, nil
+}
+
+// FailUnfinishedIndexJobs marks jobs which are still pending or running as failed.
+func (m *MemoryStore) FailUnfinishedIndexJobs() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for _, j := range m.indexJobs {
+		if j.State != JobPending && j.State != JobRunning {
+			continue
+		}
+		j.State = JobFailed
+		j.Error = unfinishedJobMessage
+		j.EndTime = now
+		j.UpdatedAt = now
+	}
+	return nil
+}
+
+// IndexStats computes statistics about the docs, links and entities.
+func (m *MemoryStore) IndexStats(q StatsQuery) (*IndexStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var inDocs map[string]bool
+	if q.DocIDs != nil {
+		inDocs = map[string]bool{}
+		for _, id := range q.DocIDs {
+			inDocs[id] = true
+		}
+	}
+	include := func(docId string) bool {
+		return inDocs == nil || inDocs[docId]
+	}
+
+	stats := &IndexStats{
+		Docs: DocStats{
+			ByMimeType: map[string]int64{},
+			ByState:    map[string]int64{},
+		},
+	}
+	for _, r := range m.docReferences {
+		if !include(r.ID) {
+			continue
+		}
+		stats.Docs.Total++
+		stats.Docs.ByMimeType[r.MimeType]++
+		stats.Docs.ByState[docState(r)]++
+	}
+
+	linked := map[string]*LinkedDoc{}
+	sources := map[string]map[string]bool{}
+	for _, l := range m.docLinks {
+		if !include(l.SourceID) {
+			continue
+		}
+		stats.Links.Total++
+		if l.DestID == "" {
+			stats.Links.External++
+			continue
+		}
+		stats.Links.Internal++
+		r, ok := m.docReferences[l.DestID]
+		if !ok {
+			stats.Links.Dangling++
+			continue
+		}
+		stats.Links.Resolved++
+
+		if l.SourceID == l.DestID || !include(l.DestID) {
+			continue
+		}
+		doc, ok := linked[l.DestID]
+		if !ok {
+			doc = &LinkedDoc{DocID: l.DestID, Name: r.Name}
+			linked[l.DestID] = doc
+			sources[l.DestID] = map[string]bool{}
+		}
+		doc.NumLinks++
+		sources[l.DestID][l.SourceID] = true
+	}
+
+	stats.TopLinkedDocs = make([]*LinkedDoc, 0, len(linked))
+	for id, doc := range linked {
+		doc.NumSources = int64(len(sources[id]))
+		stats.TopLinkedDocs = append(stats.TopLinkedDocs, doc)
+	}
+	sort.Slice(stats.TopLinkedDocs, func(i, j int) bool {
+		a, b := stats.TopLinkedDocs[i], stats.TopLinkedDocs[j]
+		if a.NumLinks != b.NumLinks {
+			return a.NumLinks > b.NumLinks
+		}
+		return a.DocID < b.DocID
+	})
+
+	stats.Unlinked = make([]*LinkedDoc, 0, 0)
+	for _, r := range m.docReferences {
+		if !include(r.ID) || linked[r.ID] != nil {
+			continue
+		}
+		stats.Unlinked = append(stats.Unlinked, &LinkedDoc{DocID: r.ID, Name: r.Name})
+	}
+	sort.Slice(stats.Unlinked, func(i, j int) bool {
+		return stats.Unlinked[i].DocID < stats.Unlinked[j].DocID
+	})
+	stats.Docs.NumUnlinked = int64(len(stats.Unlinked))
+
+	counts := map[string]*EntityCount{}
+	docs := map[string]map[string]bool{}
+	for _, e := range m.entityMentions {
+		if !include(e.DocID) {
+			continue
+		}
+		c, ok := counts[e.EntityID]
+		if !ok {
+			c = &EntityCount{EntityID: e.EntityID}
+			if entity, ok := m.entities[e.EntityID]; ok {
+				c.Name = entity.Name
+				c.Type = entity.Type
+			}
+			counts[e.EntityID] = c
+			docs[e.EntityID] = map[string]bool{}
+		}
+		c.NumMentions++
+		docs[e.EntityID][e.DocID] = true
+	}
+
+	stats.TopEntities = make([]*EntityCount, 0, len(counts))
+	for id, c := range counts {
+		c.NumDocuments = int64(len(docs[id]))
+		stats.TopEntities = append(stats.TopEntities, c)
+	}
+	sort.Slice(stats.TopEntities, func(i, j int) bool {
+		a, b := stats.TopEntities[i], stats.TopEntities[j]
+		if a.NumMentions != b.NumMentions {
+			return a.NumMentions > b.NumMentions
+		}
+		return a.EntityID < b.EntityID
+	})
+
+	if q.Limit > 0 {
+		if len(stats.TopEntities) > q.Limit {
+			stats.TopEntities = stats.TopEntities[:q.Limit]
+		}
+		if len(stats.TopLinkedDocs) > q.Limit {
+			stats.TopLinkedDocs = stats.TopLinkedDocs[:q.Limit]
+		}
+		if len(stats.Unlinked) > q.Limit {
+			stats.Unlinked = stats.Unlinked[:q.Limit]
+		}
+	}
+	return stats, nil
+}
+
+// WithTx runs fn with m. If fn returns an error the changes made while it ran are rolled back.
+//
+// Rolling back restores a copy of the data taken before fn ran so it also discards changes made concurrently by
+// other goroutines. This is fine for tests which is what MemoryStore is intended for.
+func (m *MemoryStore) WithTx(fn func(tx Store) error) error {
+	m.mu.Lock()
+	snapshot := m.clone()
+	m.mu.Unlock()
+
+	if err := fn(m); err != nil {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.restore(snapshot)
+		return err
+	}
+	return nil
+}
+
+// clone returns a copy of the store. m.mu must be held.
+func (m *MemoryStore) clone() *MemoryStore {
+	c := NewMemoryStore(m.log)
+	for k, v := range m.docReferences {
+		r := *v
+		c.docReferences[k] = &r
+	}
+	for k, v := range m.docLinks {
+		r := *v
+		c.docLinks[k] = &r
+	}
+	for k, v := range m.entities {
+		r := *v
+		c.entities[k] = &r
+	}
+	for k, v := range m.entityMentions {
+		r := *v
+		c.entityMentions[k] = &r
+	}
+	for k, v := range m.nlpResponses {
+		r := *v
+		c.nlpResponses[k] = &r
+	}
+	for k, v := range m.nlpUsage {
+		r := *v
+		c.nlpUsage[k] = &r
+	}
+	for k, v := range m.redactions {
+		r := *v
+		c.redactions[k] = &r
+	}
+	for k, v := range m.docCategories {
+		r := *v
+		c.docCategories[k] = &r
+	}
+	for k, v := range m.keyphrases {
+		r := *v
+		c.keyphrases[k] = &r
+	}
+	for k, v := range m.keyphraseMentions {
+		r := *v
+		c.keyphraseMentions[k] = &r
+	}
+	for k, v := range m.docKeyphrases {
+		r := *v
+		c.docKeyphrases[k] = &r
+	}
+	for k, v := range m.cooccurrences {
+		r := *v
+		c.cooccurrences[k] = &r
+	}
+	for k, v := range m.docPeople {
+		r := *v
+		c.docPeople[k] = &r
+	}
+	for k, v := range m.docPermissions {
+		r := *v
+		c.docPermissions[k] = &r
+	}
+	for k, v := range m.indexJobs {
+		r := *v
+		c.indexJobs[k] = &r
+	}
+	return c
+}
+
+// restore replaces the data with the data in s. m.mu must be held.
+func (m *MemoryStore) restore(s *MemoryStore) {
+	m.docReferences = s.docReferences
+	m.docLinks = s.docLinks
+	m.entities = s.entities
+	m.entityMentions = s.entityMentions
+	m.nlpResponses = s.nlpResponses
+	m.nlpUsage = s.nlpUsage
+	m.redactions = s.redactions
+	m.docCategories = s.docCategories
+	m.keyphrases = s.keyphrases
+	m.keyphraseMentions = s.keyphraseMentions
+	m.docKeyphrases = s.docKeyphrases
+	m.cooccurrences = s.cooccurrences
+	m.docPeople = s.docPeople
+	m.docPermissions = s.docPermissions
+	m.indexJobs = s.indexJobs
+}
+
+// UpsertDocReferences creates the DocReferences or updates them if they already exist. Either all of them are
+// stored or none are.
+func (m *MemoryStore) UpsertDocReferences(refs []*DocReference) error {
+	for _, r := range refs {
+		if err := setDocReferenceID(r); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, r := range refs {
+		var existing *time.Time
+		if current, ok := m.docReferences[r.ID]; ok {
+			existing = &current.CreatedAt
+		}
+		setTimestamps(&r.CreatedAt, &r.UpdatedAt, existing)
+
+		c := *r
+		m.docReferences[r.ID] = &c
+	}
+	return nil
+}
+
+// UpsertDocLinks creates the DocLinks or updates them if they already exist. Either all of them are stored or
+// none are.
+func (m *MemoryStore) UpsertDocLinks(links []*DocLink) error {
+	for _, l := range links {
+		if err := setDocLinkID(l); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, l := range links {
+		var existing *time.Time
+		if current, ok := m.docLinks[l.ID]; ok {
+			existing = &current.CreatedAt
+		}
+		setTimestamps(&l.CreatedAt, &l.UpdatedAt, existing)
+
+		c := *l
+		m.docLinks[l.ID] = &c
+	}
+	return nil
+}
+
+// UpsertEntityMentions creates the EntityMentions or updates them if they already exist. Either all of them are
+// stored or none are.
+func (m *MemoryStore) UpsertEntityMentions(mentions []*EntityMention) error {
+	for _, e := range mentions {
+		if err := setEntityMentionID(e); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, e := range mentions {
+		var existing *time.Time
+		if current, ok := m.entityMentions[e.ID]; ok {
+			existing = &current.CreatedAt
+		}
+		setTimestamps(&e.CreatedAt, &e.UpdatedAt, existing)
+
+		c := *e
+		m.entityMentions[e.ID] = &c
+	}
+	return nil
+}
+
+// ReplaceDocLinks replaces the links in the doc sourceId with links. Links which are no longer in the doc are
+// deleted.
+func (m *MemoryStore) ReplaceDocLinks(sourceId string, links []*DocLink) error {
+	if sourceId == "" {
+		return errors.New("sourceId must be set")
+	}
+	for _, l := range links {
+		if l.SourceID != sourceId {
+			return errors.Errorf("Link to %v has SourceID %v; want %v", l.URI, l.SourceID, sourceId)
+		}
+		if err := setDocLinkID(l); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	for id, l := range m.docLinks {
+		if l.SourceID == sourceId {
+			delete(m.docLinks, id)
+		}
+	}
+	m.mu.Unlock()
+
+	return m.UpsertDocLinks(links)
+}
+
+// ReplaceEntityMentions replaces the entity mentions in the doc with mentions. Mentions which are no longer in the
+// doc are deleted.
+func (m *MemoryStore) ReplaceEntityMentions(docId string, mentions []*EntityMention) error {
+	if docId == "" {
+		return errors.New("docId must be set")
+	}
+	for _, e := range mentions {
+		if e.DocID != docId {
+			return errors.Errorf("Mention of %v has DocID %v; want %v", e.EntityID, e.DocID, docId)
+		}
+		if err := setEntityMentionID(e); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	for id, e := range m.entityMentions {
+		if e.DocID == docId {
+			delete(m.entityMentions, id)
+		}
+	}
+	m.mu.Unlock()
+
+	return m.UpsertEntityMentions(mentions)
+}
+
+// ListRows lists all the rows of a model ordered by ID. rows is a pointer to a slice of pointers to the model e.g.
+// *[]*DocPermission.
+func (m *MemoryStore) ListRows(rows interface{}) error {
+	v := reflect.ValueOf(rows)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return errors.Errorf("rows must be a pointer to a slice of pointers to models; got %T", rows)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	table, err := m.table(v.Elem().Type().Elem())
+	if err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, table.Len())
+	for _, k := range table.MapKeys() {
+		ids = append(ids, k.String())
+	}
+	sort.Strings(ids)
+
+	list := reflect.MakeSlice(v.Elem().Type(), 0, len(ids))
+	for _, id := range ids {
+		c := reflect.New(list.Type().Elem().Elem())
+		c.Elem().Set(table.MapIndex(reflect.ValueOf(id)).Elem())
+		list = reflect.Append(list, c)
+	}
+	v.Elem().Set(list)
+	return nil
+}
+
+// UpsertRows creates the rows or updates them if they already exist. rows is a slice of pointers to a model e.g.
+// []*DocPermission; every row must have an ID.
+func (m *MemoryStore) UpsertRows(rows interface{}) error {
+	if _, err := checkRowIDs(rows); err != nil {
+		return err
+	}
+	v := reflect.ValueOf(rows)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	table, err := m.table(v.Type().Elem())
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < v.Len(); i++ {
+		row := v.Index(i).Elem()
+		id := row.FieldByName("ID")
+
+		createdAt := row.FieldByName("CreatedAt").Addr().Interface().(*time.Time)
+		updatedAt := row.FieldByName("UpdatedAt").Addr().Interface().(*time.Time)
+		var existing *time.Time
+		if current := table.MapIndex(id); current.IsValid() {
+			t := current.Elem().FieldByName("CreatedAt").Interface().(time.Time)
+			existing = &t
+		}
+		setTimestamps(createdAt, updatedAt, existing)
+
+		c := reflect.New(row.Type())
+		c.Elem().Set(row)
+		table.SetMapIndex(id, c)
+	}
+	return nil
+}
+
+// table returns the map storing the rows of model; model is a pointer to the model's type.
+func (m *MemoryStore) table(model reflect.Type) (reflect.Value, error) {
+	var table interface{}
+	switch reflect.Zero(model).Interface().(type) {
+	case *DocReference:
+		table = m.docReferences
+	case *DocLink:
+		table = m.docLinks
+	case *Entity:
+		table = m.entities
+	case *EntityMention:
+		table = m.entityMentions
+	case *NLPResponse:
+		table = m.nlpResponses
+	case *NLPUsage:
+		table = m.nlpUsage
+	case *Redaction:
+		table = m.redactions
+	case *DocCategory:
+		table = m.docCategories
+	case *Keyphrase:
+		table = m.keyphrases
+	case *KeyphraseMention:
+		table = m.keyphraseMentions
+	case *DocKeyphrase:
+		table = m.docKeyphrases
+	case *EntityCooccurrence:
+		table = m.cooccurrences
+	case *DocPerson:
+		table = m.docPeople
+	case *DocPermission:
+		table = m.docPermissions
+	case *IndexJob:
+		table = m.indexJobs
+	default:
+		return reflect.Value{}, errors.Errorf("MemoryStore doesn't store %v", model)
+	}
+	return reflect.ValueOf(table), nil
+}
+
+// Close is a no-op; the data is discarded once the store is no longer referenced.
+func (m *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,479 @@
+package datastore
+
+import (
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"sort"
+	"time"
+)
+
+// Migration is a versioned change to the schema of a SQL database.
+//
+// Migrations are applied in order of Version and each one runs in a transaction. Applied migrations are recorded in
+// the schema_version table. Once a migration is released it must not be changed; change the schema by adding a
+// migration instead. Up and Down must not use the models in models.go since those change over time; declare the
+// columns being changed in the migration as in baselineModels.
+type Migration struct {
+	// Version orders the migrations. Versions start at 1 and must be consecutive.
+	Version int
+	// Name describes the migration.
+	Name string
+	// Up applies the migration.
+	Up func(tx *gorm.DB) error
+	// Down reverts the migration. It is nil if the migration can't be reverted.
+	Down func(tx *gorm.DB) error
+}
+
+// MigrationStatus is the status of a migration in a database.
+type MigrationStatus struct {
+	Version int
+	Name    string
+	// Applied is true if the migration has been applied.
+	Applied bool
+	// AppliedAt is the time the migration was applied.
+	AppliedAt time.Time
+	// Unknown is true if the migration was applied to the database but isn't known to this binary; i.e. the
+	// database was migrated by a newer version.
+	Unknown bool
+}
+
+// migrations is the list of migrations in order of version.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "baseline",
+		Up: func(tx *gorm.DB) error {
+			// Databases created before versioned migrations already have these tables; AutoMigrate leaves them
+			// as is since the models are the same.
+			for _, m := range baselineModels() {
+				if err := tx.AutoMigrate(m); err != nil {
+					return errors.Wrapf(err, "Failed to create the table for %T", m)
+				}
+			}
+			return nil
+		},
+		// The baseline can't be rolled back since that would drop every table and all the data in it.
+		Down: nil,
+	},
+	{
+		Version: 2,
+		Name:    "encryptionKeys",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&encryptionKeyV2{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&encryptionKeyV2{})
+		},
+	},
+}
+
+// encryptionKeyV2 is the encryption_keys table created by migration 2.
+type encryptionKeyV2 struct {
+	ID        string `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Check     string
+}
+
+// TableName overrides the table name used by gorm.
+func (encryptionKeyV2) TableName() string {
+	return "encryption_keys"
+}
+
+// LatestSchemaVersion returns the version of the last migration known to this binary.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// Migrate applies the pending migrations up to and including version target. If target is 0 all pending
+// migrations are applied.
+func (d *Datastore) Migrate(target int) error {
+	return d.migrate(migrations, target)
+}
+
+// Rollback reverts the applied migrations with a version greater than target in reverse order.
+func (d *Datastore) Rollback(target int) error {
+	return d.rollback(migrations, target)
+}
+
+// SchemaVersion returns the version of the last migration applied to the database; 0 if none have been applied.
+func (d *Datastore) SchemaVersion() (int, error) {
+	applied, err := d.appliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+	if len(applied) == 0 {
+		return 0, nil
+	}
+	return applied[len(applied)-1].Version, nil
+}
+
+// MigrationStatus returns the status of the known migrations followed by any unknown migrations applied to the
+// database.
+func (d *Datastore) MigrationStatus() ([]*MigrationStatus, error) {
+	return d.migrationStatus(migrations)
+}
+
+func (d *Datastore) migrationStatus(ms []Migration) ([]*MigrationStatus, error) {
+	applied, err := d.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*AppliedMigration{}
+	for _, a := range applied {
+		byVersion[a.Version] = a
+	}
+
+	results := make([]*MigrationStatus, 0, len(ms))
+	for _, m := range ms {
+		s := &MigrationStatus{
+			Version: m.Version,
+			Name:    m.Name,
+		}
+		if a, ok := byVersion[m.Version]; ok {
+			s.Applied = true
+			s.AppliedAt = a.AppliedAt
+			delete(byVersion, m.Version)
+		}
+		results = append(results, s)
+	}
+
+	for _, a := range applied {
+		if _, ok := byVersion[a.Version]; !ok {
+			continue
+		}
+		results = append(results, &MigrationStatus{
+			Version:   a.Version,
+			Name:      a.Name,
+			Applied:   true,
+			AppliedAt: a.AppliedAt,
+			Unknown:   true,
+		})
+	}
+	return results, nil
+}
+
+func (d *Datastore) migrate(ms []Migration, target int) error {
+	if err := checkMigrations(ms); err != nil {
+		return err
+	}
+
+	latest := ms[len(ms)-1].Version
+	if target == 0 {
+		target = latest
+	}
+	if target < 0 || target > latest {
+		return errors.Errorf("Can't migrate to version %v; the latest version is %v", target, latest)
+	}
+
+	current, err := d.checkVersion(ms)
+	if err != nil {
+		return err
+	}
+
+	if current > target {
+		return errors.Errorf("Database is at version %v which is newer than %v; use rollback to revert migrations", current, target)
+	}
+
+	for _, m := range ms {
+		if m.Version <= current || m.Version > target {
+			continue
+		}
+		m := m
+		d.log.Info("Applying migration", "version", m.Version, "name", m.Name)
+		err := d.db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&AppliedMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return errors.Wrapf(err, "Failed to apply migration %v %v", m.Version, m.Name)
+		}
+	}
+	return nil
+}
+
+func (d *Datastore) rollback(ms []Migration, target int) error {
+	if err := checkMigrations(ms); err != nil {
+		return err
+	}
+
+	if target < 0 {
+		return errors.Errorf("Can't roll back to version %v; target must be >= 0", target)
+	}
+
+	current, err := d.checkVersion(ms)
+	if err != nil {
+		return err
+	}
+
+	// Check all the migrations can be reverted before reverting any so a rollback is never left half done.
+	for _, m := range ms {
+		if m.Version > current || m.Version <= target {
+			continue
+		}
+		if m.Down == nil {
+			return errors.Errorf("Migration %v %v can't be rolled back; can't roll back past version %v", m.Version, m.Name, m.Version)
+		}
+	}
+
+	for i := len(ms) - 1; i >= 0; i-- {
+		m := ms[i]
+		if m.Version > current || m.Version <= target {
+			continue
+		}
+		d.log.Info("Rolling back migration", "version", m.Version, "name", m.Name)
+		err := d.db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&AppliedMigration{}, m.Version).Error
+		})
+		if err != nil {
+			return errors.Wrapf(err, "Failed to roll back migration %v %v", m.Version, m.Name)
+		}
+	}
+	return nil
+}
+
+// checkVersion returns the current version of the database. An error is returned if the database has migrations
+// which aren't in ms since this binary doesn't know how to handle them.
+func (d *Datastore) checkVersion(ms []Migration) (int, error) {
+	current, err := d.SchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+
+	if latest := ms[len(ms)-1].Version; current > latest {
+		return 0, errors.Errorf("Database is at schema version %v but this binary only supports up to version %v; upgrade p22h", current, latest)
+	}
+	return current, nil
+}
+
+// appliedMigrations returns the migrations applied to the database in order of version. The schema_version table
+// is created if it doesn't exist.
+func (d *Datastore) appliedMigrations() ([]*AppliedMigration, error) {
+	if err := d.db.AutoMigrate(&AppliedMigration{}); err != nil {
+		return nil, errors.Wrapf(err, "Failed to create the schema_version table")
+	}
+
+	applied := []*AppliedMigration{}
+	if err := d.db.Order("version").Find(&applied).Error; err != nil {
+		return nil, errors.Wrapf(err, "Failed to list the applied migrations")
+	}
+	return applied, nil
+}
+
+// checkMigrations verifies the versions are consecutive starting at 1.
+func checkMigrations(ms []Migration) error {
+	if len(ms) == 0 {
+		return errors.New("There are no migrations")
+	}
+	if !sort.SliceIsSorted(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version }) {
+		return errors.New("Migrations aren't sorted by version")
+	}
+	for i, m := range ms {
+		if m.Version != i+1 {
+			return errors.Errorf("Migration %v has version %v; want %v", m.Name, m.Version, i+1)
+		}
+		if m.Up == nil {
+			return errors.Errorf("Migration %v %v is missing Up", m.Version, m.Name)
+		}
+	}
+	return nil
+}
+
+// baselineModels returns the models as they were when versioned migrations were introduced. They are copies of
+// the models in models.go so that migration 1 creates the same schema regardless of later changes to the models.
+// The types have the same names as the models so gorm uses the same table, column and index names.
+func baselineModels() []interface{} {
+	type DocReference struct {
+		ID                     string `gorm:"primarykey"`
+		CreatedAt              time.Time
+		UpdatedAt              time.Time
+		DeletedAt              gorm.DeletedAt `gorm:"index"`
+		DriveId                string         `gorm:"index:uid,unique"`
+		Name                   string
+		MimeType               string
+		Md5Checksum            string
+		LastIndexedMd5Checksum string
+		ModifiedTime           time.Time `gorm:"index"`
+		FileCreatedTime        time.Time
+	}
+
+	type DocLink struct {
+		ID         string `gorm:"primarykey"`
+		CreatedAt  time.Time
+		UpdatedAt  time.Time
+		DeletedAt  gorm.DeletedAt `gorm:"index"`
+		SourceID   string         `gorm:"index"`
+		DestID     string         `gorm:"index"`
+		URI        string
+		Text       string
+		StartIndex int64
+		EndIndex   int64
+	}
+
+	type Entity struct {
+		ID           string `gorm:"primarykey"`
+		CreatedAt    time.Time
+		UpdatedAt    time.Time
+		DeletedAt    gorm.DeletedAt `gorm:"index"`
+		Name         string
+		Type         string
+		WikipediaUrl string
+		MID          string `gorm:"column:mid"`
+		Email        string `gorm:"index"`
+	}
+
+	type EntityMention struct {
+		ID                 string `gorm:"primarykey"`
+		CreatedAt          time.Time
+		UpdatedAt          time.Time
+		DeletedAt          gorm.DeletedAt `gorm:"index"`
+		DocID              string         `gorm:"index"`
+		EntityID           string
+		Text               string
+		StartIndex         int64
+		EndIndex           int64
+		Type               string
+		Salience           float32
+		SentimentScore     float32
+		SentimentMagnitude float32
+		Sentence           int64
+	}
+
+	type NLPResponse struct {
+		ID            string `gorm:"primarykey"`
+		CreatedAt     time.Time
+		UpdatedAt     time.Time
+		DeletedAt     gorm.DeletedAt `gorm:"index"`
+		Method        string         `gorm:"index"`
+		Response      []byte
+		NumCharacters int64
+		Hits          int64
+	}
+
+	type NLPUsage struct {
+		ID            string `gorm:"primarykey"`
+		CreatedAt     time.Time
+		UpdatedAt     time.Time
+		DeletedAt     gorm.DeletedAt `gorm:"index"`
+		RunID         string         `gorm:"index"`
+		Day           string         `gorm:"index"`
+		DriveID       string
+		Method        string
+		Requests      int64
+		NumCharacters int64
+		Units         int64
+	}
+
+	type Redaction struct {
+		ID         string `gorm:"primarykey"`
+		CreatedAt  time.Time
+		UpdatedAt  time.Time
+		DeletedAt  gorm.DeletedAt `gorm:"index"`
+		DocID      string         `gorm:"index"`
+		Rule       string
+		StartIndex int64
+		EndIndex   int64
+	}
+
+	type DocCategory struct {
+		ID         string `gorm:"primarykey"`
+		CreatedAt  time.Time
+		UpdatedAt  time.Time
+		DeletedAt  gorm.DeletedAt `gorm:"index"`
+		DocID      string         `gorm:"index"`
+		Category   string         `gorm:"index"`
+		Confidence float32
+	}
+
+	type Keyphrase struct {
+		ID                       string `gorm:"primarykey"`
+		CreatedAt                time.Time
+		UpdatedAt                time.Time
+		DeletedAt                gorm.DeletedAt `gorm:"index"`
+		DocumentFrequency        int64
+		InverseDocumentFrequency float64
+	}
+
+	type KeyphraseMention struct {
+		ID          string `gorm:"primarykey"`
+		CreatedAt   time.Time
+		UpdatedAt   time.Time
+		DeletedAt   gorm.DeletedAt `gorm:"index"`
+		DocID       string         `gorm:"index"`
+		KeyphraseID string         `gorm:"index"`
+		Text        string
+		StartIndex  int64
+		EndIndex    int64
+	}
+
+	type DocKeyphrase struct {
+		ID          string `gorm:"primarykey"`
+		CreatedAt   time.Time
+		UpdatedAt   time.Time
+		DeletedAt   gorm.DeletedAt `gorm:"index"`
+		DocID       string         `gorm:"index"`
+		KeyphraseID string         `gorm:"index"`
+		NumMentions int64
+		Weight      float64 `gorm:"index"`
+	}
+
+	type EntityCooccurrence struct {
+		ID           string `gorm:"primarykey"`
+		CreatedAt    time.Time
+		UpdatedAt    time.Time
+		DeletedAt    gorm.DeletedAt `gorm:"index"`
+		EntityID     string         `gorm:"index"`
+		RelatedID    string
+		NumDocuments int64
+		NumSentences int64
+	}
+
+	type DocPerson struct {
+		ID        string `gorm:"primarykey"`
+		CreatedAt time.Time
+		UpdatedAt time.Time
+		DeletedAt gorm.DeletedAt `gorm:"index"`
+		DocID     string         `gorm:"index"`
+		EntityID  string         `gorm:"index"`
+		Role      string
+	}
+
+	type DocPermission struct {
+		ID        string `gorm:"primarykey"`
+		CreatedAt time.Time
+		UpdatedAt time.Time
+		DeletedAt gorm.DeletedAt `gorm:"index"`
+		DocID     string         `gorm:"index"`
+		Type      string         `gorm:"index:principal"`
+		Principal string         `gorm:"index:principal"`
+		Role      string
+	}
+
+	type IndexJob struct {
+		ID            string    `gorm:"primarykey"`
+		CreatedAt     time.Time `gorm:"index"`
+		UpdatedAt     time.Time
+		DeletedAt     gorm.DeletedAt `gorm:"index"`
+		DriveID       string
+		FileID        string
+		State         string `gorm:"index"`
+		Caller        string
+		DocsTotal     int64
+		DocsProcessed int64
+		Error         string
+		StartTime     time.Time
+		EndTime       time.Time
+	}
+
+	return []interface{}{
+		&DocReference{}, &DocLink{}, &Entity{}, &EntityMention{}, &NLPResponse{}, &NLPUsage{}, &Redaction{},
+		&DocCategory{}, &Keyphrase{}, &KeyphraseMention{}, &DocKeyphrase{}, &EntityCooccurrence{}, &DocPerson{},
+		&DocPermission{}, &IndexJob{},
+	}
+}
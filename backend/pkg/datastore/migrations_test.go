@@ -0,0 +1,223 @@
+package datastore
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"gorm.io/gorm"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func Test_Migrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testMigrations")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+
+	log, err := logging.InitLogger("info", true)
+	if err != nil {
+		t.Fatalf("Failed to initialize logger; %v", err)
+	}
+
+	dbFile := path.Join(dir, "database.db")
+	db, err := New(dbFile, *log)
+	if err != nil {
+		t.Fatalf("Failed to create datastore; error %v", err)
+	}
+	defer db.Close()
+
+	if version, err := db.SchemaVersion(); err != nil || version != LatestSchemaVersion() {
+		t.Fatalf("SchemaVersion returned %v, %v; want %v", version, err, LatestSchemaVersion())
+	}
+
+	if err := db.UpdateDocReference(&DocReference{DriveId: "doc1", Name: "Doc 1"}); err != nil {
+		t.Fatalf("Failed to create doc; error %v", err)
+	}
+
+	// A test migration which adds a column and backfills it.
+	type DocReference struct {
+		ID    string `gorm:"primarykey"`
+		Name  string
+		Upper string
+	}
+	ms := append([]Migration{}, migrations...)
+	ms = append(ms, Migration{
+		Version: len(ms) + 1,
+		Name:    "addUpper",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Migrator().AddColumn(&DocReference{}, "Upper"); err != nil {
+				return err
+			}
+			return tx.Exec("update doc_references set upper = upper(name)").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&DocReference{}, "Upper")
+		},
+	})
+	last := ms[len(ms)-1].Version
+
+	if err := db.migrate(ms, 0); err != nil {
+		t.Fatalf("Failed to migrate; error %v", err)
+	}
+
+	rows := []*DocReference{}
+	if err := db.db.Find(&rows).Error; err != nil {
+		t.Fatalf("Failed to list docs; error %v", err)
+	}
+	if len(rows) != 1 || rows[0].Upper != "DOC 1" {
+		t.Errorf("Migration didn't backfill the column; got %+v", rows)
+	}
+
+	status, err := db.migrationStatus(ms)
+	if err != nil {
+		t.Fatalf("Failed to get migration status; error %v", err)
+	}
+	expected := []*MigrationStatus{}
+	for _, m := range ms {
+		expected = append(expected, &MigrationStatus{Version: m.Version, Name: m.Name, Applied: true})
+	}
+	if d := cmp.Diff(expected, status, cmpopts.IgnoreFields(MigrationStatus{}, "AppliedAt")); d != "" {
+		t.Errorf("Unexpected status; diff:\n%v", d)
+	}
+
+	// This binary doesn't know about the test migration so it should refuse to migrate the database.
+	if err := db.Migrate(0); err == nil {
+		t.Errorf("Migrate succeeded on a database with an unknown migration; want error")
+	}
+	status, err = db.MigrationStatus()
+	if err != nil {
+		t.Fatalf("Failed to get migration status; error %v", err)
+	}
+	if len(status) != len(ms) || !status[len(ms)-1].Unknown {
+		t.Errorf("MigrationStatus didn't report the unknown migration; got %+v", status)
+	}
+
+	if err := db.rollback(ms, last-1); err != nil {
+		t.Fatalf("Failed to roll back; error %v", err)
+	}
+	if db.db.Migrator().HasColumn(&DocReference{}, "Upper") {
+		t.Errorf("Rollback didn't drop the column")
+	}
+	if version, err := db.SchemaVersion(); err != nil || version != last-1 {
+		t.Errorf("SchemaVersion returned %v, %v; want %v", version, err, last-1)
+	}
+
+	// Data is preserved.
+	docs, err := db.ListDocReferences()
+	if err != nil {
+		t.Fatalf("Failed to list docs; error %v", err)
+	}
+	if len(docs) != 1 || docs[0].Name != "Doc 1" {
+		t.Errorf("Docs weren't preserved; got %+v", docs)
+	}
+
+	// The baseline can't be rolled back and nothing is reverted when the rollback would go past it.
+	before, err := db.SchemaVersion()
+	if err != nil {
+		t.Fatalf("Failed to get the schema version; error %v", err)
+	}
+	if err := db.rollback(ms, 0); err == nil {
+		t.Errorf("Rolling back the baseline should fail")
+	}
+	if !db.db.Migrator().HasTable(&DocReference{}) {
+		t.Errorf("Rolling back the baseline dropped the tables")
+	}
+	if version, err := db.SchemaVersion(); err != nil || version != before {
+		t.Errorf("SchemaVersion returned %v, %v; want %v", version, err, before)
+	}
+}
+
+func Test_MigrateExistingDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testMigrations")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+
+	log, err := logging.InitLogger("info", true)
+	if err != nil {
+		t.Fatalf("Failed to initialize logger; %v", err)
+	}
+
+	// Create a database the way it was created before versioned migrations i.e. with AutoMigrate and no
+	// schema_version table.
+	dbFile := path.Join(dir, "database.db")
+	db, err := New(dbFile, *log, DatastoreWithoutMigrations())
+	if err != nil {
+		t.Fatalf("Failed to create datastore; error %v", err)
+	}
+
+	if version, err := db.SchemaVersion(); err != nil || version != 0 {
+		t.Fatalf("SchemaVersion returned %v, %v; want 0", version, err)
+	}
+
+	if err := db.db.AutoMigrate(&DocReference{}, &DocLink{}, &Entity{}); err != nil {
+		t.Fatalf("Failed to create the tables; error %v", err)
+	}
+
+	if err := db.UpdateDocReference(&DocReference{DriveId: "doc1", Name: "Doc 1"}); err != nil {
+		t.Fatalf("Failed to create doc; error %v", err)
+	}
+	db.Close()
+
+	db, err = New(dbFile, *log)
+	if err != nil {
+		t.Fatalf("Failed to open datastore; error %v", err)
+	}
+	defer db.Close()
+
+	if version, err := db.SchemaVersion(); err != nil || version != LatestSchemaVersion() {
+		t.Errorf("SchemaVersion returned %v, %v; want %v", version, err, LatestSchemaVersion())
+	}
+
+	docs, err := db.ListDocReferences()
+	if err != nil {
+		t.Fatalf("Failed to list docs; error %v", err)
+	}
+	if len(docs) != 1 || docs[0].Name != "Doc 1" {
+		t.Errorf("Docs weren't preserved; got %+v", docs)
+	}
+}
+
+// Test_MigrationsMatchModels verifies the schema created by the migrations is the schema gorm expects for the
+// models. If it fails, add a migration for the change to the models.
+func Test_MigrationsMatchModels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testMigrations")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+
+	log, err := logging.InitLogger("info", true)
+	if err != nil {
+		t.Fatalf("Failed to initialize logger; %v", err)
+	}
+
+	db, err := New(path.Join(dir, "database.db"), *log)
+	if err != nil {
+		t.Fatalf("Failed to create datastore; error %v", err)
+	}
+	defer db.Close()
+
+	schema := func() []string {
+		rows := []string{}
+		if err := db.db.Raw("select sql from sqlite_master where sql is not null order by name").Scan(&rows).Error; err != nil {
+			t.Fatalf("Failed to read the schema; error %v", err)
+		}
+		return rows
+	}
+
+	expected := schema()
+	models := []interface{}{
+		&DocReference{}, &DocLink{}, &Entity{}, &EntityMention{}, &NLPResponse{}, &NLPUsage{}, &Redaction{},
+		&DocCategory{}, &Keyphrase{}, &KeyphraseMention{}, &DocKeyphrase{}, &EntityCooccurrence{}, &DocPerson{},
+		&DocPermission{}, &IndexJob{}, &EncryptionKey{},
+	}
+	if err := db.db.AutoMigrate(models...); err != nil {
+		t.Fatalf("Failed to automigrate the models; error %v", err)
+	}
+
+	if d := cmp.Diff(expected, schema()); d != "" {
+		t.Errorf("The models don't match the schema created by the migrations; diff:\n%v", d)
+	}
+}
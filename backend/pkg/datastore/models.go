@@ -29,6 +29,12 @@ type DocReference struct {
 
 	// LastIndexedMd5Checksum is the checksum at which it was last indexed
 	LastIndexedMd5Checksum string
+
+	// ModifiedTime is the time the file was last modified according to Drive. It is the zero time if unknown.
+	ModifiedTime time.Time `gorm:"index"`
+	// FileCreatedTime is the time the file was created according to Drive. It is the zero time if unknown.
+	// It is named FileCreatedTime to avoid confusion with CreatedAt which is when the row was created.
+	FileCreatedTime time.Time
 }
 
 // DocLink is a directional link between two docs.
@@ -93,6 +99,19 @@ type EntityMention struct {
 	StartIndex int64
 	// EndIndex of the text for the link.
 	EndIndex int64
+
+	// Type of the mention; PROPER or COMMON.
+	Type string
+	// Salience of the entity in the doc. It is in the range [0, 1]; higher values mean the entity is more central
+	// to the doc. All mentions of an entity in a doc have the same salience.
+	Salience float32
+	// SentimentScore of the mention in the range [-1, 1]. Only set if sentiment analysis was enabled.
+	SentimentScore float32
+	// SentimentMagnitude is the strength of the sentiment of the mention. Only set if sentiment analysis was enabled.
+	SentimentMagnitude float32
+	// Sentence is the 1 based number of the sentence in the doc containing the mention. 0 means unknown e.g. the
+	// mention was indexed before sentences were tracked.
+	Sentence int64
 }
 
 // Entity is a unique entity.
@@ -113,4 +132,241 @@ type Entity struct {
 
 	// MID is the Google Knowledge Graph MID if there is one
 	MID string `gorm:"column:mid"`
+
+	// Email is only set for people known to Google Drive e.g. owners and editors of files. The ID of these
+	// entities is derived from the email; see PersonKey.
+	Email string `gorm:"index"`
+}
+
+// NLPResponse is a cached response from the Google Cloud Natural Language API.
+//
+// Responses are cached so that reindexing content which hasn't changed doesn't incur the cost of calling the API
+// again.
+type NLPResponse struct {
+	// ID is the cache key. It is a hash of the method and the request; see glanguage.CacheKey.
+	ID        string `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+
+	// Method is the name of the API method e.g. AnalyzeEntities
+	Method string `gorm:"index"`
+
+	// Response is the serialized response proto.
+	Response []byte
+
+	// NumCharacters is the number of characters of text in the request.
+	NumCharacters int64
+
+	// Hits is the number of times the response was served from the cache.
+	Hits int64
+}
+
+// NLPUsage counts the usage of the Google Cloud Natural Language API.
+//
+// There is one row for each combination of indexing run, day, drive and method. Cumulative usage is computed
+// by summing the rows.
+type NLPUsage struct {
+	// The unique id follows the convention runId.day.driveId.method; see NLPUsageKey.
+	ID        string `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+
+	// RunID identifies the indexing run that used the API.
+	RunID string `gorm:"index"`
+	// Day is the UTC date in the form YYYY-MM-DD.
+	Day string `gorm:"index"`
+	// DriveID is the id of the drive being indexed.
+	DriveID string
+	// Method is the name of the API method e.g. AnalyzeEntities
+	Method string
+
+	// Requests is the number of requests.
+	Requests int64
+	// NumCharacters is the number of characters of text sent to the API.
+	NumCharacters int64
+	// Units is the number of billing units.
+	Units int64
+}
+
+// Redaction is an audit record that text in a document was masked before being sent to an external service.
+//
+// The masked text itself is deliberately not stored.
+type Redaction struct {
+	// The unique id follows the convention docId-startIndex-endIndex; see RedactionKey.
+	ID        string `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+	// DocID is the id of the doc
+	DocID string `gorm:"index"`
+	// Rule is the name of the rule that matched the text.
+	Rule string
+	// StartIndex of the masked text.
+	StartIndex int64
+	// EndIndex of the masked text.
+	EndIndex int64
+}
+
+// DocCategory is a content category assigned to a document by the NL API.
+// See https://cloud.google.com/natural-language/docs/categories.
+type DocCategory struct {
+	// The unique id follows the convention docId-category; see DocCategoryKey.
+	ID        string `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+	// DocID is the id of the doc
+	DocID string `gorm:"index"`
+	// Category is the name of the category e.g. "/Computers & Electronics/Software".
+	Category string `gorm:"index"`
+	// Confidence of the classifier that the category represents the document in the range [0, 1].
+	Confidence float32
+}
+
+// Keyphrase is a noun phrase e.g. "feature store" found by chunking the output of AnalyzeSyntax.
+//
+// Keyphrases are a separate kind from Entity; they capture concepts the NL API doesn't recognize as entities.
+type Keyphrase struct {
+	// The unique id is the normalized phrase; see KeyphraseKey.
+	ID        string `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+	// DocumentFrequency is the number of documents mentioning the keyphrase.
+	DocumentFrequency int64
+	// InverseDocumentFrequency of the keyphrase across the corpus; see UpdateKeyphraseWeights.
+	InverseDocumentFrequency float64
+}
+
+// KeyphraseMention is the mention of a keyphrase in a doc.
+type KeyphraseMention struct {
+	// The unique id follows the convention docId-keyphraseId-startIndex; see KeyphraseMentionKey.
+	ID          string `gorm:"primarykey"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	DeletedAt   gorm.DeletedAt `gorm:"index"`
+	DocID       string         `gorm:"index"`
+	KeyphraseID string         `gorm:"index"`
+	// Text is the phrase as it appears in the doc.
+	Text       string
+	StartIndex int64
+	EndIndex   int64
+}
+
+// DocKeyphrase is the TF-IDF weight of a keyphrase in a doc.
+// These are derived from KeyphraseMention and Keyphrase; see UpdateKeyphraseWeights.
+type DocKeyphrase struct {
+	// The unique id follows the convention docId-keyphraseId; see DocKeyphraseKey.
+	ID          string `gorm:"primarykey"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	DeletedAt   gorm.DeletedAt `gorm:"index"`
+	DocID       string         `gorm:"index"`
+	KeyphraseID string         `gorm:"index"`
+	// NumMentions is the number of mentions of the keyphrase in the doc.
+	NumMentions int64
+	// Weight is the TF-IDF weight of the keyphrase in the doc.
+	Weight float64 `gorm:"index"`
+}
+
+// EntityCooccurrence counts how often two entities are mentioned together.
+// These are derived from EntityMention; see UpdateEntityCooccurrences. Each pair is stored in both directions so
+// the related entities of an entity can be looked up by EntityID.
+type EntityCooccurrence struct {
+	// The unique id follows the convention entityId-relatedId; see EntityCooccurrenceKey.
+	ID        string `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+	EntityID  string         `gorm:"index"`
+	RelatedID string
+	// NumDocuments is the number of docs mentioning both entities.
+	NumDocuments int64
+	// NumSentences is the number of sentences mentioning both entities.
+	NumSentences int64
+}
+
+// DocPerson is the relationship between a doc and a person known to Google Drive e.g. an owner or editor.
+type DocPerson struct {
+	// The unique id follows the convention docId-entityId-role; see DocPersonKey.
+	ID        string `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+	DocID     string         `gorm:"index"`
+	// EntityID is the id of the person entity.
+	EntityID string `gorm:"index"`
+	// Role is the relationship of the person to the doc; either RoleOwner, RoleLastModifier or the Drive permission
+	// role e.g. writer, commenter or reader.
+	Role string
+}
+
+// DocPermission is a principal that can read a doc according to its Drive ACL.
+type DocPermission struct {
+	// The unique id follows the convention docId-type-principal; see DocPermissionKey.
+	ID        string `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+	DocID     string         `gorm:"index"`
+	// Type of the principal; one of PrincipalUser, PrincipalGroup, PrincipalDomain or PrincipalAnyone.
+	Type string `gorm:"index:principal"`
+	// Principal is the email of a user or group, the domain for domain permissions and empty for anyone.
+	Principal string `gorm:"index:principal"`
+	// Role is the Drive permission role e.g. reader or writer.
+	Role string
+}
+
+// IndexJob is a run of the indexer started through the API.
+type IndexJob struct {
+	// ID is a UUID assigned when the job is created.
+	ID        string    `gorm:"primarykey"`
+	CreatedAt time.Time `gorm:"index"`
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+	// DriveID is the drive to index. Only one of DriveID and FileID is set.
+	DriveID string
+	// FileID is the file to index.
+	FileID string
+	// State is one of JobPending, JobRunning, JobSucceeded, JobFailed or JobCancelled.
+	State string `gorm:"index"`
+	// Caller is the email of the user who started the job if known.
+	Caller string
+	// DocsTotal is the number of docs that need to be processed.
+	DocsTotal int64
+	// DocsProcessed is the number of docs processed so far.
+	DocsProcessed int64
+	// Error is the error the job failed with.
+	Error     string
+	StartTime time.Time
+	EndTime   time.Time
+}
+
+// AppliedMigration records a migration applied to the database; see Migration.
+type AppliedMigration struct {
+	Version   int `gorm:"primarykey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// TableName overrides the table name used by gorm.
+func (AppliedMigration) TableName() string {
+	return "schema_version"
+}
+
+// EncryptionKey records that the sensitive columns of the database are encrypted; see DatastoreWithEncryptionKey.
+// There is at most one row. The key itself is never stored.
+type EncryptionKey struct {
+	ID        string `gorm:"primarykey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// Check is a known value encrypted with the key. It is used to detect opening the database with the wrong key.
+	Check string
+}
+
+// TableName overrides the table name used by gorm.
+func (EncryptionKey) TableName() string {
+	return "encryption_keys"
 }
@@ -0,0 +1,100 @@
+package datastore
+
+import (
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"time"
+)
+
+// NLPCacheStats are statistics about the cached responses for a given method.
+type NLPCacheStats struct {
+	Method string
+	// Count is the number of cached responses.
+	Count int64
+	// Bytes is the total size of the cached responses.
+	Bytes int64
+	// NumCharacters is the number of characters of text in the requests.
+	NumCharacters int64
+	// Hits is the number of times responses were served from the cache.
+	Hits int64
+}
+
+// GetNLPResponse returns the cached response with the given key. It returns nil if there is no cached response.
+// Each call that finds a response increments the number of hits for that response.
+func (d *Datastore) GetNLPResponse(key string) ([]byte, error) {
+	db := d.db
+	current := &NLPResponse{}
+	result := db.Where("id = ?", key).Limit(1).Find(current)
+
+	if result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to get NLPResponse ID: %v", key)
+	}
+
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	if result := db.Model(current).UpdateColumn("hits", gorm.Expr("hits + ?", 1)); result.Error != nil {
+		d.log.Error(result.Error, "Failed to update hits for NLPResponse", "id", key)
+	}
+	return current.Response, nil
+}
+
+// PutNLPResponse updates or creates the cached response.
+func (d *Datastore) PutNLPResponse(key string, method string, numCharacters int64, response []byte) error {
+	if key == "" {
+		return errors.New("key must be set")
+	}
+
+	log := d.log.WithValues("id", key, "method", method)
+	r := &NLPResponse{
+		ID:            key,
+		Method:        method,
+		Response:      response,
+		NumCharacters: numCharacters,
+	}
+
+	log.V(logging.Debug).Info("Updating record")
+	if result := d.db.Save(r); result.Error != nil {
+		return errors.Wrapf(result.Error, "Failed to update NLPResponse ID: %v", key)
+	}
+	return nil
+}
+
+// GetNLPCacheStats returns statistics about the cache broken down by method.
+func (d *Datastore) GetNLPCacheStats() ([]*NLPCacheStats, error) {
+	stats := make([]*NLPCacheStats, 0, 0)
+	result := d.db.Model(&NLPResponse{}).
+		Select("method, count(*) as count, coalesce(sum(length(response)), 0) as bytes, coalesce(sum(num_characters), 0) as num_characters, coalesce(sum(hits), 0) as hits").
+		Group("method").
+		Order("method").
+		Scan(&stats)
+
+	if result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to compute NLP cache statistics")
+	}
+	return stats, nil
+}
+
+// PurgeNLPCache permanently deletes cached responses. It returns the number of responses deleted.
+// method is optional; if supplied only responses for that method are deleted.
+// olderThan is optional; if supplied only responses last updated before that time are deleted.
+func (d *Datastore) PurgeNLPCache(method string, olderThan time.Time) (int64, error) {
+	// Use Unscoped so the rows are actually deleted rather than soft deleted.
+	db := d.db.Unscoped().Where("1 = 1")
+
+	if method != "" {
+		db = db.Where("method = ?", method)
+	}
+
+	if !olderThan.IsZero() {
+		db = db.Where("updated_at < ?", olderThan)
+	}
+
+	result := db.Delete(&NLPResponse{})
+	if result.Error != nil {
+		return 0, errors.Wrapf(result.Error, "Failed to purge NLP cache")
+	}
+	return result.RowsAffected, nil
+}
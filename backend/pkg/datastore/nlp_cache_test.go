@@ -0,0 +1,95 @@
+package datastore
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+)
+
+func Test_NLPCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testDatabase")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+
+	dbFile := path.Join(dir, "database.db")
+
+	log, _ := logging.InitLogger("info", true)
+	db, err := New(dbFile, *log)
+
+	if err != nil {
+		t.Fatalf("Failed to create database; error %v", err)
+	}
+
+	if b, err := db.GetNLPResponse("missing"); err != nil || b != nil {
+		t.Fatalf("GetNLPResponse for missing key should return nil, nil; got %v, %v", b, err)
+	}
+
+	if err := db.PutNLPResponse("key1", "AnalyzeEntities", 10, []byte("resp1")); err != nil {
+		t.Fatalf("Failed to put response; error %v", err)
+	}
+
+	if err := db.PutNLPResponse("key2", "ClassifyText", 5, []byte("r2")); err != nil {
+		t.Fatalf("Failed to put response; error %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		b, err := db.GetNLPResponse("key1")
+		if err != nil {
+			t.Fatalf("Failed to get response; error %v", err)
+		}
+		if string(b) != "resp1" {
+			t.Errorf("Got response %v; want resp1", string(b))
+		}
+	}
+
+	stats, err := db.GetNLPCacheStats()
+	if err != nil {
+		t.Fatalf("Failed to get stats; error %v", err)
+	}
+
+	expected := []*NLPCacheStats{
+		{
+			Method:        "AnalyzeEntities",
+			Count:         1,
+			Bytes:         5,
+			NumCharacters: 10,
+			Hits:          2,
+		},
+		{
+			Method:        "ClassifyText",
+			Count:         1,
+			Bytes:         2,
+			NumCharacters: 5,
+			Hits:          0,
+		},
+	}
+
+	if d := cmp.Diff(expected, stats); d != "" {
+		t.Errorf("Did not get expected stats; diff:\n%v", d)
+	}
+
+	// Nothing should be older than an hour ago
+	num, err := db.PurgeNLPCache("", time.Now().Add(-1*time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to purge cache; error %v", err)
+	}
+	if num != 0 {
+		t.Errorf("Purge deleted %v responses; want 0", num)
+	}
+
+	num, err = db.PurgeNLPCache("AnalyzeEntities", time.Time{})
+	if err != nil {
+		t.Fatalf("Failed to purge cache; error %v", err)
+	}
+	if num != 1 {
+		t.Errorf("Purge deleted %v responses; want 1", num)
+	}
+
+	if b, err := db.GetNLPResponse("key1"); err != nil || b != nil {
+		t.Errorf("Response should have been purged; got %v, %v", b, err)
+	}
+}
@@ -0,0 +1,364 @@
+package datastore
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidArgument is returned when a list call has an invalid page token or sort order.
+var ErrInvalidArgument = errors.New("Invalid argument")
+
+// ListOptions are the pagination and sort options of the Query methods. They follow the conventions in
+// https://google.aip.dev/158 and https://google.aip.dev/132.
+//
+// Pages are computed from the sort value and ID of the last result rather than an offset so rows added or deleted
+// between calls don't cause results to be skipped or repeated.
+type ListOptions struct {
+	// PageSize is the maximum number of results to return. If it is 0 all the results are returned.
+	PageSize int `json:"-"`
+	// PageToken is the token returned by the previous call to get the next page; empty for the first page.
+	// All the other fields of the query must be the same as in the call that returned the token.
+	PageToken string `json:"-"`
+	// OrderBy is the field to sort by optionally followed by " desc" e.g. "name desc". Ties are broken by ID. If it
+	// is empty results are sorted by ID. The fields each Query method can sort by are documented on its query.
+	OrderBy string `json:"orderBy"`
+}
+
+// sortFields are the fields a kind can be sorted by.
+type sortFields struct {
+	// columns maps the name of each field, as used in OrderBy, to its column.
+	columns map[string]string
+	// value returns the value of the field of the row. It must return a string, int64, float32 or time.Time.
+	value func(row interface{}, field string) interface{}
+}
+
+// pageToken is the decoded form of a page token.
+type pageToken struct {
+	// Query is a hash of the query the token was returned for.
+	Query string `json:"q"`
+	// Value is the sort value of the last result encoded by encodeSortValue.
+	Value string `json:"v"`
+	// ID is the ID of the last result.
+	ID string `json:"id"`
+}
+
+// pager applies ListOptions to a query.
+type pager struct {
+	fields   sortFields
+	field    string
+	column   string
+	desc     bool
+	pageSize int
+	query    string
+	// after is the last result of the previous page; nil for the first page.
+	after *pageToken
+	// afterValue is the decoded sort value of after.
+	afterValue interface{}
+}
+
+// newPager validates the options. query is the query being run; its fields other than PageSize and PageToken
+// must be serialized to JSON so that tokens can't be used with a different query.
+func newPager(opts ListOptions, query interface{}, fields sortFields, zero interface{}) (*pager, error) {
+	if opts.PageSize < 0 {
+		return nil, errors.Wrapf(ErrInvalidArgument, "PageSize %v must be >= 0", opts.PageSize)
+	}
+
+	p := &pager{
+		fields:   fields,
+		field:    "id",
+		pageSize: opts.PageSize,
+	}
+
+	if opts.OrderBy != "" {
+		pieces := strings.Fields(opts.OrderBy)
+		if len(pieces) > 2 || (len(pieces) == 2 && pieces[1] != "desc" && pieces[1] != "asc") {
+			return nil, errors.Wrapf(ErrInvalidArgument, "OrderBy %q must be a field optionally followed by asc or desc", opts.OrderBy)
+		}
+		p.field = pieces[0]
+		p.desc = len(pieces) == 2 && pieces[1] == "desc"
+	}
+
+	column, ok := fields.columns[p.field]
+	if !ok {
+		return nil, errors.Wrapf(ErrInvalidArgument, "Can't sort by %v; it isn't a sortable field", p.field)
+	}
+	p.column = column
+
+	b, err := json.Marshal(query)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to serialize the query")
+	}
+	sum := sha256.Sum256(b)
+	p.query = hex.EncodeToString(sum[:8])
+
+	if opts.PageToken == "" {
+		return p, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(opts.PageToken)
+	if err != nil {
+		return nil, errors.Wrapf(ErrInvalidArgument, "PageToken is invalid")
+	}
+	token := &pageToken{}
+	if err := json.Unmarshal(raw, token); err != nil {
+		return nil, errors.Wrapf(ErrInvalidArgument, "PageToken is invalid")
+	}
+	if token.Query != p.query {
+		return nil, errors.Wrapf(ErrInvalidArgument, "PageToken was returned for a different query")
+	}
+
+	v, err := decodeSortValue(token.Value, fields.value(zero, p.field))
+	if err != nil {
+		return nil, errors.Wrapf(ErrInvalidArgument, "PageToken is invalid")
+	}
+	p.after = token
+	p.afterValue = v
+	return p, nil
+}
+
+// apply adds the conditions, sort order and limit to db.
+func (p *pager) apply(db *gorm.DB) *gorm.DB {
+	dir, op := "asc", ">"
+	if p.desc {
+		dir, op = "desc", "<"
+	}
+
+	if p.after != nil {
+		if p.column == "id" {
+			db = db.Where(fmt.Sprintf("id %v ?", op), p.after.ID)
+		} else {
+			db = db.Where(fmt.Sprintf("(%v %v ? or (%v = ? and id %v ?))", p.column, op, p.column, op), p.afterValue, p.afterValue, p.after.ID)
+		}
+	}
+
+	db = db.Order(p.column + " " + dir)
+	if p.column != "id" {
+		db = db.Order("id " + dir)
+	}
+
+	if p.pageSize > 0 {
+		// Fetch one more row to find out whether there is another page.
+		db = db.Limit(p.pageSize + 1)
+	}
+	return db
+}
+
+// less reports whether row a sorts before row b. It is the in memory equivalent of apply.
+func (p *pager) less(a interface{}, b interface{}) bool {
+	c := compareValues(p.fields.value(a, p.field), p.fields.value(b, p.field))
+	if c == 0 {
+		c = compareValues(p.fields.value(a, "id"), p.fields.value(b, "id"))
+	}
+	if p.desc {
+		return c > 0
+	}
+	return c < 0
+}
+
+// include reports whether the row sorts after the last result of the previous page.
+func (p *pager) include(row interface{}) bool {
+	if p.after == nil {
+		return true
+	}
+	c := compareValues(p.fields.value(row, p.field), p.afterValue)
+	if c == 0 {
+		c = compareValues(p.fields.value(row, "id"), p.after.ID)
+	}
+	if p.desc {
+		return c < 0
+	}
+	return c > 0
+}
+
+// page returns the number of the n sorted results, fetched by apply or filtered by include, that belong on the
+// page and the token for the next page; the token is empty if this is the last page. row returns the i'th result.
+func (p *pager) page(n int, row func(i int) interface{}) (int, string, error) {
+	if p.pageSize == 0 || n <= p.pageSize {
+		return n, "", nil
+	}
+
+	last := row(p.pageSize - 1)
+	token := &pageToken{
+		Query: p.query,
+		Value: encodeSortValue(p.fields.value(last, p.field)),
+		ID:    p.fields.value(last, "id").(string),
+	}
+	b, err := json.Marshal(token)
+	if err != nil {
+		return 0, "", errors.Wrapf(err, "Failed to serialize the page token")
+	}
+	return p.pageSize, base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// encodeSortValue encodes a value returned by sortFields.value as a string.
+func encodeSortValue(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case int64:
+		return strconv.FormatInt(t, 10)
+	case float32:
+		return strconv.FormatFloat(float64(t), 'g', -1, 32)
+	case time.Time:
+		return t.Format(time.RFC3339Nano)
+	default:
+		panic(fmt.Sprintf("Unsupported sort value type %T", v))
+	}
+}
+
+// decodeSortValue decodes a value encoded by encodeSortValue. zero is a value of the same type.
+func decodeSortValue(s string, zero interface{}) (interface{}, error) {
+	switch zero.(type) {
+	case string:
+		return s, nil
+	case int64:
+		return strconv.ParseInt(s, 10, 64)
+	case float32:
+		f, err := strconv.ParseFloat(s, 32)
+		return float32(f), err
+	case time.Time:
+		return time.Parse(time.RFC3339Nano, s)
+	default:
+		return nil, errors.Errorf("Unsupported sort value type %T", zero)
+	}
+}
+
+// compareValues returns -1, 0 or 1 if a is less than, equal to or greater than b. a and b must have the same type.
+func compareValues(a interface{}, b interface{}) int {
+	switch x := a.(type) {
+	case string:
+		y := b.(string)
+		return strings.Compare(x, y)
+	case int64:
+		y := b.(int64)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case float32:
+		y := b.(float32)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case time.Time:
+		y := b.(time.Time)
+		switch {
+		case x.Before(y):
+			return -1
+		case x.After(y):
+			return 1
+		}
+		return 0
+	default:
+		panic(fmt.Sprintf("Unsupported sort value type %T", a))
+	}
+}
+
+var docReferenceSortFields = sortFields{
+	columns: map[string]string{
+		"id":              "id",
+		"name":            "name",
+		"mimeType":        "mime_type",
+		"modifiedTime":    "modified_time",
+		"fileCreatedTime": "file_created_time",
+	},
+	value: func(row interface{}, field string) interface{} {
+		r := row.(*DocReference)
+		switch field {
+		case "name":
+			return r.Name
+		case "mimeType":
+			return r.MimeType
+		case "modifiedTime":
+			return r.ModifiedTime
+		case "fileCreatedTime":
+			return r.FileCreatedTime
+		default:
+			return r.ID
+		}
+	},
+}
+
+var docLinkSortFields = sortFields{
+	columns: map[string]string{
+		"id":         "id",
+		"sourceId":   "source_id",
+		"destId":     "dest_id",
+		"text":       "text",
+		"startIndex": "start_index",
+	},
+	value: func(row interface{}, field string) interface{} {
+		l := row.(*DocLink)
+		switch field {
+		case "sourceId":
+			return l.SourceID
+		case "destId":
+			return l.DestID
+		case "text":
+			return l.Text
+		case "startIndex":
+			return l.StartIndex
+		default:
+			return l.ID
+		}
+	},
+}
+
+var entitySortFields = sortFields{
+	columns: map[string]string{
+		"id":   "id",
+		"name": "name",
+		"type": "type",
+	},
+	value: func(row interface{}, field string) interface{} {
+		e := row.(*Entity)
+		switch field {
+		case "name":
+			return e.Name
+		case "type":
+			return e.Type
+		default:
+			return e.ID
+		}
+	},
+}
+
+var entityMentionSortFields = sortFields{
+	columns: map[string]string{
+		"id":         "id",
+		"entityId":   "entity_id",
+		"startIndex": "start_index",
+		"salience":   "salience",
+		"sentence":   "sentence",
+	},
+	value: func(row interface{}, field string) interface{} {
+		m := row.(*EntityMention)
+		switch field {
+		case "entityId":
+			return m.EntityID
+		case "startIndex":
+			return m.StartIndex
+		case "salience":
+			return m.Salience
+		case "sentence":
+			return m.Sentence
+		default:
+			return m.ID
+		}
+	},
+}
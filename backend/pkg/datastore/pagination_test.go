@@ -0,0 +1,179 @@
+package datastore
+
+import (
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
+	"testing"
+	"time"
+)
+
+func testStorePagination(t *testing.T, s Store) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	refs := make([]*DocReference, 0, 7)
+	for i := 0; i < 7; i++ {
+		mimeType := "doc"
+		if i%2 == 1 {
+			mimeType = "sheet"
+		}
+		refs = append(refs, &DocReference{
+			DriveId:  fmt.Sprintf("doc%v", i),
+			Name:     fmt.Sprintf("name%v", i%3),
+			MimeType: mimeType,
+			// Times are in reverse order of the ids.
+			ModifiedTime: start.Add(-time.Duration(i) * time.Hour),
+		})
+	}
+	if err := s.UpsertDocReferences(refs); err != nil {
+		t.Fatalf("Failed to create docs; error %v", err)
+	}
+
+	type testCase struct {
+		name     string
+		query    DocReferenceQuery
+		expected []string
+	}
+
+	cases := []testCase{
+		{
+			name:     "id",
+			query:    DocReferenceQuery{ListOptions: ListOptions{PageSize: 3}},
+			expected: []string{"doc0", "doc1", "doc2", "doc3", "doc4", "doc5", "doc6"},
+		},
+		{
+			name:  "name-desc",
+			query: DocReferenceQuery{ListOptions: ListOptions{PageSize: 2, OrderBy: "name desc"}},
+			// Ties are broken by id in the same direction.
+			expected: []string{"doc5", "doc2", "doc4", "doc1", "doc6", "doc3", "doc0"},
+		},
+		{
+			name:     "modifiedTime",
+			query:    DocReferenceQuery{ListOptions: ListOptions{PageSize: 4, OrderBy: "modifiedTime"}},
+			expected: []string{"doc6", "doc5", "doc4", "doc3", "doc2", "doc1", "doc0"},
+		},
+		{
+			name:     "filter",
+			query:    DocReferenceQuery{MimeType: "sheet", ListOptions: ListOptions{PageSize: 1, OrderBy: "name"}},
+			expected: []string{"doc3", "doc1", "doc5"},
+		},
+		{
+			name:     "ids",
+			query:    DocReferenceQuery{IDs: []string{DriveKey("doc4"), DriveKey("doc2")}},
+			expected: []string{"doc2", "doc4"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			actual := []string{}
+			q := c.query
+			for pages := 0; ; pages++ {
+				if pages > len(refs) {
+					t.Fatalf("Too many pages")
+				}
+				docs, token, err := s.QueryDocReferences(q)
+				if err != nil {
+					t.Fatalf("Failed to query docs; error %v", err)
+				}
+				if q.PageSize > 0 && len(docs) > q.PageSize {
+					t.Errorf("Got %v docs; want at most %v", len(docs), q.PageSize)
+				}
+				for _, d := range docs {
+					actual = append(actual, d.DriveId)
+				}
+				if token == "" {
+					break
+				}
+				q.PageToken = token
+			}
+
+			if d := cmp.Diff(c.expected, actual); d != "" {
+				t.Errorf("Unexpected docs; diff:\n%v", d)
+			}
+		})
+	}
+
+	// Rows added before the cursor aren't returned and don't cause rows to be repeated.
+	docs, token, err := s.QueryDocReferences(DocReferenceQuery{ListOptions: ListOptions{PageSize: 3}})
+	if err != nil {
+		t.Fatalf("Failed to query docs; error %v", err)
+	}
+	if err := s.UpdateDocReference(&DocReference{DriveId: "doc00"}); err != nil {
+		t.Fatalf("Failed to create doc; error %v", err)
+	}
+	next, _, err := s.QueryDocReferences(DocReferenceQuery{ListOptions: ListOptions{PageSize: 3, PageToken: token}})
+	if err != nil {
+		t.Fatalf("Failed to query docs; error %v", err)
+	}
+	if len(docs) != 3 || len(next) != 3 || next[0].DriveId != "doc3" {
+		t.Errorf("Second page starts with %v; want doc3", next[0].DriveId)
+	}
+
+	// Tokens can only be used with the query they were returned for.
+	invalid := []DocReferenceQuery{
+		{MimeType: "doc", ListOptions: ListOptions{PageSize: 3, PageToken: token}},
+		{ListOptions: ListOptions{PageSize: 3, PageToken: token, OrderBy: "name"}},
+		{ListOptions: ListOptions{PageToken: "notAToken"}},
+		{ListOptions: ListOptions{OrderBy: "md5Checksum"}},
+		{ListOptions: ListOptions{OrderBy: "name up"}},
+		{ListOptions: ListOptions{PageSize: -1}},
+	}
+	for _, q := range invalid {
+		if _, _, err := s.QueryDocReferences(q); !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("Query %+v returned error %v; want %v", q, err, ErrInvalidArgument)
+		}
+	}
+
+	// Links, entities and mentions.
+	links := []*DocLink{}
+	mentions := []*EntityMention{}
+	for i := 0; i < 5; i++ {
+		links = append(links, &DocLink{SourceID: DriveKey(fmt.Sprintf("doc%v", i)), DestID: DriveKey("doc6"), StartIndex: int64(i)})
+		mentions = append(mentions, &EntityMention{DocID: DriveKey(fmt.Sprintf("doc%v", i%2)), EntityID: fmt.Sprintf("e%v", i), StartIndex: int64(10 - i), Salience: float32(i) / 10})
+		if err := s.UpdateEntity(&Entity{ID: fmt.Sprintf("e%v", i), Name: fmt.Sprintf("entity%v", i), Type: "PERSON"}); err != nil {
+			t.Fatalf("Failed to create entity; error %v", err)
+		}
+	}
+	if err := s.UpsertDocLinks(links); err != nil {
+		t.Fatalf("Failed to create links; error %v", err)
+	}
+	if err := s.UpsertEntityMentions(mentions); err != nil {
+		t.Fatalf("Failed to create mentions; error %v", err)
+	}
+
+	pagedLinks, token, err := s.QueryDocLinks(DocLinkQuery{DestID: DriveKey("doc6"), ListOptions: ListOptions{PageSize: 2, OrderBy: "startIndex desc"}})
+	if err != nil {
+		t.Fatalf("Failed to query links; error %v", err)
+	}
+	if len(pagedLinks) != 2 || token == "" || pagedLinks[0].StartIndex != 4 || pagedLinks[1].StartIndex != 3 {
+		t.Errorf("Unexpected page of links %+v, token %q", pagedLinks, token)
+	}
+
+	entities, _, err := s.QueryEntities(EntityListQuery{DocIDs: []string{DriveKey("doc1")}, ListOptions: ListOptions{OrderBy: "name desc"}})
+	if err != nil {
+		t.Fatalf("Failed to query entities; error %v", err)
+	}
+	got := []string{}
+	for _, e := range entities {
+		got = append(got, e.ID)
+	}
+	if d := cmp.Diff([]string{"e3", "e1"}, got); d != "" {
+		t.Errorf("Unexpected entities; diff:\n%v", d)
+	}
+
+	pagedMentions, token, err := s.QueryEntityMentions(EntityMentionQuery{DocID: DriveKey("doc0"), ListOptions: ListOptions{PageSize: 2, OrderBy: "salience desc"}})
+	if err != nil {
+		t.Fatalf("Failed to query mentions; error %v", err)
+	}
+	rest, last, err := s.QueryEntityMentions(EntityMentionQuery{DocID: DriveKey("doc0"), ListOptions: ListOptions{PageSize: 2, OrderBy: "salience desc", PageToken: token}})
+	if err != nil {
+		t.Fatalf("Failed to query mentions; error %v", err)
+	}
+	got = []string{}
+	for _, m := range append(pagedMentions, rest...) {
+		got = append(got, m.EntityID)
+	}
+	if d := cmp.Diff([]string{"e4", "e2", "e0"}, got); d != "" || last != "" {
+		t.Errorf("Unexpected mentions; last token %q diff:\n%v", last, d)
+	}
+}
@@ -0,0 +1,134 @@
+package datastore
+
+import (
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"strings"
+)
+
+const (
+	// PersonType is the Type of person entities. It matches the NL API entity type.
+	PersonType = "PERSON"
+
+	// RoleOwner means the person owns the doc.
+	RoleOwner = "owner"
+	// RoleLastModifier means the person was the last to modify the doc.
+	RoleLastModifier = "lastModifier"
+)
+
+// UpdatePerson creates or updates the person entity with the given email.
+// name is the display name of the person; if it is empty the existing name is kept or the email is used.
+func (d *Datastore) UpdatePerson(email string, name string) (*Entity, error) {
+	if email == "" {
+		return nil, errors.New("email must be set")
+	}
+
+	p := &Entity{
+		ID: PersonKey(email),
+	}
+
+	result := d.db.Limit(1).Find(p)
+	if result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to get person ID: %v", p.ID)
+	}
+
+	p.Email = strings.ToLower(email)
+	p.Type = PersonType
+	if name != "" {
+		p.Name = name
+	}
+	if p.Name == "" {
+		p.Name = p.Email
+	}
+
+	if err := d.UpdateEntity(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// FindPeople returns the person entities whose name matches name ignoring case.
+func (d *Datastore) FindPeople(name string) ([]*Entity, error) {
+	people := make([]*Entity, 0, 0)
+	if name == "" {
+		return people, nil
+	}
+
+	if d.cipher != nil {
+		// Encrypted names can't be compared ignoring case in SQL so compare them after decrypting.
+		if result := d.db.Where("email != ''").Find(&people); result.Error != nil {
+			return nil, errors.Wrapf(result.Error, "Failed to find people named %v", name)
+		}
+		matches := make([]*Entity, 0, 0)
+		for _, p := range people {
+			if strings.ToLower(p.Name) == strings.ToLower(name) {
+				matches = append(matches, p)
+			}
+		}
+		return matches, nil
+	}
+
+	if result := d.db.Where("email != '' and lower(name) = ?", strings.ToLower(name)).Find(&people); result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to find people named %v", name)
+	}
+	return people, nil
+}
+
+// ReplaceDocPeople replaces the people related to the doc with the supplied people.
+func (d *Datastore) ReplaceDocPeople(docId string, people []*DocPerson) error {
+	if docId == "" {
+		return errors.New("docId must be set")
+	}
+
+	log := d.log.WithValues("docId", docId)
+
+	for _, p := range people {
+		if p.DocID != docId {
+			return errors.Errorf("Person %v has DocID %v; want %v", p.EntityID, p.DocID, docId)
+		}
+
+		expectedId := DocPersonKey(*p)
+		if p.ID != "" && p.ID != expectedId {
+			return errors.Errorf("ID and DocPerson are inconsistent; ID should be empty or %v", expectedId)
+		}
+		p.ID = expectedId
+	}
+
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		// Use Unscoped so the old rows are actually deleted and their primary keys can be reused.
+		if result := tx.Unscoped().Where("doc_id = ?", docId).Delete(&DocPerson{}); result.Error != nil {
+			return errors.Wrapf(result.Error, "Failed to delete people for doc: %v", docId)
+		}
+
+		for _, p := range people {
+			log.V(logging.Debug).Info("Creating record", "id", p.ID)
+			if result := tx.Create(p); result.Error != nil {
+				return errors.Wrapf(result.Error, "Failed to create DocPerson ID: %v", p.ID)
+			}
+		}
+		return nil
+	})
+}
+
+// ListDocPeople lists the relationships between docs and people.
+// docId is optional if supplied only list the people related to the doc.
+// entityId is optional if supplied only list the docs related to the person.
+func (d *Datastore) ListDocPeople(docId string, entityId string) ([]*DocPerson, error) {
+	db := d.db
+	people := make([]*DocPerson, 0, 0)
+
+	if docId != "" {
+		db = db.Where("doc_id = ? ", docId)
+	}
+
+	if entityId != "" {
+		db = db.Where("entity_id = ? ", entityId)
+	}
+
+	if result := db.Order("doc_id, entity_id, role").Find(&people); result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to find doc people")
+	}
+
+	return people, nil
+}
@@ -0,0 +1,78 @@
+package datastore
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func Test_People(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testDatabase")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+
+	dbFile := path.Join(dir, "database.db")
+
+	log, _ := logging.InitLogger("info", true)
+	db, err := New(dbFile, *log)
+
+	if err != nil {
+		t.Fatalf("Failed to create database; error %v", err)
+	}
+
+	alice, err := db.UpdatePerson("Alice@Example.com", "Alice Smith")
+	if err != nil {
+		t.Fatalf("Failed to update person; error %v", err)
+	}
+
+	if alice.ID != "person.alice@example.com" {
+		t.Errorf("Got ID %v; want person.alice@example.com", alice.ID)
+	}
+
+	// Updating without a name should keep the existing name.
+	if _, err := db.UpdatePerson("alice@example.com", ""); err != nil {
+		t.Fatalf("Failed to update person; error %v", err)
+	}
+
+	// An entity from the NL API with the same name isn't a person known to Drive.
+	if err := db.UpdateEntity(&Entity{ID: "nl-alice", Name: "Alice Smith", Type: PersonType}); err != nil {
+		t.Fatalf("Failed to add entity; error %v", err)
+	}
+
+	people, err := db.FindPeople("alice smith")
+	if err != nil {
+		t.Fatalf("Failed to find people; error %v", err)
+	}
+
+	expected := []*Entity{
+		{ID: "person.alice@example.com", Name: "Alice Smith", Type: PersonType, Email: "alice@example.com"},
+	}
+
+	if d := cmp.Diff(expected, people, GormIgnored(Entity{})); d != "" {
+		t.Errorf("Did not get expected people; diff:\n%v", d)
+	}
+
+	rows := []*DocPerson{
+		{DocID: "doc1", EntityID: alice.ID, Role: RoleOwner},
+		{DocID: "doc1", EntityID: alice.ID, Role: RoleLastModifier},
+	}
+	if err := db.ReplaceDocPeople("doc1", rows); err != nil {
+		t.Fatalf("Failed to replace doc people; error %v", err)
+	}
+
+	if err := db.ReplaceDocPeople("doc1", []*DocPerson{{DocID: "doc1", EntityID: alice.ID, Role: RoleOwner}}); err != nil {
+		t.Fatalf("Failed to replace doc people; error %v", err)
+	}
+
+	actual, err := db.ListDocPeople("", alice.ID)
+	if err != nil {
+		t.Fatalf("Failed to list doc people; error %v", err)
+	}
+
+	if len(actual) != 1 || actual[0].Role != RoleOwner {
+		t.Errorf("Expected alice to only be the owner of doc1; got %+v", actual)
+	}
+}
@@ -0,0 +1,138 @@
+package datastore
+
+import (
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"strings"
+)
+
+const (
+	// PrincipalUser is a permission granted to a user identified by email.
+	PrincipalUser = "user"
+	// PrincipalGroup is a permission granted to a group identified by email.
+	PrincipalGroup = "group"
+	// PrincipalDomain is a permission granted to everyone in a domain.
+	PrincipalDomain = "domain"
+	// PrincipalAnyone is a permission granted to anyone.
+	PrincipalAnyone = "anyone"
+)
+
+// Principals identifies a user and the groups they belong to for the purpose of checking Drive ACLs.
+type Principals struct {
+	Email  string
+	Groups []string
+}
+
+// Domain returns the domain of the user's email.
+func (p Principals) Domain() string {
+	i := strings.LastIndex(p.Email, "@")
+	if i < 0 {
+		return ""
+	}
+	return strings.ToLower(p.Email[i+1:])
+}
+
+// Grants returns true if the permission lets the principals read the doc.
+func (p Principals) Grants(perm *DocPermission) bool {
+	switch perm.Type {
+	case PrincipalAnyone:
+		return true
+	case PrincipalUser:
+		return p.Email != "" && perm.Principal == strings.ToLower(p.Email)
+	case PrincipalDomain:
+		domain := p.Domain()
+		return domain != "" && perm.Principal == domain
+	case PrincipalGroup:
+		for _, g := range p.Groups {
+			if perm.Principal == strings.ToLower(g) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReplaceDocPermissions replaces the ACL of the doc with the supplied permissions.
+// Principals are normalized to lower case.
+func (d *Datastore) ReplaceDocPermissions(docId string, permissions []*DocPermission) error {
+	if docId == "" {
+		return errors.New("docId must be set")
+	}
+
+	log := d.log.WithValues("docId", docId)
+
+	for _, p := range permissions {
+		if p.DocID != docId {
+			return errors.Errorf("Permission for %v has DocID %v; want %v", p.Principal, p.DocID, docId)
+		}
+
+		switch p.Type {
+		case PrincipalUser, PrincipalGroup, PrincipalDomain, PrincipalAnyone:
+		default:
+			return errors.Errorf("Permission for %v has invalid type %v", p.Principal, p.Type)
+		}
+
+		p.Principal = strings.ToLower(p.Principal)
+		expectedId := DocPermissionKey(*p)
+		if p.ID != "" && p.ID != expectedId {
+			return errors.Errorf("ID and DocPermission are inconsistent; ID should be empty or %v", expectedId)
+		}
+		p.ID = expectedId
+	}
+
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		// Use Unscoped so the old rows are actually deleted and their primary keys can be reused.
+		if result := tx.Unscoped().Where("doc_id = ?", docId).Delete(&DocPermission{}); result.Error != nil {
+			return errors.Wrapf(result.Error, "Failed to delete permissions for doc: %v", docId)
+		}
+
+		for _, p := range permissions {
+			log.V(logging.Debug).Info("Creating record", "id", p.ID)
+			if result := tx.Create(p); result.Error != nil {
+				return errors.Wrapf(result.Error, "Failed to create DocPermission ID: %v", p.ID)
+			}
+		}
+		return nil
+	})
+}
+
+// ListDocPermissions lists the ACL of the doc.
+func (d *Datastore) ListDocPermissions(docId string) ([]*DocPermission, error) {
+	permissions := make([]*DocPermission, 0, 0)
+	if result := d.db.Where("doc_id = ?", docId).Order("type, principal").Find(&permissions); result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to list permissions for doc: %v", docId)
+	}
+	return permissions, nil
+}
+
+// ListVisibleDocs returns the ids of the docs the principals can read according to the stored ACLs.
+// Docs without any stored permissions aren't visible to anyone.
+func (d *Datastore) ListVisibleDocs(p Principals) (map[string]bool, error) {
+	groups := make([]string, 0, len(p.Groups))
+	for _, g := range p.Groups {
+		groups = append(groups, strings.ToLower(g))
+	}
+
+	db := d.db.Model(&DocPermission{}).Distinct("doc_id").Where("type = ?", PrincipalAnyone)
+	if p.Email != "" {
+		db = db.Or("type = ? and principal = ?", PrincipalUser, strings.ToLower(p.Email))
+	}
+	if domain := p.Domain(); domain != "" {
+		db = db.Or("type = ? and principal = ?", PrincipalDomain, domain)
+	}
+	if len(groups) > 0 {
+		db = db.Or("type = ? and principal in ?", PrincipalGroup, groups)
+	}
+
+	ids := make([]string, 0, 0)
+	if result := db.Pluck("doc_id", &ids); result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to list docs visible to %v", p.Email)
+	}
+
+	visible := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		visible[id] = true
+	}
+	return visible, nil
+}
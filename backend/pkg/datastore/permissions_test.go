@@ -0,0 +1,75 @@
+package datastore
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func Test_ListVisibleDocs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testDatabase")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+
+	dbFile := path.Join(dir, "database.db")
+
+	log, _ := logging.InitLogger("info", true)
+	db, err := New(dbFile, *log)
+
+	if err != nil {
+		t.Fatalf("Failed to create database; error %v", err)
+	}
+
+	acls := map[string][]*DocPermission{
+		"private": {{DocID: "private", Type: PrincipalUser, Principal: "Alice@example.com", Role: "owner"}},
+		"group":   {{DocID: "group", Type: PrincipalGroup, Principal: "eng@example.com", Role: "reader"}},
+		"domain":  {{DocID: "domain", Type: PrincipalDomain, Principal: "example.com", Role: "reader"}},
+		"public":  {{DocID: "public", Type: PrincipalAnyone, Role: "reader"}},
+	}
+
+	for docId, p := range acls {
+		if err := db.ReplaceDocPermissions(docId, p); err != nil {
+			t.Fatalf("Failed to replace permissions; error %v", err)
+		}
+	}
+
+	type testCase struct {
+		name       string
+		principals Principals
+		expected   map[string]bool
+	}
+
+	cases := []testCase{
+		{
+			name:       "owner",
+			principals: Principals{Email: "alice@example.com"},
+			expected:   map[string]bool{"private": true, "domain": true, "public": true},
+		},
+		{
+			name:       "group",
+			principals: Principals{Email: "bob@example.com", Groups: []string{"ENG@example.com"}},
+			expected:   map[string]bool{"group": true, "domain": true, "public": true},
+		},
+		{
+			name:       "outsider",
+			principals: Principals{Email: "eve@other.com"},
+			expected:   map[string]bool{"public": true},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			actual, err := db.ListVisibleDocs(c.principals)
+			if err != nil {
+				t.Fatalf("Failed to list visible docs; error %v", err)
+			}
+
+			if d := cmp.Diff(c.expected, actual); d != "" {
+				t.Errorf("Did not get expected docs; diff:\n%v", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package datastore
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+const (
+	// DocStatePending means the doc has never been indexed.
+	DocStatePending = "pending"
+	// DocStateStale means the doc changed since it was last indexed.
+	DocStateStale = "stale"
+	// DocStateIndexed means the index of the doc is up to date.
+	DocStateIndexed = "indexed"
+)
+
+// StatsQuery selects the docs IndexStats reports on.
+type StatsQuery struct {
+	// DocIDs restricts the stats to these docs and the links and mentions in them. nil means all docs.
+	DocIDs []string
+	// Limit is the maximum number of items in each of the top lists. 0 means no limit.
+	Limit int
+}
+
+// IndexStats are statistics about the indexed docs, links and entities.
+type IndexStats struct {
+	Docs  DocStats
+	Links LinkStats
+	// TopEntities are the entities with the most mentions.
+	TopEntities []*EntityCount
+	// TopLinkedDocs are the docs with the most inbound links.
+	TopLinkedDocs []*LinkedDoc
+	// Unlinked are docs with no inbound links from other docs ordered by ID.
+	Unlinked []*LinkedDoc
+}
+
+// DocStats counts the docs.
+type DocStats struct {
+	Total int64
+	// ByMimeType is the number of docs of each MIME type.
+	ByMimeType map[string]int64
+	// ByState is the number of docs in each index state; one of DocStatePending, DocStateStale or DocStateIndexed.
+	ByState map[string]int64
+	// NumUnlinked is the number of docs with no inbound links from other docs.
+	NumUnlinked int64
+}
+
+// LinkStats counts the links in the docs.
+type LinkStats struct {
+	Total int64
+	// Internal links point to a Google Drive file i.e. DestID is set. External links point to anything else.
+	Internal int64
+	External int64
+	// Resolved internal links point to a known doc. Dangling ones point to a file which isn't in the index; e.g.
+	// it was deleted, isn't shared with the indexer or is in a drive that isn't indexed.
+	Resolved int64
+	Dangling int64
+}
+
+// EntityCount is the number of mentions of an entity.
+type EntityCount struct {
+	EntityID     string
+	Name         string
+	Type         string
+	NumMentions  int64
+	NumDocuments int64
+}
+
+// LinkedDoc is the number of links to a doc.
+type LinkedDoc struct {
+	DocID string
+	Name  string
+	// NumLinks is the number of links to the doc from other docs.
+	NumLinks int64
+	// NumSources is the number of docs linking to it.
+	NumSources int64
+}
+
+// docState returns the index state of the doc. It matches the condition used by ToBeIndexed.
+func docState(r *DocReference) string {
+	switch {
+	case r.LastIndexedMd5Checksum == "":
+		return DocStatePending
+	case r.Md5Checksum != r.LastIndexedMd5Checksum:
+		return DocStateStale
+	default:
+		return DocStateIndexed
+	}
+}
+
+// IndexStats computes statistics about the docs, links and entities. Links from a doc to itself e.g. to one of its
+// headings aren't counted as inbound links.
+func (d *Datastore) IndexStats(q StatsQuery) (*IndexStats, error) {
+	stats := &IndexStats{
+		Docs: DocStats{
+			ByMimeType: map[string]int64{},
+			ByState:    map[string]int64{},
+		},
+	}
+
+	// inDocs restricts the query to the docs in the query.
+	inDocs := func(db *gorm.DB, column string) *gorm.DB {
+		if q.DocIDs == nil {
+			return db
+		}
+		return db.Where(column+" in ?", q.DocIDs)
+	}
+	limit := func(db *gorm.DB) *gorm.DB {
+		if q.Limit > 0 {
+			return db.Limit(q.Limit)
+		}
+		return db
+	}
+
+	type docCount struct {
+		MimeType string
+		State    string
+		Count    int64
+	}
+	docCounts := make([]*docCount, 0, 0)
+	result := inDocs(d.db.Model(&DocReference{}), "id").
+		Select(fmt.Sprintf("mime_type, case when last_indexed_md5_checksum = '' then '%v' when md5_checksum != last_indexed_md5_checksum then '%v' else '%v' end as state, count(*) as count",
+			DocStatePending, DocStateStale, DocStateIndexed)).
+		Group("mime_type, state").
+		Scan(&docCounts)
+	if result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to count docs")
+	}
+	for _, c := range docCounts {
+		stats.Docs.Total += c.Count
+		stats.Docs.ByMimeType[c.MimeType] += c.Count
+		stats.Docs.ByState[c.State] += c.Count
+	}
+
+	result = inDocs(d.db.Model(&DocLink{}), "source_id").
+		Select("count(*) as total, " +
+			"coalesce(sum(case when dest_id = '' then 1 else 0 end), 0) as external, " +
+			"coalesce(sum(case when dest_id != '' and exists (select 1 from doc_references as r where r.id = doc_links.dest_id and r.deleted_at is null) then 1 else 0 end), 0) as resolved").
+		Scan(&stats.Links)
+	if result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to count links")
+	}
+	stats.Links.Internal = stats.Links.Total - stats.Links.External
+	stats.Links.Dangling = stats.Links.Internal - stats.Links.Resolved
+
+	stats.TopEntities = make([]*EntityCount, 0, 0)
+	db := d.db.Table("entity_mentions as m").
+		Select("m.entity_id as entity_id, coalesce(e.name, '') as name, coalesce(e.type, '') as type, count(*) as num_mentions, count(distinct m.doc_id) as num_documents").
+		Joins("left join entities as e on e.id = m.entity_id and e.deleted_at is null").
+		Where("m.deleted_at is null").
+		Group("m.entity_id, e.name, e.type").
+		Order("num_mentions desc, m.entity_id")
+	if result := limit(inDocs(db, "m.doc_id")).Scan(&stats.TopEntities); result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to count entity mentions")
+	}
+
+	stats.TopLinkedDocs = make([]*LinkedDoc, 0, 0)
+	db = d.db.Table("doc_links as l").
+		Select("l.dest_id as doc_id, r.name as name, count(*) as num_links, count(distinct l.source_id) as num_sources").
+		Joins("join doc_references as r on r.id = l.dest_id and r.deleted_at is null").
+		Where("l.deleted_at is null and l.source_id != l.dest_id").
+		Group("l.dest_id, r.name").
+		Order("num_links desc, l.dest_id")
+	if result := limit(inDocs(inDocs(db, "l.source_id"), "l.dest_id")).Scan(&stats.TopLinkedDocs); result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to count links to docs")
+	}
+
+	inbound := inDocs(d.db.Model(&DocLink{}).Select("1").Where("doc_links.dest_id = doc_references.id and doc_links.source_id != doc_links.dest_id"), "doc_links.source_id")
+	unlinked := inDocs(d.db.Model(&DocReference{}), "doc_references.id").Where("not exists (?)", inbound)
+	if result := unlinked.Count(&stats.Docs.NumUnlinked); result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to count unlinked docs")
+	}
+
+	docs := make([]*DocReference, 0, 0)
+	db = inDocs(d.db.Model(&DocReference{}), "doc_references.id").Where("not exists (?)", inbound).Order("doc_references.id")
+	if result := limit(db).Find(&docs); result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to list unlinked docs")
+	}
+	stats.Unlinked = make([]*LinkedDoc, 0, len(docs))
+	for _, r := range docs {
+		stats.Unlinked = append(stats.Unlinked, &LinkedDoc{DocID: r.ID, Name: r.Name})
+	}
+
+	if err := d.decryptRows(stats.TopEntities); err != nil {
+		return nil, err
+	}
+	if err := d.decryptRows(stats.TopLinkedDocs); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
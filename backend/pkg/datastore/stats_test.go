@@ -0,0 +1,91 @@
+package datastore
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"testing"
+)
+
+func testStoreStats(t *testing.T, s Store) {
+	docs := []*DocReference{
+		{DriveId: "doc1", Name: "Doc 1", MimeType: "application/vnd.google-apps.document", Md5Checksum: "a", LastIndexedMd5Checksum: "a"},
+		{DriveId: "doc2", Name: "Doc 2", MimeType: "application/vnd.google-apps.document", Md5Checksum: "b", LastIndexedMd5Checksum: "a"},
+		{DriveId: "doc3", Name: "Doc 3", MimeType: "text/markdown"},
+	}
+	if err := s.UpsertDocReferences(docs); err != nil {
+		t.Fatalf("Failed to create docs; error %v", err)
+	}
+	links := []*DocLink{
+		{SourceID: DriveKey("doc1"), DestID: DriveKey("doc2"), StartIndex: 1, EndIndex: 2},
+		{SourceID: DriveKey("doc1"), DestID: DriveKey("doc2"), StartIndex: 3, EndIndex: 4},
+		{SourceID: DriveKey("doc3"), DestID: DriveKey("doc2"), StartIndex: 1, EndIndex: 2},
+		{SourceID: DriveKey("doc2"), DestID: DriveKey("doc1"), StartIndex: 1, EndIndex: 2},
+		// Links to itself aren't inbound links.
+		{SourceID: DriveKey("doc3"), DestID: DriveKey("doc3"), StartIndex: 3, EndIndex: 4},
+		{SourceID: DriveKey("doc3"), DestID: DriveKey("missing"), StartIndex: 5, EndIndex: 6},
+		{SourceID: DriveKey("doc3"), URI: "https://example.com", StartIndex: 7, EndIndex: 8},
+	}
+	if err := s.UpsertDocLinks(links); err != nil {
+		t.Fatalf("Failed to create links; error %v", err)
+	}
+	if err := s.UpdateEntity(&Entity{ID: "e1", Name: "Kubeflow", Type: "ORGANIZATION"}); err != nil {
+		t.Fatalf("Failed to create entity; error %v", err)
+	}
+	mentions := []*EntityMention{
+		{DocID: DriveKey("doc1"), EntityID: "e1", StartIndex: 1, EndIndex: 2},
+		{DocID: DriveKey("doc1"), EntityID: "e1", StartIndex: 3, EndIndex: 4},
+		{DocID: DriveKey("doc2"), EntityID: "e1", StartIndex: 1, EndIndex: 2},
+		{DocID: DriveKey("doc2"), EntityID: "e2", StartIndex: 3, EndIndex: 4},
+	}
+	if err := s.UpsertEntityMentions(mentions); err != nil {
+		t.Fatalf("Failed to create mentions; error %v", err)
+	}
+
+	stats, err := s.IndexStats(StatsQuery{})
+	if err != nil {
+		t.Fatalf("IndexStats failed; error %v", err)
+	}
+	expected := &IndexStats{
+		Docs: DocStats{
+			Total:       3,
+			ByMimeType:  map[string]int64{"application/vnd.google-apps.document": 2, "text/markdown": 1},
+			ByState:     map[string]int64{DocStateIndexed: 1, DocStateStale: 1, DocStatePending: 1},
+			NumUnlinked: 1,
+		},
+		Links: LinkStats{Total: 7, Internal: 6, External: 1, Resolved: 5, Dangling: 1},
+		TopEntities: []*EntityCount{
+			{EntityID: "e1", Name: "Kubeflow", Type: "ORGANIZATION", NumMentions: 3, NumDocuments: 2},
+			{EntityID: "e2", NumMentions: 1, NumDocuments: 1},
+		},
+		TopLinkedDocs: []*LinkedDoc{
+			{DocID: DriveKey("doc2"), Name: "Doc 2", NumLinks: 3, NumSources: 2},
+			{DocID: DriveKey("doc1"), Name: "Doc 1", NumLinks: 1, NumSources: 1},
+		},
+		Unlinked: []*LinkedDoc{{DocID: DriveKey("doc3"), Name: "Doc 3"}},
+	}
+	if d := cmp.Diff(expected, stats); d != "" {
+		t.Errorf("Unexpected stats; diff:\n%v", d)
+	}
+
+	// Restricting the docs excludes links and mentions in other docs.
+	stats, err = s.IndexStats(StatsQuery{DocIDs: []string{DriveKey("doc1"), DriveKey("doc3")}, Limit: 1})
+	if err != nil {
+		t.Fatalf("IndexStats failed; error %v", err)
+	}
+	expected = &IndexStats{
+		Docs: DocStats{
+			Total:       2,
+			ByMimeType:  map[string]int64{"application/vnd.google-apps.document": 1, "text/markdown": 1},
+			ByState:     map[string]int64{DocStateIndexed: 1, DocStatePending: 1},
+			NumUnlinked: 2,
+		},
+		Links: LinkStats{Total: 6, Internal: 5, External: 1, Resolved: 4, Dangling: 1},
+		TopEntities: []*EntityCount{
+			{EntityID: "e1", Name: "Kubeflow", Type: "ORGANIZATION", NumMentions: 2, NumDocuments: 1},
+		},
+		TopLinkedDocs: []*LinkedDoc{},
+		Unlinked:      []*LinkedDoc{{DocID: DriveKey("doc1"), Name: "Doc 1"}},
+	}
+	if d := cmp.Diff(expected, stats); d != "" {
+		t.Errorf("Unexpected stats for docs; diff:\n%v", d)
+	}
+}
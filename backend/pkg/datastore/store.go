@@ -0,0 +1,115 @@
+package datastore
+
+import (
+	"github.com/go-logr/logr"
+	"strings"
+	"time"
+)
+
+const (
+	// memoryDSN is the DSN passed to Open to create a MemoryStore.
+	memoryDSN = "memory:"
+)
+
+// Store is the interface to the datastore. It is implemented by Datastore, which stores the data in SQLite or
+// Postgres, and MemoryStore.
+//
+// The methods are documented on Datastore. All implementations must pass the conformance tests in store_test.go.
+type Store interface {
+	// Docs and links.
+	UpdateDocReference(r *DocReference) error
+	ListDocReferences() ([]*DocReference, error)
+	QueryDocReferences(q DocReferenceQuery) ([]*DocReference, string, error)
+	ToBeIndexed() ([]*DocReference, error)
+	UpdateDocLink(l *DocLink) error
+	ListDocLinks(destId string) ([]*DocLink, error)
+	ReplaceDocLinks(sourceId string, links []*DocLink) error
+	QueryDocLinks(q DocLinkQuery) ([]*DocLink, string, error)
+
+	// Entities.
+	UpdateEntity(m *Entity) error
+	ListEntities() ([]*Entity, error)
+	QueryEntities(q EntityListQuery) ([]*Entity, string, error)
+	FindEntity(q EntityQuery) ([]*Entity, error)
+	UpdateEntityMention(m *EntityMention) error
+	ListEntityMentions(docId string) ([]*EntityMention, error)
+	ReplaceEntityMentions(docId string, mentions []*EntityMention) error
+	QueryEntityMentions(q EntityMentionQuery) ([]*EntityMention, string, error)
+	ListEntityDocuments(entityId string) ([]*EntityDocument, error)
+	EntityTimeline(entityId string, interval string) ([]*TimelineBucket, error)
+	UpdateEntityCooccurrences() error
+	UpdateEntityCooccurrencesOf(entityIds []string) error
+	ListRelatedEntities(entityId string, limit int) ([]*RelatedEntity, error)
+	ListRelatedEntitiesInDocs(entityId string, docIds []string, limit int) ([]*RelatedEntity, error)
+
+	// People and permissions.
+	UpdatePerson(email string, name string) (*Entity, error)
+	FindPeople(name string) ([]*Entity, error)
+	ReplaceDocPeople(docId string, people []*DocPerson) error
+	ListDocPeople(docId string, entityId string) ([]*DocPerson, error)
+	ReplaceDocPermissions(docId string, permissions []*DocPermission) error
+	ListDocPermissions(docId string) ([]*DocPermission, error)
+	ListVisibleDocs(p Principals) (map[string]bool, error)
+
+	// Redactions.
+	UpdateRedaction(r *Redaction) error
+	ListRedactions(docId string) ([]*Redaction, error)
+
+	// Categories.
+	ReplaceDocCategories(docId string, categories []*DocCategory) error
+	ListDocCategories(docId string, category string) ([]*DocCategory, error)
+	CountDocCategories() ([]*CategoryCount, error)
+
+	// Keyphrases.
+	ReplaceKeyphraseMentions(docId string, mentions []*KeyphraseMention) error
+	ListKeyphraseMentions(docId string) ([]*KeyphraseMention, error)
+	UpdateKeyphraseWeights() error
+	ListKeyphrases(limit int) ([]*Keyphrase, error)
+	SearchKeyphrases(query string, limit int) ([]*DocKeyphrase, error)
+	ListDocKeyphrases(docId string) ([]*DocKeyphrase, error)
+
+	// Natural Language API cache and usage.
+	GetNLPResponse(key string) ([]byte, error)
+	PutNLPResponse(key string, method string, numCharacters int64, response []byte) error
+	GetNLPCacheStats() ([]*NLPCacheStats, error)
+	PurgeNLPCache(method string, olderThan time.Time) (int64, error)
+	AddNLPUsage(u *NLPUsage) error
+	SumNLPUnits(since string) (int64, error)
+	ReportNLPUsage(groupBy []string, since string) ([]*NLPUsage, error)
+
+	// Index jobs.
+	UpdateIndexJob(j *IndexJob) error
+	GetIndexJob(id string) (*IndexJob, error)
+	ListIndexJobs(limit int) ([]*IndexJob, error)
+	FailUnfinishedIndexJobs() error
+
+	// Statistics.
+	IndexStats(q StatsQuery) (*IndexStats, error)
+
+	// Bulk writes and transactions.
+	UpsertDocReferences(refs []*DocReference) error
+	UpsertDocLinks(links []*DocLink) error
+	UpsertEntityMentions(mentions []*EntityMention) error
+	ListRows(rows interface{}) error
+	UpsertRows(rows interface{}) error
+	WithTx(fn func(tx Store) error) error
+
+	Close() error
+}
+
+var _ Store = &Datastore{}
+var _ Store = &MemoryStore{}
+
+// Open opens the store identified by dsn. A postgres:// or postgresql:// URL opens a Postgres database, "memory:"
+// creates an empty MemoryStore and anything else is the path of a SQLite database. opts only apply to SQLite and
+// Postgres.
+func Open(dsn string, log logr.Logger, opts ...DatastoreOption) (Store, error) {
+	switch {
+	case strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://"):
+		return NewPostgres(dsn, log, opts...)
+	case dsn == memoryDSN:
+		return NewMemoryStore(log), nil
+	default:
+		return New(dsn, log, opts...)
+	}
+}
@@ -0,0 +1,106 @@
+package datastore
+
+import (
+	"github.com/pkg/errors"
+	"time"
+)
+
+const (
+	// TimelineWeek groups mentions by the week, starting on Monday, in which the doc was last modified.
+	TimelineWeek = "week"
+	// TimelineMonth groups mentions by the month in which the doc was last modified.
+	TimelineMonth = "month"
+
+	timelineFormat = "2006-01-02"
+)
+
+// TimelineBucket is the number of mentions of an entity in docs last modified in some period.
+type TimelineBucket struct {
+	// Start is the first day of the period in the form YYYY-MM-DD.
+	Start       string
+	NumMentions int64
+	Docs        []*TimelineDoc
+}
+
+// TimelineDoc is a doc contributing mentions to a TimelineBucket.
+type TimelineDoc struct {
+	DocID        string
+	Name         string
+	ModifiedTime time.Time
+	NumMentions  int64
+}
+
+// EntityTimeline returns the number of mentions of the entity grouped by the week or month in which the docs
+// mentioning it were last modified. Buckets are ordered by time and only periods with mentions are included.
+// Docs whose modification time isn't known are excluded.
+//
+// interval is one of TimelineWeek or TimelineMonth.
+func (d *Datastore) EntityTimeline(entityId string, interval string) ([]*TimelineBucket, error) {
+	if err := validateTimeline(entityId, interval); err != nil {
+		return nil, err
+	}
+
+	docs := make([]*TimelineDoc, 0, 0)
+	result := d.db.Table("entity_mentions as m").
+		Select("m.doc_id as doc_id, r.name as name, r.modified_time as modified_time, count(*) as num_mentions").
+		Joins("join doc_references as r on r.id = m.doc_id").
+		Where("m.entity_id = ? and m.deleted_at is null and r.deleted_at is null", entityId).
+		Group("m.doc_id, r.name, r.modified_time").
+		Order("r.modified_time, m.doc_id").
+		Scan(&docs)
+
+	if result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to get mentions of entity %v", entityId)
+	}
+	if err := d.decryptRows(docs); err != nil {
+		return nil, err
+	}
+
+	return timelineBuckets(docs, interval), nil
+}
+
+func validateTimeline(entityId string, interval string) error {
+	if entityId == "" {
+		return errors.New("entityId must be set")
+	}
+
+	if interval != TimelineWeek && interval != TimelineMonth {
+		return errors.Errorf("Invalid interval %v; must be one of %v, %v", interval, TimelineWeek, TimelineMonth)
+	}
+	return nil
+}
+
+// timelineBuckets groups the docs, which must be ordered by modification time, into buckets.
+func timelineBuckets(docs []*TimelineDoc, interval string) []*TimelineBucket {
+	buckets := make([]*TimelineBucket, 0, 10)
+	for _, doc := range docs {
+		if doc.ModifiedTime.IsZero() {
+			continue
+		}
+
+		start := periodStart(doc.ModifiedTime, interval).Format(timelineFormat)
+		if len(buckets) == 0 || buckets[len(buckets)-1].Start != start {
+			buckets = append(buckets, &TimelineBucket{
+				Start: start,
+				Docs:  make([]*TimelineDoc, 0, 1),
+			})
+		}
+
+		b := buckets[len(buckets)-1]
+		b.NumMentions = b.NumMentions + doc.NumMentions
+		b.Docs = append(b.Docs, doc)
+	}
+	return buckets
+}
+
+// periodStart returns the start of the week or month containing t in UTC.
+func periodStart(t time.Time, interval string) time.Time {
+	t = t.UTC()
+	if interval == TimelineMonth {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	// Weeks start on Monday.
+	offset := (int(t.Weekday()) + 6) % 7
+	return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,111 @@
+package datastore
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+)
+
+func Test_EntityTimeline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testDatabase")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+
+	dbFile := path.Join(dir, "database.db")
+
+	log, _ := logging.InitLogger("info", true)
+	db, err := New(dbFile, *log)
+
+	if err != nil {
+		t.Fatalf("Failed to create database; error %v", err)
+	}
+
+	refs := []*DocReference{
+		// 2022-01-03 is a Monday.
+		{DriveId: "doc1", Name: "Doc 1", ModifiedTime: time.Date(2022, 1, 3, 10, 0, 0, 0, time.UTC)},
+		{DriveId: "doc2", Name: "Doc 2", ModifiedTime: time.Date(2022, 1, 9, 23, 0, 0, 0, time.UTC)},
+		{DriveId: "doc3", Name: "Doc 3", ModifiedTime: time.Date(2022, 1, 10, 1, 0, 0, 0, time.UTC)},
+		{DriveId: "doc4", Name: "Doc 4", ModifiedTime: time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC)},
+		// The modified time of doc5 isn't known.
+		{DriveId: "doc5", Name: "Doc 5"},
+	}
+
+	for _, r := range refs {
+		if err := db.UpdateDocReference(r); err != nil {
+			t.Fatalf("Failed to add doc reference; error %v", err)
+		}
+	}
+
+	mentions := []*EntityMention{
+		{DocID: DriveKey("doc1"), EntityID: "kubeflow", StartIndex: 0, EndIndex: 8},
+		{DocID: DriveKey("doc1"), EntityID: "kubeflow", StartIndex: 10, EndIndex: 18},
+		{DocID: DriveKey("doc2"), EntityID: "kubeflow", StartIndex: 0, EndIndex: 8},
+		{DocID: DriveKey("doc3"), EntityID: "kubeflow", StartIndex: 0, EndIndex: 8},
+		{DocID: DriveKey("doc4"), EntityID: "kubeflow", StartIndex: 0, EndIndex: 8},
+		{DocID: DriveKey("doc5"), EntityID: "kubeflow", StartIndex: 0, EndIndex: 8},
+		{DocID: DriveKey("doc4"), EntityID: "other", StartIndex: 20, EndIndex: 25},
+	}
+
+	for _, m := range mentions {
+		if err := db.UpdateEntityMention(m); err != nil {
+			t.Fatalf("Failed to add mention; error %v", err)
+		}
+	}
+
+	type testCase struct {
+		interval string
+		expected map[string]int64
+	}
+
+	cases := []testCase{
+		{
+			interval: TimelineWeek,
+			expected: map[string]int64{
+				"2022-01-03": 3,
+				"2022-01-10": 1,
+				"2022-01-31": 1,
+			},
+		},
+		{
+			interval: TimelineMonth,
+			expected: map[string]int64{
+				"2022-01-01": 4,
+				"2022-02-01": 1,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.interval, func(t *testing.T) {
+			buckets, err := db.EntityTimeline("kubeflow", c.interval)
+			if err != nil {
+				t.Fatalf("Failed to get timeline; error %v", err)
+			}
+
+			actual := map[string]int64{}
+			for _, b := range buckets {
+				actual[b.Start] = b.NumMentions
+
+				var docMentions int64
+				for _, d := range b.Docs {
+					docMentions = docMentions + d.NumMentions
+				}
+				if docMentions != b.NumMentions {
+					t.Errorf("Bucket %v has %v mentions but its docs have %v", b.Start, b.NumMentions, docMentions)
+				}
+			}
+
+			if d := cmp.Diff(c.expected, actual); d != "" {
+				t.Errorf("Did not get expected timeline; diff:\n%v", d)
+			}
+		})
+	}
+
+	if _, err := db.EntityTimeline("kubeflow", "year"); err == nil {
+		t.Errorf("Expected an error for an invalid interval")
+	}
+}
@@ -0,0 +1,256 @@
+package datastore
+
+import (
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"reflect"
+)
+
+const (
+	// upsertBatchSize is the number of rows inserted by each statement. It keeps the number of bind variables
+	// below SQLite's limit of 999.
+	upsertBatchSize = 50
+)
+
+// WithTx runs fn in a transaction. fn must use tx rather than d for the reads and writes that are part of the
+// transaction. The transaction is committed if fn returns nil and rolled back otherwise.
+func (d *Datastore) WithTx(fn func(tx Store) error) error {
+	return d.db.Transaction(func(db *gorm.DB) error {
+		return fn(d.withTx(db))
+	})
+}
+
+// withTx returns a Datastore which reads and writes using the transaction db.
+func (d *Datastore) withTx(db *gorm.DB) *Datastore {
+	return &Datastore{
+		log:    d.log,
+		dbFile: d.dbFile,
+		db:     db,
+		inTx:   true,
+		cipher: d.cipher,
+	}
+}
+
+// UpsertDocReferences creates the DocReferences or updates them if they already exist. The rows are written in a
+// single transaction using INSERT ... ON CONFLICT DO UPDATE. If the same doc appears more than once the last one
+// wins.
+func (d *Datastore) UpsertDocReferences(refs []*DocReference) error {
+	ids := make([]string, 0, len(refs))
+	for _, r := range refs {
+		if err := setDocReferenceID(r); err != nil {
+			return err
+		}
+		ids = append(ids, r.ID)
+	}
+
+	rows := make([]*DocReference, 0, len(refs))
+	for _, i := range lastOccurrences(ids) {
+		rows = append(rows, refs[i])
+	}
+
+	if err := d.upsert(rows, len(rows)); err != nil {
+		return errors.Wrapf(err, "Failed to upsert %v DocReferences", len(rows))
+	}
+	return nil
+}
+
+// UpsertDocLinks creates the DocLinks or updates them if they already exist. The rows are written in a single
+// transaction using INSERT ... ON CONFLICT DO UPDATE. If the same link appears more than once the last one wins.
+func (d *Datastore) UpsertDocLinks(links []*DocLink) error {
+	ids := make([]string, 0, len(links))
+	for _, l := range links {
+		if err := setDocLinkID(l); err != nil {
+			return err
+		}
+		ids = append(ids, l.ID)
+	}
+
+	rows := make([]*DocLink, 0, len(links))
+	for _, i := range lastOccurrences(ids) {
+		rows = append(rows, links[i])
+	}
+
+	if err := d.upsert(rows, len(rows)); err != nil {
+		return errors.Wrapf(err, "Failed to upsert %v DocLinks", len(rows))
+	}
+	return nil
+}
+
+// UpsertEntityMentions creates the EntityMentions or updates them if they already exist. The rows are written in
+// a single transaction using INSERT ... ON CONFLICT DO UPDATE. If the same mention appears more than once the last
+// one wins.
+func (d *Datastore) UpsertEntityMentions(mentions []*EntityMention) error {
+	ids := make([]string, 0, len(mentions))
+	for _, m := range mentions {
+		if err := setEntityMentionID(m); err != nil {
+			return err
+		}
+		ids = append(ids, m.ID)
+	}
+
+	rows := make([]*EntityMention, 0, len(mentions))
+	for _, i := range lastOccurrences(ids) {
+		rows = append(rows, mentions[i])
+	}
+
+	if err := d.upsert(rows, len(rows)); err != nil {
+		return errors.Wrapf(err, "Failed to upsert %v EntityMentions", len(rows))
+	}
+	return nil
+}
+
+// ReplaceDocLinks replaces the links in the doc sourceId with links. Links which are no longer in the doc are
+// deleted.
+func (d *Datastore) ReplaceDocLinks(sourceId string, links []*DocLink) error {
+	if sourceId == "" {
+		return errors.New("sourceId must be set")
+	}
+	for _, l := range links {
+		if l.SourceID != sourceId {
+			return errors.Errorf("Link to %v has SourceID %v; want %v", l.URI, l.SourceID, sourceId)
+		}
+	}
+
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		// Use Unscoped so the old links are actually deleted and their primary keys can be reused.
+		if result := tx.Unscoped().Where("source_id = ?", sourceId).Delete(&DocLink{}); result.Error != nil {
+			return errors.Wrapf(result.Error, "Failed to delete links for doc: %v", sourceId)
+		}
+		return d.withTx(tx).UpsertDocLinks(links)
+	})
+}
+
+// ReplaceEntityMentions replaces the entity mentions in the doc with mentions. Mentions which are no longer in the
+// doc are deleted. Co-occurrences aren't updated; call UpdateEntityCooccurrencesOf with the entities mentioned
+// before and after.
+func (d *Datastore) ReplaceEntityMentions(docId string, mentions []*EntityMention) error {
+	if docId == "" {
+		return errors.New("docId must be set")
+	}
+	for _, m := range mentions {
+		if m.DocID != docId {
+			return errors.Errorf("Mention of %v has DocID %v; want %v", m.EntityID, m.DocID, docId)
+		}
+	}
+
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		// Use Unscoped so the old mentions are actually deleted and their primary keys can be reused.
+		if result := tx.Unscoped().Where("doc_id = ?", docId).Delete(&EntityMention{}); result.Error != nil {
+			return errors.Wrapf(result.Error, "Failed to delete entity mentions for doc: %v", docId)
+		}
+		return d.withTx(tx).UpsertEntityMentions(mentions)
+	})
+}
+
+// ListRows lists all the rows of a model ordered by ID. rows is a pointer to a slice of pointers to the model e.g.
+// *[]*DocPermission. It is used to export tables which don't have a paged query.
+func (d *Datastore) ListRows(rows interface{}) error {
+	if err := d.db.Order("id").Find(rows).Error; err != nil {
+		return errors.Wrapf(err, "Failed to list %T", rows)
+	}
+	return nil
+}
+
+// UpsertRows creates the rows or updates them if they already exist. rows is a slice of pointers to a model e.g.
+// []*DocPermission; every row must have an ID. It is used to import tables which don't have a bulk upsert.
+func (d *Datastore) UpsertRows(rows interface{}) error {
+	n, err := checkRowIDs(rows)
+	if err != nil {
+		return err
+	}
+	if err := d.upsert(rows, n); err != nil {
+		return errors.Wrapf(err, "Failed to upsert %v rows of %T", n, rows)
+	}
+	return nil
+}
+
+// checkRowIDs verifies rows is a slice of pointers to models with IDs and returns its length.
+func checkRowIDs(rows interface{}) (int, error) {
+	v := reflect.ValueOf(rows)
+	if v.Kind() != reflect.Slice || v.Type().Elem().Kind() != reflect.Ptr || v.Type().Elem().Elem().Kind() != reflect.Struct {
+		return 0, errors.Errorf("rows must be a slice of pointers to models; got %T", rows)
+	}
+	for i := 0; i < v.Len(); i++ {
+		id := v.Index(i).Elem().FieldByName("ID")
+		if !id.IsValid() || id.Kind() != reflect.String {
+			return 0, errors.Errorf("%T doesn't have a string ID", rows)
+		}
+		if id.String() == "" {
+			return 0, errors.Errorf("Row %v of %T doesn't have an ID", i, rows)
+		}
+	}
+	return v.Len(), nil
+}
+
+// upsert inserts the rows updating any existing rows with the same primary key. rows is a slice of pointers to
+// models and n is its length. CreatedAt of existing rows is preserved.
+func (d *Datastore) upsert(rows interface{}, n int) error {
+	if n == 0 {
+		return nil
+	}
+
+	// CreateInBatches runs the batches in a transaction.
+	return d.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		UpdateAll: true,
+	}).CreateInBatches(rows, upsertBatchSize).Error
+}
+
+// setDocReferenceID sets the ID of the DocReference. An error is returned if it has an inconsistent ID.
+func setDocReferenceID(r *DocReference) error {
+	if r.ID != "" && r.ID != DriveKey(r.DriveId) {
+		return errors.Errorf("ID and DriveID are inconsistent ID should be empty or %v", DriveKey(r.DriveId))
+	}
+
+	r.ID = DriveKey(r.DriveId)
+	return nil
+}
+
+// setDocLinkID validates the DocLink and sets its ID.
+func setDocLinkID(l *DocLink) error {
+	// DestID isn't required because not all links point ot Google Docs.
+	if l.SourceID == "" {
+		return errors.New("SourceID must be set")
+	}
+
+	expectedId := DocLinkKey(*l)
+	if l.ID != "" && l.ID != expectedId {
+		return errors.Errorf("ID and DockLink are inconsistent ID should be empty or %v", expectedId)
+	}
+
+	l.ID = expectedId
+	return nil
+}
+
+// setEntityMentionID validates the EntityMention and sets its ID.
+func setEntityMentionID(m *EntityMention) error {
+	if m.DocID == "" {
+		return errors.New("DocID must be set")
+	}
+
+	expectedId := EntityMentionKey(*m)
+	if m.ID != "" && m.ID != expectedId {
+		return errors.Errorf("ID and EntityMention are inconsistent; ID should be empty or %v", expectedId)
+	}
+
+	m.ID = expectedId
+	return nil
+}
+
+// lastOccurrences returns the index of the last occurrence of each id ordered by index. Postgres rejects an
+// INSERT ... ON CONFLICT DO UPDATE which updates the same row twice so duplicates have to be removed.
+func lastOccurrences(ids []string) []int {
+	last := map[string]int{}
+	for i, id := range ids {
+		last[id] = i
+	}
+
+	indexes := make([]int, 0, len(last))
+	for i, id := range ids {
+		if last[id] == i {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
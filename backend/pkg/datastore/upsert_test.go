@@ -0,0 +1,221 @@
+package datastore
+
+import (
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
+	"testing"
+	"time"
+)
+
+func testStoreUpserts(t *testing.T, s Store) {
+	refs := []*DocReference{
+		{DriveId: "doc1", Name: "Doc 1"},
+		{DriveId: "doc2", Name: "Doc 2"},
+		// Duplicates are allowed; the last one wins.
+		{DriveId: "doc1", Name: "Doc 1 renamed"},
+	}
+	if err := s.UpsertDocReferences(refs); err != nil {
+		t.Fatalf("Failed to upsert docs; error %v", err)
+	}
+
+	docs, err := s.ListDocReferences()
+	if err != nil {
+		t.Fatalf("Failed to list docs; error %v", err)
+	}
+	sortDocs(docs)
+	expectedDocs := []*DocReference{
+		{ID: DriveKey("doc1"), DriveId: "doc1", Name: "Doc 1 renamed"},
+		{ID: DriveKey("doc2"), DriveId: "doc2", Name: "Doc 2"},
+	}
+	if d := cmp.Diff(expectedDocs, docs, ignoreTimestamps(DocReference{})); d != "" {
+		t.Errorf("Unexpected docs; diff:\n%v", d)
+	}
+
+	// Enough rows to need more than one batch.
+	links := make([]*DocLink, 0, 3*upsertBatchSize)
+	mentions := make([]*EntityMention, 0, 3*upsertBatchSize)
+	for i := 0; i < 3*upsertBatchSize; i++ {
+		links = append(links, &DocLink{SourceID: DriveKey("doc1"), DestID: DriveKey("doc2"), Text: "link", StartIndex: int64(i), EndIndex: int64(i + 1)})
+		mentions = append(mentions, &EntityMention{DocID: DriveKey("doc1"), EntityID: "e1", Text: "e1", StartIndex: int64(i), EndIndex: int64(i + 1)})
+	}
+
+	if err := s.UpsertDocLinks(links); err != nil {
+		t.Fatalf("Failed to upsert links; error %v", err)
+	}
+	if err := s.UpsertEntityMentions(mentions); err != nil {
+		t.Fatalf("Failed to upsert mentions; error %v", err)
+	}
+
+	// Upserting again updates the existing rows and preserves CreatedAt.
+	stored, err := s.ListDocLinks(DriveKey("doc2"))
+	if err != nil {
+		t.Fatalf("Failed to list links; error %v", err)
+	}
+	created := map[string]time.Time{}
+	for _, l := range stored {
+		created[l.ID] = l.CreatedAt
+	}
+
+	update := make([]*DocLink, 0, len(links))
+	for _, l := range links {
+		update = append(update, &DocLink{SourceID: l.SourceID, DestID: l.DestID, Text: "updated", StartIndex: l.StartIndex, EndIndex: l.EndIndex})
+	}
+	if err := s.UpsertDocLinks(update); err != nil {
+		t.Fatalf("Failed to upsert links; error %v", err)
+	}
+
+	stored, err = s.ListDocLinks(DriveKey("doc2"))
+	if err != nil {
+		t.Fatalf("Failed to list links; error %v", err)
+	}
+	if len(stored) != len(links) {
+		t.Fatalf("Got %v links; want %v", len(stored), len(links))
+	}
+	for _, l := range stored {
+		if l.Text != "updated" {
+			t.Errorf("Link %v has text %v; want updated", l.ID, l.Text)
+		}
+		if !l.CreatedAt.Equal(created[l.ID]) {
+			t.Errorf("Link %v has CreatedAt %v; want %v", l.ID, l.CreatedAt, created[l.ID])
+		}
+	}
+
+	storedMentions, err := s.ListEntityMentions(DriveKey("doc1"))
+	if err != nil {
+		t.Fatalf("Failed to list mentions; error %v", err)
+	}
+	if len(storedMentions) != len(mentions) {
+		t.Errorf("Got %v mentions; want %v", len(storedMentions), len(mentions))
+	}
+
+	// An invalid row means nothing is written.
+	invalid := []*DocLink{
+		{SourceID: DriveKey("doc2"), Text: "valid"},
+		{Text: "missing source"},
+	}
+	if err := s.UpsertDocLinks(invalid); err == nil {
+		t.Errorf("Upserting an invalid link succeeded; want error")
+	}
+	all, err := s.ListDocLinks("")
+	if err != nil {
+		t.Fatalf("Failed to list links; error %v", err)
+	}
+	if len(all) != len(links) {
+		t.Errorf("Got %v links after a failed upsert; want %v", len(all), len(links))
+	}
+}
+
+func testStoreWithTx(t *testing.T, s Store) {
+	// A transaction which fails is rolled back.
+	failed := errors.New("failed")
+	err := s.WithTx(func(tx Store) error {
+		if err := tx.UpsertDocReferences([]*DocReference{{DriveId: "doc1"}}); err != nil {
+			return err
+		}
+		if err := tx.UpdateEntity(&Entity{ID: "e1", Name: "e1"}); err != nil {
+			return err
+		}
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("WithTx returned %v; want %v", err, failed)
+	}
+
+	docs, err := s.ListDocReferences()
+	if err != nil {
+		t.Fatalf("Failed to list docs; error %v", err)
+	}
+	entities, err := s.ListEntities()
+	if err != nil {
+		t.Fatalf("Failed to list entities; error %v", err)
+	}
+	if len(docs) != 0 || len(entities) != 0 {
+		t.Errorf("Rolled back transaction left %v docs and %v entities; want none", len(docs), len(entities))
+	}
+
+	// A transaction which succeeds is committed.
+	err = s.WithTx(func(tx Store) error {
+		if err := tx.UpsertDocReferences([]*DocReference{{DriveId: "doc1"}}); err != nil {
+			return err
+		}
+		mentions := []*EntityMention{}
+		for i := 0; i < 3; i++ {
+			mentions = append(mentions, &EntityMention{DocID: DriveKey("doc1"), EntityID: "e1", Text: fmt.Sprintf("m%v", i), StartIndex: int64(i)})
+		}
+		if err := tx.UpdateEntity(&Entity{ID: "e1", Name: "e1"}); err != nil {
+			return err
+		}
+		return tx.UpsertEntityMentions(mentions)
+	})
+	if err != nil {
+		t.Fatalf("WithTx failed; error %v", err)
+	}
+
+	mentions, err := s.ListEntityMentions(DriveKey("doc1"))
+	if err != nil {
+		t.Fatalf("Failed to list mentions; error %v", err)
+	}
+	if len(mentions) != 3 {
+		t.Errorf("Got %v mentions; want 3", len(mentions))
+	}
+}
+
+func testStoreReplaceLinksAndMentions(t *testing.T, s Store) {
+	links := []*DocLink{
+		{SourceID: DriveKey("doc1"), DestID: DriveKey("doc2"), Text: "a", StartIndex: 1, EndIndex: 2},
+		{SourceID: DriveKey("doc1"), DestID: DriveKey("doc3"), Text: "b", StartIndex: 3, EndIndex: 4},
+		{SourceID: DriveKey("doc2"), DestID: DriveKey("doc3"), Text: "c", StartIndex: 1, EndIndex: 2},
+	}
+	if err := s.UpsertDocLinks(links); err != nil {
+		t.Fatalf("Failed to upsert links; error %v", err)
+	}
+	mentions := []*EntityMention{
+		{DocID: DriveKey("doc1"), EntityID: "e1", Text: "e1", StartIndex: 1, EndIndex: 2},
+		{DocID: DriveKey("doc1"), EntityID: "e2", Text: "e2", StartIndex: 3, EndIndex: 4},
+		{DocID: DriveKey("doc2"), EntityID: "e1", Text: "e1", StartIndex: 1, EndIndex: 2},
+	}
+	if err := s.UpsertEntityMentions(mentions); err != nil {
+		t.Fatalf("Failed to upsert mentions; error %v", err)
+	}
+
+	// Replacing is transactional so run it the way the indexer does.
+	err := s.WithTx(func(tx Store) error {
+		if err := tx.ReplaceDocLinks(DriveKey("doc1"), []*DocLink{{SourceID: DriveKey("doc1"), DestID: DriveKey("doc3"), Text: "b", StartIndex: 5, EndIndex: 6}}); err != nil {
+			return err
+		}
+		return tx.ReplaceEntityMentions(DriveKey("doc1"), []*EntityMention{{DocID: DriveKey("doc1"), EntityID: "e2", Text: "e2", StartIndex: 3, EndIndex: 4}})
+	})
+	if err != nil {
+		t.Fatalf("Failed to replace links and mentions; error %v", err)
+	}
+
+	stored, _, err := s.QueryDocLinks(DocLinkQuery{SourceID: DriveKey("doc1")})
+	if err != nil {
+		t.Fatalf("Failed to list links; error %v", err)
+	}
+	if len(stored) != 1 || stored[0].DestID != DriveKey("doc3") || stored[0].StartIndex != 5 {
+		t.Errorf("Got links %+v; want only the replacement", stored)
+	}
+	if other, err := s.ListDocLinks(DriveKey("doc3")); err != nil || len(other) != 2 {
+		t.Errorf("Got %v links to doc3, error %v; want 2 since links of other docs are kept", len(other), err)
+	}
+
+	storedMentions, err := s.ListEntityMentions(DriveKey("doc1"))
+	if err != nil {
+		t.Fatalf("Failed to list mentions; error %v", err)
+	}
+	if len(storedMentions) != 1 || storedMentions[0].EntityID != "e2" {
+		t.Errorf("Got mentions %+v; want only the mention of e2", storedMentions)
+	}
+	if other, err := s.ListEntityMentions(DriveKey("doc2")); err != nil || len(other) != 1 {
+		t.Errorf("Got %v mentions in doc2, error %v; want 1", len(other), err)
+	}
+
+	if err := s.ReplaceDocLinks(DriveKey("doc1"), []*DocLink{{SourceID: DriveKey("doc2")}}); err == nil {
+		t.Errorf("ReplaceDocLinks should fail if a link is from another doc")
+	}
+	if err := s.ReplaceEntityMentions(DriveKey("doc1"), []*EntityMention{{DocID: DriveKey("doc2")}}); err == nil {
+		t.Errorf("ReplaceEntityMentions should fail if a mention is in another doc")
+	}
+}
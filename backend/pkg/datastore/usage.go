@@ -0,0 +1,116 @@
+package datastore
+
+import (
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"strings"
+)
+
+var (
+	// usageColumns maps the fields NLPUsage can be grouped by to the corresponding columns.
+	usageColumns = map[string]string{
+		"run":    "run_id",
+		"day":    "day",
+		"drive":  "drive_id",
+		"method": "method",
+	}
+)
+
+// AddNLPUsage adds the counters in u to the counters already stored for the same run, day, drive and method.
+func (d *Datastore) AddNLPUsage(u *NLPUsage) error {
+	if u.RunID == "" {
+		return errors.New("RunID must be set")
+	}
+
+	if u.Day == "" {
+		return errors.New("Day must be set")
+	}
+
+	expectedId := NLPUsageKey(*u)
+	if u.ID != "" && u.ID != expectedId {
+		return errors.Errorf("ID and NLPUsage are inconsistent; ID should be empty or %v", expectedId)
+	}
+
+	u.ID = expectedId
+
+	log := d.log.WithValues("id", u.ID)
+
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		current := &NLPUsage{}
+		result := tx.Where("id = ?", u.ID).Limit(1).Find(current)
+		if result.Error != nil {
+			return errors.Wrapf(result.Error, "Failed to get NLPUsage ID: %v", u.ID)
+		}
+
+		if result.RowsAffected == 0 {
+			log.V(logging.Debug).Info("Record not found; it will be created")
+			if result := tx.Create(u); result.Error != nil {
+				return errors.Wrapf(result.Error, "Failed to create NLPUsage ID: %v", u.ID)
+			}
+			return nil
+		}
+
+		log.V(logging.Debug).Info("Updating record")
+		updates := map[string]interface{}{
+			"requests":       gorm.Expr("requests + ?", u.Requests),
+			"num_characters": gorm.Expr("num_characters + ?", u.NumCharacters),
+			"units":          gorm.Expr("units + ?", u.Units),
+		}
+		if result := tx.Model(current).UpdateColumns(updates); result.Error != nil {
+			return errors.Wrapf(result.Error, "Failed to update NLPUsage ID: %v", u.ID)
+		}
+		return nil
+	})
+}
+
+// SumNLPUnits returns the total number of units used since the given day (inclusive).
+// since is a UTC date in the form YYYY-MM-DD; if empty all usage is included.
+func (d *Datastore) SumNLPUnits(since string) (int64, error) {
+	db := d.db.Model(&NLPUsage{})
+	if since != "" {
+		db = db.Where("day >= ?", since)
+	}
+
+	var total int64
+	if result := db.Select("coalesce(sum(units), 0)").Scan(&total); result.Error != nil {
+		return 0, errors.Wrapf(result.Error, "Failed to sum NLP usage")
+	}
+	return total, nil
+}
+
+// ReportNLPUsage returns the usage summed over the fields not in groupBy.
+//
+// groupBy is a list of fields; allowed values are run, day, drive and method. Fields not in groupBy are left
+// empty in the results.
+// since is optional; it is a UTC date in the form YYYY-MM-DD. If supplied only usage on or after that day is
+// included.
+func (d *Datastore) ReportNLPUsage(groupBy []string, since string) ([]*NLPUsage, error) {
+	columns := make([]string, 0, len(groupBy))
+	for _, g := range groupBy {
+		c, ok := usageColumns[strings.ToLower(g)]
+		if !ok {
+			return nil, errors.Errorf("Can't group usage by %v; allowed values are run, day, drive, method", g)
+		}
+		columns = append(columns, c)
+	}
+
+	db := d.db.Model(&NLPUsage{})
+	if since != "" {
+		db = db.Where("day >= ?", since)
+	}
+
+	selected := append([]string{}, columns...)
+	selected = append(selected, "coalesce(sum(requests), 0) as requests", "coalesce(sum(num_characters), 0) as num_characters", "coalesce(sum(units), 0) as units")
+	db = db.Select(strings.Join(selected, ", "))
+
+	if len(columns) > 0 {
+		db = db.Group(strings.Join(columns, ", ")).Order(strings.Join(columns, ", "))
+	}
+
+	usage := make([]*NLPUsage, 0, 0)
+	if result := db.Scan(&usage); result.Error != nil {
+		return nil, errors.Wrapf(result.Error, "Failed to report NLP usage")
+	}
+	return usage, nil
+}
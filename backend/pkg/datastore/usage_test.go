@@ -0,0 +1,99 @@
+package datastore
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func Test_NLPUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testDatabase")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+
+	dbFile := path.Join(dir, "database.db")
+
+	log, _ := logging.InitLogger("info", true)
+	db, err := New(dbFile, *log)
+
+	if err != nil {
+		t.Fatalf("Failed to create database; error %v", err)
+	}
+
+	rows := []*NLPUsage{
+		{RunID: "run1", Day: "2022-01-01", DriveID: "drive1", Method: "AnalyzeEntities", Requests: 1, NumCharacters: 1500, Units: 2},
+		{RunID: "run1", Day: "2022-01-01", DriveID: "drive1", Method: "AnalyzeEntities", Requests: 1, NumCharacters: 100, Units: 1},
+		{RunID: "run1", Day: "2022-01-01", DriveID: "drive2", Method: "AnalyzeEntities", Requests: 1, NumCharacters: 10, Units: 1},
+		{RunID: "run2", Day: "2022-01-02", DriveID: "drive1", Method: "AnalyzeEntities", Requests: 1, NumCharacters: 10, Units: 1},
+	}
+
+	for _, r := range rows {
+		if err := db.AddNLPUsage(r); err != nil {
+			t.Fatalf("Failed to add usage; error %v", err)
+		}
+	}
+
+	type testCase struct {
+		name     string
+		groupBy  []string
+		since    string
+		expected []*NLPUsage
+	}
+
+	cases := []testCase{
+		{
+			name:    "day-drive",
+			groupBy: []string{"day", "drive"},
+			expected: []*NLPUsage{
+				{Day: "2022-01-01", DriveID: "drive1", Requests: 2, NumCharacters: 1600, Units: 3},
+				{Day: "2022-01-01", DriveID: "drive2", Requests: 1, NumCharacters: 10, Units: 1},
+				{Day: "2022-01-02", DriveID: "drive1", Requests: 1, NumCharacters: 10, Units: 1},
+			},
+		},
+		{
+			name:    "run",
+			groupBy: []string{"run"},
+			expected: []*NLPUsage{
+				{RunID: "run1", Requests: 3, NumCharacters: 1610, Units: 4},
+				{RunID: "run2", Requests: 1, NumCharacters: 10, Units: 1},
+			},
+		},
+		{
+			name:    "total-since",
+			groupBy: []string{},
+			since:   "2022-01-02",
+			expected: []*NLPUsage{
+				{Requests: 1, NumCharacters: 10, Units: 1},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			actual, err := db.ReportNLPUsage(c.groupBy, c.since)
+			if err != nil {
+				t.Fatalf("Failed to report usage; error %v", err)
+			}
+
+			if d := cmp.Diff(c.expected, actual, GormIgnored(NLPUsage{})); d != "" {
+				t.Errorf("Did not get expected usage; diff:\n%v", d)
+			}
+		})
+	}
+
+	total, err := db.SumNLPUnits("")
+	if err != nil {
+		t.Fatalf("Failed to sum units; error %v", err)
+	}
+
+	if total != 5 {
+		t.Errorf("Got total units %v; want 5", total)
+	}
+
+	if _, err := db.ReportNLPUsage([]string{"color"}, ""); err == nil {
+		t.Errorf("ReportNLPUsage should fail for an invalid group by field")
+	}
+}
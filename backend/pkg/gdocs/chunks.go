@@ -0,0 +1,143 @@
+package gdocs
+
+import (
+	"github.com/jlewi/p22h/backend/pkg/glanguage"
+	languagepb "google.golang.org/genproto/googleapis/cloud/language/v1"
+	"google.golang.org/protobuf/proto"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// MaxRequestBytes is the maximum number of bytes of text to send in a single request to the NL API.
+	// The API limits requests to 1MB; https://cloud.google.com/natural-language/quotas#content.
+	// We leave some headroom for the rest of the request.
+	MaxRequestBytes = 900000
+)
+
+// textChunk is a contiguous piece of a larger text.
+type textChunk struct {
+	Text string
+	// Offset is the byte offset of the chunk in the original text.
+	Offset int
+}
+
+// chunkText splits text into chunks of at most maxBytes bytes.
+//
+// Chunks are split on paragraph boundaries (i.e. newlines) so that sentences aren't broken across chunks.
+// A paragraph which is larger than maxBytes is split on a UTF8 character boundary.
+func chunkText(text string, maxBytes int) []textChunk {
+	chunks := make([]textChunk, 0, len(text)/maxBytes+1)
+	start := 0
+	end := 0
+
+	for end < len(text) {
+		// Find the end of the next paragraph.
+		next := strings.IndexByte(text[end:], '\n')
+		if next < 0 {
+			next = len(text)
+		} else {
+			next = end + next + 1
+		}
+
+		if next-start <= maxBytes {
+			end = next
+			continue
+		}
+
+		// Adding the paragraph would make the chunk too large so emit the current chunk.
+		if end > start {
+			chunks = append(chunks, textChunk{Text: text[start:end], Offset: start})
+			start = end
+			continue
+		}
+
+		// A single paragraph is larger than the limit; split it on a character boundary.
+		end = start + maxBytes
+		for end > start && !utf8.RuneStart(text[end]) {
+			end = end - 1
+		}
+		if end == start {
+			end = start + maxBytes
+		}
+		chunks = append(chunks, textChunk{Text: text[start:end], Offset: start})
+		start = end
+	}
+
+	if end > start {
+		chunks = append(chunks, textChunk{Text: text[start:end], Offset: start})
+	}
+	return chunks
+}
+
+// entityKey returns the key used to decide if entities from different chunks are the same entity.
+func entityKey(e *languagepb.Entity) string {
+	if mid := glanguage.GetMID(e); mid != "" {
+		return mid
+	}
+	return e.GetType().String() + "." + e.GetName()
+}
+
+// mergeEntities combines the entities found in each chunk.
+//
+// Mention offsets are shifted by the offset of the chunk so they are relative to the original text.
+// Entities found in multiple chunks are merged into a single entity containing all the mentions. The salience
+// of the merged entity is the maximum salience in any chunk; sentiments are combined with mergeSentiment.
+func mergeEntities(chunks []textChunk, results [][]*languagepb.Entity) []*languagepb.Entity {
+	merged := make([]*languagepb.Entity, 0, 10)
+	byKey := map[string]*languagepb.Entity{}
+
+	for i, entities := range results {
+		offset := int32(chunks[i].Offset)
+		for _, e := range entities {
+			e = proto.Clone(e).(*languagepb.Entity)
+			for _, m := range e.GetMentions() {
+				if m.Text != nil {
+					m.Text.BeginOffset = m.Text.BeginOffset + offset
+				}
+			}
+
+			key := entityKey(e)
+			existing, ok := byKey[key]
+			if !ok {
+				byKey[key] = e
+				merged = append(merged, e)
+				continue
+			}
+
+			existing.Mentions = append(existing.Mentions, e.Mentions...)
+			if e.GetSalience() > existing.GetSalience() {
+				existing.Salience = e.GetSalience()
+			}
+			if e.GetSentiment() != nil {
+				existing.Sentiment = mergeSentiment(existing.GetSentiment(), e.GetSentiment())
+			}
+			for k, v := range e.GetMetadata() {
+				if existing.Metadata == nil {
+					existing.Metadata = map[string]string{}
+				}
+				if _, ok := existing.Metadata[k]; !ok {
+					existing.Metadata[k] = v
+				}
+			}
+		}
+	}
+	return merged
+}
+
+// mergeSentiment combines the sentiment of an entity in two chunks. Magnitudes are summed and the score
+// is the average of the scores weighted by magnitude.
+func mergeSentiment(a *languagepb.Sentiment, b *languagepb.Sentiment) *languagepb.Sentiment {
+	if a == nil {
+		return b
+	}
+
+	magnitude := a.GetMagnitude() + b.GetMagnitude()
+	if magnitude == 0 {
+		return &languagepb.Sentiment{Score: (a.GetScore() + b.GetScore()) / 2}
+	}
+	return &languagepb.Sentiment{
+		Magnitude: magnitude,
+		Score:     (a.GetScore()*a.GetMagnitude() + b.GetScore()*b.GetMagnitude()) / magnitude,
+	}
+}
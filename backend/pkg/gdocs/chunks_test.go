@@ -0,0 +1,249 @@
+package gdocs
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	gax "github.com/googleapis/gax-go/v2"
+	"github.com/jlewi/p22h/backend/pkg/glanguage"
+	languagepb "google.golang.org/genproto/googleapis/cloud/language/v1"
+	"google.golang.org/protobuf/testing/protocmp"
+	"strings"
+	"testing"
+)
+
+func Test_chunkText(t *testing.T) {
+	type testCase struct {
+		name     string
+		text     string
+		maxBytes int
+		expected []textChunk
+	}
+
+	cases := []testCase{
+		{
+			name:     "fits",
+			text:     "para one\npara two\n",
+			maxBytes: 100,
+			expected: []textChunk{
+				{Text: "para one\npara two\n", Offset: 0},
+			},
+		},
+		{
+			name:     "paragraphs",
+			text:     "para one\npara two\npara three",
+			maxBytes: 19,
+			expected: []textChunk{
+				{Text: "para one\npara two\n", Offset: 0},
+				{Text: "para three", Offset: 18},
+			},
+		},
+		{
+			name:     "long-paragraph",
+			text:     "abcdefghij\nxy\n",
+			maxBytes: 4,
+			expected: []textChunk{
+				{Text: "abcd", Offset: 0},
+				{Text: "efgh", Offset: 4},
+				{Text: "ij\n", Offset: 8},
+				{Text: "xy\n", Offset: 11},
+			},
+		},
+		{
+			name: "multibyte",
+			// é is 2 bytes so the split must not fall in the middle of it.
+			text:     "abcé",
+			maxBytes: 4,
+			expected: []textChunk{
+				{Text: "abc", Offset: 0},
+				{Text: "é", Offset: 3},
+			},
+		},
+		{
+			name:     "empty",
+			text:     "",
+			maxBytes: 4,
+			expected: []textChunk{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			actual := chunkText(c.text, c.maxBytes)
+			if d := cmp.Diff(c.expected, actual); d != "" {
+				t.Errorf("Did not get expected chunks; diff:\n%v", d)
+			}
+
+			for _, chunk := range actual {
+				if len(chunk.Text) > c.maxBytes {
+					t.Errorf("Chunk %q is larger than %v bytes", chunk.Text, c.maxBytes)
+				}
+				if c.text[chunk.Offset:chunk.Offset+len(chunk.Text)] != chunk.Text {
+					t.Errorf("Chunk %q doesn't match text at offset %v", chunk.Text, chunk.Offset)
+				}
+			}
+		})
+	}
+}
+
+// wordClient is a fake NL API client that returns an entity for each occurrence of the words in the request.
+type wordClient struct {
+	words []string
+	// entityType is the type of the entities; defaults to ORGANIZATION.
+	entityType languagepb.Entity_Type
+	numCalls   int
+}
+
+func (c *wordClient) AnalyzeEntities(ctx context.Context, req *languagepb.AnalyzeEntitiesRequest, opts ...gax.CallOption) (*languagepb.AnalyzeEntitiesResponse, error) {
+	c.numCalls += 1
+	text := req.GetDocument().GetContent()
+	resp := &languagepb.AnalyzeEntitiesResponse{}
+	entityType := c.entityType
+	if entityType == languagepb.Entity_UNKNOWN {
+		entityType = languagepb.Entity_ORGANIZATION
+	}
+	for _, w := range c.words {
+		e := &languagepb.Entity{
+			Name:     w,
+			Type:     entityType,
+			Salience: float32(strings.Count(text, w)) / 10,
+		}
+		offset := 0
+		for {
+			i := strings.Index(text[offset:], w)
+			if i < 0 {
+				break
+			}
+			e.Mentions = append(e.Mentions, &languagepb.EntityMention{
+				Text: &languagepb.TextSpan{
+					Content:     w,
+					BeginOffset: int32(offset + i),
+				},
+				Type: languagepb.EntityMention_PROPER,
+			})
+			offset = offset + i + len(w)
+		}
+		if len(e.Mentions) > 0 {
+			resp.Entities = append(resp.Entities, e)
+		}
+	}
+	return resp, nil
+}
+
+func (c *wordClient) AnalyzeEntitySentiment(ctx context.Context, req *languagepb.AnalyzeEntitySentimentRequest, opts ...gax.CallOption) (*languagepb.AnalyzeEntitySentimentResponse, error) {
+	resp, err := c.AnalyzeEntities(ctx, &languagepb.AnalyzeEntitiesRequest{Document: req.GetDocument()})
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range resp.Entities {
+		e.Sentiment = &languagepb.Sentiment{Score: 0.5, Magnitude: float32(len(e.Mentions))}
+		for _, m := range e.Mentions {
+			m.Sentiment = &languagepb.Sentiment{Score: 0.5, Magnitude: 1}
+		}
+	}
+	return &languagepb.AnalyzeEntitySentimentResponse{Entities: resp.Entities}, nil
+}
+
+// AnalyzeSyntax returns a token for each whitespace separated word in the request. Words in the request are tagged as
+// nouns and all other tokens as verbs.
+func (c *wordClient) AnalyzeSyntax(ctx context.Context, req *languagepb.AnalyzeSyntaxRequest, opts ...gax.CallOption) (*languagepb.AnalyzeSyntaxResponse, error) {
+	c.numCalls += 1
+	text := req.GetDocument().GetContent()
+	resp := &languagepb.AnalyzeSyntaxResponse{}
+	offset := 0
+	for _, f := range strings.Fields(text) {
+		i := strings.Index(text[offset:], f)
+		tag := languagepb.PartOfSpeech_VERB
+		for _, w := range c.words {
+			if f == w {
+				tag = languagepb.PartOfSpeech_NOUN
+			}
+		}
+		resp.Tokens = append(resp.Tokens, &languagepb.Token{
+			Text: &languagepb.TextSpan{
+				Content:     f,
+				BeginOffset: int32(offset + i),
+			},
+			PartOfSpeech: &languagepb.PartOfSpeech{Tag: tag},
+			Lemma:        strings.ToLower(f),
+		})
+		offset = offset + i + len(f)
+	}
+	return resp, nil
+}
+
+// ClassifyText returns a category for each of the words in the request.
+func (c *wordClient) ClassifyText(ctx context.Context, req *languagepb.ClassifyTextRequest, opts ...gax.CallOption) (*languagepb.ClassifyTextResponse, error) {
+	c.numCalls += 1
+	text := req.GetDocument().GetContent()
+	resp := &languagepb.ClassifyTextResponse{}
+	for _, w := range c.words {
+		if !strings.Contains(text, w) {
+			continue
+		}
+		resp.Categories = append(resp.Categories, &languagepb.ClassificationCategory{
+			Name:       "/Computers & Electronics/" + w,
+			Confidence: 0.5,
+		})
+	}
+	return resp, nil
+}
+
+var _ glanguage.Client = &wordClient{}
+
+func Test_analyzeEntities(t *testing.T) {
+	text := "kubeflow is great.\nkubeflow uses kubernetes.\nkubernetes is everywhere.\n"
+	client := &wordClient{words: []string{"kubeflow", "kubernetes"}}
+
+	actual, err := analyzeEntities(context.Background(), client, text, 30, false)
+	if err != nil {
+		t.Fatalf("analyzeEntities failed; error %v", err)
+	}
+
+	if client.numCalls != 3 {
+		t.Errorf("Got %v calls; want 3", client.numCalls)
+	}
+
+	mention := func(w string, offset int32) *languagepb.EntityMention {
+		return &languagepb.EntityMention{
+			Text: &languagepb.TextSpan{
+				Content:     w,
+				BeginOffset: offset,
+			},
+			Type: languagepb.EntityMention_PROPER,
+		}
+	}
+
+	expected := []*languagepb.Entity{
+		{
+			Name:     "kubeflow",
+			Type:     languagepb.Entity_ORGANIZATION,
+			Salience: 0.1,
+			Mentions: []*languagepb.EntityMention{
+				mention("kubeflow", 0),
+				mention("kubeflow", 19),
+			},
+		},
+		{
+			Name:     "kubernetes",
+			Type:     languagepb.Entity_ORGANIZATION,
+			Salience: 0.1,
+			Mentions: []*languagepb.EntityMention{
+				mention("kubernetes", 33),
+				mention("kubernetes", 45),
+			},
+		},
+	}
+
+	if d := cmp.Diff(expected, actual, protocmp.Transform()); d != "" {
+		t.Errorf("Did not get expected entities; diff:\n%v", d)
+	}
+
+	for _, e := range actual {
+		for _, m := range e.GetMentions() {
+			start := m.GetText().GetBeginOffset()
+			if text[start:int(start)+len(m.GetText().GetContent())] != m.GetText().GetContent() {
+				t.Errorf("Mention %v at offset %v doesn't match the text", m.GetText().GetContent(), start)
+			}
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package gdocs
+
+import (
+	"context"
+	"github.com/jlewi/p22h/backend/pkg/glanguage"
+	"github.com/pkg/errors"
+	languagepb "google.golang.org/genproto/googleapis/cloud/language/v1"
+)
+
+// ClassifyText returns the content categories for the text.
+//
+// Only the first MaxRequestBytes of text are classified; that is more than enough to determine the topic of a
+// document and avoids paying to classify every chunk of long documents.
+func ClassifyText(ctx context.Context, client glanguage.Client, text string) ([]*languagepb.ClassificationCategory, error) {
+	chunks := chunkText(text, MaxRequestBytes)
+	if len(chunks) == 0 {
+		return []*languagepb.ClassificationCategory{}, nil
+	}
+
+	// TODO(jeremy): Retries?
+	resp, err := client.ClassifyText(ctx, &languagepb.ClassifyTextRequest{
+		Document: &languagepb.Document{
+			Source: &languagepb.Document_Content{
+				Content: chunks[0].Text,
+			},
+			Type: languagepb.Document_PLAIN_TEXT,
+		},
+	})
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to call NLP API.")
+	}
+
+	return resp.GetCategories(), nil
+}
@@ -62,7 +62,7 @@ func (c *Client) Search(query string, driveId string, corpora string, resultFunc
 		if pageToken != "" {
 			l.PageToken(pageToken)
 		}
-		r, err := l.PageSize(pageSize).Fields("nextPageToken, files(id, name, mimeType, md5Checksum, size)").Do()
+		r, err := l.PageSize(pageSize).Fields("nextPageToken, files(id, name, mimeType, md5Checksum, size, modifiedTime, createdTime)").Do()
 
 		if err != nil {
 			return errors.Wrapf(err, "Failed to fetch results from drive")
@@ -43,6 +43,15 @@ func Test_GetEntities(t *testing.T) {
 					{
 						Name: "john",
 						Type: languagepb.Entity_PERSON,
+						Mentions: []*languagepb.EntityMention{
+							{
+								Type: languagepb.EntityMention_PROPER,
+							},
+						},
+					},
+					{
+						Name: "yesterday",
+						Type: languagepb.Entity_DATE,
 					},
 				},
 			},
@@ -50,6 +59,11 @@ func Test_GetEntities(t *testing.T) {
 				{
 					Name: "john",
 					Type: languagepb.Entity_PERSON,
+					Mentions: []*languagepb.EntityMention{
+						{
+							Type: languagepb.EntityMention_PROPER,
+						},
+					},
 				},
 			},
 		},
@@ -76,12 +90,12 @@ func Test_GetEntities(t *testing.T) {
 
 			mockLanguage.Resps = []proto.Message{c.response}
 
-			links, err := GetEntities(context.Background(), lClient, doc)
+			links, err := GetEntities(context.Background(), lClient, doc, EntityOptions{})
 			if err != nil {
 				t.Fatalf("failed to get links; error %v", err)
 			}
 
-			if d := cmp.Diff(c.expected, links, EntityIgnored); d != "" {
+			if d := cmp.Diff(c.expected, links, EntityIgnored, EntityMentionIgnored); d != "" {
 				t.Errorf("Actual links didn't match; diff:\n%v", d)
 			}
 		})
@@ -122,7 +136,11 @@ func Test_newEntityCandidates(t *testing.T) {
 				t.Fatalf("failed to unmarshal AnalyzeEntitiesResponse from file; %v; error %v", p, err)
 			}
 
-			actual := newEntityCandidates(resp.GetEntities())
+			filter := DefaultEntityFilter()
+			if err := filter.Validate(); err != nil {
+				t.Fatalf("Default filter is invalid; error %v", err)
+			}
+			actual := newEntityCandidates(resp.GetEntities(), filter)
 
 			ePath := filepath.Join(testData, c.expectedFile)
 			expB, err := ioutil.ReadFile(ePath)
@@ -0,0 +1,147 @@
+package gdocs
+
+import (
+	"github.com/jlewi/p22h/backend/pkg/glanguage"
+	"github.com/pkg/errors"
+	languagepb "google.golang.org/genproto/googleapis/cloud/language/v1"
+	"io/ioutil"
+	"sigs.k8s.io/yaml"
+	"strings"
+)
+
+const (
+	// MentionPolicyAny keeps entities regardless of the type of their mentions.
+	MentionPolicyAny = "any"
+	// MentionPolicyProper keeps entities only if at least one mention is a proper noun.
+	MentionPolicyProper = "proper"
+	// MentionPolicyProperOrLinked keeps entities that have at least one proper noun mention or that the NL API
+	// linked to an entry in its knowledge graph (i.e. there is a MID or Wikipedia URL).
+	MentionPolicyProperOrLinked = "properOrLinked"
+)
+
+// EntityFilter is the policy used to decide which entities returned by the NL API could represent new entities.
+//
+// The zero value is not a useful policy; use DefaultEntityFilter or ReadEntityFilter and then call Validate.
+type EntityFilter struct {
+	// AllowedTypes is the list of entity types to keep e.g. PERSON, ORGANIZATION. Values are the names of
+	// languagepb.Entity_Type. If it is nil all types are allowed; an empty list is invalid since it would keep
+	// no entities.
+	AllowedTypes []string `json:"allowedTypes,omitempty"`
+
+	// MinSalience is the minimum salience an entity must have to be kept.
+	MinSalience float32 `json:"minSalience,omitempty"`
+
+	// MentionPolicy is one of MentionPolicyAny, MentionPolicyProper or MentionPolicyProperOrLinked.
+	// Defaults to MentionPolicyProperOrLinked.
+	MentionPolicy string `json:"mentionPolicy,omitempty"`
+
+	// StopList is a list of entity names to always drop. Matching is case-insensitive.
+	StopList []string `json:"stopList,omitempty"`
+
+	allowed map[languagepb.Entity_Type]bool
+	stop    map[string]bool
+}
+
+// DefaultEntityFilter returns the default policy.
+//
+// Entities such as addresses, dates and numbers are not "things" we want to track. OTHER returns a lot of
+// spammy organizations so it is excluded as well.
+func DefaultEntityFilter() *EntityFilter {
+	return &EntityFilter{
+		AllowedTypes: []string{
+			languagepb.Entity_UNKNOWN.String(),
+			languagepb.Entity_PERSON.String(),
+			languagepb.Entity_ORGANIZATION.String(),
+			languagepb.Entity_EVENT.String(),
+			languagepb.Entity_CONSUMER_GOOD.String(),
+		},
+		MentionPolicy: MentionPolicyProperOrLinked,
+	}
+}
+
+// ReadEntityFilter reads the policy from a YAML or JSON file.
+// Fields not set in the file keep their default values.
+func ReadEntityFilter(path string) (*EntityFilter, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read entity filter file: %v", path)
+	}
+
+	f := DefaultEntityFilter()
+	if err := yaml.Unmarshal(b, f); err != nil {
+		return nil, errors.Wrapf(err, "Failed to unmarshal entity filter from file: %v", path)
+	}
+
+	if err := f.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "Invalid entity filter in file: %v", path)
+	}
+	return f, nil
+}
+
+// Validate checks the policy and builds the lookup tables used by Keep.
+// It must be called after modifying any of the fields.
+func (f *EntityFilter) Validate() error {
+	if f.MentionPolicy == "" {
+		f.MentionPolicy = MentionPolicyProperOrLinked
+	}
+
+	switch f.MentionPolicy {
+	case MentionPolicyAny, MentionPolicyProper, MentionPolicyProperOrLinked:
+	default:
+		return errors.Errorf("Invalid mentionPolicy %v; must be one of %v, %v, %v", f.MentionPolicy, MentionPolicyAny, MentionPolicyProper, MentionPolicyProperOrLinked)
+	}
+
+	if f.MinSalience < 0 || f.MinSalience > 1 {
+		return errors.Errorf("Invalid minSalience %v; must be in [0, 1]", f.MinSalience)
+	}
+
+	if f.AllowedTypes != nil && len(f.AllowedTypes) == 0 {
+		return errors.New("Invalid allowedTypes; it must list at least one entity type or be omitted to allow all types")
+	}
+
+	f.allowed = map[languagepb.Entity_Type]bool{}
+	for _, t := range f.AllowedTypes {
+		v, ok := languagepb.Entity_Type_value[strings.ToUpper(t)]
+		if !ok {
+			return errors.Errorf("Invalid entity type %v", t)
+		}
+		f.allowed[languagepb.Entity_Type(v)] = true
+	}
+
+	f.stop = map[string]bool{}
+	for _, n := range f.StopList {
+		f.stop[strings.ToLower(n)] = true
+	}
+	return nil
+}
+
+// Keep returns true if the entity passes the policy.
+func (f *EntityFilter) Keep(e *languagepb.Entity) bool {
+	if len(f.allowed) > 0 && !f.allowed[e.GetType()] {
+		return false
+	}
+
+	if e.GetSalience() < f.MinSalience {
+		return false
+	}
+
+	if f.stop[strings.ToLower(e.GetName())] {
+		return false
+	}
+
+	switch f.MentionPolicy {
+	case MentionPolicyAny:
+		return true
+	case MentionPolicyProperOrLinked:
+		if glanguage.GetWikipediaURL(e) != "" || glanguage.GetMID(e) != "" {
+			return true
+		}
+	}
+
+	for _, m := range e.GetMentions() {
+		if m.GetType() == languagepb.EntityMention_PROPER {
+			return true
+		}
+	}
+	return false
+}
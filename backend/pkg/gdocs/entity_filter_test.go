@@ -0,0 +1,157 @@
+package gdocs
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/jlewi/p22h/backend/pkg/glanguage"
+	languagepb "google.golang.org/genproto/googleapis/cloud/language/v1"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func Test_EntityFilter(t *testing.T) {
+	proper := []*languagepb.EntityMention{{Type: languagepb.EntityMention_PROPER}}
+	common := []*languagepb.EntityMention{{Type: languagepb.EntityMention_COMMON}}
+	linked := map[string]string{glanguage.MIDKey: "/m/1234"}
+
+	type testCase struct {
+		name     string
+		filter   *EntityFilter
+		entity   *languagepb.Entity
+		expected bool
+	}
+
+	cases := []testCase{
+		{
+			name:     "default-allowed-type",
+			filter:   DefaultEntityFilter(),
+			entity:   &languagepb.Entity{Name: "john", Type: languagepb.Entity_PERSON, Mentions: proper},
+			expected: true,
+		},
+		{
+			name:     "default-excluded-type",
+			filter:   DefaultEntityFilter(),
+			entity:   &languagepb.Entity{Name: "1234 Main St", Type: languagepb.Entity_ADDRESS, Mentions: proper},
+			expected: false,
+		},
+		{
+			name:     "default-excluded-other",
+			filter:   DefaultEntityFilter(),
+			entity:   &languagepb.Entity{Name: "team", Type: languagepb.Entity_OTHER, Mentions: proper},
+			expected: false,
+		},
+		{
+			name:     "all-types-allowed",
+			filter:   &EntityFilter{MentionPolicy: MentionPolicyAny},
+			entity:   &languagepb.Entity{Name: "yesterday", Type: languagepb.Entity_DATE},
+			expected: true,
+		},
+		{
+			name:     "below-min-salience",
+			filter:   &EntityFilter{MinSalience: 0.5, MentionPolicy: MentionPolicyAny},
+			entity:   &languagepb.Entity{Name: "john", Salience: 0.1},
+			expected: false,
+		},
+		{
+			name:     "above-min-salience",
+			filter:   &EntityFilter{MinSalience: 0.5, MentionPolicy: MentionPolicyAny},
+			entity:   &languagepb.Entity{Name: "john", Salience: 0.7},
+			expected: true,
+		},
+		{
+			name:     "proper-policy-common-mention",
+			filter:   &EntityFilter{MentionPolicy: MentionPolicyProper},
+			entity:   &languagepb.Entity{Name: "john", Mentions: common, Metadata: linked},
+			expected: false,
+		},
+		{
+			name:     "proper-policy-proper-mention",
+			filter:   &EntityFilter{MentionPolicy: MentionPolicyProper},
+			entity:   &languagepb.Entity{Name: "john", Mentions: proper},
+			expected: true,
+		},
+		{
+			name:     "proper-or-linked-policy-linked",
+			filter:   &EntityFilter{MentionPolicy: MentionPolicyProperOrLinked},
+			entity:   &languagepb.Entity{Name: "kubeflow", Mentions: common, Metadata: linked},
+			expected: true,
+		},
+		{
+			name:     "proper-or-linked-policy-common",
+			filter:   &EntityFilter{MentionPolicy: MentionPolicyProperOrLinked},
+			entity:   &languagepb.Entity{Name: "kubeflow", Mentions: common},
+			expected: false,
+		},
+		{
+			name:     "stop-list",
+			filter:   &EntityFilter{MentionPolicy: MentionPolicyAny, StopList: []string{"Google"}},
+			entity:   &languagepb.Entity{Name: "google", Mentions: proper},
+			expected: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := c.filter.Validate(); err != nil {
+				t.Fatalf("Filter is invalid; error %v", err)
+			}
+
+			if actual := c.filter.Keep(c.entity); actual != c.expected {
+				t.Errorf("Keep returned %v; want %v", actual, c.expected)
+			}
+		})
+	}
+}
+
+func Test_EntityFilterValidate(t *testing.T) {
+	cases := map[string]*EntityFilter{
+		"bad-type":     {AllowedTypes: []string{"NOT_A_TYPE"}},
+		"no-types":     {AllowedTypes: []string{}},
+		"bad-policy":   {MentionPolicy: "sometimes"},
+		"bad-salience": {MinSalience: 2},
+	}
+
+	for name, f := range cases {
+		t.Run(name, func(t *testing.T) {
+			if err := f.Validate(); err == nil {
+				t.Errorf("Validate should have returned an error")
+			}
+		})
+	}
+}
+
+func Test_ReadEntityFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "entityFilter")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+
+	p := filepath.Join(dir, "filter.yaml")
+	contents := `
+allowedTypes:
+  - person
+minSalience: 0.25
+stopList:
+  - Google
+`
+	if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+		t.Fatalf("Failed to write file %v; error %v", p, err)
+	}
+
+	actual, err := ReadEntityFilter(p)
+	if err != nil {
+		t.Fatalf("Failed to read filter; error %v", err)
+	}
+
+	expected := &EntityFilter{
+		AllowedTypes:  []string{"person"},
+		MinSalience:   0.25,
+		MentionPolicy: MentionPolicyProperOrLinked,
+		StopList:      []string{"Google"},
+	}
+
+	if d := cmp.Diff(expected, actual, cmpopts.IgnoreUnexported(EntityFilter{})); d != "" {
+		t.Errorf("Did not get expected filter; diff:\n%v", d)
+	}
+}
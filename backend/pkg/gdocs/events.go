@@ -0,0 +1,123 @@
+package gdocs
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// EventDocStarted is emitted when the indexer starts processing a doc.
+	EventDocStarted = "docStarted"
+	// EventLinksFound is emitted once the links in a doc are stored.
+	EventLinksFound = "linksFound"
+	// EventEntitiesFound is emitted once the entities in a doc are stored.
+	EventEntitiesFound = "entitiesFound"
+	// EventDocFailed is emitted when a doc couldn't be processed.
+	EventDocFailed = "docFailed"
+	// EventRunFinished is emitted when Index or IndexDocument finishes.
+	EventRunFinished = "runFinished"
+
+	// subscriberBuffer is the number of events buffered for each subscriber of an EventHub.
+	subscriberBuffer = 100
+)
+
+// IndexEvent reports the progress of the indexer.
+type IndexEvent struct {
+	// Type is one of the Event* constants.
+	Type string
+	Time time.Time
+	// JobID is the id of the index job emitting the event if it was run by a JobManager.
+	JobID string
+	// DocID and Name identify the doc; they are empty for EventRunFinished.
+	DocID string
+	Name  string
+	// NumLinks is set for EventLinksFound.
+	NumLinks int
+	// NumEntities is set for EventEntitiesFound.
+	NumEntities int
+	// NumDocs is the number of docs processed; it is set for EventRunFinished.
+	NumDocs int
+	// Error is set for EventDocFailed and for EventRunFinished if the run failed.
+	Error string
+}
+
+// IndexObserver is notified of the progress of the indexer.
+//
+// OnIndexEvent is called synchronously from the indexer so it should return quickly.
+type IndexObserver interface {
+	OnIndexEvent(e IndexEvent)
+}
+
+// ObserverFunc is an IndexObserver implemented by a function.
+type ObserverFunc func(e IndexEvent)
+
+// OnIndexEvent calls f.
+func (f ObserverFunc) OnIndexEvent(e IndexEvent) {
+	f(e)
+}
+
+// emit notifies the observers of the event.
+func (idx *Indexer) emit(e IndexEvent) {
+	if len(idx.observers) == 0 {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	for _, o := range idx.observers {
+		o.OnIndexEvent(e)
+	}
+}
+
+// EventHub is an IndexObserver which broadcasts events to any number of subscribers e.g. clients of the events
+// stream.
+//
+// Subscribers that don't keep up miss events rather than block the indexer.
+type EventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan IndexEvent]bool
+}
+
+// NewEventHub creates a new hub.
+func NewEventHub() *EventHub {
+	return &EventHub{
+		subscribers: map[chan IndexEvent]bool{},
+	}
+}
+
+// OnIndexEvent sends the event to every subscriber.
+func (h *EventHub) OnIndexEvent(e IndexEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for c := range h.subscribers {
+		select {
+		case c <- e:
+		default:
+			// Drop the event; the subscriber is too slow.
+		}
+	}
+}
+
+// Subscribe returns a channel receiving events and a function to unsubscribe. The channel is closed once
+// unsubscribe is called.
+func (h *EventHub) Subscribe() (<-chan IndexEvent, func()) {
+	c := make(chan IndexEvent, subscriberBuffer)
+
+	h.mu.Lock()
+	h.subscribers[c] = true
+	h.mu.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.subscribers, c)
+			h.mu.Unlock()
+			close(c)
+		})
+	}
+	return c, unsubscribe
+}
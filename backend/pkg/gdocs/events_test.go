@@ -0,0 +1,96 @@
+package gdocs
+
+import (
+	"github.com/jlewi/p22h/backend/pkg/datastore"
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"google.golang.org/api/docs/v1"
+	"google.golang.org/api/drive/v3"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func Test_EventHub(t *testing.T) {
+	hub := NewEventHub()
+
+	events, unsubscribe := hub.Subscribe()
+
+	// A subscriber which never reads shouldn't block the hub.
+	_, slowUnsubscribe := hub.Subscribe()
+	defer slowUnsubscribe()
+
+	for i := 0; i < subscriberBuffer+10; i++ {
+		hub.OnIndexEvent(IndexEvent{Type: EventDocStarted})
+		<-events
+	}
+
+	hub.OnIndexEvent(IndexEvent{Type: EventRunFinished})
+	if e := <-events; e.Type != EventRunFinished {
+		t.Errorf("Got event %v; want %v", e.Type, EventRunFinished)
+	}
+
+	unsubscribe()
+	// Unsubscribing more than once is allowed.
+	unsubscribe()
+
+	if _, ok := <-events; ok {
+		t.Errorf("Channel wasn't closed after unsubscribing")
+	}
+
+	// Publishing after a subscriber is removed mustn't panic.
+	hub.OnIndexEvent(IndexEvent{Type: EventRunFinished})
+}
+
+func Test_JobManagerEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testDatabase")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+
+	log, err := logging.InitLogger("info", true)
+	if err != nil {
+		t.Fatalf("Failed to initialize logger; %v", err)
+	}
+
+	store, err := datastore.New(path.Join(dir, "database.db"), *log)
+	if err != nil {
+		t.Fatalf("Failed to create datastore; error %v", err)
+	}
+
+	searcher := &fakeSearcher{
+		files: []*drive.File{
+			{Id: "file1", Name: "File 1", MimeType: "application/pdf"},
+			{Id: "file2", Name: "File 2", MimeType: "application/pdf"},
+		},
+	}
+
+	newIndexer := func(opts ...IndexerOption) (*Indexer, error) {
+		return NewIndexer(searcher, &docs.Service{}, store, &wordClient{}, *log, opts...)
+	}
+
+	var events []IndexEvent
+	observer := ObserverFunc(func(e IndexEvent) {
+		events = append(events, e)
+	})
+
+	m, err := NewJobManager(store, newIndexer, *log, JobManagerWithObserver(observer))
+	if err != nil {
+		t.Fatalf("Failed to create job manager; error %v", err)
+	}
+
+	job, err := m.Start("drive1", "", "")
+	if err != nil {
+		t.Fatalf("Failed to start job; error %v", err)
+	}
+	m.Wait()
+
+	// Files which aren't Google Docs are skipped so the only event is the end of the run.
+	if len(events) != 1 {
+		t.Fatalf("Got %v events; want 1: %+v", len(events), events)
+	}
+
+	e := events[0]
+	if e.Type != EventRunFinished || e.JobID != job.ID || e.NumDocs != 2 || e.Error != "" || e.Time.IsZero() {
+		t.Errorf("Unexpected event %+v", e)
+	}
+}
@@ -1,7 +1,6 @@
 package gdocs
 
 import (
-	language "cloud.google.com/go/language/apiv1"
 	"context"
 	"github.com/go-logr/logr"
 	"github.com/google/uuid"
@@ -13,22 +12,62 @@ import (
 	"google.golang.org/api/docs/v1"
 	"google.golang.org/api/drive/v3"
 	"google.golang.org/api/option"
+	languagepb "google.golang.org/genproto/googleapis/cloud/language/v1"
 	"net/http"
+	"sort"
+	"time"
 )
 
 // Indexer indexes Google Drive.
 type Indexer struct {
 	log        logr.Logger
-	store      *datastore.Datastore
+	store      datastore.Store
 	httpClient *http.Client
 	searcher   DriveSearch
 
 	docsService *docs.Service
-	nlpClient   *language.Client
+	nlpClient   glanguage.Client
+
+	// entityFilter is the policy used to select candidate entities. If nil the default policy is used.
+	entityFilter *EntityFilter
+
+	// entitySentiment if true means entity sentiment is computed.
+	entitySentiment bool
+
+	// redactor if set masks sensitive text before it is sent to the NL API.
+	redactor Redactor
+
+	// classify if true means documents are classified into content categories with ClassifyText.
+	classify bool
+
+	// keyphrases if true means noun phrases are extracted with AnalyzeSyntax.
+	keyphrases bool
+
+	// people if true means the owners and editors of files are fetched from Drive and stored as person entities.
+	people bool
+
+	// acls if true means the principals that can read each file are stored so results can be filtered by caller.
+	acls bool
+
+	// progress if set is updated as docs are processed.
+	progress *IndexProgress
+
+	// observers are notified of index events.
+	observers []IndexObserver
+
+	// meter if set is the UsageMeter metering the NL API usage of nlpClient. It is only used to report usage.
+	meter *UsageMeter
+
+	// driveId is the id of the drive currently being indexed. It is used to attribute NL API usage.
+	driveId string
+
+	// touchedEntities are the entities whose mentions changed in the current run. Their co-occurrences are
+	// recomputed once the run finishes.
+	touchedEntities map[string]bool
 }
 
 // NewIndexer creates a new indexer
-func NewIndexer(searcher DriveSearch, docsService *docs.Service, store *datastore.Datastore, nlpClient *language.Client, log logr.Logger, opts ...IndexerOption) (*Indexer, error) {
+func NewIndexer(searcher DriveSearch, docsService *docs.Service, store datastore.Store, nlpClient glanguage.Client, log logr.Logger, opts ...IndexerOption) (*Indexer, error) {
 	if searcher == nil {
 		return nil, errors.New("client is required")
 	}
@@ -74,28 +113,129 @@ func IndexerWithHTTPClient(c *http.Client) IndexerOption {
 	}
 }
 
+// IndexerWithEntityFilter sets the policy used to select candidate entities.
+// The filter should already have been validated.
+func IndexerWithEntityFilter(f *EntityFilter) IndexerOption {
+	return func(idx *Indexer) {
+		idx.entityFilter = f
+	}
+}
+
+// IndexerWithEntitySentiment enables computing the sentiment of entities with AnalyzeEntitySentiment.
+func IndexerWithEntitySentiment(enabled bool) IndexerOption {
+	return func(idx *Indexer) {
+		idx.entitySentiment = enabled
+	}
+}
+
+// IndexerWithRedactor sets the Redactor used to mask text before it is sent to the NL API.
+func IndexerWithRedactor(r Redactor) IndexerOption {
+	return func(idx *Indexer) {
+		idx.redactor = r
+	}
+}
+
+// IndexerWithClassification enables classifying documents into content categories with ClassifyText.
+func IndexerWithClassification(enabled bool) IndexerOption {
+	return func(idx *Indexer) {
+		idx.classify = enabled
+	}
+}
+
+// IndexerWithKeyphrases enables extracting keyphrases (noun phrases) with AnalyzeSyntax.
+func IndexerWithKeyphrases(enabled bool) IndexerOption {
+	return func(idx *Indexer) {
+		idx.keyphrases = enabled
+	}
+}
+
+// IndexerWithPeople enables creating person entities for the owners, last modifying users and collaborators of
+// files. PERSON mentions whose name matches one of these people are linked to them.
+func IndexerWithPeople(enabled bool) IndexerOption {
+	return func(idx *Indexer) {
+		idx.people = enabled
+	}
+}
+
+// IndexerWithACLs enables storing the Drive ACL of each file so that API responses can be filtered to the docs
+// the caller can read.
+func IndexerWithACLs(enabled bool) IndexerOption {
+	return func(idx *Indexer) {
+		idx.acls = enabled
+	}
+}
+
+// IndexerWithProgress reports the number of docs processed to p.
+func IndexerWithProgress(p *IndexProgress) IndexerOption {
+	return func(idx *Indexer) {
+		idx.progress = p
+	}
+}
+
+// IndexerWithObserver notifies o of index events. It can be used more than once to add multiple observers.
+func IndexerWithObserver(o IndexObserver) IndexerOption {
+	return func(idx *Indexer) {
+		idx.observers = append(idx.observers, o)
+	}
+}
+
+// IndexerWithUsageMeter sets the UsageMeter metering the NL API usage of the indexer so callers can report the
+// usage of its runs. It doesn't meter nlpClient; the client passed to NewIndexer must already use m.
+func IndexerWithUsageMeter(m *UsageMeter) IndexerOption {
+	return func(idx *Indexer) {
+		idx.meter = m
+	}
+}
+
+// UsageMeter returns the UsageMeter set with IndexerWithUsageMeter or nil.
+func (idx *Indexer) UsageMeter() *UsageMeter {
+	return idx.meter
+}
+
 // newDbInserter returns a ResultFunc that will insert documents into a datastore.
-func newDbInserter(store *datastore.Datastore) (ResultFunc, error) {
+func newDbInserter(store datastore.Store) (ResultFunc, error) {
 	if store == nil {
 		return nil, errors.New("store can't be nil")
 	}
 
 	return func(f *drive.File) error {
-		r := datastore.DocReference{
-			DriveId:     f.Id,
-			Name:        f.Name,
-			MimeType:    f.MimeType,
-			Md5Checksum: f.Md5Checksum,
-		}
-
-		return store.UpdateDocReference(&r)
+		return store.UpdateDocReference(newDocReference(f))
 	}, nil
 }
 
+// newDocReference creates a DocReference from the Drive metadata for the file.
+func newDocReference(f *drive.File) *datastore.DocReference {
+	return &datastore.DocReference{
+		DriveId:         f.Id,
+		Name:            f.Name,
+		MimeType:        f.MimeType,
+		Md5Checksum:     f.Md5Checksum,
+		ModifiedTime:    parseDriveTime(f.ModifiedTime),
+		FileCreatedTime: parseDriveTime(f.CreatedTime),
+	}
+}
+
+// parseDriveTime parses an RFC 3339 timestamp returned by the Drive API. The zero time is returned if the
+// timestamp is missing or invalid.
+func parseDriveTime(v string) time.Time {
+	if v == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}
+	}
+	return t.UTC()
+}
+
+// Index indexes the docs in the drive that changed since they were last indexed. If ctx is cancelled indexing
+// stops after the doc being processed.
+//
 // TODO(jeremy): Should rename this IndexFolder or IndexDrive
-func (idx *Indexer) Index(driveId string) error {
+func (idx *Indexer) Index(ctx context.Context, driveId string) error {
 	log := idx.log
 	log.Info("Indexing drive", "driveId", driveId)
+	idx.driveId = driveId
 
 	query := ""
 	corpora := "drive"
@@ -114,42 +254,83 @@ func (idx *Indexer) Index(driveId string) error {
 		return errors.Wrapf(err, "Failed to get docs needing indexing")
 	}
 
+	idx.progress.setTotal(int64(len(docReferences)))
+	numDocs := 0
 	for _, r := range docReferences {
+		if err := ctx.Err(); err != nil {
+			err = errors.Wrapf(err, "Indexing drive %v stopped", driveId)
+			idx.emit(IndexEvent{Type: EventRunFinished, NumDocs: numDocs, Error: err.Error()})
+			return err
+		}
 		idx.ProcessDoc(r)
+		idx.progress.addProcessed(1)
+		numDocs++
 	}
 
-	return nil
+	return idx.finishRun(numDocs)
 }
 
 // IndexDocument indexes a specific document
-func (idx *Indexer) IndexDocument(docId string) error {
+func (idx *Indexer) IndexDocument(ctx context.Context, docId string) error {
 	log := idx.log
 	log.Info("Indexing doc", "driveId", docId)
 
-	svc, err := drive.NewService(context.Background(), option.WithHTTPClient(idx.httpClient))
+	svc, err := drive.NewService(ctx, option.WithHTTPClient(idx.httpClient))
 
 	if err != nil {
 		return errors.Wrapf(err, "Failed to create drive client")
 	}
 
-	f, err := svc.Files.Get(docId).Do()
+	f, err := svc.Files.Get(docId).SupportsAllDrives(true).Fields("id, name, mimeType, md5Checksum, driveId, modifiedTime, createdTime").Context(ctx).Do()
 
 	if err != nil {
 		return errors.Wrapf(err, "Failed to get Drive document: %v", docId)
 	}
 
-	r := &datastore.DocReference{
-		DriveId:     f.Id,
-		Name:        f.Name,
-		MimeType:    f.MimeType,
-		Md5Checksum: f.Md5Checksum,
-	}
+	idx.driveId = f.DriveId
+
+	r := newDocReference(f)
 
 	if err := idx.store.UpdateDocReference(r); err != nil {
 		return errors.Wrapf(err, "Failed to UpdateDocReference; DocId: %v", docId)
 	}
 
+	idx.progress.setTotal(1)
 	idx.ProcessDoc(r)
+	idx.progress.addProcessed(1)
+	return idx.finishRun(1)
+}
+
+// finishRun post processes the docs and emits EventRunFinished.
+func (idx *Indexer) finishRun(numDocs int) error {
+	err := idx.postProcess()
+	e := IndexEvent{Type: EventRunFinished, NumDocs: numDocs}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	idx.emit(e)
+	return err
+}
+
+// postProcess updates data derived from the whole corpus once docs have been processed.
+func (idx *Indexer) postProcess() error {
+	if len(idx.touchedEntities) > 0 {
+		ids := make([]string, 0, len(idx.touchedEntities))
+		for id := range idx.touchedEntities {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		if err := idx.store.UpdateEntityCooccurrencesOf(ids); err != nil {
+			return errors.Wrapf(err, "Failed to update entity co-occurrences")
+		}
+		idx.touchedEntities = nil
+	}
+
+	if idx.keyphrases {
+		if err := idx.store.UpdateKeyphraseWeights(); err != nil {
+			return errors.Wrapf(err, "Failed to update keyphrase weights")
+		}
+	}
 	return nil
 }
 
@@ -169,46 +350,112 @@ func (idx *Indexer) ProcessDoc(r *datastore.DocReference) {
 		log.V(logging.Debug).Info("Skipping document; not a Google Document", "driveId", r.DriveId)
 		return
 	}
+	idx.emit(IndexEvent{Type: EventDocStarted, DocID: r.ID, Name: r.Name})
+
 	d, err := idx.docsService.Documents.Get(r.DriveId).Do()
 	// TODO(jeremy): We probably need to handle the case where a document was deleted or we lost access to it.
 	if err != nil {
 		log.Error(err, "Failed to get document; Was it deleted?", "driveId", r.ID, "name", r.Name)
+		idx.emit(IndexEvent{Type: EventDocFailed, DocID: r.ID, Name: r.Name, Error: err.Error()})
 		return
 	}
 
-	if err := idx.ProcessDocLinks(r, d); err != nil {
-		// Keep going to try to degrade gracefully
-		log.Error(err, "Failed to process links")
+	// Keep going to try to degrade gracefully; the existing links are left as is.
+	links, err := idx.docLinks(r, d)
+	if err != nil {
+		log.Error(err, "Failed to get document links")
+	}
+
+	// The ACL is stored before EventLinksFound is emitted so event subscribers can check the visibility of a new
+	// doc from then on.
+	if idx.people || idx.acls {
+		if f, err := idx.getSharing(r); err != nil {
+			log.Error(err, "Failed to get sharing metadata")
+		} else {
+			// Process people before entities so that PERSON mentions can be linked to them.
+			if idx.people {
+				if err := idx.ProcessPeople(r, f); err != nil {
+					log.Error(err, "Failed to process people")
+				}
+			}
+			if idx.acls {
+				if err := idx.ProcessACL(r, f); err != nil {
+					log.Error(err, "Failed to process ACL")
+				}
+			}
+		}
 	}
 
 	// If there is an error try to keep going even though this means some data might end up being missed.
-	if err := idx.ProcessEntities(r, d); err != nil {
-		log.Error(err, "failed to get entities for document", "driveId", r.ID)
+	nlpSkipped := false
+	entities, err := idx.docEntities(r, d)
+	if err != nil {
+		if errors.Is(err, glanguage.ErrBudgetExceeded) {
+			// Don't mark the document as indexed so that entities are processed by a later run once there is
+			// budget. The existing mentions are left as is until then.
+			log.Info("Skipping entities; Natural Language API budget exceeded")
+			nlpSkipped = true
+		} else {
+			log.Error(err, "failed to get entities for document", "driveId", r.ID)
+		}
+	}
+
+	if err := idx.storeDoc(r, links, entities); err != nil {
+		log.Error(err, "Failed to store links and entities")
+	}
+
+	if idx.keyphrases {
+		if err := idx.ProcessKeyphrases(r, d); err != nil {
+			if errors.Is(err, glanguage.ErrBudgetExceeded) {
+				log.Info("Skipping keyphrases; Natural Language API budget exceeded")
+				nlpSkipped = true
+			} else {
+				log.Error(err, "failed to get keyphrases for document", "driveId", r.ID)
+			}
+		}
+	}
+
+	if idx.classify {
+		if err := idx.ProcessCategories(r, d); err != nil {
+			if errors.Is(err, glanguage.ErrBudgetExceeded) {
+				log.Info("Skipping classification; Natural Language API budget exceeded")
+				nlpSkipped = true
+			} else {
+				log.Error(err, "failed to classify document", "driveId", r.ID)
+			}
+		}
 	}
 
 	r.Md5Checksum = d.RevisionId
-	r.LastIndexedMd5Checksum = d.RevisionId
+	if !nlpSkipped {
+		r.LastIndexedMd5Checksum = d.RevisionId
+	}
 
 	if err := idx.store.UpdateDocReference(r); err != nil {
 		log.Error(err, "failed to update doc reference", "doc", r)
 	}
 }
 
-// ProcessDocLinks processes all the docs for the doc referenced by r and represented by d.
+// ProcessDocLinks processes all the links in the doc referenced by r and represented by d. The doc's existing
+// links are replaced.
 func (idx *Indexer) ProcessDocLinks(r *datastore.DocReference, d *docs.Document) error {
+	links, err := idx.docLinks(r, d)
+	if err != nil {
+		idx.log.Error(err, "Failed to get document links", "driveId", r.ID, "name", r.Name)
+		return nil
+	}
+	return idx.storeDoc(r, links, nil)
+}
+
+// docLinks returns the links in the doc referenced by r and represented by d.
+func (idx *Indexer) docLinks(r *datastore.DocReference, d *docs.Document) ([]*datastore.DocLink, error) {
 	log := idx.log.WithValues("driveId", r.ID, "name", r.Name)
 	links, err := GetAllLinks(d)
 	if err != nil {
-		log.Error(err, "Failed to get document links")
-		return nil
+		return nil, err
 	}
 
-	// TODO(jeremy): This will lead to duplicates because each time we reindex the document we will re-add the
-	// same links. To fix this I think we want to add some sort of version number to the links. We can then
-	// overwrite any existing links updating the version number. We can then delete any links whose version
-	// number doesn't equal the new version number. This avoids the need for transactions and ensures we would
-	// never be in a state where the is no data for a document that had been previously indexed. There would
-	// be a state where we would potentially return links which had since been deleted.
+	docLinks := make([]*datastore.DocLink, 0, len(links))
 	for _, l := range links {
 		g, err := ParseGoogleDocUri(l.Url)
 
@@ -219,59 +466,352 @@ func (idx *Indexer) ProcessDocLinks(r *datastore.DocReference, d *docs.Document)
 
 		destId := ""
 
-		// TODO(jeremy): Should we verify the ID? Should we do something with the heading?
+		// The ID and heading aren't verified here since that would cost Drive API calls for every link each
+		// time the doc is indexed. LinkChecker verifies them.
 		if g != nil {
 			destId = datastore.DriveKey(g.ID)
 		}
 
-		docLink := &datastore.DocLink{
+		docLinks = append(docLinks, &datastore.DocLink{
 			SourceID:   r.ID,
 			DestID:     destId,
 			URI:        l.Url,
 			Text:       l.Text,
 			StartIndex: l.StartIndex,
 			EndIndex:   l.EndIndex,
+		})
+	}
+	return docLinks, nil
+}
+
+// ProcessCategories classifies the document and stores its content categories.
+func (idx *Indexer) ProcessCategories(r *datastore.DocReference, d *docs.Document) error {
+	text, err := ReadText(d)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read text from document")
+	}
+
+	// Redactions are audited by ProcessEntities so we don't record them again.
+	if idx.redactor != nil {
+		text, _, err = idx.redactor.Redact(text)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to redact text")
 		}
+	}
+
+	categories, err := ClassifyText(withDrive(context.Background(), idx.driveId), idx.nlpClient, text)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to classify text")
+	}
 
-		// If there is an error try to keep going even though this means some data might end up being missed.
-		if err := idx.store.UpdateDocLink(docLink); err != nil {
-			log.Error(err, "failed to update doclink", "docLink", docLink)
+	docCategories := make([]*datastore.DocCategory, 0, len(categories))
+	for _, c := range categories {
+		docCategories = append(docCategories, &datastore.DocCategory{
+			DocID:      r.ID,
+			Category:   c.GetName(),
+			Confidence: c.GetConfidence(),
+		})
+	}
+
+	return idx.store.ReplaceDocCategories(r.ID, docCategories)
+}
+
+// getSharing fetches the owners, last modifying user and permissions of the file from Drive.
+func (idx *Indexer) getSharing(r *datastore.DocReference) (*drive.File, error) {
+	ctx := context.Background()
+	svc, err := drive.NewService(ctx, option.WithHTTPClient(idx.httpClient))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create drive client")
+	}
+
+	f, err := svc.Files.Get(r.DriveId).SupportsAllDrives(true).Fields("owners(displayName, emailAddress), lastModifyingUser(displayName, emailAddress)").Do()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get Drive metadata for file: %v", r.DriveId)
+	}
+
+	// Files.Get doesn't return the permissions of files in shared drives so we list them separately.
+	f.Permissions = make([]*drive.Permission, 0, 10)
+	err = svc.Permissions.List(r.DriveId).SupportsAllDrives(true).Fields("nextPageToken, permissions(type, role, displayName, emailAddress, domain)").Pages(ctx, func(l *drive.PermissionList) error {
+		f.Permissions = append(f.Permissions, l.Permissions...)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to list permissions for file: %v", r.DriveId)
+	}
+	return f, nil
+}
+
+// ProcessACL stores the principals that can read the file f referenced by r.
+func (idx *Indexer) ProcessACL(r *datastore.DocReference, f *drive.File) error {
+	permissions := make([]*datastore.DocPermission, 0, len(f.Permissions))
+	for _, p := range f.Permissions {
+		principal := p.EmailAddress
+		switch p.Type {
+		case datastore.PrincipalDomain:
+			principal = p.Domain
+		case datastore.PrincipalAnyone:
+			principal = ""
+		case datastore.PrincipalUser, datastore.PrincipalGroup:
+		default:
+			idx.log.Info("Ignoring permission with unknown type", "driveId", r.DriveId, "type", p.Type)
+			continue
 		}
+
+		permissions = append(permissions, &datastore.DocPermission{
+			DocID:     r.ID,
+			Type:      p.Type,
+			Principal: principal,
+			Role:      p.Role,
+		})
 	}
-	return nil
+
+	return idx.store.ReplaceDocPermissions(r.ID, permissions)
+}
+
+// ProcessPeople creates a person entity keyed by email for the owners, last modifying user and collaborators of
+// the file f referenced by r and records their relationship to the doc.
+//
+// Only permissions granted to individual users are used; permissions granted to groups, domains or anyone with
+// the link don't identify a person.
+func (idx *Indexer) ProcessPeople(r *datastore.DocReference, f *drive.File) error {
+	type grant struct {
+		email string
+		name  string
+		role  string
+	}
+
+	grants := make([]grant, 0, len(f.Owners)+len(f.Permissions)+1)
+	for _, u := range f.Owners {
+		grants = append(grants, grant{email: u.EmailAddress, name: u.DisplayName, role: datastore.RoleOwner})
+	}
+
+	if f.LastModifyingUser != nil {
+		grants = append(grants, grant{email: f.LastModifyingUser.EmailAddress, name: f.LastModifyingUser.DisplayName, role: datastore.RoleLastModifier})
+	}
+
+	for _, p := range f.Permissions {
+		if p.Type != "user" {
+			continue
+		}
+		grants = append(grants, grant{email: p.EmailAddress, name: p.DisplayName, role: p.Role})
+	}
+
+	rows := make([]*datastore.DocPerson, 0, len(grants))
+	seen := map[string]bool{}
+	for _, g := range grants {
+		// The email isn't returned for users who've hidden it.
+		if g.email == "" {
+			continue
+		}
+
+		p, err := idx.store.UpdatePerson(g.email, g.name)
+		if err != nil {
+			return err
+		}
+
+		row := &datastore.DocPerson{
+			DocID:    r.ID,
+			EntityID: p.ID,
+			Role:     g.role,
+		}
+
+		// Owners also show up as permissions with the role owner.
+		key := datastore.DocPersonKey(*row)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		rows = append(rows, row)
+	}
+
+	return idx.store.ReplaceDocPeople(r.ID, rows)
+}
+
+// ProcessKeyphrases extracts the keyphrases in the document and stores their mentions.
+func (idx *Indexer) ProcessKeyphrases(r *datastore.DocReference, d *docs.Document) error {
+	text, err := ReadText(d)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read text from document")
+	}
+
+	// Redactions are audited by ProcessEntities so we don't record them again.
+	redactions := []Redaction{}
+	if idx.redactor != nil {
+		text, redactions, err = idx.redactor.Redact(text)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to redact text")
+		}
+	}
+
+	phrases, err := GetTextKeyphrases(withDrive(context.Background(), idx.driveId), idx.nlpClient, text)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to get keyphrases")
+	}
+
+	phrases = removeRedactedKeyphrases(phrases, redactions)
+
+	mentions := make([]*datastore.KeyphraseMention, 0, len(phrases))
+	for _, p := range phrases {
+		mentions = append(mentions, &datastore.KeyphraseMention{
+			DocID:       r.ID,
+			KeyphraseID: p.Phrase,
+			Text:        p.Text,
+			StartIndex:  p.StartIndex,
+			EndIndex:    p.EndIndex,
+		})
+	}
+
+	return idx.store.ReplaceKeyphraseMentions(r.ID, mentions)
+}
+
+// findPerson returns the person known to Drive with the given name. nil is returned if there isn't exactly one
+// person with that name; ambiguous names aren't linked.
+func (idx *Indexer) findPerson(store datastore.Store, name string) (*datastore.Entity, error) {
+	people, err := store.FindPeople(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(people) != 1 {
+		if len(people) > 1 {
+			idx.log.V(logging.Debug).Info("Name matches more than one person; not linking", "name", name, "numMatched", len(people))
+		}
+		return nil, nil
+	}
+	return people[0], nil
 }
 
-// ProcessEntities gets all the entities in the document
+// ProcessEntities gets all the entities in the document and replaces the doc's existing mentions.
 func (idx *Indexer) ProcessEntities(r *datastore.DocReference, d *docs.Document) error {
+	entities, err := idx.docEntities(r, d)
+	if err != nil {
+		return err
+	}
+	return idx.storeDoc(r, nil, entities)
+}
+
+// extractedEntities are the entities found in a doc.
+type extractedEntities struct {
+	entities []*languagepb.Entity
+	// sentences are the offsets of the starts of the sentences in the text sent to the NL API.
+	sentences []int
+}
+
+// docEntities gets the entities in the doc referenced by r and represented by d using the NL API.
+func (idx *Indexer) docEntities(r *datastore.DocReference, d *docs.Document) (*extractedEntities, error) {
+	text, err := ReadText(d)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read text from document")
+	}
+
+	redactions := []Redaction{}
+	if idx.redactor != nil {
+		text, redactions, err = idx.redactor.Redact(text)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to redact text")
+		}
+		idx.auditRedactions(r, redactions)
+	}
+
+	entities, err := GetTextEntities(withDrive(context.Background(), idx.driveId), idx.nlpClient, text, EntityOptions{Filter: idx.entityFilter, Sentiment: idx.entitySentiment})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get entities")
+	}
+
+	return &extractedEntities{
+		// Mentions of masked text don't correspond to anything in the document.
+		entities: removeRedactedMentions(entities, redactions),
+		// Masking preserves offsets so sentence boundaries computed from the redacted text are valid.
+		sentences: sentenceStarts(text),
+	}, nil
+}
+
+// storeDoc replaces the links and entity mentions of the doc referenced by r in a single transaction so readers
+// never see the doc half written. If links or entities is nil the doc's existing links or mentions are left as is;
+// e.g. because the NL API budget was exceeded.
+func (idx *Indexer) storeDoc(r *datastore.DocReference, links []*datastore.DocLink, entities *extractedEntities) error {
+	numEntities := 0
+	// touched are the entities mentioned in the doc before and after it is processed.
+	touched := map[string]bool{}
+	err := idx.store.WithTx(func(tx datastore.Store) error {
+		numEntities = 0
+		touched = map[string]bool{}
+		if links != nil {
+			if err := tx.ReplaceDocLinks(r.ID, links); err != nil {
+				return errors.Wrapf(err, "Failed to store links")
+			}
+		}
+
+		if entities == nil {
+			return nil
+		}
+		n, err := idx.storeEntities(tx, r, entities, touched)
+		numEntities = n
+		if err != nil {
+			return errors.Wrapf(err, "Failed to store entities")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if idx.touchedEntities == nil {
+		idx.touchedEntities = map[string]bool{}
+	}
+	for id := range touched {
+		idx.touchedEntities[id] = true
+	}
+
+	if links != nil {
+		idx.emit(IndexEvent{Type: EventLinksFound, DocID: r.ID, Name: r.Name, NumLinks: len(links)})
+	}
+	if entities != nil {
+		idx.emit(IndexEvent{Type: EventEntitiesFound, DocID: r.ID, Name: r.Name, NumEntities: numEntities})
+	}
+	return nil
+}
+
+// storeEntities resolves each entity found in the doc to an entity already in the database, creating it if there
+// isn't one, and replaces the doc's mentions using tx. The entities mentioned before and after are added to touched.
+// The number of entities is returned.
+func (idx *Indexer) storeEntities(tx datastore.Store, r *datastore.DocReference, found *extractedEntities, touched map[string]bool) (int, error) {
 	log := idx.log.WithValues("driveId", r.ID, "name", r.Name)
-	// TODO(jeremy): This will lead to duplicates because each time we reindex the document we will re-add the
-	// same entity mentions. To fix this I think we want to add some sort of version number to the mentions. We can then
-	// overwrite any existing mentions updating the version number. We can then delete any mentions whose version
-	// number doesn't equal the new version number. This avoids the need for transactions and ensures we would
-	// never be in a state where the is no data for a document that had been previously indexed. There would
-	// be a state where we would potentially return mentions which had since been deleted.
-	//
-	// Get the entities in the document
-
-	entities, err := GetEntities(context.Background(), idx.nlpClient, d)
+	existing, err := tx.ListEntityMentions(r.ID)
 	if err != nil {
-		return errors.Wrapf(err, "Failed to get entities")
+		return 0, errors.Wrapf(err, "Failed to list the existing mentions")
+	}
+	for _, m := range existing {
+		touched[m.EntityID] = true
 	}
 
-	// For each entity found in the doc try to resolve it to an entity already in the database.
-	// If there isn't one then create a new entry.
-	for _, e := range entities {
+	numEntities := 0
+	mentions := make([]*datastore.EntityMention, 0, len(found.entities))
+	for _, e := range found.entities {
 		var dEntity *datastore.Entity
 
+		if e.GetType() == languagepb.Entity_PERSON {
+			person, err := idx.findPerson(tx, e.GetName())
+			if err != nil {
+				return 0, err
+			}
+			dEntity = person
+		}
+
 		q := datastore.EntityQuery{
 			Name:         e.GetName(),
-			WikipediaURL: glanguage.GetWikipediaURL(*e),
-			MID:          glanguage.GetMID(*e),
+			WikipediaURL: glanguage.GetWikipediaURL(e),
+			MID:          glanguage.GetMID(e),
 		}
-		entities, err := idx.store.FindEntity(q)
+		entities, err := tx.FindEntity(q)
 
 		if err != nil {
-			return errors.Wrapf(err, "Failed to find matching entities")
+			return 0, errors.Wrapf(err, "Failed to find matching entities")
+		}
+
+		if dEntity != nil {
+			// The mention was linked to a person known to Drive.
+			entities = []*datastore.Entity{dEntity}
 		}
 
 		if len(entities) > 1 {
@@ -294,33 +834,57 @@ func (idx *Indexer) ProcessEntities(r *datastore.DocReference, d *docs.Document)
 			}
 			log.Info("Creating Entity", "name", q.Name)
 
-			if err := idx.store.UpdateEntity(dEntity); err != nil {
-				log.Error(err, "Failed to add entity to database", "id", dEntity.ID, "name", dEntity.Name)
-				// Try to degrade gracefully and continue processing the other entities
-				continue
+			if err := tx.UpdateEntity(dEntity); err != nil {
+				return 0, errors.Wrapf(err, "Failed to add entity %v to database", dEntity.Name)
 			}
 		} else {
 			dEntity = entities[0]
 		}
+		numEntities++
 
 		// Now add all the entity mentions to the doc.
 		for _, m := range e.Mentions {
 			content := m.Text.GetContent()
-			dMention := &datastore.EntityMention{
-				DocID:      r.ID,
-				EntityID:   dEntity.ID,
-				Text:       content,
-				StartIndex: int64(m.Text.GetBeginOffset()),
-				EndIndex:   int64(m.Text.GetBeginOffset()) + int64(len(content)),
-			}
+			mentions = append(mentions, &datastore.EntityMention{
+				DocID:              r.ID,
+				EntityID:           dEntity.ID,
+				Text:               content,
+				StartIndex:         int64(m.Text.GetBeginOffset()),
+				EndIndex:           int64(m.Text.GetBeginOffset()) + int64(len(content)),
+				Type:               m.GetType().String(),
+				Salience:           e.GetSalience(),
+				SentimentScore:     m.GetSentiment().GetScore(),
+				SentimentMagnitude: m.GetSentiment().GetMagnitude(),
+				Sentence:           sentenceNumber(found.sentences, int64(m.Text.GetBeginOffset())),
+			})
+		}
+	}
 
-			if err := idx.store.UpdateEntityMention(dMention); err != nil {
-				log.Error(err, "Failed to add entity mention to database", "id", dEntity.ID, "name", dEntity.Name)
-				// Try to degrade gracefully and continue processing the other entities
-				continue
-			}
+	for _, m := range mentions {
+		touched[m.EntityID] = true
+	}
+	return numEntities, tx.ReplaceEntityMentions(r.ID, mentions)
+}
+
+// auditRedactions records the redactions in the datastore so there is an audit log of what was masked.
+func (idx *Indexer) auditRedactions(r *datastore.DocReference, redactions []Redaction) {
+	log := idx.log.WithValues("driveId", r.ID, "name", r.Name)
+
+	counts := map[string]int{}
+	for _, red := range redactions {
+		counts[red.Rule] = counts[red.Rule] + 1
+		dRedaction := &datastore.Redaction{
+			DocID:      r.ID,
+			Rule:       red.Rule,
+			StartIndex: red.StartIndex,
+			EndIndex:   red.EndIndex,
+		}
+		if err := idx.store.UpdateRedaction(dRedaction); err != nil {
+			log.Error(err, "Failed to add redaction to database", "rule", red.Rule, "start", red.StartIndex)
 		}
 	}
 
-	return nil
+	if len(redactions) > 0 {
+		log.Info("Redacted text", "counts", counts)
+	}
 }
@@ -4,17 +4,22 @@ import (
 	language "cloud.google.com/go/language/apiv1"
 	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/golang/protobuf/proto"
 	"github.com/google/go-cmp/cmp"
 	"github.com/jlewi/p22h/backend/pkg/datastore"
+	"github.com/jlewi/p22h/backend/pkg/httptesting"
 	"github.com/jlewi/p22h/backend/pkg/logging"
 	"google.golang.org/api/docs/v1"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
 	languagepb "google.golang.org/genproto/googleapis/cloud/language/v1"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 type testDocs struct {
@@ -150,6 +155,7 @@ func TestIndexer_ProcessEntities(t *testing.T) {
 								Content:     "john",
 								BeginOffset: 10,
 							},
+							Type: languagepb.EntityMention_PROPER,
 						},
 					},
 				},
@@ -192,6 +198,8 @@ func TestIndexer_ProcessEntities(t *testing.T) {
 			Text:       "john",
 			StartIndex: 10,
 			EndIndex:   14,
+			Type:       languagepb.EntityMention_PROPER.String(),
+			Sentence:   1,
 		},
 	}
 
@@ -204,6 +212,370 @@ func TestIndexer_ProcessEntities(t *testing.T) {
 	}
 }
 
+func TestIndexer_ProcessEntitiesSentiment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testDatabase")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+
+	log, err := logging.InitLogger("info", true)
+
+	if err != nil {
+		t.Fatalf("Failed to initialize logger; %v", err)
+	}
+
+	store, err := datastore.New(path.Join(dir, "database.db"), *log)
+
+	if err != nil {
+		t.Fatalf("Failted to create datastore; error %v", err)
+	}
+
+	data := loadTestDocs(t)
+
+	idx := &Indexer{
+		log:             *log,
+		store:           store,
+		nlpClient:       &wordClient{words: []string{"Link"}},
+		entitySentiment: true,
+	}
+
+	doc := data.docsbyName["test_doc.json"]
+	if err := idx.ProcessEntities(data.refsByName["test_doc.json"], &doc); err != nil {
+		t.Fatalf("indexing failed; error %v", err)
+	}
+
+	mentions, err := store.ListEntityMentions("")
+	if err != nil {
+		t.Fatalf("failed to list entity mentions; error %v", err)
+	}
+
+	if len(mentions) == 0 {
+		t.Fatalf("Expected entity mentions")
+	}
+
+	for _, m := range mentions {
+		if m.Type != languagepb.EntityMention_PROPER.String() || m.Salience == 0 || m.SentimentScore != 0.5 || m.SentimentMagnitude != 1 {
+			t.Errorf("Mention is missing type, salience or sentiment; %+v", m)
+		}
+	}
+}
+
+func TestIndexer_ProcessEntitiesRedacted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testDatabase")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+
+	log, err := logging.InitLogger("info", true)
+
+	if err != nil {
+		t.Fatalf("Failed to initialize logger; %v", err)
+	}
+
+	store, err := datastore.New(path.Join(dir, "database.db"), *log)
+
+	if err != nil {
+		t.Fatalf("Failted to create datastore; error %v", err)
+	}
+
+	data := loadTestDocs(t)
+
+	redactor, err := NewPatternRedactor([]*RedactionRule{{Name: "below", Pattern: "Below"}}, "")
+	if err != nil {
+		t.Fatalf("Failed to create redactor; error %v", err)
+	}
+
+	fake := &wordClient{words: []string{"Below", "Link"}}
+	idx := &Indexer{
+		log:       *log,
+		store:     store,
+		nlpClient: fake,
+		redactor:  redactor,
+		entityFilter: &EntityFilter{
+			MentionPolicy: MentionPolicyAny,
+		},
+	}
+
+	if err := idx.entityFilter.Validate(); err != nil {
+		t.Fatalf("Invalid filter; error %v", err)
+	}
+
+	doc := data.docsbyName["test_doc.json"]
+	if err := idx.ProcessEntities(data.refsByName["test_doc.json"], &doc); err != nil {
+		t.Fatalf("indexing failed; error %v", err)
+	}
+
+	entities, err := store.ListEntities()
+	if err != nil {
+		t.Fatalf("failed to list entities; error %v", err)
+	}
+
+	// Below is masked so the NL API never sees it.
+	if len(entities) != 1 || entities[0].Name != "Link" {
+		t.Errorf("Expected only the entity Link; got %+v", entities)
+	}
+
+	redactions, err := store.ListRedactions(data.refsByName["test_doc.json"].ID)
+	if err != nil {
+		t.Fatalf("failed to list redactions; error %v", err)
+	}
+
+	if len(redactions) == 0 {
+		t.Fatalf("Expected redactions to be recorded in the audit log")
+	}
+
+	for _, r := range redactions {
+		if r.Rule != "below" || r.EndIndex-r.StartIndex != int64(len("Below")) {
+			t.Errorf("Unexpected redaction %+v", r)
+		}
+	}
+}
+
+func TestIndexer_ProcessCategories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testDatabase")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+
+	log, err := logging.InitLogger("info", true)
+
+	if err != nil {
+		t.Fatalf("Failed to initialize logger; %v", err)
+	}
+
+	store, err := datastore.New(path.Join(dir, "database.db"), *log)
+
+	if err != nil {
+		t.Fatalf("Failted to create datastore; error %v", err)
+	}
+
+	data := loadTestDocs(t)
+
+	fake := &wordClient{words: []string{"Below", "Link"}}
+	idx := &Indexer{
+		log:       *log,
+		store:     store,
+		nlpClient: fake,
+	}
+
+	ref := data.refsByName["test_doc.json"]
+	doc := data.docsbyName["test_doc.json"]
+	if err := idx.ProcessCategories(ref, &doc); err != nil {
+		t.Fatalf("classification failed; error %v", err)
+	}
+
+	// Reprocessing the doc should replace rather than duplicate the categories.
+	fake.words = []string{"Link"}
+	if err := idx.ProcessCategories(ref, &doc); err != nil {
+		t.Fatalf("classification failed; error %v", err)
+	}
+
+	categories, err := store.ListDocCategories(ref.ID, "")
+	if err != nil {
+		t.Fatalf("failed to list categories; error %v", err)
+	}
+
+	if len(categories) != 1 || categories[0].Category != "/Computers & Electronics/Link" || categories[0].Confidence != 0.5 {
+		t.Errorf("Expected only the category /Computers & Electronics/Link; got %+v", categories)
+	}
+}
+
+func TestIndexer_ProcessKeyphrases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testDatabase")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+
+	log, err := logging.InitLogger("info", true)
+
+	if err != nil {
+		t.Fatalf("Failed to initialize logger; %v", err)
+	}
+
+	store, err := datastore.New(path.Join(dir, "database.db"), *log)
+
+	if err != nil {
+		t.Fatalf("Failted to create datastore; error %v", err)
+	}
+
+	data := loadTestDocs(t)
+
+	idx := &Indexer{
+		log:        *log,
+		store:      store,
+		nlpClient:  &wordClient{words: []string{"chip", "link", "Google", "Document"}},
+		keyphrases: true,
+	}
+
+	ref := data.refsByName["test_doc.json"]
+	doc := data.docsbyName["test_doc.json"]
+	if err := idx.ProcessKeyphrases(ref, &doc); err != nil {
+		t.Fatalf("keyphrase extraction failed; error %v", err)
+	}
+
+	if err := idx.postProcess(); err != nil {
+		t.Fatalf("postProcess failed; error %v", err)
+	}
+
+	mentions, err := store.ListKeyphraseMentions(ref.ID)
+	if err != nil {
+		t.Fatalf("failed to list keyphrase mentions; error %v", err)
+	}
+
+	actual := []string{}
+	for _, m := range mentions {
+		actual = append(actual, m.KeyphraseID)
+	}
+
+	expected := []string{"google document", "chip link"}
+	if d := cmp.Diff(expected, actual); d != "" {
+		t.Errorf("Did not get expected keyphrases; diff:\n%v", d)
+	}
+
+	results, err := store.SearchKeyphrases("document", 0)
+	if err != nil {
+		t.Fatalf("failed to search keyphrases; error %v", err)
+	}
+
+	if len(results) != 1 || results[0].DocID != ref.ID || results[0].Weight <= 0 {
+		t.Errorf("Expected doc %v to have a positive weight for google document; got %+v", ref.ID, results)
+	}
+}
+
+func TestIndexer_ProcessPeople(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testDatabase")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+
+	log, err := logging.InitLogger("info", true)
+
+	if err != nil {
+		t.Fatalf("Failed to initialize logger; %v", err)
+	}
+
+	store, err := datastore.New(path.Join(dir, "database.db"), *log)
+
+	if err != nil {
+		t.Fatalf("Failted to create datastore; error %v", err)
+	}
+
+	data := loadTestDocs(t)
+
+	// The doc starts with the word "Below" so we pretend that is the name of the owner.
+	file := &drive.File{
+		Owners: []*drive.User{
+			{DisplayName: "Below", EmailAddress: "below@example.com"},
+		},
+		LastModifyingUser: &drive.User{DisplayName: "Bob", EmailAddress: "bob@example.com"},
+		Permissions: []*drive.Permission{
+			{Type: "user", Role: "owner", DisplayName: "Below", EmailAddress: "below@example.com"},
+			{Type: "user", Role: "writer", DisplayName: "Bob", EmailAddress: "bob@example.com"},
+			{Type: "group", Role: "reader", EmailAddress: "eng@example.com"},
+		},
+	}
+
+	idx := &Indexer{
+		log:        *log,
+		store:      store,
+		httpClient: httptesting.NewTestClient(httptesting.BuildJSONRoundTrip(file)),
+		nlpClient:  &wordClient{words: []string{"Below"}, entityType: languagepb.Entity_PERSON},
+		entityFilter: &EntityFilter{
+			MentionPolicy: MentionPolicyAny,
+		},
+	}
+
+	if err := idx.entityFilter.Validate(); err != nil {
+		t.Fatalf("Invalid filter; error %v", err)
+	}
+
+	ref := data.refsByName["test_doc.json"]
+	f, err := idx.getSharing(ref)
+	if err != nil {
+		t.Fatalf("getSharing failed; error %v", err)
+	}
+
+	if err := idx.ProcessPeople(ref, f); err != nil {
+		t.Fatalf("ProcessPeople failed; error %v", err)
+	}
+
+	if err := idx.ProcessACL(ref, f); err != nil {
+		t.Fatalf("ProcessACL failed; error %v", err)
+	}
+
+	visible, err := store.ListVisibleDocs(datastore.Principals{Email: "carol@example.com", Groups: []string{"eng@example.com"}})
+	if err != nil {
+		t.Fatalf("Failed to list visible docs; error %v", err)
+	}
+
+	if !visible[ref.ID] {
+		t.Errorf("Expected doc to be visible to members of eng@example.com")
+	}
+
+	people, err := store.ListDocPeople(ref.ID, "")
+	if err != nil {
+		t.Fatalf("Failed to list doc people; error %v", err)
+	}
+
+	actual := []string{}
+	for _, p := range people {
+		actual = append(actual, p.EntityID+" "+p.Role)
+	}
+
+	expected := []string{
+		"person.below@example.com owner",
+		"person.bob@example.com lastModifier",
+		"person.bob@example.com writer",
+	}
+
+	if d := cmp.Diff(expected, actual); d != "" {
+		t.Errorf("Did not get expected people; diff:\n%v", d)
+	}
+
+	doc := data.docsbyName["test_doc.json"]
+	if err := idx.ProcessEntities(ref, &doc); err != nil {
+		t.Fatalf("ProcessEntities failed; error %v", err)
+	}
+
+	mentions, err := store.ListEntityMentions("")
+	if err != nil {
+		t.Fatalf("failed to list entity mentions; error %v", err)
+	}
+
+	if len(mentions) == 0 {
+		t.Fatalf("Expected entity mentions")
+	}
+
+	for _, m := range mentions {
+		if m.EntityID != "person.below@example.com" {
+			t.Errorf("Mention %v wasn't linked to the owner; got entity %v", m.Text, m.EntityID)
+		}
+	}
+}
+
+func Test_newDocReference(t *testing.T) {
+	f := &drive.File{
+		Id:           "abc",
+		Name:         "doc",
+		MimeType:     DocumentMimeType,
+		Md5Checksum:  "1234",
+		ModifiedTime: "2022-01-05T10:00:00.000-08:00",
+		CreatedTime:  "",
+	}
+
+	expected := &datastore.DocReference{
+		DriveId:      "abc",
+		Name:         "doc",
+		MimeType:     DocumentMimeType,
+		Md5Checksum:  "1234",
+		ModifiedTime: time.Date(2022, 1, 5, 18, 0, 0, 0, time.UTC),
+	}
+
+	if d := cmp.Diff(expected, newDocReference(f)); d != "" {
+		t.Errorf("Did not get expected DocReference; diff:\n%v", d)
+	}
+}
+
 func loadTestDocs(t *testing.T) *testDocs {
 	wDir, err := os.Getwd()
 	if err != nil {
@@ -245,3 +617,91 @@ func loadTestDocs(t *testing.T) *testDocs {
 	}
 	return data
 }
+
+func TestIndexer_ProcessDocReplacesLinksAndMentions(t *testing.T) {
+	log, err := logging.InitLogger("info", true)
+	if err != nil {
+		t.Fatalf("Failed to initialize logger; %v", err)
+	}
+
+	store := datastore.NewMemoryStore(*log)
+	ref := &datastore.DocReference{DriveId: "doc1", Name: "Doc 1", MimeType: DocumentMimeType}
+	if err := store.UpdateDocReference(ref); err != nil {
+		t.Fatalf("Failed to create doc; error %v", err)
+	}
+
+	// linkDoc returns a doc consisting of a link to a doc for each of the words.
+	linkDoc := func(words ...string) *docs.Document {
+		p := &docs.Paragraph{}
+		offset := int64(1)
+		for _, w := range words {
+			p.Elements = append(p.Elements, &docs.ParagraphElement{
+				StartIndex: offset,
+				EndIndex:   offset + int64(len(w)),
+				TextRun: &docs.TextRun{
+					Content:   w + " ",
+					TextStyle: &docs.TextStyle{Link: &docs.Link{Url: "https://docs.google.com/document/d/" + w + "/edit"}},
+				},
+			})
+			offset += int64(len(w)) + 1
+		}
+		return &docs.Document{DocumentId: "doc1", RevisionId: fmt.Sprintf("%v", len(words)), Body: &docs.Body{Content: []*docs.StructuralElement{{Paragraph: p}}}}
+	}
+
+	served := map[string]*docs.Document{}
+	docsService, err := docs.NewService(context.Background(), option.WithHTTPClient(httptesting.NewTestClient(fakeGoogleAPIs(nil, served))))
+	if err != nil {
+		t.Fatalf("Failed to create docs service; error %v", err)
+	}
+
+	idx := &Indexer{
+		log:         *log,
+		store:       store,
+		docsService: docsService,
+		nlpClient:   &wordClient{words: []string{"Acme", "Globex"}},
+		entityFilter: &EntityFilter{
+			MentionPolicy: MentionPolicyAny,
+		},
+	}
+	if err := idx.entityFilter.Validate(); err != nil {
+		t.Fatalf("Invalid filter; error %v", err)
+	}
+
+	served["doc1"] = linkDoc("Acme", "Globex")
+	idx.ProcessDoc(ref)
+	if links, _, err := store.QueryDocLinks(datastore.DocLinkQuery{SourceID: ref.ID}); err != nil || len(links) != 2 {
+		t.Fatalf("Got %v links, error %v; want 2", len(links), err)
+	}
+	if mentions, err := store.ListEntityMentions(ref.ID); err != nil || len(mentions) != 2 {
+		t.Fatalf("Got %v mentions, error %v; want 2", len(mentions), err)
+	}
+
+	// Reindexing a doc which no longer mentions Globex should delete its link and mentions.
+	served["doc1"] = linkDoc("Acme")
+	idx.ProcessDoc(ref)
+
+	links, _, err := store.QueryDocLinks(datastore.DocLinkQuery{SourceID: ref.ID})
+	if err != nil {
+		t.Fatalf("Failed to list links; error %v", err)
+	}
+	if len(links) != 1 || links[0].DestID != datastore.DriveKey("Acme") {
+		t.Errorf("Got links %+v; want only the link to Acme", links)
+	}
+
+	mentions, err := store.ListEntityMentions(ref.ID)
+	if err != nil {
+		t.Fatalf("Failed to list mentions; error %v", err)
+	}
+	if len(mentions) != 1 || mentions[0].Text != "Acme" {
+		t.Errorf("Got mentions %+v; want only the mention of Acme", mentions)
+	}
+
+	// Globex was mentioned before so its co-occurrences need to be recomputed.
+	globex, err := store.FindEntity(datastore.EntityQuery{Name: "Globex"})
+	if err != nil || len(globex) != 1 {
+		t.Fatalf("FindEntity returned %v, %v; want the entity Globex", globex, err)
+	}
+	if !idx.touchedEntities[globex[0].ID] {
+		t.Errorf("Globex isn't in the touched entities %v", idx.touchedEntities)
+	}
+}
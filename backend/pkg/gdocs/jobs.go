@@ -0,0 +1,298 @@
+package gdocs
+
+import (
+	"context"
+	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+	"github.com/jlewi/p22h/backend/pkg/datastore"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrJobRunning is returned when a job is started while another job is running.
+	ErrJobRunning = errors.New("Another index job is running")
+	// ErrJobNotRunning is returned when cancelling a job that isn't running.
+	ErrJobNotRunning = errors.New("Index job isn't running")
+	// ErrShutdown is returned when a job is started after the manager was shut down.
+	ErrShutdown = errors.New("Job manager is shut down")
+)
+
+// IndexProgress counts the docs processed by an Indexer. It is safe to read while indexing is in progress.
+// The methods are no-ops on a nil IndexProgress.
+type IndexProgress struct {
+	mu        sync.Mutex
+	total     int64
+	processed int64
+}
+
+// Counts returns the number of docs to process and the number processed so far.
+func (p *IndexProgress) Counts() (total int64, processed int64) {
+	if p == nil {
+		return 0, 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.total, p.processed
+}
+
+func (p *IndexProgress) setTotal(n int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total = n
+}
+
+func (p *IndexProgress) addProcessed(n int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.processed = p.processed + n
+}
+
+// IndexerFactory creates the Indexer for a job. opts must be passed to NewIndexer.
+type IndexerFactory func(opts ...IndexerOption) (*Indexer, error)
+
+// JobManager runs index jobs in the background and records them in the datastore.
+//
+// Only one job runs at a time since concurrent jobs would process the same docs.
+type JobManager struct {
+	log        logr.Logger
+	store      datastore.Store
+	newIndexer IndexerFactory
+	// observers are notified of the events of every job.
+	observers []IndexObserver
+
+	mu      sync.Mutex
+	running *runningJob
+	// shutdown is true once Shutdown is called.
+	shutdown bool
+}
+
+type runningJob struct {
+	job      datastore.IndexJob
+	progress *IndexProgress
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// JobManagerOption is an option for the job manager.
+type JobManagerOption func(m *JobManager)
+
+// JobManagerWithObserver notifies o of the index events of every job. Events have JobID set.
+func JobManagerWithObserver(o IndexObserver) JobManagerOption {
+	return func(m *JobManager) {
+		m.observers = append(m.observers, o)
+	}
+}
+
+// NewJobManager creates a new job manager. Jobs left unfinished by a previous process are marked as failed.
+func NewJobManager(store datastore.Store, newIndexer IndexerFactory, log logr.Logger, opts ...JobManagerOption) (*JobManager, error) {
+	if store == nil {
+		return nil, errors.New("store is required")
+	}
+
+	if newIndexer == nil {
+		return nil, errors.New("newIndexer is required")
+	}
+
+	if err := store.FailUnfinishedIndexJobs(); err != nil {
+		return nil, err
+	}
+
+	m := &JobManager{
+		log:        log,
+		store:      store,
+		newIndexer: newIndexer,
+	}
+
+	for _, o := range opts {
+		o(m)
+	}
+	return m, nil
+}
+
+// Start starts a job indexing either the drive or a single file. caller is the email of the user starting
+// the job if known. ErrJobRunning is returned if a job is already running.
+func (m *JobManager) Start(driveId string, fileId string, caller string) (*datastore.IndexJob, error) {
+	if (driveId == "") == (fileId == "") {
+		return nil, errors.New("Exactly one of driveId and fileId must be set")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.shutdown {
+		return nil, ErrShutdown
+	}
+
+	if m.running != nil {
+		return nil, errors.Wrapf(ErrJobRunning, "Job %v is running", m.running.job.ID)
+	}
+
+	uid, err := uuid.NewUUID()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create job id")
+	}
+
+	job := datastore.IndexJob{
+		ID:        uid.String(),
+		DriveID:   driveId,
+		FileID:    fileId,
+		State:     datastore.JobRunning,
+		Caller:    caller,
+		StartTime: time.Now(),
+	}
+
+	if err := m.store.UpdateIndexJob(&job); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &runningJob{
+		job:      job,
+		progress: &IndexProgress{},
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	m.running = r
+
+	go m.run(ctx, r)
+
+	result := job
+	return &result, nil
+}
+
+func (m *JobManager) run(ctx context.Context, r *runningJob) {
+	defer close(r.done)
+	defer r.cancel()
+
+	log := m.log.WithValues("jobId", r.job.ID, "driveId", r.job.DriveID, "fileId", r.job.FileID)
+	log.Info("Starting index job")
+
+	opts := []IndexerOption{IndexerWithProgress(r.progress)}
+	for _, o := range m.observers {
+		o := o
+		opts = append(opts, IndexerWithObserver(ObserverFunc(func(e IndexEvent) {
+			e.JobID = r.job.ID
+			o.OnIndexEvent(e)
+		})))
+	}
+
+	idx, err := m.newIndexer(opts...)
+	if err == nil {
+		if r.job.FileID != "" {
+			err = idx.IndexDocument(ctx, r.job.FileID)
+		} else {
+			err = idx.Index(ctx, r.job.DriveID)
+		}
+	}
+
+	m.mu.Lock()
+	job := m.current(r)
+	m.mu.Unlock()
+
+	job.EndTime = time.Now()
+	switch {
+	case err == nil:
+		job.State = datastore.JobSucceeded
+	case ctx.Err() != nil:
+		job.State = datastore.JobCancelled
+	default:
+		job.State = datastore.JobFailed
+		job.Error = err.Error()
+		log.Error(err, "Index job failed")
+	}
+
+	if err := m.store.UpdateIndexJob(job); err != nil {
+		log.Error(err, "Failed to record the result of the index job")
+	}
+
+	// Only clear the running job once its result is stored so Get never returns a stale state.
+	m.mu.Lock()
+	m.running = nil
+	m.mu.Unlock()
+	log.Info("Index job finished", "state", job.State, "docsProcessed", job.DocsProcessed)
+}
+
+// current returns a copy of the running job with its current progress. m.mu must be held.
+func (m *JobManager) current(r *runningJob) *datastore.IndexJob {
+	job := r.job
+	job.DocsTotal, job.DocsProcessed = r.progress.Counts()
+	return &job
+}
+
+// Get returns the job with the given id. datastore.ErrNotFound is returned if it doesn't exist.
+func (m *JobManager) Get(id string) (*datastore.IndexJob, error) {
+	m.mu.Lock()
+	if m.running != nil && m.running.job.ID == id {
+		defer m.mu.Unlock()
+		return m.current(m.running), nil
+	}
+	m.mu.Unlock()
+
+	return m.store.GetIndexJob(id)
+}
+
+// List lists the jobs starting with the most recent.
+// limit is optional; if > 0 at most limit jobs are returned.
+func (m *JobManager) List(limit int) ([]*datastore.IndexJob, error) {
+	jobs, err := m.store.ListIndexJobs(limit)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, j := range jobs {
+		if m.running != nil && m.running.job.ID == j.ID {
+			jobs[i] = m.current(m.running)
+		}
+	}
+	return jobs, nil
+}
+
+// Cancel cancels the job. The job stops once the doc being processed is finished.
+// ErrJobNotRunning is returned if the job exists but isn't running.
+func (m *JobManager) Cancel(id string) error {
+	m.mu.Lock()
+	if m.running != nil && m.running.job.ID == id {
+		defer m.mu.Unlock()
+		m.running.cancel()
+		return nil
+	}
+	m.mu.Unlock()
+
+	if _, err := m.store.GetIndexJob(id); err != nil {
+		return err
+	}
+	return errors.Wrapf(ErrJobNotRunning, "Job %v", id)
+}
+
+// Wait blocks until the running job, if any, finishes.
+func (m *JobManager) Wait() {
+	m.mu.Lock()
+	r := m.running
+	m.mu.Unlock()
+
+	if r != nil {
+		<-r.done
+	}
+}
+
+// Shutdown cancels the running job, if any, and waits for it to stop. Jobs can't be started afterwards.
+func (m *JobManager) Shutdown() {
+	m.mu.Lock()
+	m.shutdown = true
+	if m.running != nil {
+		m.running.cancel()
+	}
+	m.mu.Unlock()
+
+	m.Wait()
+}
@@ -0,0 +1,136 @@
+package gdocs
+
+import (
+	"github.com/jlewi/p22h/backend/pkg/datastore"
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"github.com/pkg/errors"
+	"google.golang.org/api/docs/v1"
+	"google.golang.org/api/drive/v3"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+// fakeSearcher returns a fixed list of files. If block is set Search waits until it is closed.
+type fakeSearcher struct {
+	files []*drive.File
+	block chan struct{}
+}
+
+func (s *fakeSearcher) Search(query string, driveId string, corpora string, resultFunc ResultFunc) error {
+	if s.block != nil {
+		<-s.block
+	}
+
+	for _, f := range s.files {
+		if err := resultFunc(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func Test_JobManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testDatabase")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+
+	log, err := logging.InitLogger("info", true)
+	if err != nil {
+		t.Fatalf("Failed to initialize logger; %v", err)
+	}
+
+	store, err := datastore.New(path.Join(dir, "database.db"), *log)
+	if err != nil {
+		t.Fatalf("Failed to create datastore; error %v", err)
+	}
+
+	// Files which aren't Google Docs are counted but skipped so no API calls are needed.
+	searcher := &fakeSearcher{
+		files: []*drive.File{
+			{Id: "file1", Name: "File 1", MimeType: "application/pdf"},
+			{Id: "file2", Name: "File 2", MimeType: "application/pdf"},
+		},
+	}
+
+	newIndexer := func(opts ...IndexerOption) (*Indexer, error) {
+		return NewIndexer(searcher, &docs.Service{}, store, &wordClient{}, *log, opts...)
+	}
+
+	m, err := NewJobManager(store, newIndexer, *log)
+	if err != nil {
+		t.Fatalf("Failed to create job manager; error %v", err)
+	}
+
+	t.Run("succeeded", func(t *testing.T) {
+		job, err := m.Start("drive1", "", "alice@example.com")
+		if err != nil {
+			t.Fatalf("Failed to start job; error %v", err)
+		}
+		m.Wait()
+
+		actual, err := m.Get(job.ID)
+		if err != nil {
+			t.Fatalf("Failed to get job; error %v", err)
+		}
+
+		if actual.State != datastore.JobSucceeded {
+			t.Fatalf("Got state %v; want %v; error %v", actual.State, datastore.JobSucceeded, actual.Error)
+		}
+
+		if actual.DocsTotal != 2 || actual.DocsProcessed != 2 {
+			t.Errorf("Got %v of %v docs processed; want 2 of 2", actual.DocsProcessed, actual.DocsTotal)
+		}
+
+		if actual.Caller != "alice@example.com" {
+			t.Errorf("Got caller %v; want alice@example.com", actual.Caller)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		searcher.block = make(chan struct{})
+		defer func() { searcher.block = nil }()
+
+		job, err := m.Start("drive1", "", "")
+		if err != nil {
+			t.Fatalf("Failed to start job; error %v", err)
+		}
+
+		if _, err := m.Start("drive2", "", ""); !errors.Is(err, ErrJobRunning) {
+			t.Errorf("Starting a second job returned %v; want %v", err, ErrJobRunning)
+		}
+
+		if err := m.Cancel(job.ID); err != nil {
+			t.Fatalf("Failed to cancel job; error %v", err)
+		}
+		close(searcher.block)
+		m.Wait()
+
+		actual, err := m.Get(job.ID)
+		if err != nil {
+			t.Fatalf("Failed to get job; error %v", err)
+		}
+
+		if actual.State != datastore.JobCancelled {
+			t.Errorf("Got state %v; want %v", actual.State, datastore.JobCancelled)
+		}
+
+		if err := m.Cancel(job.ID); !errors.Is(err, ErrJobNotRunning) {
+			t.Errorf("Cancelling a finished job returned %v; want %v", err, ErrJobNotRunning)
+		}
+	})
+
+	jobs, err := m.List(0)
+	if err != nil {
+		t.Fatalf("Failed to list jobs; error %v", err)
+	}
+
+	if len(jobs) != 2 {
+		t.Errorf("Got %v jobs; want 2", len(jobs))
+	}
+
+	if _, err := m.Get("missing"); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("Getting a missing job returned %v; want %v", err, datastore.ErrNotFound)
+	}
+}
@@ -0,0 +1,143 @@
+package gdocs
+
+import (
+	"context"
+	"github.com/jlewi/p22h/backend/pkg/glanguage"
+	"github.com/pkg/errors"
+	languagepb "google.golang.org/genproto/googleapis/cloud/language/v1"
+	"strings"
+)
+
+const (
+	// MinKeyphraseTokens is the minimum number of tokens in a keyphrase. Single nouns are too generic to be
+	// useful concepts and most of the interesting ones are already found as entities.
+	MinKeyphraseTokens = 2
+	// MaxKeyphraseTokens is the maximum number of tokens in a keyphrase. Longer chunks are usually the result of
+	// mistagged tokens.
+	MaxKeyphraseTokens = 5
+)
+
+// Keyphrase is a noun phrase found in the text e.g. "feature store" or "canary rollout".
+type Keyphrase struct {
+	// Phrase is the normalized form of the phrase; the lower case lemmas of the tokens separated by spaces.
+	// Different inflections of the same phrase e.g. "feature stores" and "Feature Store" have the same Phrase.
+	Phrase string
+	// Text is the phrase as it appears in the text.
+	Text string
+	// StartIndex is the byte offset of the start of the phrase.
+	StartIndex int64
+	// EndIndex is the byte offset of the end of the phrase.
+	EndIndex int64
+}
+
+// GetTextKeyphrases uses AnalyzeSyntax to find the noun phrases in text.
+func GetTextKeyphrases(ctx context.Context, client glanguage.Client, text string) ([]Keyphrase, error) {
+	return analyzeKeyphrases(ctx, client, text, MaxRequestBytes)
+}
+
+// analyzeKeyphrases calls AnalyzeSyntax and chunks the tokens into keyphrases.
+//
+// Text larger than maxBytes is split into multiple requests; see chunkText. Offsets of the returned keyphrases are
+// relative to the start of text.
+func analyzeKeyphrases(ctx context.Context, client glanguage.Client, text string, maxBytes int) ([]Keyphrase, error) {
+	phrases := make([]Keyphrase, 0, 10)
+	for _, c := range chunkText(text, maxBytes) {
+		// TODO(jeremy): Retries?
+		resp, err := client.AnalyzeSyntax(ctx, &languagepb.AnalyzeSyntaxRequest{
+			Document: &languagepb.Document{
+				Source: &languagepb.Document_Content{
+					Content: c.Text,
+				},
+				Type: languagepb.Document_PLAIN_TEXT,
+			},
+			EncodingType: languagepb.EncodingType_UTF8,
+		})
+
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to call NLP API.")
+		}
+
+		for _, p := range chunkNounPhrases(c.Text, resp.GetTokens()) {
+			p.StartIndex = p.StartIndex + int64(c.Offset)
+			p.EndIndex = p.EndIndex + int64(c.Offset)
+			phrases = append(phrases, p)
+		}
+	}
+	return phrases, nil
+}
+
+// chunkNounPhrases groups tokens into noun phrases.
+//
+// A noun phrase is a maximal run of adjectives and nouns ending in a noun e.g. "blue/green deployment" or
+// "canary rollout". Phrases with fewer than MinKeyphraseTokens or more than MaxKeyphraseTokens tokens are dropped.
+func chunkNounPhrases(text string, tokens []*languagepb.Token) []Keyphrase {
+	phrases := make([]Keyphrase, 0, 10)
+	run := make([]*languagepb.Token, 0, MaxKeyphraseTokens)
+
+	flush := func() {
+		// Trim trailing adjectives; the phrase must end in a noun.
+		for len(run) > 0 && run[len(run)-1].GetPartOfSpeech().GetTag() != languagepb.PartOfSpeech_NOUN {
+			run = run[:len(run)-1]
+		}
+
+		if len(run) >= MinKeyphraseTokens && len(run) <= MaxKeyphraseTokens {
+			phrases = append(phrases, newKeyphrase(text, run))
+		}
+		run = run[:0]
+	}
+
+	for _, t := range tokens {
+		switch t.GetPartOfSpeech().GetTag() {
+		case languagepb.PartOfSpeech_NOUN, languagepb.PartOfSpeech_ADJ:
+			run = append(run, t)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return phrases
+}
+
+// newKeyphrase creates the keyphrase spanning the tokens.
+func newKeyphrase(text string, tokens []*languagepb.Token) Keyphrase {
+	lemmas := make([]string, 0, len(tokens))
+	for _, t := range tokens {
+		l := t.GetLemma()
+		if l == "" {
+			l = t.GetText().GetContent()
+		}
+		lemmas = append(lemmas, strings.ToLower(l))
+	}
+
+	first := tokens[0].GetText()
+	last := tokens[len(tokens)-1].GetText()
+	start := int64(first.GetBeginOffset())
+	end := int64(last.GetBeginOffset()) + int64(len(last.GetContent()))
+
+	p := Keyphrase{
+		Phrase:     strings.Join(lemmas, " "),
+		StartIndex: start,
+		EndIndex:   end,
+	}
+
+	if start >= 0 && end <= int64(len(text)) && start <= end {
+		p.Text = text[start:end]
+	}
+	return p
+}
+
+// removeRedactedKeyphrases removes keyphrases which overlap redacted text.
+func removeRedactedKeyphrases(phrases []Keyphrase, redactions []Redaction) []Keyphrase {
+	if len(redactions) == 0 {
+		return phrases
+	}
+
+	kept := make([]Keyphrase, 0, len(phrases))
+	for _, p := range phrases {
+		if isRedacted(redactions, p.StartIndex, p.EndIndex) {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	return kept
+}
@@ -0,0 +1,102 @@
+package gdocs
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	languagepb "google.golang.org/genproto/googleapis/cloud/language/v1"
+	"strings"
+	"testing"
+)
+
+func Test_chunkNounPhrases(t *testing.T) {
+	type token struct {
+		text  string
+		lemma string
+		tag   languagepb.PartOfSpeech_Tag
+	}
+
+	type testCase struct {
+		name     string
+		text     string
+		tokens   []token
+		expected []Keyphrase
+	}
+
+	cases := []testCase{
+		{
+			name: "phrases",
+			text: "We use Feature Stores for a canary rollout",
+			tokens: []token{
+				{"We", "we", languagepb.PartOfSpeech_PRON},
+				{"use", "use", languagepb.PartOfSpeech_VERB},
+				{"Feature", "Feature", languagepb.PartOfSpeech_NOUN},
+				{"Stores", "Store", languagepb.PartOfSpeech_NOUN},
+				{"for", "for", languagepb.PartOfSpeech_ADP},
+				{"a", "a", languagepb.PartOfSpeech_DET},
+				{"canary", "canary", languagepb.PartOfSpeech_ADJ},
+				{"rollout", "rollout", languagepb.PartOfSpeech_NOUN},
+			},
+			expected: []Keyphrase{
+				{Phrase: "feature store", Text: "Feature Stores", StartIndex: 7, EndIndex: 21},
+				{Phrase: "canary rollout", Text: "canary rollout", StartIndex: 28, EndIndex: 42},
+			},
+		},
+		{
+			name: "trailing-adjective",
+			text: "the model is fast and good",
+			tokens: []token{
+				{"the", "the", languagepb.PartOfSpeech_DET},
+				{"model", "model", languagepb.PartOfSpeech_NOUN},
+				{"is", "be", languagepb.PartOfSpeech_VERB},
+				{"fast", "fast", languagepb.PartOfSpeech_ADJ},
+				{"and", "and", languagepb.PartOfSpeech_CONJ},
+				{"good", "good", languagepb.PartOfSpeech_ADJ},
+			},
+			expected: []Keyphrase{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tokens := make([]*languagepb.Token, 0, len(c.tokens))
+			offset := 0
+			for _, tok := range c.tokens {
+				i := offset + strings.Index(c.text[offset:], tok.text)
+				tokens = append(tokens, &languagepb.Token{
+					Text:         &languagepb.TextSpan{Content: tok.text, BeginOffset: int32(i)},
+					PartOfSpeech: &languagepb.PartOfSpeech{Tag: tok.tag},
+					Lemma:        tok.lemma,
+				})
+				offset = i + len(tok.text)
+			}
+
+			actual := chunkNounPhrases(c.text, tokens)
+			if d := cmp.Diff(c.expected, actual); d != "" {
+				t.Errorf("Did not get expected keyphrases; diff:\n%v", d)
+			}
+		})
+	}
+}
+
+func Test_analyzeKeyphrases(t *testing.T) {
+	text := "feature store docs.\nthe feature store is great.\n"
+	client := &wordClient{words: []string{"feature", "store"}}
+
+	actual, err := analyzeKeyphrases(context.Background(), client, text, 30)
+	if err != nil {
+		t.Fatalf("analyzeKeyphrases failed; error %v", err)
+	}
+
+	if client.numCalls != 2 {
+		t.Errorf("Got %v calls; want 2", client.numCalls)
+	}
+
+	expected := []Keyphrase{
+		{Phrase: "feature store", Text: "feature store", StartIndex: 0, EndIndex: 13},
+		{Phrase: "feature store", Text: "feature store", StartIndex: 24, EndIndex: 37},
+	}
+
+	if d := cmp.Diff(expected, actual); d != "" {
+		t.Errorf("Did not get expected keyphrases; diff:\n%v", d)
+	}
+}
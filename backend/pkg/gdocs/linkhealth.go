@@ -0,0 +1,321 @@
+package gdocs
+
+import (
+	"context"
+	"github.com/go-logr/logr"
+	"github.com/jlewi/p22h/backend/pkg/datastore"
+	"github.com/pkg/errors"
+	"google.golang.org/api/docs/v1"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	// LinkNotFound means Drive returned 404 for the target; it was deleted or the ID is wrong.
+	LinkNotFound = "notFound"
+	// LinkForbidden means Drive returned 403 for the target; the indexer can't read it so readers probably can't
+	// either.
+	LinkForbidden = "forbidden"
+	// LinkTrashed means the target is in the trash.
+	LinkTrashed = "trashed"
+	// LinkMissingHeading means the target doesn't have the heading the link points to; it was probably deleted.
+	LinkMissingHeading = "missingHeading"
+	// LinkDangling means the target isn't a known doc. It is only reported when Drive isn't checked.
+	LinkDangling = "dangling"
+	// LinkCheckFailed means the target couldn't be checked e.g. because of a transient error.
+	LinkCheckFailed = "checkFailed"
+
+	linkPageSize = 500
+)
+
+// LinkReport is the result of checking the links in the indexed docs.
+type LinkReport struct {
+	// NumLinks is the number of internal links checked.
+	NumLinks int
+	// NumBroken is the number of broken links.
+	NumBroken int
+	// Docs are the source docs with broken links ordered by ID.
+	Docs []*SourceDocReport
+}
+
+// SourceDocReport lists the broken links in a doc.
+type SourceDocReport struct {
+	DocID string
+	Name  string
+	// Owners are the emails of the owners of the doc. They are only known if people were indexed.
+	Owners []string
+	Links  []*BrokenLink
+}
+
+// BrokenLink is a link whose target or heading doesn't exist or can't be read.
+type BrokenLink struct {
+	DestID  string
+	URI     string
+	Text    string
+	Heading string
+	// Problem is one of LinkNotFound, LinkForbidden, LinkTrashed, LinkMissingHeading, LinkDangling or
+	// LinkCheckFailed.
+	Problem string
+	// Error is the error for LinkCheckFailed.
+	Error string
+}
+
+// LinkChecker checks that the targets of links in the indexed docs exist and are readable.
+//
+// Targets are looked up with the Drive API, including known docs since they may have been deleted or trashed
+// since they were indexed. Links to headings are checked against the headings of the target which is fetched with
+// the Docs API. Each target is only fetched once per check.
+type LinkChecker struct {
+	log        logr.Logger
+	store      datastore.Store
+	httpClient *http.Client
+}
+
+// NewLinkChecker creates a LinkChecker. If httpClient is nil Drive isn't checked; known docs are assumed to exist,
+// other targets are reported as dangling and headings aren't checked.
+func NewLinkChecker(store datastore.Store, httpClient *http.Client, log logr.Logger) (*LinkChecker, error) {
+	if store == nil {
+		return nil, errors.New("store is required")
+	}
+
+	return &LinkChecker{
+		log:        log,
+		store:      store,
+		httpClient: httpClient,
+	}, nil
+}
+
+// target is the result of checking the target of links.
+type target struct {
+	problem string
+	err     error
+	// headings are the IDs of the headings in the target. nil means they haven't been fetched.
+	headings map[string]bool
+}
+
+// Check checks the links in the doc sourceId or all docs if sourceId is empty. Links to other websites aren't
+// checked.
+func (c *LinkChecker) Check(ctx context.Context, sourceId string) (*LinkReport, error) {
+	refs, err := c.store.ListDocReferences()
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]*datastore.DocReference{}
+	for _, r := range refs {
+		known[r.ID] = r
+	}
+
+	var driveSvc *drive.Service
+	var docsSvc *docs.Service
+	if c.httpClient != nil {
+		driveSvc, err = drive.NewService(ctx, option.WithHTTPClient(c.httpClient))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to create drive client")
+		}
+		docsSvc, err = docs.NewService(ctx, option.WithHTTPClient(c.httpClient))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to create docs client")
+		}
+	}
+
+	report := &LinkReport{
+		Docs: make([]*SourceDocReport, 0, 10),
+	}
+	bySource := map[string]*SourceDocReport{}
+	targets := map[string]*target{}
+
+	q := datastore.DocLinkQuery{SourceID: sourceId, ListOptions: datastore.ListOptions{PageSize: linkPageSize}}
+	for {
+		links, next, err := c.store.QueryDocLinks(q)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, l := range links {
+			if l.DestID == "" {
+				continue
+			}
+			report.NumLinks++
+
+			broken := c.checkLink(ctx, l, known, targets, driveSvc, docsSvc)
+			if broken == nil {
+				continue
+			}
+			report.NumBroken++
+
+			doc, ok := bySource[l.SourceID]
+			if !ok {
+				doc = &SourceDocReport{DocID: l.SourceID, Links: make([]*BrokenLink, 0, 10)}
+				if r, ok := known[l.SourceID]; ok {
+					doc.Name = r.Name
+				}
+				bySource[l.SourceID] = doc
+				report.Docs = append(report.Docs, doc)
+			}
+			doc.Links = append(doc.Links, broken)
+		}
+
+		if next == "" {
+			break
+		}
+		q.PageToken = next
+	}
+
+	for _, doc := range report.Docs {
+		owners, err := c.owners(doc.DocID)
+		if err != nil {
+			return nil, err
+		}
+		doc.Owners = owners
+	}
+
+	sort.Slice(report.Docs, func(i, j int) bool {
+		return report.Docs[i].DocID < report.Docs[j].DocID
+	})
+	return report, nil
+}
+
+// checkLink checks the link l and returns nil if it isn't broken. targets caches the targets which were checked.
+func (c *LinkChecker) checkLink(ctx context.Context, l *datastore.DocLink, known map[string]*datastore.DocReference, targets map[string]*target, driveSvc *drive.Service, docsSvc *docs.Service) *BrokenLink {
+	heading := ""
+	if g, err := ParseGoogleDocUri(l.URI); err == nil && g != nil {
+		heading = g.Heading
+	}
+
+	broken := &BrokenLink{
+		DestID:  l.DestID,
+		URI:     l.URI,
+		Text:    l.Text,
+		Heading: heading,
+	}
+
+	t, ok := targets[l.DestID]
+	if !ok {
+		t = &target{}
+		targets[l.DestID] = t
+		if driveSvc != nil {
+			// Files.Get with only the id and trashed fields is cheap so known docs are checked too.
+			t.problem, t.err = checkDriveFile(ctx, driveSvc, driveId(l.DestID))
+		} else if _, ok := known[l.DestID]; !ok {
+			t.problem = LinkDangling
+		}
+	}
+
+	if t.problem == "" && heading != "" && docsSvc != nil {
+		if t.headings == nil {
+			t.headings, t.problem, t.err = fetchHeadings(ctx, docsSvc, driveId(l.DestID))
+		}
+		if t.problem == "" && !t.headings[heading] {
+			broken.Problem = LinkMissingHeading
+			return broken
+		}
+	}
+
+	if t.problem == "" {
+		return nil
+	}
+	broken.Problem = t.problem
+	if t.err != nil {
+		broken.Error = t.err.Error()
+	}
+	return broken
+}
+
+// owners returns the emails of the owners of the doc.
+func (c *LinkChecker) owners(docId string) ([]string, error) {
+	people, err := c.store.ListDocPeople(docId, "")
+	if err != nil {
+		return nil, err
+	}
+
+	owners := make([]string, 0, 1)
+	for _, p := range people {
+		if p.Role != datastore.RoleOwner {
+			continue
+		}
+		owners = append(owners, strings.TrimPrefix(p.EntityID, datastore.PersonKey("")))
+	}
+	sort.Strings(owners)
+	return owners, nil
+}
+
+// driveId returns the Drive ID of the doc with the given key; see datastore.DriveKey.
+func driveId(key string) string {
+	return strings.TrimPrefix(key, datastore.DriveKey(""))
+}
+
+// checkDriveFile looks up the file in Drive and returns the problem if the file can't be read.
+func checkDriveFile(ctx context.Context, svc *drive.Service, fileId string) (string, error) {
+	f, err := svc.Files.Get(fileId).SupportsAllDrives(true).Fields("id, trashed").Context(ctx).Do()
+	if err != nil {
+		return apiProblem(err)
+	}
+	if f.Trashed {
+		return LinkTrashed, nil
+	}
+	return "", nil
+}
+
+// fetchHeadings returns the IDs of the headings in the doc. If the doc can't be read the problem is returned.
+func fetchHeadings(ctx context.Context, svc *docs.Service, docId string) (map[string]bool, string, error) {
+	d, err := svc.Documents.Get(docId).Context(ctx).Do()
+	if err != nil {
+		problem, err := apiProblem(err)
+		return nil, problem, err
+	}
+
+	headings := map[string]bool{}
+	if d.Body != nil {
+		readElementHeadings(d.Body.Content, headings)
+	}
+	return headings, "", nil
+}
+
+// readElementHeadings adds the IDs of the headings in the elements to headings.
+func readElementHeadings(elements []*docs.StructuralElement, headings map[string]bool) {
+	for _, e := range elements {
+		if e.Paragraph != nil && e.Paragraph.ParagraphStyle != nil && e.Paragraph.ParagraphStyle.HeadingId != "" {
+			headings[e.Paragraph.ParagraphStyle.HeadingId] = true
+		}
+
+		if e.Table != nil {
+			for _, r := range e.Table.TableRows {
+				for _, cell := range r.TableCells {
+					readElementHeadings(cell.Content, headings)
+				}
+			}
+		}
+	}
+}
+
+// apiProblem maps an error from a Google API to the problem with the link. Drive also returns 403 when a rate limit
+// is exceeded; that says nothing about the link so it is reported as a failed check.
+func apiProblem(err error) (string, error) {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case http.StatusNotFound:
+			return LinkNotFound, nil
+		case http.StatusForbidden:
+			if isRateLimited(apiErr) {
+				return LinkCheckFailed, err
+			}
+			return LinkForbidden, nil
+		}
+	}
+	return LinkCheckFailed, err
+}
+
+// isRateLimited returns true if the error is because a rate limit was exceeded.
+func isRateLimited(apiErr *googleapi.Error) bool {
+	for _, e := range apiErr.Errors {
+		if e.Reason == "rateLimitExceeded" || e.Reason == "userRateLimitExceeded" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,195 @@
+package gdocs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"github.com/jlewi/p22h/backend/pkg/datastore"
+	"github.com/jlewi/p22h/backend/pkg/httptesting"
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"google.golang.org/api/docs/v1"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// fakeGoogleAPIs returns the Drive files and Docs in files and docs and 404 for anything else. Files whose ID
+// starts with "status" return the status in the rest of the ID e.g. "status403". The file "rateLimited" returns
+// the 403 Drive returns when the user rate limit is exceeded.
+func fakeGoogleAPIs(files map[string]interface{}, docs map[string]*docs.Document) httptesting.RoundTripFunc {
+	return func(req *http.Request) *http.Response {
+		respond := func(code int, payload interface{}) *http.Response {
+			b, _ := json.Marshal(payload)
+			return &http.Response{
+				StatusCode: code,
+				Body:       ioutil.NopCloser(bytes.NewBuffer(b)),
+				Header:     http.Header{"Content-Type": {"application/json"}},
+			}
+		}
+
+		id := req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]
+		var payload interface{}
+		var ok bool
+		if strings.HasPrefix(req.URL.Path, "/drive/") {
+			if id == "rateLimited" {
+				reasons := []interface{}{map[string]interface{}{"domain": "usageLimits", "reason": "userRateLimitExceeded", "message": "User Rate Limit Exceeded"}}
+				return respond(http.StatusForbidden, map[string]interface{}{"error": map[string]interface{}{"code": http.StatusForbidden, "message": "User Rate Limit Exceeded", "errors": reasons}})
+			}
+			var code int
+			if n, _ := fmt.Sscanf(id, "status%d", &code); n == 1 {
+				return respond(code, map[string]interface{}{"error": map[string]interface{}{"code": code, "message": "error"}})
+			}
+			payload, ok = files[id]
+		} else {
+			payload, ok = docs[id]
+		}
+
+		if !ok {
+			return respond(http.StatusNotFound, map[string]interface{}{"error": map[string]interface{}{"code": http.StatusNotFound, "message": "not found"}})
+		}
+		return respond(http.StatusOK, payload)
+	}
+}
+
+func TestLinkChecker(t *testing.T) {
+	log, err := logging.InitLogger("info", true)
+	if err != nil {
+		t.Fatalf("Failed to initialize logger; %v", err)
+	}
+
+	store := datastore.NewMemoryStore(*log)
+	if err := store.UpsertDocReferences([]*datastore.DocReference{{DriveId: "doc1", Name: "Doc 1"}, {DriveId: "doc2", Name: "Doc 2"}, {DriveId: "gone", Name: "Gone"}}); err != nil {
+		t.Fatalf("Failed to create docs; error %v", err)
+	}
+
+	uri := func(id string, heading string) string {
+		u := "https://docs.google.com/document/d/" + id + "/edit"
+		if heading != "" {
+			u = u + "#heading=" + heading
+		}
+		return u
+	}
+	links := []*datastore.DocLink{
+		{SourceID: datastore.DriveKey("doc1"), DestID: datastore.DriveKey("doc2"), URI: uri("doc2", "h.intro"), StartIndex: 1},
+		{SourceID: datastore.DriveKey("doc1"), DestID: datastore.DriveKey("doc2"), URI: uri("doc2", "h.table"), StartIndex: 2},
+		{SourceID: datastore.DriveKey("doc1"), DestID: datastore.DriveKey("doc2"), URI: uri("doc2", "h.gone"), Text: "gone", StartIndex: 3},
+		{SourceID: datastore.DriveKey("doc1"), DestID: datastore.DriveKey("doc2"), URI: uri("doc2", ""), StartIndex: 4},
+		{SourceID: datastore.DriveKey("doc2"), DestID: datastore.DriveKey("doc1"), URI: uri("doc1", ""), StartIndex: 1},
+		{SourceID: datastore.DriveKey("doc2"), DestID: datastore.DriveKey("deleted"), URI: uri("deleted", ""), StartIndex: 2},
+		{SourceID: datastore.DriveKey("doc2"), DestID: datastore.DriveKey("status403"), URI: uri("status403", ""), StartIndex: 3},
+		{SourceID: datastore.DriveKey("doc2"), DestID: datastore.DriveKey("status403"), URI: uri("status403", "h.intro"), StartIndex: 4},
+		{SourceID: datastore.DriveKey("doc2"), DestID: datastore.DriveKey("trashed"), URI: uri("trashed", ""), StartIndex: 5},
+		{SourceID: datastore.DriveKey("doc2"), DestID: datastore.DriveKey("unindexed"), URI: uri("unindexed", ""), StartIndex: 6},
+		{SourceID: datastore.DriveKey("doc2"), URI: "https://example.com", StartIndex: 7},
+		// gone was indexed but has since been deleted.
+		{SourceID: datastore.DriveKey("doc2"), DestID: datastore.DriveKey("gone"), URI: uri("gone", ""), StartIndex: 8},
+		{SourceID: datastore.DriveKey("doc2"), DestID: datastore.DriveKey("rateLimited"), URI: uri("rateLimited", ""), StartIndex: 9},
+	}
+	if err := store.UpsertDocLinks(links); err != nil {
+		t.Fatalf("Failed to create links; error %v", err)
+	}
+	if err := store.ReplaceDocPeople(datastore.DriveKey("doc2"), []*datastore.DocPerson{{DocID: datastore.DriveKey("doc2"), EntityID: datastore.PersonKey("alice@example.com"), Role: datastore.RoleOwner}}); err != nil {
+		t.Fatalf("Failed to add people; error %v", err)
+	}
+
+	files := map[string]interface{}{
+		"doc1":      map[string]interface{}{"id": "doc1"},
+		"doc2":      map[string]interface{}{"id": "doc2"},
+		"trashed":   map[string]interface{}{"id": "trashed", "trashed": true},
+		"unindexed": map[string]interface{}{"id": "unindexed"},
+	}
+	heading := func(id string) *docs.StructuralElement {
+		return &docs.StructuralElement{Paragraph: &docs.Paragraph{ParagraphStyle: &docs.ParagraphStyle{HeadingId: id}}}
+	}
+	targets := map[string]*docs.Document{
+		"doc2": {Body: &docs.Body{Content: []*docs.StructuralElement{
+			heading("h.intro"),
+			{Table: &docs.Table{TableRows: []*docs.TableRow{{TableCells: []*docs.TableCell{{Content: []*docs.StructuralElement{heading("h.table")}}}}}}},
+		}}},
+	}
+
+	checker, err := NewLinkChecker(store, httptesting.NewTestClient(fakeGoogleAPIs(files, targets)), *log)
+	if err != nil {
+		t.Fatalf("Failed to create link checker; error %v", err)
+	}
+
+	report, err := checker.Check(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Check failed; error %v", err)
+	}
+
+	expected := &LinkReport{
+		NumLinks:  12,
+		NumBroken: 7,
+		Docs: []*SourceDocReport{
+			{
+				DocID:  datastore.DriveKey("doc1"),
+				Name:   "Doc 1",
+				Owners: []string{},
+				Links: []*BrokenLink{
+					{DestID: datastore.DriveKey("doc2"), URI: uri("doc2", "h.gone"), Text: "gone", Heading: "h.gone", Problem: LinkMissingHeading},
+				},
+			},
+			{
+				DocID:  datastore.DriveKey("doc2"),
+				Name:   "Doc 2",
+				Owners: []string{"alice@example.com"},
+				Links: []*BrokenLink{
+					{DestID: datastore.DriveKey("deleted"), URI: uri("deleted", ""), Problem: LinkNotFound},
+					{DestID: datastore.DriveKey("gone"), URI: uri("gone", ""), Problem: LinkNotFound},
+					// Exceeding a rate limit doesn't mean the link is broken.
+					{DestID: datastore.DriveKey("rateLimited"), URI: uri("rateLimited", ""), Problem: LinkCheckFailed, Error: "googleapi: Error 403: User Rate Limit Exceeded, userRateLimitExceeded"},
+					{DestID: datastore.DriveKey("status403"), URI: uri("status403", ""), Problem: LinkForbidden},
+					{DestID: datastore.DriveKey("status403"), URI: uri("status403", "h.intro"), Heading: "h.intro", Problem: LinkForbidden},
+					{DestID: datastore.DriveKey("trashed"), URI: uri("trashed", ""), Problem: LinkTrashed},
+				},
+			},
+		},
+	}
+	if d := cmp.Diff(expected, report); d != "" {
+		t.Errorf("Unexpected report; diff:\n%v", d)
+	}
+
+	// Without Drive unknown targets are dangling and headings aren't checked.
+	checker, err = NewLinkChecker(store, nil, *log)
+	if err != nil {
+		t.Fatalf("Failed to create link checker; error %v", err)
+	}
+	report, err = checker.Check(context.Background(), datastore.DriveKey("doc1"))
+	if err != nil {
+		t.Fatalf("Check failed; error %v", err)
+	}
+	if report.NumLinks != 4 || report.NumBroken != 0 {
+		t.Errorf("Got %v broken links out of %v; want 0 out of 4", report.NumBroken, report.NumLinks)
+	}
+	report, err = checker.Check(context.Background(), datastore.DriveKey("doc2"))
+	if err != nil {
+		t.Fatalf("Check failed; error %v", err)
+	}
+	if report.NumLinks != 8 || report.NumBroken != 6 {
+		t.Errorf("Got %v broken links out of %v; want 6 out of 8", report.NumBroken, report.NumLinks)
+	}
+
+	// Other errors are reported as failed checks.
+	if err := store.UpdateDocLink(&datastore.DocLink{SourceID: datastore.DriveKey("doc1"), DestID: datastore.DriveKey("status500"), URI: uri("status500", "")}); err != nil {
+		t.Fatalf("Failed to create link; error %v", err)
+	}
+	checker, err = NewLinkChecker(store, httptesting.NewTestClient(fakeGoogleAPIs(files, targets)), *log)
+	if err != nil {
+		t.Fatalf("Failed to create link checker; error %v", err)
+	}
+	report, err = checker.Check(context.Background(), datastore.DriveKey("doc1"))
+	if err != nil {
+		t.Fatalf("Check failed; error %v", err)
+	}
+	if report.NumBroken != 2 {
+		t.Fatalf("Got %v broken links; want 2", report.NumBroken)
+	}
+	failed := report.Docs[0].Links[1]
+	if failed.DestID != datastore.DriveKey("status500") || failed.Problem != LinkCheckFailed || failed.Error == "" {
+		t.Errorf("Unexpected report for a failed check; got %+v", failed)
+	}
+}
@@ -0,0 +1,182 @@
+package gdocs
+
+import (
+	"github.com/pkg/errors"
+	languagepb "google.golang.org/genproto/googleapis/cloud/language/v1"
+	"io/ioutil"
+	"regexp"
+	"sigs.k8s.io/yaml"
+	"strings"
+)
+
+// Redaction identifies a range of text that was masked.
+type Redaction struct {
+	// Rule is the name of the rule that matched the text.
+	Rule string
+	// StartIndex is the byte offset of the start of the masked text.
+	StartIndex int64
+	// EndIndex is the byte offset of the end of the masked text.
+	EndIndex int64
+}
+
+// Redactor masks sensitive text before it is sent to external services such as the NL API.
+type Redactor interface {
+	// Redact returns the masked text along with the ranges that were masked.
+	// Implementations must preserve the length in bytes of the text and of every range they mask so that offsets
+	// into the masked text are also valid offsets into the original text.
+	Redact(text string) (string, []Redaction, error)
+}
+
+// RedactionRule is a named regular expression matching text to mask.
+type RedactionRule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+
+	re *regexp.Regexp
+}
+
+// PatternRedactor is a Redactor which masks text matching regular expressions.
+type PatternRedactor struct {
+	// Rules are the patterns to mask.
+	Rules []*RedactionRule `json:"rules,omitempty"`
+	// Mask is the ASCII character used to replace each byte of masked text. Defaults to "*".
+	Mask string `json:"mask,omitempty"`
+}
+
+// DefaultRedactionRules returns rules for common kinds of PII.
+func DefaultRedactionRules() []*RedactionRule {
+	return []*RedactionRule{
+		{
+			Name:    "email",
+			Pattern: `[a-zA-Z0-9._%+\-]+@[a-zA-Z0-9.\-]+\.[a-zA-Z]{2,}`,
+		},
+		{
+			Name:    "phone",
+			Pattern: `(\+?\d{1,3}[\s.\-]?)?\(?\d{3}\)?[\s.\-]?\d{3}[\s.\-]?\d{4}\b`,
+		},
+	}
+}
+
+// NewPatternRedactor creates a redactor from the rules.
+func NewPatternRedactor(rules []*RedactionRule, mask string) (*PatternRedactor, error) {
+	r := &PatternRedactor{
+		Rules: rules,
+		Mask:  mask,
+	}
+
+	if err := r.compile(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// ReadPatternRedactor reads the redactor configuration from a YAML or JSON file.
+func ReadPatternRedactor(path string) (*PatternRedactor, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read redaction config: %v", path)
+	}
+
+	r := &PatternRedactor{}
+	if err := yaml.Unmarshal(b, r); err != nil {
+		return nil, errors.Wrapf(err, "Failed to unmarshal redaction config from file: %v", path)
+	}
+
+	if err := r.compile(); err != nil {
+		return nil, errors.Wrapf(err, "Invalid redaction config in file: %v", path)
+	}
+	return r, nil
+}
+
+func (r *PatternRedactor) compile() error {
+	if r.Mask == "" {
+		r.Mask = "*"
+	}
+
+	if len(r.Mask) != 1 {
+		return errors.Errorf("Mask %q must be a single ASCII character", r.Mask)
+	}
+
+	for _, rule := range r.Rules {
+		if rule.Name == "" {
+			return errors.Errorf("Rule with pattern %v is missing a name", rule.Pattern)
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to compile pattern for rule %v", rule.Name)
+		}
+		rule.re = re
+	}
+	return nil
+}
+
+// Redact masks all text matching the rules. Each byte of matching text is replaced by Mask so offsets are
+// preserved. Rules are applied in order against the text masked by earlier rules.
+func (r *PatternRedactor) Redact(text string) (string, []Redaction, error) {
+	redactions := make([]Redaction, 0, 10)
+	for _, rule := range r.Rules {
+		if rule.re == nil {
+			return "", nil, errors.Errorf("Rule %v hasn't been compiled", rule.Name)
+		}
+
+		matches := rule.re.FindAllStringIndex(text, -1)
+		if len(matches) == 0 {
+			continue
+		}
+
+		b := strings.Builder{}
+		b.Grow(len(text))
+		last := 0
+		for _, m := range matches {
+			b.WriteString(text[last:m[0]])
+			b.WriteString(strings.Repeat(r.Mask, m[1]-m[0]))
+			last = m[1]
+
+			redactions = append(redactions, Redaction{
+				Rule:       rule.Name,
+				StartIndex: int64(m[0]),
+				EndIndex:   int64(m[1]),
+			})
+		}
+		b.WriteString(text[last:])
+		text = b.String()
+	}
+	return text, redactions, nil
+}
+
+// removeRedactedMentions removes mentions which overlap redacted text. Entities without any remaining mentions
+// are dropped.
+func removeRedactedMentions(entities []*languagepb.Entity, redactions []Redaction) []*languagepb.Entity {
+	if len(redactions) == 0 {
+		return entities
+	}
+
+	kept := make([]*languagepb.Entity, 0, len(entities))
+	for _, e := range entities {
+		mentions := make([]*languagepb.EntityMention, 0, len(e.GetMentions()))
+		for _, m := range e.GetMentions() {
+			start := int64(m.GetText().GetBeginOffset())
+			if isRedacted(redactions, start, start+int64(len(m.GetText().GetContent()))) {
+				continue
+			}
+			mentions = append(mentions, m)
+		}
+
+		if len(mentions) == 0 {
+			continue
+		}
+		e.Mentions = mentions
+		kept = append(kept, e)
+	}
+	return kept
+}
+
+// isRedacted returns true if the range [start, end) overlaps any of the redactions.
+func isRedacted(redactions []Redaction, start int64, end int64) bool {
+	for _, r := range redactions {
+		if start < r.EndIndex && r.StartIndex < end {
+			return true
+		}
+	}
+	return false
+}
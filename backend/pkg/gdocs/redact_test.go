@@ -0,0 +1,83 @@
+package gdocs
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"testing"
+)
+
+func Test_PatternRedactor(t *testing.T) {
+	type testCase struct {
+		name       string
+		rules      []*RedactionRule
+		text       string
+		expected   string
+		redactions []Redaction
+	}
+
+	cases := []testCase{
+		{
+			name:     "email-and-phone",
+			rules:    DefaultRedactionRules(),
+			text:     "Contact jane.doe@acme.com or 555-123-4567 about kubeflow.",
+			expected: "Contact ***************** or ************ about kubeflow.",
+			redactions: []Redaction{
+				{Rule: "email", StartIndex: 8, EndIndex: 25},
+				{Rule: "phone", StartIndex: 29, EndIndex: 41},
+			},
+		},
+		{
+			name: "custom-rule",
+			rules: []*RedactionRule{
+				{Name: "customer", Pattern: `CUST-[0-9]+`},
+			},
+			text:     "Ticket for CUST-1234: élan",
+			expected: "Ticket for *********: élan",
+			redactions: []Redaction{
+				{Rule: "customer", StartIndex: 11, EndIndex: 20},
+			},
+		},
+		{
+			name:       "nothing-to-redact",
+			rules:      DefaultRedactionRules(),
+			text:       "Nothing sensitive here.",
+			expected:   "Nothing sensitive here.",
+			redactions: []Redaction{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r, err := NewPatternRedactor(c.rules, "")
+			if err != nil {
+				t.Fatalf("Failed to create redactor; error %v", err)
+			}
+
+			actual, redactions, err := r.Redact(c.text)
+			if err != nil {
+				t.Fatalf("Redact failed; error %v", err)
+			}
+
+			if len(actual) != len(c.text) {
+				t.Errorf("Redacted text has length %v; want %v", len(actual), len(c.text))
+			}
+
+			if actual != c.expected {
+				t.Errorf("Got %q; want %q", actual, c.expected)
+			}
+
+			if d := cmp.Diff(c.redactions, redactions); d != "" {
+				t.Errorf("Did not get expected redactions; diff:\n%v", d)
+			}
+		})
+	}
+}
+
+func Test_PatternRedactorInvalid(t *testing.T) {
+	if _, err := NewPatternRedactor([]*RedactionRule{{Name: "bad", Pattern: "("}}, ""); err == nil {
+		t.Errorf("Expected an error for an invalid pattern")
+	}
+
+	if _, err := NewPatternRedactor(DefaultRedactionRules(), "##"); err == nil {
+		t.Errorf("Expected an error for an invalid mask")
+	}
+}
@@ -0,0 +1,103 @@
+package gdocs
+
+import (
+	"context"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"math/rand"
+	"time"
+)
+
+const (
+	// SchedulerCaller is recorded as the caller of jobs started by the Scheduler.
+	SchedulerCaller = "scheduler"
+
+	// defaultJitter is the fraction by which the interval between passes is randomly varied.
+	defaultJitter = 0.1
+)
+
+// Scheduler periodically starts incremental index jobs for a set of drives.
+//
+// Passes don't overlap; the next pass is scheduled once the previous one finishes. If a job started some other
+// way e.g. through the API is running when a pass is due the pass is skipped.
+type Scheduler struct {
+	log      logr.Logger
+	jobs     *JobManager
+	drives   []string
+	interval time.Duration
+	// jitter is the fraction by which the interval is randomly varied so that servers sharing a schedule don't
+	// all hit the Drive API at the same time.
+	jitter float64
+	rand   *rand.Rand
+}
+
+// NewScheduler creates a scheduler which indexes drives every interval.
+func NewScheduler(jobs *JobManager, drives []string, interval time.Duration, log logr.Logger) (*Scheduler, error) {
+	if jobs == nil {
+		return nil, errors.New("jobs is required")
+	}
+
+	if len(drives) == 0 {
+		return nil, errors.New("At least one drive must be scheduled")
+	}
+
+	if interval <= 0 {
+		return nil, errors.Errorf("Invalid interval %v; must be positive", interval)
+	}
+
+	return &Scheduler{
+		log:      log,
+		jobs:     jobs,
+		drives:   drives,
+		interval: interval,
+		jitter:   defaultJitter,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+// Run runs a pass immediately and then every interval until ctx is cancelled. It blocks until then.
+// Cancelling ctx doesn't stop a pass in progress; use JobManager.Shutdown to cancel the running job.
+func (s *Scheduler) Run(ctx context.Context) {
+	log := s.log
+	for {
+		s.runPass(ctx)
+
+		wait := s.nextInterval()
+		log.Info("Scheduled next index pass", "in", wait.String())
+		select {
+		case <-ctx.Done():
+			log.Info("Stopping index scheduler")
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// runPass indexes each drive in turn.
+func (s *Scheduler) runPass(ctx context.Context) {
+	log := s.log
+	for _, d := range s.drives {
+		if ctx.Err() != nil {
+			return
+		}
+
+		job, err := s.jobs.Start(d, "", SchedulerCaller)
+		if err != nil {
+			if errors.Is(err, ErrJobRunning) {
+				log.Info("Skipping index pass; another job is running", "driveId", d)
+			} else if !errors.Is(err, ErrShutdown) {
+				log.Error(err, "Failed to start scheduled index job", "driveId", d)
+			}
+			return
+		}
+
+		log.Info("Started scheduled index job", "jobId", job.ID, "driveId", d)
+		s.jobs.Wait()
+	}
+}
+
+// nextInterval returns the interval randomly varied by up to jitter in either direction.
+func (s *Scheduler) nextInterval() time.Duration {
+	delta := (s.rand.Float64()*2 - 1) * s.jitter * float64(s.interval)
+	return s.interval + time.Duration(delta)
+}
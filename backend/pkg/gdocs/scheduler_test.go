@@ -0,0 +1,91 @@
+package gdocs
+
+import (
+	"context"
+	"github.com/jlewi/p22h/backend/pkg/datastore"
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"google.golang.org/api/docs/v1"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+)
+
+func Test_Scheduler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testDatabase")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+
+	log, err := logging.InitLogger("info", true)
+	if err != nil {
+		t.Fatalf("Failed to initialize logger; %v", err)
+	}
+
+	store, err := datastore.New(path.Join(dir, "database.db"), *log)
+	if err != nil {
+		t.Fatalf("Failed to create datastore; error %v", err)
+	}
+
+	newIndexer := func(opts ...IndexerOption) (*Indexer, error) {
+		return NewIndexer(&fakeSearcher{}, &docs.Service{}, store, &wordClient{}, *log, opts...)
+	}
+
+	jobs, err := NewJobManager(store, newIndexer, *log)
+	if err != nil {
+		t.Fatalf("Failed to create job manager; error %v", err)
+	}
+
+	s, err := NewScheduler(jobs, []string{"drive1", "drive2"}, 20*time.Millisecond, *log)
+	if err != nil {
+		t.Fatalf("Failed to create scheduler; error %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if d := s.nextInterval(); d < 18*time.Millisecond || d > 22*time.Millisecond {
+			t.Fatalf("Interval %v isn't within 10%% of 20ms", d)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	jobs.Shutdown()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Scheduler didn't stop")
+	}
+
+	list, err := jobs.List(0)
+	if err != nil {
+		t.Fatalf("Failed to list jobs; error %v", err)
+	}
+
+	// There should be at least one pass over both drives.
+	drives := map[string]bool{}
+	for _, j := range list {
+		drives[j.DriveID] = true
+		if j.Caller != SchedulerCaller {
+			t.Errorf("Job %v has caller %v; want %v", j.ID, j.Caller, SchedulerCaller)
+		}
+		if j.State == datastore.JobRunning {
+			t.Errorf("Job %v is still running after shutdown", j.ID)
+		}
+	}
+
+	if !drives["drive1"] || !drives["drive2"] {
+		t.Errorf("Got jobs for drives %v; want drive1 and drive2", drives)
+	}
+
+	if _, err := jobs.Start("drive1", "", ""); err != ErrShutdown {
+		t.Errorf("Starting a job after shutdown returned %v; want %v", err, ErrShutdown)
+	}
+}
@@ -0,0 +1,51 @@
+package gdocs
+
+import (
+	"sort"
+	"unicode"
+	"unicode/utf8"
+)
+
+// sentenceStarts returns the byte offsets of the start of each sentence in text.
+//
+// A sentence ends at a newline, since paragraphs, list items and headings are separate sentences, or at '.', '!'
+// or '?' followed by whitespace. This is a heuristic; abbreviations such as "e.g. " will split sentences.
+func sentenceStarts(text string) []int {
+	starts := []int{0}
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		next := i + size
+		end := false
+		switch r {
+		case '\n':
+			end = true
+		case '.', '!', '?':
+			n, _ := utf8.DecodeRuneInString(text[next:])
+			end = next < len(text) && unicode.IsSpace(n)
+		}
+
+		if end {
+			// The next sentence starts at the first non space character.
+			for next < len(text) {
+				n, size := utf8.DecodeRuneInString(text[next:])
+				if !unicode.IsSpace(n) {
+					break
+				}
+				next = next + size
+			}
+			if next < len(text) {
+				starts = append(starts, next)
+			}
+		}
+		i = next
+	}
+	return starts
+}
+
+// sentenceNumber returns the 1 based number of the sentence containing offset.
+func sentenceNumber(starts []int, offset int64) int64 {
+	i := sort.Search(len(starts), func(i int) bool {
+		return int64(starts[i]) > offset
+	})
+	return int64(i)
+}
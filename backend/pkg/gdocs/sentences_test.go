@@ -0,0 +1,36 @@
+package gdocs
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"testing"
+)
+
+func Test_sentenceStarts(t *testing.T) {
+	text := "Kubeflow is great. It runs on Kubernetes!\nHeading\nWhat about v1.2? Yes."
+
+	starts := sentenceStarts(text)
+	expected := []int{0, 19, 42, 50, 67}
+	if d := cmp.Diff(expected, starts); d != "" {
+		t.Errorf("Did not get expected sentence starts; diff:\n%v", d)
+	}
+
+	type testCase struct {
+		offset   int64
+		expected int64
+	}
+
+	cases := []testCase{
+		{offset: 0, expected: 1},
+		{offset: 17, expected: 1},
+		{offset: 30, expected: 2},
+		{offset: 42, expected: 3},
+		{offset: 59, expected: 4},
+		{offset: 67, expected: 5},
+	}
+
+	for _, c := range cases {
+		if actual := sentenceNumber(starts, c.offset); actual != c.expected {
+			t.Errorf("sentenceNumber(%v) = %v; want %v", c.offset, actual, c.expected)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package gdocs
+
+import (
+	"context"
+	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+	"github.com/jlewi/p22h/backend/pkg/datastore"
+	"github.com/jlewi/p22h/backend/pkg/glanguage"
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+const (
+	// BudgetPeriodRun means the budget applies to a single indexing run.
+	BudgetPeriodRun = "run"
+	// BudgetPeriodDay means the budget applies to each UTC day.
+	BudgetPeriodDay = "day"
+	// BudgetPeriodMonth means the budget applies to each UTC calendar month.
+	BudgetPeriodMonth = "month"
+
+	dayFormat = "2006-01-02"
+)
+
+type driveKeyType string
+
+// driveKey is the context key for the id of the drive being indexed.
+const driveKey driveKeyType = "driveId"
+
+// withDrive returns a context recording the id of the drive being indexed so usage can be attributed to it.
+func withDrive(ctx context.Context, driveId string) context.Context {
+	return context.WithValue(ctx, driveKey, driveId)
+}
+
+func driveFromContext(ctx context.Context) string {
+	v, _ := ctx.Value(driveKey).(string)
+	return v
+}
+
+// UsageBudget limits how much the NL API can be used.
+type UsageBudget struct {
+	// MaxUnits is the maximum number of billing units that can be used in each period. 0 means unlimited.
+	MaxUnits int64
+	// Period is one of BudgetPeriodRun, BudgetPeriodDay or BudgetPeriodMonth.
+	Period string
+}
+
+// UsageMeter implements glanguage.Meter. Usage is stored in the datastore.
+type UsageMeter struct {
+	store  datastore.Store
+	budget UsageBudget
+	runID  string
+	log    logr.Logger
+	now    func() time.Time
+
+	mu  sync.Mutex
+	run datastore.NLPUsage
+}
+
+// NewUsageMeter creates a meter for a new indexing run.
+func NewUsageMeter(store datastore.Store, budget UsageBudget, log logr.Logger) (*UsageMeter, error) {
+	if store == nil {
+		return nil, errors.New("store is required")
+	}
+
+	if budget.Period == "" {
+		budget.Period = BudgetPeriodMonth
+	}
+
+	switch budget.Period {
+	case BudgetPeriodRun, BudgetPeriodDay, BudgetPeriodMonth:
+	default:
+		return nil, errors.Errorf("Invalid budget period %v; must be one of %v, %v, %v", budget.Period, BudgetPeriodRun, BudgetPeriodDay, BudgetPeriodMonth)
+	}
+
+	if budget.MaxUnits < 0 {
+		return nil, errors.Errorf("Invalid budget %v; must be >= 0", budget.MaxUnits)
+	}
+
+	uid, err := uuid.NewUUID()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create run id")
+	}
+
+	return &UsageMeter{
+		store:  store,
+		budget: budget,
+		runID:  uid.String(),
+		log:    log,
+		now:    time.Now,
+		run: datastore.NLPUsage{
+			RunID: uid.String(),
+		},
+	}, nil
+}
+
+// Allow returns glanguage.ErrBudgetExceeded if the request would exceed the budget.
+func (m *UsageMeter) Allow(ctx context.Context, method string, numCharacters int64) error {
+	if m.budget.MaxUnits == 0 {
+		return nil
+	}
+
+	used, err := m.used()
+	if err != nil {
+		return err
+	}
+
+	if used+glanguage.Units(numCharacters) > m.budget.MaxUnits {
+		m.log.V(logging.Debug).Info("Budget exceeded", "used", used, "budget", m.budget.MaxUnits, "period", m.budget.Period)
+		return glanguage.ErrBudgetExceeded
+	}
+	return nil
+}
+
+// used returns the number of units used in the current budget period.
+func (m *UsageMeter) used() (int64, error) {
+	now := m.now().UTC()
+	switch m.budget.Period {
+	case BudgetPeriodRun:
+		return m.RunUsage().Units, nil
+	case BudgetPeriodDay:
+		return m.store.SumNLPUnits(now.Format(dayFormat))
+	default:
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return m.store.SumNLPUnits(start.Format(dayFormat))
+	}
+}
+
+// Record stores the usage in the datastore.
+func (m *UsageMeter) Record(ctx context.Context, method string, numCharacters int64) error {
+	u := &datastore.NLPUsage{
+		RunID:         m.runID,
+		Day:           m.now().UTC().Format(dayFormat),
+		DriveID:       driveFromContext(ctx),
+		Method:        method,
+		Requests:      1,
+		NumCharacters: numCharacters,
+		Units:         glanguage.Units(numCharacters),
+	}
+
+	m.mu.Lock()
+	m.run.Requests = m.run.Requests + u.Requests
+	m.run.NumCharacters = m.run.NumCharacters + u.NumCharacters
+	m.run.Units = m.run.Units + u.Units
+	m.mu.Unlock()
+
+	return m.store.AddNLPUsage(u)
+}
+
+// RunUsage returns the usage for this run.
+func (m *UsageMeter) RunUsage() datastore.NLPUsage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.run
+}
@@ -0,0 +1,76 @@
+package gdocs
+
+import (
+	"context"
+	"github.com/jlewi/p22h/backend/pkg/datastore"
+	"github.com/jlewi/p22h/backend/pkg/glanguage"
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+func Test_UsageMeter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testDatabase")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+
+	log, err := logging.InitLogger("info", true)
+	if err != nil {
+		t.Fatalf("Failed to initialize logger; %v", err)
+	}
+
+	store, err := datastore.New(path.Join(dir, "database.db"), *log)
+	if err != nil {
+		t.Fatalf("Failed to create datastore; error %v", err)
+	}
+
+	meter, err := NewUsageMeter(store, UsageBudget{MaxUnits: 3, Period: BudgetPeriodRun}, *log)
+	if err != nil {
+		t.Fatalf("Failed to create meter; error %v", err)
+	}
+
+	fake := &wordClient{words: []string{"kubeflow"}}
+	client, err := glanguage.NewMeteredClient(fake, meter, *log)
+	if err != nil {
+		t.Fatalf("Failed to create client; error %v", err)
+	}
+
+	ctx := withDrive(context.Background(), "drive1")
+
+	// 1500 characters is 2 units.
+	if _, err := analyzeEntities(ctx, client, strings.Repeat("a", 1500), MaxRequestBytes, false); err != nil {
+		t.Fatalf("First request should be within budget; error %v", err)
+	}
+
+	// This would bring the total to 4 units which exceeds the budget.
+	_, err = analyzeEntities(ctx, client, strings.Repeat("a", 1500), MaxRequestBytes, false)
+	if !errors.Is(err, glanguage.ErrBudgetExceeded) {
+		t.Fatalf("Second request should exceed the budget; got error %v", err)
+	}
+
+	if _, err := analyzeEntities(ctx, client, "kubeflow", MaxRequestBytes, false); err != nil {
+		t.Fatalf("Third request should be within budget; error %v", err)
+	}
+
+	if fake.numCalls != 2 {
+		t.Errorf("Got %v calls to the API; want 2", fake.numCalls)
+	}
+
+	run := meter.RunUsage()
+	if run.Units != 3 || run.Requests != 2 || run.NumCharacters != 1508 {
+		t.Errorf("Unexpected run usage %+v", run)
+	}
+
+	usage, err := store.ReportNLPUsage([]string{"drive"}, "")
+	if err != nil {
+		t.Fatalf("Failed to report usage; error %v", err)
+	}
+
+	if len(usage) != 1 || usage[0].DriveID != "drive1" || usage[0].Units != 3 {
+		t.Errorf("Usage wasn't stored in the datastore; got %+v", usage)
+	}
+}
@@ -0,0 +1,189 @@
+package glanguage
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"github.com/go-logr/logr"
+	gax "github.com/googleapis/gax-go/v2"
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"github.com/pkg/errors"
+	languagepb "google.golang.org/genproto/googleapis/cloud/language/v1"
+	"google.golang.org/protobuf/proto"
+	"unicode/utf8"
+)
+
+const (
+	// AnalyzeEntitiesMethod is the name of the AnalyzeEntities method.
+	AnalyzeEntitiesMethod = "AnalyzeEntities"
+	// AnalyzeEntitySentimentMethod is the name of the AnalyzeEntitySentiment method.
+	AnalyzeEntitySentimentMethod = "AnalyzeEntitySentiment"
+	// AnalyzeSyntaxMethod is the name of the AnalyzeSyntax method.
+	AnalyzeSyntaxMethod = "AnalyzeSyntax"
+	// ClassifyTextMethod is the name of the ClassifyText method.
+	ClassifyTextMethod = "ClassifyText"
+)
+
+// ResponseCache stores serialized responses keyed by CacheKey.
+type ResponseCache interface {
+	// GetNLPResponse returns the cached response or nil if there isn't one.
+	GetNLPResponse(key string) ([]byte, error)
+	// PutNLPResponse adds the response to the cache.
+	PutNLPResponse(key string, method string, numCharacters int64, response []byte) error
+}
+
+// CacheKey computes the key for the given request.
+//
+// The key is a hash of the method and the serialized request. The request contains the text as well as the
+// configuration (e.g. the encoding type and language) so changing either will result in a cache miss.
+func CacheKey(method string, req proto.Message) (string, error) {
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to marshal %v request", method)
+	}
+
+	h := sha256.New()
+	h.Write([]byte(method))
+	h.Write(b)
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// CachedClient is a Client which caches responses.
+//
+// Errors reading or writing the cache are logged but otherwise ignored; the request is sent to the wrapped client.
+type CachedClient struct {
+	client Client
+	cache  ResponseCache
+	log    logr.Logger
+}
+
+// NewCachedClient creates a new client that caches the responses of client in cache.
+func NewCachedClient(client Client, cache ResponseCache, log logr.Logger) (*CachedClient, error) {
+	if client == nil {
+		return nil, errors.New("client is required")
+	}
+
+	if cache == nil {
+		return nil, errors.New("cache is required")
+	}
+
+	return &CachedClient{
+		client: client,
+		cache:  cache,
+		log:    log,
+	}, nil
+}
+
+// AnalyzeEntities returns the cached response if there is one and otherwise calls the wrapped client.
+func (c *CachedClient) AnalyzeEntities(ctx context.Context, req *languagepb.AnalyzeEntitiesRequest, opts ...gax.CallOption) (*languagepb.AnalyzeEntitiesResponse, error) {
+	resp := &languagepb.AnalyzeEntitiesResponse{}
+	key, hit := c.get(AnalyzeEntitiesMethod, req, resp)
+	if hit {
+		return resp, nil
+	}
+
+	resp, err := c.client.AnalyzeEntities(ctx, req, opts...)
+	if err != nil {
+		return resp, err
+	}
+
+	c.put(key, AnalyzeEntitiesMethod, int64(utf8.RuneCountInString(req.GetDocument().GetContent())), resp)
+	return resp, nil
+}
+
+// AnalyzeEntitySentiment returns the cached response if there is one and otherwise calls the wrapped client.
+func (c *CachedClient) AnalyzeEntitySentiment(ctx context.Context, req *languagepb.AnalyzeEntitySentimentRequest, opts ...gax.CallOption) (*languagepb.AnalyzeEntitySentimentResponse, error) {
+	resp := &languagepb.AnalyzeEntitySentimentResponse{}
+	key, hit := c.get(AnalyzeEntitySentimentMethod, req, resp)
+	if hit {
+		return resp, nil
+	}
+
+	resp, err := c.client.AnalyzeEntitySentiment(ctx, req, opts...)
+	if err != nil {
+		return resp, err
+	}
+
+	c.put(key, AnalyzeEntitySentimentMethod, int64(utf8.RuneCountInString(req.GetDocument().GetContent())), resp)
+	return resp, nil
+}
+
+// AnalyzeSyntax returns the cached response if there is one and otherwise calls the wrapped client.
+func (c *CachedClient) AnalyzeSyntax(ctx context.Context, req *languagepb.AnalyzeSyntaxRequest, opts ...gax.CallOption) (*languagepb.AnalyzeSyntaxResponse, error) {
+	resp := &languagepb.AnalyzeSyntaxResponse{}
+	key, hit := c.get(AnalyzeSyntaxMethod, req, resp)
+	if hit {
+		return resp, nil
+	}
+
+	resp, err := c.client.AnalyzeSyntax(ctx, req, opts...)
+	if err != nil {
+		return resp, err
+	}
+
+	c.put(key, AnalyzeSyntaxMethod, int64(utf8.RuneCountInString(req.GetDocument().GetContent())), resp)
+	return resp, nil
+}
+
+// ClassifyText returns the cached response if there is one and otherwise calls the wrapped client.
+func (c *CachedClient) ClassifyText(ctx context.Context, req *languagepb.ClassifyTextRequest, opts ...gax.CallOption) (*languagepb.ClassifyTextResponse, error) {
+	resp := &languagepb.ClassifyTextResponse{}
+	key, hit := c.get(ClassifyTextMethod, req, resp)
+	if hit {
+		return resp, nil
+	}
+
+	resp, err := c.client.ClassifyText(ctx, req, opts...)
+	if err != nil {
+		return resp, err
+	}
+
+	c.put(key, ClassifyTextMethod, int64(utf8.RuneCountInString(req.GetDocument().GetContent())), resp)
+	return resp, nil
+}
+
+// get looks up the response for req in the cache and unmarshals it into resp. It returns the key and whether
+// the response was found.
+func (c *CachedClient) get(method string, req proto.Message, resp proto.Message) (string, bool) {
+	log := c.log.WithValues("method", method)
+	key, err := CacheKey(method, req)
+	if err != nil {
+		log.Error(err, "Failed to compute cache key")
+		return "", false
+	}
+
+	b, err := c.cache.GetNLPResponse(key)
+	if err != nil {
+		log.Error(err, "Failed to read cache", "key", key)
+		return key, false
+	}
+
+	if b == nil {
+		return key, false
+	}
+
+	if err := proto.Unmarshal(b, resp); err != nil {
+		log.Error(err, "Failed to unmarshal cached response", "key", key)
+		return key, false
+	}
+	log.V(logging.Debug).Info("Using cached response", "key", key)
+	return key, true
+}
+
+// put adds the response to the cache.
+func (c *CachedClient) put(key string, method string, numCharacters int64, resp proto.Message) {
+	log := c.log.WithValues("method", method)
+	if key == "" {
+		return
+	}
+
+	b, err := proto.Marshal(resp)
+	if err != nil {
+		log.Error(err, "Failed to marshal response")
+		return
+	}
+
+	if err := c.cache.PutNLPResponse(key, method, numCharacters, b); err != nil {
+		log.Error(err, "Failed to write response to cache", "key", key)
+	}
+}
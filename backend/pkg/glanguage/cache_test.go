@@ -0,0 +1,126 @@
+package glanguage
+
+import (
+	"context"
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	gax "github.com/googleapis/gax-go/v2"
+	languagepb "google.golang.org/genproto/googleapis/cloud/language/v1"
+	"google.golang.org/protobuf/testing/protocmp"
+	"testing"
+)
+
+type fakeClient struct {
+	numCalls int
+	resp     *languagepb.AnalyzeEntitiesResponse
+}
+
+func (f *fakeClient) AnalyzeEntities(ctx context.Context, req *languagepb.AnalyzeEntitiesRequest, opts ...gax.CallOption) (*languagepb.AnalyzeEntitiesResponse, error) {
+	f.numCalls += 1
+	return f.resp, nil
+}
+
+func (f *fakeClient) AnalyzeEntitySentiment(ctx context.Context, req *languagepb.AnalyzeEntitySentimentRequest, opts ...gax.CallOption) (*languagepb.AnalyzeEntitySentimentResponse, error) {
+	f.numCalls += 1
+	return &languagepb.AnalyzeEntitySentimentResponse{Entities: f.resp.Entities}, nil
+}
+
+func (f *fakeClient) AnalyzeSyntax(ctx context.Context, req *languagepb.AnalyzeSyntaxRequest, opts ...gax.CallOption) (*languagepb.AnalyzeSyntaxResponse, error) {
+	f.numCalls += 1
+	return &languagepb.AnalyzeSyntaxResponse{}, nil
+}
+
+func (f *fakeClient) ClassifyText(ctx context.Context, req *languagepb.ClassifyTextRequest, opts ...gax.CallOption) (*languagepb.ClassifyTextResponse, error) {
+	f.numCalls += 1
+	return &languagepb.ClassifyTextResponse{}, nil
+}
+
+type mapCache map[string][]byte
+
+func (m mapCache) GetNLPResponse(key string) ([]byte, error) {
+	return m[key], nil
+}
+
+func (m mapCache) PutNLPResponse(key string, method string, numCharacters int64, response []byte) error {
+	m[key] = response
+	return nil
+}
+
+func newRequest(text string) *languagepb.AnalyzeEntitiesRequest {
+	return &languagepb.AnalyzeEntitiesRequest{
+		Document: &languagepb.Document{
+			Source: &languagepb.Document_Content{
+				Content: text,
+			},
+			Type: languagepb.Document_PLAIN_TEXT,
+		},
+		EncodingType: languagepb.EncodingType_UTF8,
+	}
+}
+
+func Test_CachedClient(t *testing.T) {
+	fake := &fakeClient{
+		resp: &languagepb.AnalyzeEntitiesResponse{
+			Entities: []*languagepb.Entity{
+				{
+					Name: "john",
+					Type: languagepb.Entity_PERSON,
+				},
+			},
+		},
+	}
+
+	c, err := NewCachedClient(fake, mapCache{}, logr.Discard())
+	if err != nil {
+		t.Fatalf("Failed to create client; error %v", err)
+	}
+
+	type testCase struct {
+		name          string
+		req           *languagepb.AnalyzeEntitiesRequest
+		expectedCalls int
+	}
+
+	utf16 := newRequest("hello john")
+	utf16.EncodingType = languagepb.EncodingType_UTF16
+
+	cases := []testCase{
+		{
+			name:          "miss",
+			req:           newRequest("hello john"),
+			expectedCalls: 1,
+		},
+		{
+			name:          "hit",
+			req:           newRequest("hello john"),
+			expectedCalls: 1,
+		},
+		{
+			name:          "different-text",
+			req:           newRequest("goodbye john"),
+			expectedCalls: 2,
+		},
+		{
+			name:          "different-config",
+			req:           utf16,
+			expectedCalls: 3,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := c.AnalyzeEntities(context.Background(), tc.req)
+			if err != nil {
+				t.Fatalf("AnalyzeEntities failed; error %v", err)
+			}
+
+			if d := cmp.Diff(fake.resp, resp, protocmp.Transform()); d != "" {
+				t.Errorf("Did not get expected response; diff:\n%v", d)
+			}
+
+			if fake.numCalls != tc.expectedCalls {
+				t.Errorf("Got %v calls to the client; want %v", fake.numCalls, tc.expectedCalls)
+			}
+		})
+	}
+}
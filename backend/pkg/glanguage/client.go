@@ -0,0 +1,17 @@
+package glanguage
+
+import (
+	"context"
+	gax "github.com/googleapis/gax-go/v2"
+	languagepb "google.golang.org/genproto/googleapis/cloud/language/v1"
+)
+
+// Client is the subset of the methods of language.Client that we use.
+//
+// Using an interface rather than language.Client allows us to wrap the client e.g. to cache responses.
+type Client interface {
+	AnalyzeEntities(ctx context.Context, req *languagepb.AnalyzeEntitiesRequest, opts ...gax.CallOption) (*languagepb.AnalyzeEntitiesResponse, error)
+	AnalyzeEntitySentiment(ctx context.Context, req *languagepb.AnalyzeEntitySentimentRequest, opts ...gax.CallOption) (*languagepb.AnalyzeEntitySentimentResponse, error)
+	AnalyzeSyntax(ctx context.Context, req *languagepb.AnalyzeSyntaxRequest, opts ...gax.CallOption) (*languagepb.AnalyzeSyntaxResponse, error)
+	ClassifyText(ctx context.Context, req *languagepb.ClassifyTextRequest, opts ...gax.CallOption) (*languagepb.ClassifyTextResponse, error)
+}
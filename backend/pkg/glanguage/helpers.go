@@ -10,13 +10,13 @@ const (
 )
 
 // GetWikipediaURL gets the wikipedia url from the entity if there is one otherwise returns the empty string.
-func GetWikipediaURL(e languagepb.Entity) string {
+func GetWikipediaURL(e *languagepb.Entity) string {
 	v := e.GetMetadata()[WikipediaKey]
 	return v
 }
 
 // GetMID gets the mid (knowledge graph id ) from the entity if there is one otherwise returns the empty string.
-func GetMID(e languagepb.Entity) string {
+func GetMID(e *languagepb.Entity) string {
 	v := e.GetMetadata()[MIDKey]
 	return v
 }
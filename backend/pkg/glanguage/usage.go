@@ -0,0 +1,138 @@
+package glanguage
+
+import (
+	"context"
+	"github.com/go-logr/logr"
+	gax "github.com/googleapis/gax-go/v2"
+	"github.com/pkg/errors"
+	languagepb "google.golang.org/genproto/googleapis/cloud/language/v1"
+	"unicode/utf8"
+)
+
+const (
+	// CharactersPerUnit is the number of characters in a billing unit.
+	// https://cloud.google.com/natural-language/pricing
+	CharactersPerUnit = 1000
+)
+
+var (
+	// ErrBudgetExceeded is returned when a request isn't sent because it would exceed the budget.
+	ErrBudgetExceeded = errors.New("Natural Language API budget exceeded")
+)
+
+// Units returns the number of billing units for a request with the given number of characters.
+// Each request is at least one unit.
+func Units(numCharacters int64) int64 {
+	units := (numCharacters + CharactersPerUnit - 1) / CharactersPerUnit
+	if units < 1 {
+		units = 1
+	}
+	return units
+}
+
+// Meter keeps track of how much the NL API is used.
+type Meter interface {
+	// Allow is called before sending a request. It should return ErrBudgetExceeded if the request
+	// shouldn't be sent.
+	Allow(ctx context.Context, method string, numCharacters int64) error
+	// Record is called after a request succeeds.
+	Record(ctx context.Context, method string, numCharacters int64) error
+}
+
+// MeteredClient is a Client which reports usage to a Meter.
+//
+// Errors recording usage are logged but don't cause the request to fail.
+type MeteredClient struct {
+	client Client
+	meter  Meter
+	log    logr.Logger
+}
+
+// NewMeteredClient creates a new client that reports the usage of client to meter.
+func NewMeteredClient(client Client, meter Meter, log logr.Logger) (*MeteredClient, error) {
+	if client == nil {
+		return nil, errors.New("client is required")
+	}
+
+	if meter == nil {
+		return nil, errors.New("meter is required")
+	}
+
+	return &MeteredClient{
+		client: client,
+		meter:  meter,
+		log:    log,
+	}, nil
+}
+
+// AnalyzeEntities calls the wrapped client if the meter allows it.
+func (c *MeteredClient) AnalyzeEntities(ctx context.Context, req *languagepb.AnalyzeEntitiesRequest, opts ...gax.CallOption) (*languagepb.AnalyzeEntitiesResponse, error) {
+	numCharacters := int64(utf8.RuneCountInString(req.GetDocument().GetContent()))
+	if err := c.meter.Allow(ctx, AnalyzeEntitiesMethod, numCharacters); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.AnalyzeEntities(ctx, req, opts...)
+	if err != nil {
+		return resp, err
+	}
+
+	if err := c.meter.Record(ctx, AnalyzeEntitiesMethod, numCharacters); err != nil {
+		c.log.Error(err, "Failed to record usage", "method", AnalyzeEntitiesMethod, "numCharacters", numCharacters)
+	}
+	return resp, nil
+}
+
+// AnalyzeEntitySentiment calls the wrapped client if the meter allows it.
+func (c *MeteredClient) AnalyzeEntitySentiment(ctx context.Context, req *languagepb.AnalyzeEntitySentimentRequest, opts ...gax.CallOption) (*languagepb.AnalyzeEntitySentimentResponse, error) {
+	numCharacters := int64(utf8.RuneCountInString(req.GetDocument().GetContent()))
+	if err := c.meter.Allow(ctx, AnalyzeEntitySentimentMethod, numCharacters); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.AnalyzeEntitySentiment(ctx, req, opts...)
+	if err != nil {
+		return resp, err
+	}
+
+	if err := c.meter.Record(ctx, AnalyzeEntitySentimentMethod, numCharacters); err != nil {
+		c.log.Error(err, "Failed to record usage", "method", AnalyzeEntitySentimentMethod, "numCharacters", numCharacters)
+	}
+	return resp, nil
+}
+
+// AnalyzeSyntax calls the wrapped client if the meter allows it.
+func (c *MeteredClient) AnalyzeSyntax(ctx context.Context, req *languagepb.AnalyzeSyntaxRequest, opts ...gax.CallOption) (*languagepb.AnalyzeSyntaxResponse, error) {
+	numCharacters := int64(utf8.RuneCountInString(req.GetDocument().GetContent()))
+	if err := c.meter.Allow(ctx, AnalyzeSyntaxMethod, numCharacters); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.AnalyzeSyntax(ctx, req, opts...)
+	if err != nil {
+		return resp, err
+	}
+
+	if err := c.meter.Record(ctx, AnalyzeSyntaxMethod, numCharacters); err != nil {
+		c.log.Error(err, "Failed to record usage", "method", AnalyzeSyntaxMethod, "numCharacters", numCharacters)
+	}
+	return resp, nil
+}
+
+// ClassifyText calls the wrapped client if the meter allows it.
+func (c *MeteredClient) ClassifyText(ctx context.Context, req *languagepb.ClassifyTextRequest, opts ...gax.CallOption) (*languagepb.ClassifyTextResponse, error) {
+	numCharacters := int64(utf8.RuneCountInString(req.GetDocument().GetContent()))
+	if err := c.meter.Allow(ctx, ClassifyTextMethod, numCharacters); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.ClassifyText(ctx, req, opts...)
+	if err != nil {
+		return resp, err
+	}
+
+	if err := c.meter.Record(ctx, ClassifyTextMethod, numCharacters); err != nil {
+		c.log.Error(err, "Failed to record usage", "method", ClassifyTextMethod, "numCharacters", numCharacters)
+	}
+	return resp, nil
+}
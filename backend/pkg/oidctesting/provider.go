@@ -0,0 +1,252 @@
+// Package oidctesting provides a fake OpenID Connect provider for testing login without a real identity provider.
+package oidctesting
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	keyID = "fake-key"
+
+	discoveryPath = "/.well-known/openid-configuration"
+	authorizePath = "/authorize"
+	tokenPath     = "/token"
+	jwksPath      = "/jwks"
+
+	tokenTTL = time.Hour
+)
+
+// Provider is a fake OIDC provider. It logs users in without prompting for credentials; the user is the
+// login_hint in the authorization request or Email if no hint is supplied.
+//
+// Provider implements http.Handler and must be served at Issuer.
+type Provider struct {
+	// Issuer is the URL the provider is served at e.g. http://localhost:9090.
+	Issuer string
+	// Email is the user logged in when the authorization request doesn't include a login_hint.
+	Email string
+
+	key *rsa.PrivateKey
+
+	mu sync.Mutex
+	// codes maps outstanding authorization codes to the login they were issued for.
+	codes map[string]login
+}
+
+type login struct {
+	email    string
+	clientID string
+	nonce    string
+}
+
+// NewProvider creates a fake provider served at issuer.
+func NewProvider(issuer string, email string) (*Provider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to generate signing key")
+	}
+
+	return &Provider{
+		Issuer: strings.TrimSuffix(issuer, "/"),
+		Email:  email,
+		key:    key,
+		codes:  map[string]login{},
+	}, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (p *Provider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case discoveryPath:
+		p.discovery(w, r)
+	case authorizePath:
+		p.authorize(w, r)
+	case tokenPath:
+		p.token(w, r)
+	case jwksPath:
+		p.jwks(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// IDToken returns a signed ID token for email with the given audience. Use it to test bearer tokens.
+func (p *Provider) IDToken(email string, audience string, nonce string) (string, error) {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":            p.Issuer,
+		"sub":            email,
+		"aud":            audience,
+		"iat":            now.Unix(),
+		"exp":            now.Add(tokenTTL).Unix(),
+		"email":          email,
+		"email_verified": true,
+	}
+
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	return p.SignClaims(claims)
+}
+
+// SignClaims returns an ID token with the given claims signed by the provider. Use it to test tokens with
+// unusual claims.
+func (p *Provider) SignClaims(claims map[string]interface{}) (string, error) {
+	header, err := encodeSegment(map[string]string{"alg": "RS256", "kid": keyID, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := encodeSegment(claims)
+	if err != nil {
+		return "", err
+	}
+
+	digest := sha256.Sum256([]byte(header + "." + payload))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to sign ID token")
+	}
+	return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.Issuer,
+		"authorization_endpoint":                p.Issuer + authorizePath,
+		"token_endpoint":                        p.Issuer + tokenPath,
+		"jwks_uri":                              p.Issuer + jwksPath,
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+// authorize immediately redirects back to the client with an authorization code.
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || q.Get("redirect_uri") == "" {
+		http.Error(w, "Invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	if q.Get("response_type") != "code" {
+		http.Error(w, "Only response_type=code is supported", http.StatusBadRequest)
+		return
+	}
+
+	email := q.Get("login_hint")
+	if email == "" {
+		email = p.Email
+	}
+
+	code, err := randomString()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	p.mu.Lock()
+	p.codes[code] = login{email: email, clientID: q.Get("client_id"), nonce: q.Get("nonce")}
+	p.mu.Unlock()
+
+	params := redirect.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// token exchanges an authorization code for an ID token.
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	clientID, _, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+	}
+
+	code := r.PostForm.Get("code")
+	p.mu.Lock()
+	l, ok := p.codes[code]
+	delete(p.codes, code)
+	p.mu.Unlock()
+
+	if !ok || l.clientID != clientID {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	idToken, err := p.IDToken(l.email, l.clientID, l.nonce)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	accessToken, err := randomString()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(tokenTTL.Seconds()),
+		"id_token":     idToken,
+	})
+}
+
+func (p *Provider) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": keyID,
+				"alg": "RS256",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+			},
+		},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	// Errors writing the response can't be reported to the client.
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func encodeSegment(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to marshal JWT segment")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrapf(err, "Failed to generate random string")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
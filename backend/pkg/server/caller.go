@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+)
+
+// Caller is the authenticated user making a request.
+type Caller struct {
+	Email string
+	// Groups are the emails of the groups the caller belongs to.
+	Groups []string
+}
+
+type callerKeyType string
+
+const callerKey callerKeyType = "caller"
+
+// WithCaller returns a context recording the caller of the request.
+func WithCaller(ctx context.Context, c *Caller) context.Context {
+	return context.WithValue(ctx, callerKey, c)
+}
+
+// CallerFromContext returns the caller of the request or nil if the request isn't authenticated.
+func CallerFromContext(ctx context.Context) *Caller {
+	c, _ := ctx.Value(callerKey).(*Caller)
+	return c
+}
+
+// Authenticator identifies the caller of a request.
+type Authenticator interface {
+	// Authenticate returns the caller or nil if the request isn't authenticated. An error is returned if the
+	// request contains invalid credentials.
+	Authenticate(r *http.Request) (*Caller, error)
+}
+
+// GroupResolver looks up the groups a user belongs to.
+type GroupResolver interface {
+	Groups(ctx context.Context, email string) ([]string, error)
+}
+
+// HeaderAuthenticator trusts a header set by an authenticating proxy in front of the server e.g.
+// X-Goog-Authenticated-User-Email set by Identity-Aware Proxy.
+//
+// Only use this if the server can't be reached without going through the proxy; otherwise anyone can set the header.
+type HeaderAuthenticator struct {
+	// Header containing the email of the caller. A prefix ending in ":" e.g. "accounts.google.com:" is removed.
+	Header string
+	// Groups is optional; if set it is used to look up the groups of the caller.
+	Groups GroupResolver
+}
+
+// Authenticate returns the caller identified by the header.
+func (a *HeaderAuthenticator) Authenticate(r *http.Request) (*Caller, error) {
+	v := r.Header.Get(a.Header)
+	if v == "" {
+		return nil, nil
+	}
+
+	if i := strings.LastIndex(v, ":"); i >= 0 {
+		v = v[i+1:]
+	}
+
+	return newCaller(r.Context(), v, a.Groups)
+}
+
+// newCaller creates the caller with the given email looking up their groups if groups isn't nil.
+func newCaller(ctx context.Context, email string, groups GroupResolver) (*Caller, error) {
+	c := &Caller{
+		Email:  strings.ToLower(email),
+		Groups: []string{},
+	}
+
+	if groups == nil {
+		return c, nil
+	}
+
+	g, err := groups.Groups(ctx, c.Email)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get groups for %v", c.Email)
+	}
+	c.Groups = g
+	return c, nil
+}
+
+// StaticGroups is a GroupResolver backed by a fixed map from each group to its members.
+//
+// Nested groups aren't expanded; list the members of nested groups explicitly.
+type StaticGroups struct {
+	// members maps the email of each user to the groups they belong to.
+	members map[string][]string
+}
+
+// staticGroupsFile is the format of the file read by ReadStaticGroups.
+type staticGroupsFile struct {
+	// Groups maps the email of each group to the emails of its members.
+	Groups map[string][]string `json:"groups"`
+}
+
+// NewStaticGroups creates a resolver from a map of the email of each group to the emails of its members.
+func NewStaticGroups(groups map[string][]string) *StaticGroups {
+	g := &StaticGroups{
+		members: map[string][]string{},
+	}
+
+	for group, members := range groups {
+		for _, m := range members {
+			m = strings.ToLower(m)
+			g.members[m] = append(g.members[m], strings.ToLower(group))
+		}
+	}
+
+	for _, groups := range g.members {
+		sort.Strings(groups)
+	}
+	return g
+}
+
+// ReadStaticGroups reads the group memberships from a YAML or JSON file of the form
+//
+//	groups:
+//	  eng@example.com:
+//	    - alice@example.com
+func ReadStaticGroups(path string) (*StaticGroups, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read groups file: %v", path)
+	}
+
+	f := &staticGroupsFile{}
+	if err := yaml.Unmarshal(b, f); err != nil {
+		return nil, errors.Wrapf(err, "Failed to unmarshal groups from file: %v", path)
+	}
+	return NewStaticGroups(f.Groups), nil
+}
+
+// Groups returns the groups email is a member of.
+func (g *StaticGroups) Groups(ctx context.Context, email string) ([]string, error) {
+	groups := g.members[strings.ToLower(email)]
+	if groups == nil {
+		return []string{}, nil
+	}
+	return groups, nil
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+)
+
+func Test_HeaderAuthenticator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testGroups")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+
+	groupsFile := path.Join(dir, "groups.yaml")
+	contents := `groups:
+  eng@example.com:
+    - Alice@example.com
+  all@example.com:
+    - alice@example.com
+    - bob@example.com
+`
+	if err := ioutil.WriteFile(groupsFile, []byte(contents), 0644); err != nil {
+		t.Fatalf("Failed to write groups file; error %v", err)
+	}
+
+	groups, err := ReadStaticGroups(groupsFile)
+	if err != nil {
+		t.Fatalf("Failed to read groups; error %v", err)
+	}
+
+	a := &HeaderAuthenticator{
+		Header: "X-Goog-Authenticated-User-Email",
+		Groups: groups,
+	}
+
+	type testCase struct {
+		name     string
+		value    string
+		expected *Caller
+	}
+
+	cases := []testCase{
+		{
+			name:     "iap",
+			value:    "accounts.google.com:alice@example.com",
+			expected: &Caller{Email: "alice@example.com", Groups: []string{"all@example.com", "eng@example.com"}},
+		},
+		{
+			name:     "no-groups",
+			value:    "carol@example.com",
+			expected: &Caller{Email: "carol@example.com", Groups: []string{}},
+		},
+		{
+			name:     "missing",
+			value:    "",
+			expected: nil,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+			if c.value != "" {
+				req.Header.Set(a.Header, c.value)
+			}
+
+			actual, err := a.Authenticate(req)
+			if err != nil {
+				t.Fatalf("Authenticate failed; error %v", err)
+			}
+
+			if d := cmp.Diff(c.expected, actual); d != "" {
+				t.Errorf("Unexpected caller; diff:\n%v", d)
+			}
+		})
+	}
+}
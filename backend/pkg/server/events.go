@@ -0,0 +1,152 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jlewi/p22h/backend/api"
+	"github.com/jlewi/p22h/backend/pkg/datastore"
+	"github.com/jlewi/p22h/backend/pkg/gdocs"
+	"net/http"
+	"time"
+)
+
+// heartbeatInterval is how often a comment is sent on idle event streams so proxies don't close them.
+const heartbeatInterval = 15 * time.Second
+
+// IndexEvents streams index events to the client using Server-Sent Events. Each event's name is the event
+// type and its data is an api.IndexEvent. The stream stays open until the client disconnects or the server
+// shuts down.
+//
+// If ACL filtering is enabled events about docs the caller can't read are dropped. Each event is checked against
+// the ACLs in the store so events about docs first indexed by the current run are sent once the run has stored
+// their ACLs; see docVisibility.
+func (s *Server) IndexEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.writeStatus(w, "Streaming isn't supported", http.StatusInternalServerError)
+		return
+	}
+
+	var visibility *docVisibility
+	if s.aclFilter {
+		c := CallerFromContext(r.Context())
+		if c == nil {
+			s.writeStatus(w, "Request isn't authenticated", http.StatusUnauthorized)
+			return
+		}
+		visibility = newDocVisibility(s, datastore.Principals{Email: c.Email, Groups: c.Groups})
+	}
+
+	events, unsubscribe := s.events.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.closing:
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if visibility != nil && !visibility.allowed(e) {
+				continue
+			}
+			payload, err := json.Marshal(toIndexEvent(e))
+			if err != nil {
+				s.log.Error(err, "Failed to encode IndexEvent", "event", e)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %v\ndata: %s\n\n", e.Type, payload); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// maxVisibilityCacheSize bounds the number of docs whose visibility is cached for each event stream.
+const maxVisibilityCacheSize = 1000
+
+// docVisibility decides which index events a caller can see by checking the ACL of each event's doc in the store.
+//
+// The result for a doc is cached until the doc is indexed again; i.e. until an EventDocStarted or EventLinksFound
+// event for it. The indexer stores a doc's ACL between those two events so a doc first indexed by the current run
+// becomes visible from its EventLinksFound event on.
+type docVisibility struct {
+	s          *Server
+	principals datastore.Principals
+	cache      map[string]bool
+}
+
+func newDocVisibility(s *Server, p datastore.Principals) *docVisibility {
+	return &docVisibility{
+		s:          s,
+		principals: p,
+		cache:      map[string]bool{},
+	}
+}
+
+// allowed returns true if the caller can see the event. Events which aren't about a doc are always allowed. If the
+// ACL can't be read the error is logged and the event is dropped.
+func (v *docVisibility) allowed(e gdocs.IndexEvent) bool {
+	if e.DocID == "" {
+		return true
+	}
+
+	if e.Type == gdocs.EventDocStarted || e.Type == gdocs.EventLinksFound {
+		delete(v.cache, e.DocID)
+	}
+
+	if visible, ok := v.cache[e.DocID]; ok {
+		return visible
+	}
+
+	permissions, err := v.s.store.ListDocPermissions(e.DocID)
+	if err != nil {
+		v.s.log.Error(err, "Failed to check whether the caller can read the doc", "email", v.principals.Email, "docId", e.DocID)
+		return false
+	}
+
+	visible := false
+	for _, p := range permissions {
+		if v.principals.Grants(p) {
+			visible = true
+			break
+		}
+	}
+
+	if len(v.cache) >= maxVisibilityCacheSize {
+		v.cache = map[string]bool{}
+	}
+	v.cache[e.DocID] = visible
+	return visible
+}
+
+func toIndexEvent(e gdocs.IndexEvent) api.IndexEvent {
+	return api.IndexEvent{
+		Type:        e.Type,
+		Time:        e.Time.UTC().Format(time.RFC3339),
+		JobId:       e.JobID,
+		DocId:       e.DocID,
+		Name:        e.Name,
+		NumLinks:    e.NumLinks,
+		NumEntities: e.NumEntities,
+		NumDocs:     e.NumDocs,
+		Error:       e.Error,
+	}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/google/go-cmp/cmp"
+	"github.com/jlewi/p22h/backend/api"
+	"github.com/jlewi/p22h/backend/pkg/datastore"
+	"github.com/jlewi/p22h/backend/pkg/gdocs"
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_IndexEvents(t *testing.T) {
+	log, err := logging.InitLogger("info", true)
+	if err != nil {
+		t.Fatalf("Failed to initialize the logger")
+	}
+
+	hub := gdocs.NewEventHub()
+	s := &Server{
+		log:     *log,
+		store:   createDatastore(t, *log, []*datastore.DocLink{}),
+		events:  hub,
+		closing: make(chan struct{}),
+	}
+	backend := httptest.NewServer(s.router())
+	defer backend.Close()
+
+	resp, err := http.Get(backend.URL + indexEventsPath)
+	if err != nil {
+		t.Fatalf("Failed to get events; error %v", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Got Content-Type %v; want text/event-stream", ct)
+	}
+
+	// The handler subscribes before sending the headers so the event is delivered.
+	now := time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC)
+	hub.OnIndexEvent(gdocs.IndexEvent{Type: gdocs.EventLinksFound, Time: now, JobID: "job1", DocID: "doc1", Name: "Doc 1", NumLinks: 3})
+
+	reader := bufio.NewReader(resp.Body)
+	lines := make([]string, 0, 3)
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read event; error %v", err)
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+
+	if lines[0] != "event: linksFound" || !strings.HasPrefix(lines[1], "data: ") || lines[2] != "" {
+		t.Fatalf("Unexpected event %q", lines)
+	}
+
+	actual := api.IndexEvent{}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &actual); err != nil {
+		t.Fatalf("Failed to unmarshal event; error %v", err)
+	}
+
+	expected := api.IndexEvent{
+		Type:     "linksFound",
+		Time:     "2022-05-01T10:00:00Z",
+		JobId:    "job1",
+		DocId:    "doc1",
+		Name:     "Doc 1",
+		NumLinks: 3,
+	}
+	if d := cmp.Diff(expected, actual); d != "" {
+		t.Errorf("Unexpected event; diff:\n%v", d)
+	}
+
+	// Shutting down the server should end the stream.
+	close(s.closing)
+	if _, err := ioutil.ReadAll(reader); err != nil {
+		t.Errorf("Failed to read the rest of the stream; error %v", err)
+	}
+}
+
+func TestServer_IndexEventsACLFilter(t *testing.T) {
+	log, err := logging.InitLogger("info", true)
+	if err != nil {
+		t.Fatalf("Failed to initialize the logger")
+	}
+
+	store := createDatastore(t, *log, []*datastore.DocLink{})
+	grant := func(docId string, email string) {
+		p := []*datastore.DocPermission{{DocID: docId, Type: datastore.PrincipalUser, Principal: email, Role: "reader"}}
+		if err := store.ReplaceDocPermissions(docId, p); err != nil {
+			t.Fatalf("Failed to add permissions; error %v", err)
+		}
+	}
+	grant("doc1", "alice@example.com")
+	grant("doc2", "bob@example.com")
+
+	hub := gdocs.NewEventHub()
+	s := &Server{
+		log:           *log,
+		store:         store,
+		events:        hub,
+		closing:       make(chan struct{}),
+		authenticator: &HeaderAuthenticator{Header: "X-Test-User"},
+		aclFilter:     true,
+	}
+	backend := httptest.NewServer(s.router())
+	defer backend.Close()
+	defer close(s.closing)
+
+	// open opens a stream for the user and returns a function reading the doc ids of the events up to and
+	// including the next runFinished event.
+	open := func(user string) func() []string {
+		req, err := http.NewRequest(http.MethodGet, backend.URL+indexEventsPath, nil)
+		if err != nil {
+			t.Fatalf("Failed to create request; error %v", err)
+		}
+		req.Header.Set("X-Test-User", user)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to get events; error %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Got code %v; want %v", resp.StatusCode, http.StatusOK)
+		}
+		reader := bufio.NewReader(resp.Body)
+
+		return func() []string {
+			docs := []string{}
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					t.Fatalf("Failed to read event; error %v", err)
+				}
+				if !strings.HasPrefix(line, "data: ") {
+					continue
+				}
+				e := api.IndexEvent{}
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+					t.Fatalf("Failed to unmarshal event; error %v", err)
+				}
+				if e.Type == gdocs.EventRunFinished {
+					return docs
+				}
+				docs = append(docs, e.DocId)
+			}
+		}
+	}
+
+	alice := open("alice@example.com")
+	bob := open("bob@example.com")
+
+	hub.OnIndexEvent(gdocs.IndexEvent{Type: gdocs.EventDocStarted, DocID: "doc1", Name: "doc1"})
+	hub.OnIndexEvent(gdocs.IndexEvent{Type: gdocs.EventDocStarted, DocID: "doc2", Name: "doc2"})
+	// doc3 is first indexed by this run; the indexer stores its ACL after the stream was opened. Its events are
+	// sent as soon as the ACL is stored rather than after the run.
+	grant("doc3", "alice@example.com")
+	hub.OnIndexEvent(gdocs.IndexEvent{Type: gdocs.EventDocStarted, DocID: "doc3", Name: "doc3"})
+	hub.OnIndexEvent(gdocs.IndexEvent{Type: gdocs.EventLinksFound, DocID: "doc3", Name: "doc3"})
+	hub.OnIndexEvent(gdocs.IndexEvent{Type: gdocs.EventRunFinished, NumDocs: 3})
+
+	if d := cmp.Diff([]string{"doc1", "doc3", "doc3"}, alice()); d != "" {
+		t.Errorf("Unexpected events for alice; diff:\n%v", d)
+	}
+	if d := cmp.Diff([]string{"doc2"}, bob()); d != "" {
+		t.Errorf("Unexpected events for bob; diff:\n%v", d)
+	}
+
+	// Reindexing doc1 after alice lost access invalidates the cached visibility.
+	grant("doc1", "bob@example.com")
+	hub.OnIndexEvent(gdocs.IndexEvent{Type: gdocs.EventDocStarted, DocID: "doc1", Name: "doc1"})
+	hub.OnIndexEvent(gdocs.IndexEvent{Type: gdocs.EventEntitiesFound, DocID: "doc1", Name: "doc1"})
+	hub.OnIndexEvent(gdocs.IndexEvent{Type: gdocs.EventRunFinished, NumDocs: 1})
+	if d := cmp.Diff([]string{}, alice()); d != "" {
+		t.Errorf("Unexpected events for alice after losing access; diff:\n%v", d)
+	}
+	if d := cmp.Diff([]string{"doc1", "doc1"}, bob()); d != "" {
+		t.Errorf("Unexpected events for bob after getting access; diff:\n%v", d)
+	}
+
+	// Unauthenticated callers can't open a stream.
+	resp, err := http.Get(backend.URL + indexEventsPath)
+	if err != nil {
+		t.Fatalf("Failed to get events; error %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Got code %v for an unauthenticated caller; want %v", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/jlewi/p22h/backend/api"
+	"github.com/jlewi/p22h/backend/pkg/datastore"
+	"github.com/pkg/errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxPageSize is the largest page size; larger values are coerced to it.
+const maxPageSize = 1000
+
+// parseListOptions parses the pagination query parameters pageSize, pageToken and orderBy following
+// https://google.aip.dev/158. If pageSize is absent or 0 all the results are returned so clients that don't
+// follow nextPageToken keep getting complete lists.
+func parseListOptions(r *http.Request) (datastore.ListOptions, error) {
+	q := r.URL.Query()
+	opts := datastore.ListOptions{
+		PageToken: q.Get("pageToken"),
+		OrderBy:   q.Get("orderBy"),
+	}
+
+	v := q.Get("pageSize")
+	if v == "" {
+		return opts, nil
+	}
+
+	size, err := strconv.Atoi(v)
+	if err != nil || size < 0 {
+		return opts, errors.Errorf("Invalid pageSize %v; must be a non-negative integer", v)
+	}
+
+	opts.PageSize = size
+	if size > maxPageSize {
+		opts.PageSize = maxPageSize
+	}
+	return opts, nil
+}
+
+// writeListError writes the error returned by a Query method. Invalid page tokens and sort orders are the
+// caller's fault.
+func (s *Server) writeListError(w http.ResponseWriter, what string, err error) {
+	if errors.Is(err, datastore.ErrInvalidArgument) {
+		s.writeStatus(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.writeStatus(w, fmt.Sprintf("Failed to list %v; error %v", what, err), http.StatusInternalServerError)
+}
+
+// Documents lists the indexed documents. It supports the query parameters mimeType and orderBy; one of name,
+// mimeType, modifiedTime or fileCreatedTime optionally followed by desc.
+func (s *Server) Documents(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseListOptions(r)
+	if err != nil {
+		s.writeStatus(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// visible is nil if ACL filtering is disabled.
+	var visible []string
+	if s.aclFilter {
+		ids, ok := s.visibleDocIds(w, r)
+		if !ok {
+			return
+		}
+		visible = ids
+	}
+
+	docList := &api.DocumentList{
+		Items: make([]api.Document, 0, 0),
+	}
+
+	// An empty list of ids means no filter so don't query if the caller can't read any docs.
+	if visible == nil || len(visible) > 0 {
+		docs, token, err := s.store.QueryDocReferences(datastore.DocReferenceQuery{
+			IDs:         visible,
+			MimeType:    r.URL.Query().Get("mimeType"),
+			ListOptions: opts,
+		})
+		if err != nil {
+			s.writeListError(w, "documents", err)
+			return
+		}
+
+		docList.NextPageToken = token
+		for _, d := range docs {
+			doc := api.Document{
+				DocId:    d.ID,
+				Name:     d.Name,
+				MimeType: d.MimeType,
+			}
+			if !d.ModifiedTime.IsZero() {
+				doc.ModifiedTime = d.ModifiedTime.UTC().Format(time.RFC3339)
+			}
+			docList.Items = append(docList.Items, doc)
+		}
+	}
+
+	payload, err := json.Marshal(docList)
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to encode DocumentList; error %v", err), http.StatusInternalServerError)
+		return
+	}
+	if _, err := w.Write(payload); err != nil {
+		s.log.Error(err, "Failed to write response")
+	}
+}
+
+// Entities lists the entities. It supports the query parameters name, type and orderBy; one of name or type
+// optionally followed by desc. If ACL filtering is enabled only entities mentioned in docs the caller can read
+// are listed.
+func (s *Server) Entities(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseListOptions(r)
+	if err != nil {
+		s.writeStatus(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// visible is nil if ACL filtering is disabled.
+	var visible []string
+	if s.aclFilter {
+		ids, ok := s.visibleDocIds(w, r)
+		if !ok {
+			return
+		}
+		visible = ids
+	}
+
+	entityList := &api.EntityList{
+		Items: make([]api.Entity, 0, 0),
+	}
+
+	if visible == nil || len(visible) > 0 {
+		entities, token, err := s.store.QueryEntities(datastore.EntityListQuery{
+			Name:        r.URL.Query().Get("name"),
+			Type:        r.URL.Query().Get("type"),
+			DocIDs:      visible,
+			ListOptions: opts,
+		})
+		if err != nil {
+			s.writeListError(w, "entities", err)
+			return
+		}
+
+		entityList.NextPageToken = token
+		for _, e := range entities {
+			entityList.Items = append(entityList.Items, api.Entity{
+				Id:           e.ID,
+				Name:         e.Name,
+				Type:         e.Type,
+				WikipediaUrl: e.WikipediaUrl,
+			})
+		}
+	}
+
+	payload, err := json.Marshal(entityList)
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to encode EntityList; error %v", err), http.StatusInternalServerError)
+		return
+	}
+	if _, err := w.Write(payload); err != nil {
+		s.log.Error(err, "Failed to write response")
+	}
+}
+
+// DocumentMentions lists the mentions of entities in a document. It supports the query parameters entityId, type
+// and orderBy; one of entityId, startIndex, salience or sentence optionally followed by desc.
+func (s *Server) DocumentMentions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, ok := vars["name"]
+	if !ok {
+		s.writeStatus(w, "Missing document name", http.StatusBadRequest)
+		return
+	}
+
+	opts, err := parseListOptions(r)
+	if err != nil {
+		s.writeStatus(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	visible, ok := s.docFilter(w, r)
+	if !ok {
+		return
+	}
+
+	// Don't reveal whether docs the caller can't read exist.
+	if !visible(name) {
+		s.writeStatus(w, fmt.Sprintf("Doc %v not found", name), http.StatusNotFound)
+		return
+	}
+
+	mentions, token, err := s.store.QueryEntityMentions(datastore.EntityMentionQuery{
+		DocID:       name,
+		EntityID:    r.URL.Query().Get("entityId"),
+		Type:        r.URL.Query().Get("type"),
+		ListOptions: opts,
+	})
+	if err != nil {
+		s.writeListError(w, "mentions", err)
+		return
+	}
+
+	mentionList := &api.EntityMentionList{
+		Items:         make([]api.EntityMention, 0, len(mentions)),
+		NextPageToken: token,
+	}
+
+	for _, m := range mentions {
+		mentionList.Items = append(mentionList.Items, api.EntityMention{
+			EntityId:   m.EntityID,
+			Text:       m.Text,
+			StartIndex: m.StartIndex,
+			EndIndex:   m.EndIndex,
+			Type:       m.Type,
+			Salience:   m.Salience,
+			Sentence:   m.Sentence,
+		})
+	}
+	payload, err := json.Marshal(mentionList)
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to encode EntityMentionList; error %v", err), http.StatusInternalServerError)
+		return
+	}
+	if _, err := w.Write(payload); err != nil {
+		s.log.Error(err, "Failed to write response")
+	}
+}
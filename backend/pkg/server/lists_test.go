@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/mux"
+	"github.com/jlewi/p22h/backend/api"
+	"github.com/jlewi/p22h/backend/pkg/datastore"
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestServer_Lists(t *testing.T) {
+	log, err := logging.InitLogger("info", true)
+	if err != nil {
+		t.Fatalf("Failed to initialize the logger")
+	}
+
+	store := createDatastore(t, *log, nil)
+	for i := 0; i < 5; i++ {
+		mimeType := "application/vnd.google-apps.document"
+		if i == 4 {
+			mimeType = "application/pdf"
+		}
+		if err := store.UpdateDocReference(&datastore.DocReference{DriveId: fmt.Sprintf("doc%v", i), Name: fmt.Sprintf("name%v", 4-i), MimeType: mimeType}); err != nil {
+			t.Fatalf("Failed to create doc; error %v", err)
+		}
+		if err := store.UpdateEntity(&datastore.Entity{ID: fmt.Sprintf("e%v", i), Name: fmt.Sprintf("entity%v", i), Type: "PERSON"}); err != nil {
+			t.Fatalf("Failed to create entity; error %v", err)
+		}
+		if err := store.UpdateEntityMention(&datastore.EntityMention{DocID: datastore.DriveKey("doc0"), EntityID: fmt.Sprintf("e%v", i), Text: "text", StartIndex: int64(i)}); err != nil {
+			t.Fatalf("Failed to create mention; error %v", err)
+		}
+	}
+
+	s := Server{
+		log:   *log,
+		store: store,
+	}
+	router := mux.NewRouter()
+	router.HandleFunc(documentsPath, s.Documents)
+	router.HandleFunc(documentMentionsPath, s.DocumentMentions)
+	router.HandleFunc(entitiesPath, s.Entities)
+
+	// get fetches the path and decodes the response into list. The status code is returned.
+	get := func(path string, params url.Values, list interface{}) int {
+		req := httptest.NewRequest(http.MethodGet, path+"?"+params.Encode(), nil)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		if resp.Code == http.StatusOK {
+			if err := json.Unmarshal(resp.Body.Bytes(), list); err != nil {
+				t.Fatalf("Failed to decode the response; error %v", err)
+			}
+		}
+		return resp.Code
+	}
+
+	// Page through the docs sorted by name.
+	names := []string{}
+	params := url.Values{"pageSize": {"2"}, "orderBy": {"name"}}
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatalf("Too many pages")
+		}
+		list := &api.DocumentList{}
+		if code := get(documentsPath, params, list); code != http.StatusOK {
+			t.Fatalf("Got code %v; want %v", code, http.StatusOK)
+		}
+		for _, d := range list.Items {
+			names = append(names, d.Name)
+		}
+		if list.NextPageToken == "" {
+			break
+		}
+		params.Set("pageToken", list.NextPageToken)
+	}
+	if d := cmp.Diff([]string{"name0", "name1", "name2", "name3", "name4"}, names); d != "" {
+		t.Errorf("Unexpected docs; diff:\n%v", d)
+	}
+
+	// Without a pageSize all the docs are returned.
+	all := &api.DocumentList{}
+	if code := get(documentsPath, url.Values{}, all); code != http.StatusOK {
+		t.Fatalf("Got code %v; want %v", code, http.StatusOK)
+	}
+	if len(all.Items) != 5 || all.NextPageToken != "" {
+		t.Errorf("Got %v docs and token %q; want 5 docs and no token", len(all.Items), all.NextPageToken)
+	}
+
+	docs := &api.DocumentList{}
+	if code := get(documentsPath, url.Values{"mimeType": {"application/pdf"}}, docs); code != http.StatusOK {
+		t.Fatalf("Got code %v; want %v", code, http.StatusOK)
+	}
+	expectedDocs := &api.DocumentList{
+		Items: []api.Document{{DocId: datastore.DriveKey("doc4"), Name: "name0", MimeType: "application/pdf"}},
+	}
+	if d := cmp.Diff(expectedDocs, docs); d != "" {
+		t.Errorf("Unexpected docs; diff:\n%v", d)
+	}
+
+	entities := &api.EntityList{}
+	if code := get(entitiesPath, url.Values{"pageSize": {"2"}, "orderBy": {"name desc"}}, entities); code != http.StatusOK {
+		t.Fatalf("Got code %v; want %v", code, http.StatusOK)
+	}
+	if len(entities.Items) != 2 || entities.Items[0].Id != "e4" || entities.Items[1].Id != "e3" || entities.NextPageToken == "" {
+		t.Errorf("Unexpected entities %+v", entities)
+	}
+
+	mentions := &api.EntityMentionList{}
+	path := fmt.Sprintf("/documents/%v:mentions", datastore.DriveKey("doc0"))
+	if code := get(path, url.Values{"orderBy": {"startIndex desc"}, "entityId": {"e1"}}, mentions); code != http.StatusOK {
+		t.Fatalf("Got code %v; want %v", code, http.StatusOK)
+	}
+	expectedMentions := &api.EntityMentionList{
+		Items: []api.EntityMention{{EntityId: "e1", Text: "text", StartIndex: 1}},
+	}
+	if d := cmp.Diff(expectedMentions, mentions); d != "" {
+		t.Errorf("Unexpected mentions; diff:\n%v", d)
+	}
+
+	// Invalid requests.
+	invalid := []url.Values{
+		{"pageSize": {"-1"}},
+		{"pageToken": {"notAToken"}},
+		{"orderBy": {"md5Checksum"}},
+		// A token for a different query.
+		{"pageToken": {entities.NextPageToken}},
+	}
+	for _, p := range invalid {
+		if code := get(documentsPath, p, &api.DocumentList{}); code != http.StatusBadRequest {
+			t.Errorf("Request with %v got code %v; want %v", p, code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,529 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// clockSkew is how far the clocks of the server and the OIDC provider may disagree when checking the times in
+	// ID tokens.
+	clockSkew = time.Minute
+
+	// jwksRefreshInterval is the minimum time between fetches of the provider's keys.
+	jwksRefreshInterval = time.Minute
+)
+
+// OIDCConfig configures login with an OpenID Connect provider e.g. https://accounts.google.com.
+type OIDCConfig struct {
+	// Issuer is the URL of the provider. The discovery document is fetched from
+	// Issuer + /.well-known/openid-configuration.
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the URL of the callback handler e.g. https://p22h.example.com/auth/callback. It must be
+	// registered with the provider.
+	RedirectURL string
+	// Audiences are additional audiences accepted in bearer tokens e.g. the client id used by a CLI to obtain
+	// ID tokens. ClientID is always accepted.
+	Audiences []string
+}
+
+// Allowlist is the set of users permitted to use the server.
+type Allowlist struct {
+	// Emails of users that are allowed.
+	Emails []string
+	// Domains whose users are allowed e.g. example.com.
+	Domains []string
+}
+
+// Allowed returns true if email is in the allowlist.
+func (a *Allowlist) Allowed(email string) bool {
+	email = strings.ToLower(email)
+	for _, e := range a.Emails {
+		if strings.ToLower(e) == email {
+			return true
+		}
+	}
+
+	pieces := strings.Split(email, "@")
+	if len(pieces) != 2 {
+		return false
+	}
+
+	for _, d := range a.Domains {
+		if strings.ToLower(d) == pieces[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// OIDCAuthenticator authenticates callers using OpenID Connect.
+//
+// Browsers log in with the authorization code flow and are then identified by a session cookie. API clients
+// can instead send an ID token issued by the provider in the header "Authorization: Bearer <token>".
+// In both cases the email must be verified and in the allowlist.
+type OIDCAuthenticator struct {
+	log       logr.Logger
+	oauth     *oauth2.Config
+	verifier  *idTokenVerifier
+	sessions  *Sessions
+	allowlist *Allowlist
+	groups    GroupResolver
+}
+
+// providerMetadata is the subset of the OIDC discovery document that we use.
+type providerMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// NewOIDCAuthenticator creates a new authenticator. The provider's discovery document is fetched to locate its
+// endpoints. groups is optional; if set it is used to look up the groups of callers.
+func NewOIDCAuthenticator(ctx context.Context, config OIDCConfig, sessions *Sessions, allowlist *Allowlist, groups GroupResolver, log logr.Logger) (*OIDCAuthenticator, error) {
+	if config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+		return nil, errors.New("Issuer, ClientID and RedirectURL must be set")
+	}
+
+	if sessions == nil {
+		return nil, errors.New("sessions must be set")
+	}
+
+	if allowlist == nil || (len(allowlist.Emails) == 0 && len(allowlist.Domains) == 0) {
+		return nil, errors.New("The allowlist must contain at least one email or domain")
+	}
+
+	client := oauth2.NewClient(ctx, nil)
+	issuer := strings.TrimSuffix(config.Issuer, "/")
+	metadata := &providerMetadata{}
+	if err := getJSON(client, issuer+"/.well-known/openid-configuration", metadata); err != nil {
+		return nil, errors.Wrapf(err, "Failed to get the OIDC discovery document for issuer %v", issuer)
+	}
+
+	if strings.TrimSuffix(metadata.Issuer, "/") != issuer {
+		return nil, errors.Errorf("Discovery document has issuer %v; want %v", metadata.Issuer, issuer)
+	}
+
+	return &OIDCAuthenticator{
+		log: log,
+		oauth: &oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.RedirectURL,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  metadata.AuthorizationEndpoint,
+				TokenURL: metadata.TokenEndpoint,
+			},
+			Scopes: []string{"openid", "email"},
+		},
+		verifier: &idTokenVerifier{
+			issuer:    metadata.Issuer,
+			audiences: append([]string{config.ClientID}, config.Audiences...),
+			jwksURI:   metadata.JWKSURI,
+			client:    client,
+			keys:      map[string]*rsa.PublicKey{},
+			now:       time.Now,
+		},
+		sessions:  sessions,
+		allowlist: allowlist,
+		groups:    groups,
+	}, nil
+}
+
+// Authenticate returns the caller identified by the bearer token or session cookie. Requests without either are
+// anonymous. Invalid bearer tokens and users that aren't in the allowlist are errors.
+func (a *OIDCAuthenticator) Authenticate(r *http.Request) (*Caller, error) {
+	if h := r.Header.Get("Authorization"); h != "" {
+		pieces := strings.SplitN(h, " ", 2)
+		if len(pieces) != 2 || !strings.EqualFold(pieces[0], "Bearer") {
+			return nil, errors.New("Authorization header must be of the form Bearer <token>")
+		}
+
+		claims, err := a.verifier.Verify(r.Context(), strings.TrimSpace(pieces[1]))
+		if err != nil {
+			return nil, err
+		}
+
+		email, err := a.checkClaims(claims)
+		if err != nil {
+			return nil, err
+		}
+		return newCaller(r.Context(), email, a.groups)
+	}
+
+	email := a.sessions.Email(r)
+	if email == "" {
+		return nil, nil
+	}
+
+	// Recheck the allowlist in case it changed since the session started.
+	if !a.allowlist.Allowed(email) {
+		return nil, errors.Errorf("User %v isn't allowed", email)
+	}
+	return newCaller(r.Context(), email, a.groups)
+}
+
+// checkClaims returns the email in the claims if it is verified and allowed.
+func (a *OIDCAuthenticator) checkClaims(claims *idTokenClaims) (string, error) {
+	if claims.Email == "" || !claims.EmailVerified {
+		return "", errors.New("ID token doesn't contain a verified email")
+	}
+
+	if !a.allowlist.Allowed(claims.Email) {
+		return "", errors.Errorf("User %v isn't allowed", claims.Email)
+	}
+	return claims.Email, nil
+}
+
+// startLogin records the state of a new login and returns the URL of the provider to redirect the user to.
+// returnTo is the path to redirect to once the login completes.
+func (a *OIDCAuthenticator) startLogin(w http.ResponseWriter, returnTo string) (string, error) {
+	state, err := randomString()
+	if err != nil {
+		return "", err
+	}
+
+	nonce, err := randomString()
+	if err != nil {
+		return "", err
+	}
+
+	if err := a.sessions.setLoginState(w, loginState{State: state, Nonce: nonce, ReturnTo: returnTo}); err != nil {
+		return "", err
+	}
+	return a.oauth.AuthCodeURL(state, oauth2.SetAuthURLParam("nonce", nonce)), nil
+}
+
+// finishLogin exchanges the authorization code in the callback request for an ID token and starts a session.
+// It returns the path to redirect the user to.
+func (a *OIDCAuthenticator) finishLogin(w http.ResponseWriter, r *http.Request) (string, error) {
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		return "", errors.Errorf("Login failed; error %v: %v", e, q.Get("error_description"))
+	}
+
+	state, err := a.sessions.loginState(w, r)
+	if err != nil {
+		return "", errors.Wrapf(err, "No login is in progress")
+	}
+
+	if q.Get("state") != state.State {
+		return "", errors.New("Login state doesn't match")
+	}
+
+	token, err := a.oauth.Exchange(r.Context(), q.Get("code"))
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to exchange the authorization code")
+	}
+
+	raw, ok := token.Extra("id_token").(string)
+	if !ok || raw == "" {
+		return "", errors.New("Token response doesn't contain an ID token")
+	}
+
+	claims, err := a.verifier.Verify(r.Context(), raw)
+	if err != nil {
+		return "", err
+	}
+
+	if claims.Nonce != state.Nonce {
+		return "", errors.New("ID token nonce doesn't match")
+	}
+
+	email, err := a.checkClaims(claims)
+	if err != nil {
+		return "", err
+	}
+
+	if err := a.sessions.Start(w, strings.ToLower(email)); err != nil {
+		return "", err
+	}
+
+	a.log.Info("User logged in", "email", email)
+	return state.ReturnTo, nil
+}
+
+// idTokenClaims are the claims of an ID token that we use.
+type idTokenClaims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	Expiry        int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	NotBefore     int64    `json:"nbf"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+
+	// AuthorizedParty is the client the token was issued to. It is required if there are several audiences.
+	AuthorizedParty string `json:"azp"`
+}
+
+// audience is the aud claim which can be a single string or a list of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil {
+		return errors.Wrapf(err, "aud must be a string or a list of strings")
+	}
+	*a = l
+	return nil
+}
+
+// idTokenVerifier verifies ID tokens signed with RS256 by the provider.
+type idTokenVerifier struct {
+	issuer    string
+	audiences []string
+	jwksURI   string
+	client    *http.Client
+	now       func() time.Time
+
+	mu sync.Mutex
+	// keys maps the key id to the provider's public keys.
+	keys map[string]*rsa.PublicKey
+	// fetchedAt is when the keys were last fetched and fetchErr the error if the fetch failed.
+	fetchedAt time.Time
+	fetchErr  error
+	// fetching is closed when the fetch in progress finishes. It is nil if there is no fetch in progress.
+	fetching chan struct{}
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+}
+
+// Verify checks the signature, issuer, audience and expiration of the token and returns its claims.
+func (v *idTokenVerifier) Verify(ctx context.Context, raw string) (*idTokenClaims, error) {
+	pieces := strings.Split(raw, ".")
+	if len(pieces) != 3 {
+		return nil, errors.New("ID token is malformed")
+	}
+
+	header := &jwtHeader{}
+	if err := decodeSegment(pieces[0], header); err != nil {
+		return nil, errors.Wrapf(err, "Failed to decode ID token header")
+	}
+
+	if header.Algorithm != "RS256" {
+		return nil, errors.Errorf("ID token uses unsupported algorithm %v", header.Algorithm)
+	}
+
+	key, err := v.key(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(pieces[2])
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to decode ID token signature")
+	}
+
+	digest := sha256.Sum256([]byte(pieces[0] + "." + pieces[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, errors.Wrapf(err, "ID token has an invalid signature")
+	}
+
+	claims := &idTokenClaims{}
+	if err := decodeSegment(pieces[1], claims); err != nil {
+		return nil, errors.Wrapf(err, "Failed to decode ID token claims")
+	}
+
+	if claims.Issuer != v.issuer {
+		return nil, errors.Errorf("ID token has issuer %v; want %v", claims.Issuer, v.issuer)
+	}
+
+	if !v.allowedAudience(claims.Audience) {
+		return nil, errors.Errorf("ID token has audience %v which isn't allowed", claims.Audience)
+	}
+
+	// https://openid.net/specs/openid-connect-core-1_0.html#IDTokenValidation
+	if len(claims.Audience) > 1 || claims.AuthorizedParty != "" {
+		if !v.allowedAudience(audience{claims.AuthorizedParty}) {
+			return nil, errors.Errorf("ID token has authorized party %q which isn't allowed", claims.AuthorizedParty)
+		}
+	}
+
+	if v.now().Add(-clockSkew).Unix() >= claims.Expiry {
+		return nil, errors.New("ID token expired")
+	}
+
+	latest := v.now().Add(clockSkew).Unix()
+	if claims.IssuedAt > latest || claims.NotBefore > latest {
+		return nil, errors.New("ID token was issued in the future or isn't valid yet")
+	}
+	return claims, nil
+}
+
+func (v *idTokenVerifier) allowedAudience(aud audience) bool {
+	for _, a := range aud {
+		for _, allowed := range v.audiences {
+			if a == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// key returns the public key with the given id. The provider's keys are refetched if the key isn't known
+// since providers rotate their keys.
+//
+// Key ids come from unauthenticated requests so refetches are rate limited to one per jwksRefreshInterval;
+// until then unknown keys fail with the result of the last fetch. The keys are fetched without holding v.mu and
+// concurrent callers wait for the fetch in progress rather than starting their own.
+func (v *idTokenVerifier) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	if k, ok := v.keys[kid]; ok {
+		v.mu.Unlock()
+		return k, nil
+	}
+
+	if fetching := v.fetching; fetching != nil {
+		v.mu.Unlock()
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return v.knownKey(kid)
+	}
+
+	if !v.fetchedAt.IsZero() && v.now().Sub(v.fetchedAt) < jwksRefreshInterval {
+		v.mu.Unlock()
+		return v.knownKey(kid)
+	}
+
+	fetching := make(chan struct{})
+	v.fetching = fetching
+	v.fetchedAt = v.now()
+	v.mu.Unlock()
+
+	keys, err := fetchKeys(v.client, v.jwksURI)
+
+	v.mu.Lock()
+	if err == nil {
+		v.keys = keys
+	}
+	v.fetchErr = err
+	v.fetching = nil
+	close(fetching)
+	v.mu.Unlock()
+
+	return v.knownKey(kid)
+}
+
+// knownKey returns the public key with the given id from the keys fetched so far.
+func (v *idTokenVerifier) knownKey(kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if k, ok := v.keys[kid]; ok {
+		return k, nil
+	}
+	if v.fetchErr != nil {
+		return nil, errors.Wrapf(v.fetchErr, "Failed to get the provider's keys")
+	}
+	return nil, errors.Errorf("ID token is signed with unknown key %v", kid)
+}
+
+// fetchKeys fetches the provider's RSA public keys from jwksURI.
+func fetchKeys(client *http.Client, jwksURI string) (map[string]*rsa.PublicKey, error) {
+	set := &jsonWebKeySet{}
+	if err := getJSON(client, jwksURI, set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.KeyType != "RSA" {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to decode modulus of key %v", k.KeyID)
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to decode exponent of key %v", k.KeyID)
+		}
+
+		keys[k.KeyID] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a JWT.
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// getJSON fetches the url and unmarshals the JSON response into v.
+func getJSON(client *http.Client, url string, v interface{}) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to get %v", url)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("Get %v returned status %v", url, resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return errors.Wrapf(err, "Failed to decode response from %v", url)
+	}
+	return nil
+}
+
+// randomString returns a random string suitable for use as an OAuth state or nonce.
+func randomString() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrapf(err, "Failed to generate random string")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
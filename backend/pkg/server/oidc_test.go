@@ -0,0 +1,364 @@
+package server
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"github.com/gorilla/mux"
+	"github.com/jlewi/p22h/backend/pkg/datastore"
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"github.com/jlewi/p22h/backend/pkg/oidctesting"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_OIDCLogin(t *testing.T) {
+	log, err := logging.InitLogger("info", true)
+	if err != nil {
+		t.Fatalf("Failed to initialize the logger")
+	}
+
+	providerMux := http.NewServeMux()
+	providerServer := httptest.NewServer(providerMux)
+	defer providerServer.Close()
+
+	provider, err := oidctesting.NewProvider(providerServer.URL, "alice@example.com")
+	if err != nil {
+		t.Fatalf("Failed to create provider; error %v", err)
+	}
+	providerMux.Handle("/", provider)
+
+	// The server's router is created once the server exists since the redirect URL depends on its address.
+	router := mux.NewRouter()
+	backend := httptest.NewServer(router)
+	defer backend.Close()
+
+	staticPath, err := ioutil.TempDir("", "testStatic")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory; error %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(staticPath, "index.html"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("Failed to write index.html; error %v", err)
+	}
+
+	key, err := NewSessionKey()
+	if err != nil {
+		t.Fatalf("Failed to create session key; error %v", err)
+	}
+
+	sessions, err := NewSessions(key, time.Hour, false)
+	if err != nil {
+		t.Fatalf("Failed to create sessions; error %v", err)
+	}
+
+	config := OIDCConfig{
+		Issuer:       provider.Issuer,
+		ClientID:     "p22h",
+		ClientSecret: "secret",
+		RedirectURL:  backend.URL + callbackPath,
+		Audiences:    []string{"cli"},
+	}
+	allowlist := &Allowlist{Emails: []string{"bob@other.com"}, Domains: []string{"example.com"}}
+	a, err := NewOIDCAuthenticator(context.Background(), config, sessions, allowlist, nil, *log)
+	if err != nil {
+		t.Fatalf("Failed to create authenticator; error %v", err)
+	}
+
+	s := &Server{
+		log:        *log,
+		staticPath: staticPath,
+		store:      createDatastore(t, *log, []*datastore.DocLink{}),
+	}
+	ServerWithOIDC(a)(s)
+	router.NotFoundHandler = s.router()
+
+	t.Run("login", func(t *testing.T) {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			t.Fatalf("Failed to create cookie jar; error %v", err)
+		}
+		client := &http.Client{Jar: jar}
+
+		// Loading the UI should redirect through the provider and back to the UI.
+		resp, err := client.Get(backend.URL + "/ui/")
+		if err != nil {
+			t.Fatalf("Failed to get the UI; error %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+			t.Fatalf("Got code %v body %v; want %v hello", resp.StatusCode, string(body), http.StatusOK)
+		}
+
+		// The session cookie should authenticate API calls.
+		resp, err = client.Get(backend.URL + categoriesPath)
+		if err != nil {
+			t.Fatalf("Failed to get categories; error %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Got code %v; want %v", resp.StatusCode, http.StatusOK)
+		}
+
+		// Logging out requires a POST so links on other sites can't log users out.
+		resp, err = client.Get(backend.URL + logoutPath)
+		if err != nil {
+			t.Fatalf("Failed to get %v; error %v", logoutPath, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Fatalf("GET %v got code %v; want %v", logoutPath, resp.StatusCode, http.StatusMethodNotAllowed)
+		}
+
+		resp, err = client.Post(backend.URL+logoutPath, "", nil)
+		if err != nil {
+			t.Fatalf("Failed to log out; error %v", err)
+		}
+		resp.Body.Close()
+
+		resp, err = client.Get(backend.URL + categoriesPath)
+		if err != nil {
+			t.Fatalf("Failed to get categories; error %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Got code %v after logging out; want %v", resp.StatusCode, http.StatusUnauthorized)
+		}
+	})
+
+	t.Run("login-not-allowed", func(t *testing.T) {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			t.Fatalf("Failed to create cookie jar; error %v", err)
+		}
+		client := &http.Client{Jar: jar}
+
+		provider.Email = "eve@evil.com"
+		defer func() { provider.Email = "alice@example.com" }()
+
+		resp, err := client.Get(backend.URL + loginPath)
+		if err != nil {
+			t.Fatalf("Failed to log in; error %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Got code %v; want %v", resp.StatusCode, http.StatusUnauthorized)
+		}
+	})
+
+	type testCase struct {
+		name     string
+		email    string
+		audience string
+		code     int
+	}
+
+	cases := []testCase{
+		{
+			name:     "bearer",
+			email:    "bob@other.com",
+			audience: "cli",
+			code:     http.StatusOK,
+		},
+		{
+			name:     "bearer-not-allowed",
+			email:    "eve@evil.com",
+			audience: "p22h",
+			code:     http.StatusUnauthorized,
+		},
+		{
+			name:     "bearer-wrong-audience",
+			email:    "alice@example.com",
+			audience: "other",
+			code:     http.StatusUnauthorized,
+		},
+		{
+			name: "anonymous",
+			code: http.StatusUnauthorized,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, backend.URL+categoriesPath, nil)
+			if err != nil {
+				t.Fatalf("Failed to create request; error %v", err)
+			}
+
+			if c.email != "" {
+				token, err := provider.IDToken(c.email, c.audience, "")
+				if err != nil {
+					t.Fatalf("Failed to create ID token; error %v", err)
+				}
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed; error %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != c.code {
+				t.Errorf("Got code %v; want %v", resp.StatusCode, c.code)
+			}
+		})
+	}
+}
+
+func Test_IDTokenVerifierKeyRefresh(t *testing.T) {
+	providerMux := http.NewServeMux()
+	providerServer := httptest.NewServer(providerMux)
+	defer providerServer.Close()
+
+	provider, err := oidctesting.NewProvider(providerServer.URL, "alice@example.com")
+	if err != nil {
+		t.Fatalf("Failed to create provider; error %v", err)
+	}
+	var fetches int32
+	providerMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/jwks" {
+			atomic.AddInt32(&fetches, 1)
+		}
+		provider.ServeHTTP(w, r)
+	})
+
+	now := time.Now()
+	v := &idTokenVerifier{
+		issuer:    provider.Issuer,
+		audiences: []string{"p22h"},
+		jwksURI:   provider.Issuer + "/jwks",
+		client:    providerServer.Client(),
+		keys:      map[string]*rsa.PublicKey{},
+		now:       func() time.Time { return now },
+	}
+
+	token, err := provider.IDToken("alice@example.com", "p22h", "")
+	if err != nil {
+		t.Fatalf("Failed to create token; error %v", err)
+	}
+	if _, err := v.Verify(context.Background(), token); err != nil {
+		t.Fatalf("Verify failed; error %v", err)
+	}
+
+	// Tokens signed with unknown keys don't refetch the keys until jwksRefreshInterval has passed.
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"unknown"}`))
+	unknown := header + token[strings.Index(token, "."):]
+	for i := 0; i < 10; i++ {
+		if _, err := v.Verify(context.Background(), unknown); err == nil {
+			t.Fatalf("Verify succeeded for a token signed with an unknown key; want error")
+		}
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("Keys were fetched %v times; want 1", n)
+	}
+
+	now = now.Add(jwksRefreshInterval)
+	if _, err := v.Verify(context.Background(), unknown); err == nil {
+		t.Fatalf("Verify succeeded for a token signed with an unknown key; want error")
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("Keys were fetched %v times; want 2", n)
+	}
+
+	// Known keys still work while refetches are rate limited.
+	if _, err := v.Verify(context.Background(), token); err != nil {
+		t.Errorf("Verify failed; error %v", err)
+	}
+}
+
+func Test_IDTokenVerifierClaims(t *testing.T) {
+	providerMux := http.NewServeMux()
+	providerServer := httptest.NewServer(providerMux)
+	defer providerServer.Close()
+
+	provider, err := oidctesting.NewProvider(providerServer.URL, "alice@example.com")
+	if err != nil {
+		t.Fatalf("Failed to create provider; error %v", err)
+	}
+	providerMux.Handle("/", provider)
+
+	now := time.Now()
+	v := &idTokenVerifier{
+		issuer:    provider.Issuer,
+		audiences: []string{"p22h", "cli"},
+		jwksURI:   provider.Issuer + "/jwks",
+		client:    providerServer.Client(),
+		keys:      map[string]*rsa.PublicKey{},
+		now:       func() time.Time { return now },
+	}
+
+	type testCase struct {
+		name   string
+		claims map[string]interface{}
+		valid  bool
+	}
+
+	cases := []testCase{
+		{
+			name:   "valid",
+			claims: map[string]interface{}{},
+			valid:  true,
+		},
+		{
+			name:   "several-audiences",
+			claims: map[string]interface{}{"aud": []string{"p22h", "other"}, "azp": "p22h"},
+			valid:  true,
+		},
+		{
+			name:   "several-audiences-no-azp",
+			claims: map[string]interface{}{"aud": []string{"p22h", "other"}},
+		},
+		{
+			name:   "several-audiences-other-azp",
+			claims: map[string]interface{}{"aud": []string{"p22h", "other"}, "azp": "other"},
+		},
+		{
+			name:   "issued-within-skew",
+			claims: map[string]interface{}{"iat": now.Add(clockSkew / 2).Unix()},
+			valid:  true,
+		},
+		{
+			name:   "issued-in-future",
+			claims: map[string]interface{}{"iat": now.Add(2 * clockSkew).Unix()},
+		},
+		{
+			name:   "not-yet-valid",
+			claims: map[string]interface{}{"nbf": now.Add(2 * clockSkew).Unix()},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			claims := map[string]interface{}{
+				"iss":   provider.Issuer,
+				"sub":   "alice@example.com",
+				"aud":   "p22h",
+				"iat":   now.Unix(),
+				"exp":   now.Add(time.Hour).Unix(),
+				"email": "alice@example.com",
+			}
+			for k, val := range c.claims {
+				claims[k] = val
+			}
+			token, err := provider.SignClaims(claims)
+			if err != nil {
+				t.Fatalf("Failed to create token; error %v", err)
+			}
+
+			_, err = v.Verify(context.Background(), token)
+			if c.valid && err != nil {
+				t.Errorf("Verify failed; error %v", err)
+			}
+			if !c.valid && err == nil {
+				t.Errorf("Verify succeeded; want error")
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/go-logr/logr"
@@ -8,26 +9,156 @@ import (
 	"github.com/jlewi/p22h/backend/api"
 	"github.com/jlewi/p22h/backend/pkg/datastore"
 	"github.com/jlewi/p22h/backend/pkg/debug"
+	"github.com/jlewi/p22h/backend/pkg/gdocs"
 	"github.com/pkg/errors"
 	"net"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
 	// What if we want to get all the links to some reference which is not a Document? e.g. all the
 	// links pointing at www.kubernetes.com
 	backLinksPath = "/documents/{name}:backLinks"
+
+	// documentsPath lists the indexed documents. Like the other list paths it is paginated with the query
+	// parameters pageSize and pageToken.
+	documentsPath = "/documents"
+
+	// documentMentionsPath lists the mentions of entities in a document.
+	documentMentionsPath = "/documents/{name}:mentions"
+
+	// entitiesPath lists the entities.
+	entitiesPath = "/entities"
+
+	// entityDocumentsPath lists the documents mentioning an entity ranked by the salience of the entity.
+	entityDocumentsPath = "/entities/{id}:documents"
+
+	// relatedEntitiesPath lists the entities mentioned together with an entity.
+	relatedEntitiesPath = "/entities/{id}:related"
+
+	// entityTimelinePath returns the mentions of an entity per week or month based on when docs were modified.
+	entityTimelinePath = "/entities/{id}:timeline"
+
+	// personDocumentsPath lists the documents a person, identified by email, owns, modified or has access to.
+	personDocumentsPath = "/people/{email}:documents"
+
+	// categoriesPath lists the content categories along with the number of documents in each.
+	categoriesPath = "/categories"
+
+	// categoryDocumentsPath lists the documents in the category specified by the query parameter category.
+	// Category names contain "/" so they are passed as a query parameter rather than in the path.
+	categoryDocumentsPath = "/categories:documents"
+
+	// keyphrasesPath lists the keyphrases ordered by the number of documents mentioning them.
+	keyphrasesPath = "/keyphrases"
+
+	// keyphraseSearchPath searches for documents mentioning keyphrases matching the query parameter q.
+	keyphraseSearchPath = "/keyphrases:search"
+
+	// statsPath returns statistics about the index e.g. the number of docs in each state and the most linked docs.
+	statsPath = "/stats"
+
+	// indexRunPath starts an index job. The body is an api.IndexRequest.
+	indexRunPath = "/index:run"
+
+	// indexJobsPath lists the index jobs starting with the most recent.
+	indexJobsPath = "/index/jobs"
+
+	// indexJobPath returns an index job including its progress.
+	indexJobPath = "/index/jobs/{id}"
+
+	// indexJobCancelPath cancels a running index job.
+	indexJobCancelPath = "/index/jobs/{id}:cancel"
+
+	// indexEventsPath streams index events using Server-Sent Events.
+	indexEventsPath = "/index/events"
+
+	// authPathPrefix is the prefix of the paths used to log in and out. They don't require authentication.
+	authPathPrefix = "/auth/"
+
+	// loginPath starts an OIDC login. The optional query parameter returnTo is the path to redirect to afterwards.
+	loginPath = authPathPrefix + "login"
+
+	// callbackPath is where the OIDC provider redirects to after the user logs in.
+	callbackPath = authPathPrefix + "callback"
+
+	// logoutPath ends the session. It only accepts POST.
+	logoutPath = authPathPrefix + "logout"
+
+	healthPath = "/healthz"
+	uiPath     = "/ui/"
 )
 
 type Server struct {
 	log        logr.Logger
 	staticPath string
 	listener   net.Listener
-	store      *datastore.Datastore
+	store      datastore.Store
+
+	// authenticator identifies the caller of requests. If nil requests are anonymous.
+	authenticator Authenticator
+	// login is set when users log in with OIDC. Requests without a caller are then rejected.
+	login *OIDCAuthenticator
+	// httpServer is the server started by StartAndBlock.
+	httpServer *http.Server
+
+	// jobs runs index jobs. If nil the index endpoints aren't served.
+	jobs *gdocs.JobManager
+	// events broadcasts index events. If nil the events stream isn't served.
+	events *gdocs.EventHub
+	// closing is closed when the server shuts down so long lived streams end.
+	closing chan struct{}
+	// aclFilter if true means responses only include docs the caller can read according to the stored Drive ACLs.
+	aclFilter bool
+}
+
+// ServerOption is an option for the server.
+type ServerOption func(s *Server)
+
+// ServerWithAuthenticator sets the Authenticator used to identify callers.
+func ServerWithAuthenticator(a Authenticator) ServerOption {
+	return func(s *Server) {
+		s.authenticator = a
+	}
 }
 
-func NewServer(staticPath string, listener net.Listener, store *datastore.Datastore, log logr.Logger) (*Server, error) {
+// ServerWithOIDC requires callers to log in with OIDC or present an ID token issued by the provider.
+func ServerWithOIDC(a *OIDCAuthenticator) ServerOption {
+	return func(s *Server) {
+		s.authenticator = a
+		s.login = a
+	}
+}
+
+// ServerWithIndexJobs serves the endpoints to start and monitor index jobs.
+func ServerWithIndexJobs(m *gdocs.JobManager) ServerOption {
+	return func(s *Server) {
+		s.jobs = m
+	}
+}
+
+// ServerWithEvents streams the events published to hub to clients of the events endpoint.
+func ServerWithEvents(hub *gdocs.EventHub) ServerOption {
+	return func(s *Server) {
+		s.events = hub
+	}
+}
+
+// ServerWithACLFilter enables filtering responses to the docs the caller can read. Requests without an
+// authenticated caller are rejected.
+func ServerWithACLFilter(enabled bool) ServerOption {
+	return func(s *Server) {
+		s.aclFilter = enabled
+	}
+}
+
+func NewServer(staticPath string, listener net.Listener, store datastore.Store, log logr.Logger, opts ...ServerOption) (*Server, error) {
 	if staticPath == "" {
 		return nil, errors.Errorf("staticPath must be set")
 	}
@@ -43,12 +174,33 @@ func NewServer(staticPath string, listener net.Listener, store *datastore.Datast
 		return nil, errors.Wrapf(err, "Failed to get absolute path; path: %v", staticPath)
 	}
 	log.Info("resolved static path", "input", staticPath, "output", resolved)
-	return &Server{
+	s := &Server{
 		log:        log,
 		staticPath: resolved,
 		listener:   listener,
 		store:      store,
-	}, nil
+		httpServer: &http.Server{},
+		closing:    make(chan struct{}),
+	}
+
+	for _, o := range opts {
+		o(s)
+	}
+
+	// Shutdown waits for in flight requests so streams need to be told to finish.
+	s.httpServer.RegisterOnShutdown(func() {
+		close(s.closing)
+	})
+
+	if s.aclFilter && s.authenticator == nil {
+		return nil, errors.New("An authenticator is required to filter responses by ACL")
+	}
+
+	// Index jobs spend the Natural Language API budget so anonymous callers mustn't be able to start them.
+	if s.jobs != nil && s.authenticator == nil {
+		return nil, errors.New("An authenticator is required to serve index jobs")
+	}
+	return s, nil
 }
 
 func (s *Server) Address() string {
@@ -76,11 +228,106 @@ func (s *Server) writeStatus(w http.ResponseWriter, message string, code int) {
 	}
 }
 
+// authenticate is middleware which records the caller of the request in the request context.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.authenticator == nil || r.URL.Path == healthPath || strings.HasPrefix(r.URL.Path, authPathPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		c, err := s.authenticator.Authenticate(r)
+		if err != nil {
+			s.writeStatus(w, fmt.Sprintf("Failed to authenticate request; error %v", err), http.StatusUnauthorized)
+			return
+		}
+
+		if c == nil && s.login != nil {
+			// Send browsers loading the UI to the login page; API calls just fail.
+			if strings.HasPrefix(r.URL.Path, uiPath) {
+				http.Redirect(w, r, loginPath+"?returnTo="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
+			s.writeStatus(w, "Request isn't authenticated; log in or supply a bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		if c != nil {
+			r = r.WithContext(WithCaller(r.Context(), c))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Login redirects the user to the OIDC provider to log in.
+func (s *Server) Login(w http.ResponseWriter, r *http.Request) {
+	returnTo := r.URL.Query().Get("returnTo")
+	// Only redirect to paths on this server to avoid being used as an open redirect.
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.HasPrefix(returnTo, "/\\") {
+		returnTo = uiPath
+	}
+
+	u, err := s.login.startLogin(w, returnTo)
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to start login; error %v", err), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, u, http.StatusFound)
+}
+
+// AuthCallback completes the login when the OIDC provider redirects back to the server.
+func (s *Server) AuthCallback(w http.ResponseWriter, r *http.Request) {
+	returnTo, err := s.login.finishLogin(w, r)
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to log in; error %v", err), http.StatusUnauthorized)
+		return
+	}
+	http.Redirect(w, r, returnTo, http.StatusFound)
+}
+
+// Logout ends the session.
+func (s *Server) Logout(w http.ResponseWriter, r *http.Request) {
+	s.login.sessions.End(w)
+	s.writeStatus(w, "Logged out", http.StatusOK)
+}
+
+// docFilter returns a function reporting whether the caller can read a doc. If ACL filtering is disabled every
+// doc is readable. If the filter can't be created an error is written to w and ok is false.
+func (s *Server) docFilter(w http.ResponseWriter, r *http.Request) (visible func(docId string) bool, ok bool) {
+	if !s.aclFilter {
+		return func(string) bool { return true }, true
+	}
+
+	docs, ok := s.callerDocs(w, r)
+	if !ok {
+		return nil, false
+	}
+	return func(docId string) bool { return docs[docId] }, true
+}
+
+// callerDocs returns the set of docs the caller can read. If the docs can't be determined an error is written
+// to w and ok is false.
+func (s *Server) callerDocs(w http.ResponseWriter, r *http.Request) (map[string]bool, bool) {
+	c := CallerFromContext(r.Context())
+	if c == nil {
+		s.writeStatus(w, "Request isn't authenticated", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	docs, err := s.store.ListVisibleDocs(datastore.Principals{Email: c.Email, Groups: c.Groups})
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to get docs visible to the caller; error %v", err), http.StatusInternalServerError)
+		return nil, false
+	}
+	return docs, true
+}
+
 func (s *Server) HealthCheck(w http.ResponseWriter, r *http.Request) {
 	s.writeStatus(w, "Feed backend is running", http.StatusOK)
 }
 
-// BackLinks returns backLinks for a given document.
+// BackLinks returns backLinks for a given document. It supports the query parameters pageSize, pageToken and
+// orderBy; one of sourceId, text or startIndex optionally followed by desc.
 func (s *Server) BackLinks(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name, ok := vars["name"]
@@ -89,22 +336,44 @@ func (s *Server) BackLinks(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	links, err := s.store.ListDocLinks(name)
+	visible, ok := s.docFilter(w, r)
+	if !ok {
+		return
+	}
+
+	// Don't reveal whether docs the caller can't read exist.
+	if !visible(name) {
+		s.writeStatus(w, fmt.Sprintf("Doc %v not found", name), http.StatusNotFound)
+		return
+	}
+
+	opts, err := parseListOptions(r)
+	if err != nil {
+		s.writeStatus(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Links from docs the caller can't read are dropped so pages can have fewer than pageSize links.
+	links, token, err := s.store.QueryDocLinks(datastore.DocLinkQuery{DestID: name, ListOptions: opts})
 
 	if err != nil {
-		s.writeStatus(w, fmt.Sprintf("Failed to get backlinks for doc: %v; error %v", name, err), http.StatusInternalServerError)
+		s.writeListError(w, fmt.Sprintf("backlinks for doc: %v", name), err)
 		return
 	}
 
 	linkList := &api.BackLinkList{
-		Items: make([]api.BackLink, len(links)),
+		Items:         make([]api.BackLink, 0, len(links)),
+		NextPageToken: token,
 	}
 
-	for i, l := range links {
-		linkList.Items[i] = api.BackLink{
+	for _, l := range links {
+		if !visible(l.SourceID) {
+			continue
+		}
+		linkList.Items = append(linkList.Items, api.BackLink{
 			Text:  l.Text,
 			DocId: l.SourceID,
-		}
+		})
 	}
 	payload, err := json.Marshal(linkList)
 	if err != nil {
@@ -116,6 +385,684 @@ func (s *Server) BackLinks(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// EntityDocuments returns the documents which mention a given entity.
+func (s *Server) EntityDocuments(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		s.writeStatus(w, "Missing entity id", http.StatusBadRequest)
+		return
+	}
+
+	visible, ok := s.docFilter(w, r)
+	if !ok {
+		return
+	}
+
+	docs, err := s.store.ListEntityDocuments(id)
+
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to get documents for entity: %v; error %v", id, err), http.StatusInternalServerError)
+		return
+	}
+
+	docList := &api.EntityDocumentList{
+		Items: make([]api.EntityDocument, 0, len(docs)),
+	}
+
+	for _, d := range docs {
+		if !visible(d.DocID) {
+			continue
+		}
+		docList.Items = append(docList.Items, api.EntityDocument{
+			DocId:              d.DocID,
+			Salience:           d.Salience,
+			Mentions:           d.NumMentions,
+			SentimentScore:     d.SentimentScore,
+			SentimentMagnitude: d.SentimentMagnitude,
+		})
+	}
+	payload, err := json.Marshal(docList)
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to encode EntityDocumentList; error %v", err), http.StatusInternalServerError)
+		return
+	}
+	if _, err := w.Write(payload); err != nil {
+		s.log.Error(err, "Failed to write response")
+	}
+}
+
+// RelatedEntities returns the entities which are mentioned in the same documents as a given entity. The optional
+// query parameter limit caps the number of entities returned.
+func (s *Server) RelatedEntities(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		s.writeStatus(w, "Missing entity id", http.StatusBadRequest)
+		return
+	}
+
+	limit, err := parseLimit(r)
+	if err != nil {
+		s.writeStatus(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var related []*datastore.RelatedEntity
+	if s.aclFilter {
+		// The precomputed co-occurrences include docs the caller might not be able to read so compute them from the
+		// visible docs.
+		docIds, ok := s.visibleDocIds(w, r)
+		if !ok {
+			return
+		}
+		related, err = s.store.ListRelatedEntitiesInDocs(id, docIds, limit)
+	} else {
+		related, err = s.store.ListRelatedEntities(id, limit)
+	}
+
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to get entities related to entity: %v; error %v", id, err), http.StatusInternalServerError)
+		return
+	}
+
+	entityList := &api.RelatedEntityList{
+		Items: make([]api.RelatedEntity, len(related)),
+	}
+
+	for i, e := range related {
+		entityList.Items[i] = api.RelatedEntity{
+			Id:        e.EntityID,
+			Name:      e.Name,
+			Type:      e.Type,
+			Documents: e.NumDocuments,
+			Sentences: e.NumSentences,
+		}
+	}
+	payload, err := json.Marshal(entityList)
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to encode RelatedEntityList; error %v", err), http.StatusInternalServerError)
+		return
+	}
+	if _, err := w.Write(payload); err != nil {
+		s.log.Error(err, "Failed to write response")
+	}
+}
+
+// EntityTimeline returns the number of mentions of an entity per period along with the contributing docs.
+// The optional query parameter interval is either week or month; it defaults to month.
+func (s *Server) EntityTimeline(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		s.writeStatus(w, "Missing entity id", http.StatusBadRequest)
+		return
+	}
+
+	interval := r.URL.Query().Get("interval")
+	if interval == "" {
+		interval = datastore.TimelineMonth
+	}
+
+	if interval != datastore.TimelineWeek && interval != datastore.TimelineMonth {
+		s.writeStatus(w, fmt.Sprintf("Invalid interval %v; must be one of %v, %v", interval, datastore.TimelineWeek, datastore.TimelineMonth), http.StatusBadRequest)
+		return
+	}
+
+	visible, ok := s.docFilter(w, r)
+	if !ok {
+		return
+	}
+
+	buckets, err := s.store.EntityTimeline(id, interval)
+
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to get timeline for entity: %v; error %v", id, err), http.StatusInternalServerError)
+		return
+	}
+
+	timeline := &api.EntityTimeline{
+		Interval: interval,
+		Items:    make([]api.TimelineBucket, 0, len(buckets)),
+	}
+
+	for _, b := range buckets {
+		bucket := api.TimelineBucket{
+			Start:     b.Start,
+			Documents: make([]api.TimelineDocument, 0, len(b.Docs)),
+		}
+		for _, d := range b.Docs {
+			if !visible(d.DocID) {
+				continue
+			}
+			bucket.Mentions = bucket.Mentions + d.NumMentions
+			bucket.Documents = append(bucket.Documents, api.TimelineDocument{
+				DocId:        d.DocID,
+				Name:         d.Name,
+				ModifiedTime: d.ModifiedTime.UTC().Format(time.RFC3339),
+				Mentions:     d.NumMentions,
+			})
+		}
+
+		if len(bucket.Documents) == 0 {
+			continue
+		}
+		timeline.Items = append(timeline.Items, bucket)
+	}
+	payload, err := json.Marshal(timeline)
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to encode EntityTimeline; error %v", err), http.StatusInternalServerError)
+		return
+	}
+	if _, err := w.Write(payload); err != nil {
+		s.log.Error(err, "Failed to write response")
+	}
+}
+
+// PersonDocuments returns the documents related to a person known to Drive. The optional query parameter role
+// restricts the results to a single role e.g. owner.
+func (s *Server) PersonDocuments(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	email, ok := vars["email"]
+	if !ok {
+		s.writeStatus(w, "Missing email", http.StatusBadRequest)
+		return
+	}
+
+	visible, ok := s.docFilter(w, r)
+	if !ok {
+		return
+	}
+
+	entityId := datastore.PersonKey(email)
+	people, err := s.store.ListDocPeople("", entityId)
+
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to get documents for person: %v; error %v", email, err), http.StatusInternalServerError)
+		return
+	}
+
+	role := r.URL.Query().Get("role")
+	docList := &api.PersonDocumentList{
+		EntityId: entityId,
+		Items:    make([]api.PersonDocument, 0, len(people)),
+	}
+
+	for _, p := range people {
+		if role != "" && p.Role != role {
+			continue
+		}
+		if !visible(p.DocID) {
+			continue
+		}
+		docList.Items = append(docList.Items, api.PersonDocument{
+			DocId: p.DocID,
+			Role:  p.Role,
+		})
+	}
+	payload, err := json.Marshal(docList)
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to encode PersonDocumentList; error %v", err), http.StatusInternalServerError)
+		return
+	}
+	if _, err := w.Write(payload); err != nil {
+		s.log.Error(err, "Failed to write response")
+	}
+}
+
+// visibleDocIds returns the ids of the docs the caller can read sorted so they can be part of the query of a page
+// token. If the ids can't be determined an error is written to w and ok is false.
+func (s *Server) visibleDocIds(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	docs, ok := s.callerDocs(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	ids := make([]string, 0, len(docs))
+	for id := range docs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, true
+}
+
+// Categories returns the content categories and the number of documents in each.
+func (s *Server) Categories(w http.ResponseWriter, r *http.Request) {
+	var counts []*datastore.CategoryCount
+	var err error
+	if s.aclFilter {
+		visible, ok := s.docFilter(w, r)
+		if !ok {
+			return
+		}
+		counts, err = s.visibleCategoryCounts(visible)
+	} else {
+		counts, err = s.store.CountDocCategories()
+	}
+
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to get categories; error %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	catList := &api.CategoryList{
+		Items: make([]api.Category, len(counts)),
+	}
+
+	for i, c := range counts {
+		catList.Items[i] = api.Category{
+			Name:      c.Category,
+			Documents: c.NumDocuments,
+		}
+	}
+	payload, err := json.Marshal(catList)
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to encode CategoryList; error %v", err), http.StatusInternalServerError)
+		return
+	}
+	if _, err := w.Write(payload); err != nil {
+		s.log.Error(err, "Failed to write response")
+	}
+}
+
+// visibleCategoryCounts counts the visible docs in each category ordered by category.
+func (s *Server) visibleCategoryCounts(visible func(string) bool) ([]*datastore.CategoryCount, error) {
+	cats, err := s.store.ListDocCategories("", "")
+	if err != nil {
+		return nil, err
+	}
+
+	byName := map[string]*datastore.CategoryCount{}
+	counts := make([]*datastore.CategoryCount, 0, 10)
+	for _, c := range cats {
+		if !visible(c.DocID) {
+			continue
+		}
+		count, ok := byName[c.Category]
+		if !ok {
+			count = &datastore.CategoryCount{Category: c.Category}
+			byName[c.Category] = count
+			counts = append(counts, count)
+		}
+		count.NumDocuments = count.NumDocuments + 1
+	}
+
+	sort.Slice(counts, func(i, j int) bool {
+		return counts[i].Category < counts[j].Category
+	})
+	return counts, nil
+}
+
+// CategoryDocuments returns the documents in a category including documents in nested categories.
+func (s *Server) CategoryDocuments(w http.ResponseWriter, r *http.Request) {
+	category := r.URL.Query().Get("category")
+	if category == "" {
+		s.writeStatus(w, "Missing query parameter category", http.StatusBadRequest)
+		return
+	}
+
+	visible, ok := s.docFilter(w, r)
+	if !ok {
+		return
+	}
+
+	cats, err := s.store.ListDocCategories("", category)
+
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to get documents for category: %v; error %v", category, err), http.StatusInternalServerError)
+		return
+	}
+
+	docList := &api.CategoryDocumentList{
+		Items: make([]api.CategoryDocument, 0, len(cats)),
+	}
+
+	for _, c := range cats {
+		if !visible(c.DocID) {
+			continue
+		}
+		docList.Items = append(docList.Items, api.CategoryDocument{
+			DocId:      c.DocID,
+			Category:   c.Category,
+			Confidence: c.Confidence,
+		})
+	}
+	payload, err := json.Marshal(docList)
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to encode CategoryDocumentList; error %v", err), http.StatusInternalServerError)
+		return
+	}
+	if _, err := w.Write(payload); err != nil {
+		s.log.Error(err, "Failed to write response")
+	}
+}
+
+// Keyphrases returns the keyphrases mentioned in the most documents. The optional query parameter limit
+// caps the number of keyphrases returned.
+func (s *Server) Keyphrases(w http.ResponseWriter, r *http.Request) {
+	limit, err := parseLimit(r)
+	if err != nil {
+		s.writeStatus(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var phrases []*datastore.Keyphrase
+	if s.aclFilter {
+		visible, ok := s.docFilter(w, r)
+		if !ok {
+			return
+		}
+		phrases, err = s.visibleKeyphrases(visible, limit)
+	} else {
+		phrases, err = s.store.ListKeyphrases(limit)
+	}
+
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to get keyphrases; error %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	phraseList := &api.KeyphraseList{
+		Items: make([]api.Keyphrase, len(phrases)),
+	}
+
+	for i, p := range phrases {
+		phraseList.Items[i] = api.Keyphrase{
+			Phrase:    p.ID,
+			Documents: p.DocumentFrequency,
+		}
+	}
+	payload, err := json.Marshal(phraseList)
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to encode KeyphraseList; error %v", err), http.StatusInternalServerError)
+		return
+	}
+	if _, err := w.Write(payload); err != nil {
+		s.log.Error(err, "Failed to write response")
+	}
+}
+
+// visibleKeyphrases returns the keyphrases ordered by the number of visible documents mentioning them. The document
+// frequency of the returned keyphrases only counts visible documents.
+func (s *Server) visibleKeyphrases(visible func(string) bool, limit int) ([]*datastore.Keyphrase, error) {
+	weights, err := s.store.ListDocKeyphrases("")
+	if err != nil {
+		return nil, err
+	}
+
+	byId := map[string]*datastore.Keyphrase{}
+	phrases := make([]*datastore.Keyphrase, 0, 10)
+	for _, k := range weights {
+		if !visible(k.DocID) {
+			continue
+		}
+		p, ok := byId[k.KeyphraseID]
+		if !ok {
+			p = &datastore.Keyphrase{ID: k.KeyphraseID}
+			byId[k.KeyphraseID] = p
+			phrases = append(phrases, p)
+		}
+		p.DocumentFrequency = p.DocumentFrequency + 1
+	}
+
+	sort.Slice(phrases, func(i, j int) bool {
+		if phrases[i].DocumentFrequency != phrases[j].DocumentFrequency {
+			return phrases[i].DocumentFrequency > phrases[j].DocumentFrequency
+		}
+		return phrases[i].ID < phrases[j].ID
+	})
+
+	if limit > 0 && len(phrases) > limit {
+		phrases = phrases[:limit]
+	}
+	return phrases, nil
+}
+
+// KeyphraseSearch returns the documents mentioning keyphrases which contain the query ranked by TF-IDF weight.
+func (s *Server) KeyphraseSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		s.writeStatus(w, "Missing query parameter q", http.StatusBadRequest)
+		return
+	}
+
+	limit, err := parseLimit(r)
+	if err != nil {
+		s.writeStatus(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	visible, ok := s.docFilter(w, r)
+	if !ok {
+		return
+	}
+
+	// When filtering the limit has to be applied after removing docs the caller can't read.
+	searchLimit := limit
+	if s.aclFilter {
+		searchLimit = 0
+	}
+	results, err := s.store.SearchKeyphrases(query, searchLimit)
+
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to search keyphrases: %v; error %v", query, err), http.StatusInternalServerError)
+		return
+	}
+
+	docList := &api.KeyphraseDocumentList{
+		Items: make([]api.KeyphraseDocument, 0, len(results)),
+	}
+
+	for _, k := range results {
+		if limit > 0 && len(docList.Items) >= limit {
+			break
+		}
+		if !visible(k.DocID) {
+			continue
+		}
+		docList.Items = append(docList.Items, api.KeyphraseDocument{
+			DocId:    k.DocID,
+			Phrase:   k.KeyphraseID,
+			Mentions: k.NumMentions,
+			Weight:   k.Weight,
+		})
+	}
+	payload, err := json.Marshal(docList)
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to encode KeyphraseDocumentList; error %v", err), http.StatusInternalServerError)
+		return
+	}
+	if _, err := w.Write(payload); err != nil {
+		s.log.Error(err, "Failed to write response")
+	}
+}
+
+// IndexRun starts an index job for a drive or a single file. Only authenticated callers can start jobs.
+func (s *Server) IndexRun(w http.ResponseWriter, r *http.Request) {
+	c := CallerFromContext(r.Context())
+	if c == nil {
+		s.writeStatus(w, "Only authenticated callers can start index jobs", http.StatusForbidden)
+		return
+	}
+
+	req := &api.IndexRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to decode IndexRequest; error %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if (req.Drive == "") == (req.File == "") {
+		s.writeStatus(w, "Exactly one of drive and file must be set", http.StatusBadRequest)
+		return
+	}
+
+	job, err := s.jobs.Start(req.Drive, req.File, c.Email)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, gdocs.ErrJobRunning) {
+			code = http.StatusConflict
+		}
+		s.writeStatus(w, fmt.Sprintf("Failed to start index job; error %v", err), code)
+		return
+	}
+
+	s.writeJob(w, job, http.StatusAccepted)
+}
+
+// IndexJob returns an index job including its progress. Only authenticated callers can read jobs; see jobFilter.
+func (s *Server) IndexJob(w http.ResponseWriter, r *http.Request) {
+	show, ok := s.jobFilter(w, r)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	job, err := s.jobs.Get(id)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, datastore.ErrNotFound) {
+			code = http.StatusNotFound
+		}
+		s.writeStatus(w, fmt.Sprintf("Failed to get index job: %v; error %v", id, err), code)
+		return
+	}
+	s.writeJob(w, show(job), http.StatusOK)
+}
+
+// CancelIndexJob cancels a running index job. The job stops once the doc being processed is finished. Only
+// authenticated callers can cancel jobs.
+func (s *Server) CancelIndexJob(w http.ResponseWriter, r *http.Request) {
+	if CallerFromContext(r.Context()) == nil {
+		s.writeStatus(w, "Only authenticated callers can cancel index jobs", http.StatusForbidden)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	if err := s.jobs.Cancel(id); err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, datastore.ErrNotFound) {
+			code = http.StatusNotFound
+		} else if errors.Is(err, gdocs.ErrJobNotRunning) {
+			code = http.StatusConflict
+		}
+		s.writeStatus(w, fmt.Sprintf("Failed to cancel index job: %v; error %v", id, err), code)
+		return
+	}
+	s.writeStatus(w, fmt.Sprintf("Cancelling index job %v", id), http.StatusOK)
+}
+
+// IndexJobs lists the index jobs starting with the most recent. The optional query parameter limit caps the
+// number of jobs returned. Only authenticated callers can list jobs; see jobFilter.
+func (s *Server) IndexJobs(w http.ResponseWriter, r *http.Request) {
+	show, ok := s.jobFilter(w, r)
+	if !ok {
+		return
+	}
+
+	limit, err := parseLimit(r)
+	if err != nil {
+		s.writeStatus(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	jobs, err := s.jobs.List(limit)
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to list index jobs; error %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	jobList := &api.IndexJobList{
+		Items: make([]api.IndexJob, len(jobs)),
+	}
+
+	for i, j := range jobs {
+		jobList.Items[i] = toIndexJob(show(j))
+	}
+	payload, err := json.Marshal(jobList)
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to encode IndexJobList; error %v", err), http.StatusInternalServerError)
+		return
+	}
+	if _, err := w.Write(payload); err != nil {
+		s.log.Error(err, "Failed to write response")
+	}
+}
+
+// jobFilter returns a function which removes the details of a job the caller shouldn't see i.e. the caller who
+// started it, the file and the error which can contain doc names. Callers see the details of the jobs they
+// started and of jobs indexing docs they can read. Only authenticated callers can read jobs; if the caller isn't
+// authenticated or the filter can't be created an error is written to w and ok is false.
+func (s *Server) jobFilter(w http.ResponseWriter, r *http.Request) (show func(j *datastore.IndexJob) *datastore.IndexJob, ok bool) {
+	c := CallerFromContext(r.Context())
+	if c == nil {
+		s.writeStatus(w, "Only authenticated callers can read index jobs", http.StatusForbidden)
+		return nil, false
+	}
+
+	visible, ok := s.docFilter(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	return func(j *datastore.IndexJob) *datastore.IndexJob {
+		if j.Caller == c.Email || (j.FileID != "" && visible(datastore.DriveKey(j.FileID))) || (j.FileID == "" && !s.aclFilter) {
+			return j
+		}
+		stripped := *j
+		stripped.Caller = ""
+		stripped.FileID = ""
+		stripped.Error = ""
+		return &stripped
+	}, true
+}
+
+// writeJob writes the job with the status code. The job is encoded before writing the header so encoding
+// errors can still be reported.
+func (s *Server) writeJob(w http.ResponseWriter, job *datastore.IndexJob, code int) {
+	payload, err := json.Marshal(toIndexJob(job))
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to encode IndexJob; error %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(code)
+	if _, err := w.Write(payload); err != nil {
+		s.log.Error(err, "Failed to write response")
+	}
+}
+
+func toIndexJob(j *datastore.IndexJob) api.IndexJob {
+	job := api.IndexJob{
+		Id:            j.ID,
+		Drive:         j.DriveID,
+		File:          j.FileID,
+		State:         j.State,
+		Caller:        j.Caller,
+		DocsTotal:     j.DocsTotal,
+		DocsProcessed: j.DocsProcessed,
+		Error:         j.Error,
+		StartTime:     j.StartTime.UTC().Format(time.RFC3339),
+	}
+
+	if !j.EndTime.IsZero() {
+		job.EndTime = j.EndTime.UTC().Format(time.RFC3339)
+	}
+	return job
+}
+
+// parseLimit parses the optional query parameter limit. 0 means no limit.
+func parseLimit(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return 0, nil
+	}
+
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < 0 {
+		return 0, errors.Errorf("Invalid limit %v; must be a non-negative integer", v)
+	}
+	return limit, nil
+}
+
 func (s *Server) NotFoundHandler(w http.ResponseWriter, r *http.Request) {
 	s.writeStatus(w, fmt.Sprintf("feed backend server doesn't handle the path; url: %v", r.URL), http.StatusNotFound)
 }
@@ -123,23 +1070,72 @@ func (s *Server) NotFoundHandler(w http.ResponseWriter, r *http.Request) {
 // StartAndBlock starts the server and blocks.
 func (s *Server) StartAndBlock() error {
 	log := s.log
+	s.httpServer.Handler = s.router()
+
+	log.Info("Gateway is running", "address", s.Address())
+	err := s.httpServer.Serve(s.listener)
+
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	if err != nil {
+		log.Error(err, "Server returned error")
+	}
+	return err
+}
+
+// Shutdown gracefully shuts down the server started by StartAndBlock. StartAndBlock returns once in flight
+// requests finish or ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.httpServer == nil {
+		return nil
+	}
+	return s.httpServer.Shutdown(ctx)
+}
+
+// router creates the router for all the server's handlers.
+func (s *Server) router() *mux.Router {
+	log := s.log
 
 	router := mux.NewRouter().StrictSlash(true)
 
 	// This will serve files under http://localhost:8000/ui/<filename>
 	// This should match the --base-href argument used to compile the flutter web app
 	log.Info("Configuring /ui/", "staticPath", s.staticPath)
-	router.PathPrefix("/ui/").Handler(http.StripPrefix("/ui/", http.FileServer(http.Dir(s.staticPath))))
+	router.PathPrefix(uiPath).Handler(http.StripPrefix(uiPath, http.FileServer(http.Dir(s.staticPath))))
 
-	router.HandleFunc("/healthz", s.HealthCheck)
+	router.HandleFunc(healthPath, s.HealthCheck)
+	if s.login != nil {
+		router.HandleFunc(loginPath, s.Login)
+		router.HandleFunc(callbackPath, s.AuthCallback)
+		// Logout only accepts POST so other sites can't log users out with a link or image.
+		router.HandleFunc(logoutPath, s.Logout).Methods(http.MethodPost)
+	}
+	if s.jobs != nil {
+		router.HandleFunc(indexRunPath, s.IndexRun).Methods(http.MethodPost)
+		router.HandleFunc(indexJobsPath, s.IndexJobs).Methods(http.MethodGet)
+		// The cancel route must be registered before indexJobPath since {id} would also match "<id>:cancel".
+		router.HandleFunc(indexJobCancelPath, s.CancelIndexJob).Methods(http.MethodPost)
+		router.HandleFunc(indexJobPath, s.IndexJob).Methods(http.MethodGet)
+	}
+	if s.events != nil {
+		router.HandleFunc(indexEventsPath, s.IndexEvents).Methods(http.MethodGet)
+	}
+	router.HandleFunc(documentsPath, s.Documents).Methods(http.MethodGet)
 	router.HandleFunc(backLinksPath, s.BackLinks)
+	router.HandleFunc(documentMentionsPath, s.DocumentMentions).Methods(http.MethodGet)
+	router.HandleFunc(entitiesPath, s.Entities).Methods(http.MethodGet)
+	router.HandleFunc(entityDocumentsPath, s.EntityDocuments)
+	router.HandleFunc(relatedEntitiesPath, s.RelatedEntities)
+	router.HandleFunc(entityTimelinePath, s.EntityTimeline)
+	router.HandleFunc(personDocumentsPath, s.PersonDocuments)
+	router.HandleFunc(categoriesPath, s.Categories)
+	router.HandleFunc(categoryDocumentsPath, s.CategoryDocuments)
+	router.HandleFunc(keyphrasesPath, s.Keyphrases)
+	router.HandleFunc(keyphraseSearchPath, s.KeyphraseSearch)
+	router.HandleFunc(statsPath, s.Stats).Methods(http.MethodGet)
 	router.NotFoundHandler = http.HandlerFunc(s.NotFoundHandler)
-
-	log.Info("Gateway is running", "address", s.Address())
-	err := http.Serve(s.listener, router)
-
-	if err != nil {
-		log.Error(err, "Server returned error")
-	}
-	return err
+	router.Use(s.authenticate)
+	return router
 }
@@ -1,17 +1,26 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/go-logr/logr"
 	"github.com/google/go-cmp/cmp"
 	"github.com/gorilla/mux"
+	"github.com/jlewi/p22h/backend/api"
 	"github.com/jlewi/p22h/backend/pkg/datastore"
+	"github.com/jlewi/p22h/backend/pkg/gdocs"
+	"github.com/jlewi/p22h/backend/pkg/glanguage"
 	"github.com/jlewi/p22h/backend/pkg/logging"
+	"google.golang.org/api/docs/v1"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"path"
+	"strings"
 	"testing"
+	"time"
 )
 
 func createDatastore(t *testing.T, logger logr.Logger, docLinks []*datastore.DocLink) *datastore.Datastore {
@@ -109,3 +118,686 @@ func TestServer_Backlinks(t *testing.T) {
 		})
 	}
 }
+
+func TestServer_EntityDocuments(t *testing.T) {
+	log, err := logging.InitLogger("info", true)
+	if err != nil {
+		t.Fatalf("Failed to initialize the logger")
+	}
+
+	store := createDatastore(t, *log, []*datastore.DocLink{})
+	mentions := []*datastore.EntityMention{
+		{DocID: "doc1", EntityID: "kubeflow", StartIndex: 0, EndIndex: 8, Salience: 0.25},
+		{DocID: "doc2", EntityID: "kubeflow", StartIndex: 0, EndIndex: 8, Salience: 0.5, SentimentScore: 1, SentimentMagnitude: 1},
+	}
+	for _, m := range mentions {
+		if err := store.UpdateEntityMention(m); err != nil {
+			t.Fatalf("Failed to add mention; error %v", err)
+		}
+	}
+
+	s := Server{
+		log:   *log,
+		store: store,
+	}
+	req := httptest.NewRequest(http.MethodGet, "/entities/kubeflow:documents", nil)
+	resp := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	router.HandleFunc(entityDocumentsPath, s.EntityDocuments)
+	router.ServeHTTP(resp, req)
+
+	result := resp.Result()
+	if result.StatusCode != http.StatusOK {
+		t.Fatalf("Got Code %v; want %v", result.StatusCode, http.StatusOK)
+	}
+
+	read, err := ioutil.ReadAll(result.Body)
+	if err != nil {
+		t.Fatalf("failed to read the response; error: %v", err)
+	}
+
+	expected := `{"items":[{"docId":"doc2","salience":0.5,"mentions":1,"sentimentScore":1,"sentimentMagnitude":1},{"docId":"doc1","salience":0.25,"mentions":1,"sentimentScore":0,"sentimentMagnitude":0}]}`
+	if d := cmp.Diff(expected, string(read)); d != "" {
+		t.Errorf("Unexpected diff for body; Got:\n%v", d)
+	}
+}
+
+func TestServer_CategoryDocuments(t *testing.T) {
+	log, err := logging.InitLogger("info", true)
+	if err != nil {
+		t.Fatalf("Failed to initialize the logger")
+	}
+
+	store := createDatastore(t, *log, []*datastore.DocLink{})
+	cats := map[string][]*datastore.DocCategory{
+		"doc1": {{DocID: "doc1", Category: "/Computers \u0026 Electronics/Software", Confidence: 0.75}},
+		"doc2": {{DocID: "doc2", Category: "/Science", Confidence: 0.5}},
+	}
+	for docId, c := range cats {
+		if err := store.ReplaceDocCategories(docId, c); err != nil {
+			t.Fatalf("Failed to add categories; error %v", err)
+		}
+	}
+
+	s := Server{
+		log:   *log,
+		store: store,
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc(categoriesPath, s.Categories)
+	router.HandleFunc(categoryDocumentsPath, s.CategoryDocuments)
+
+	type testCase struct {
+		name     string
+		url      string
+		code     int
+		expected string
+	}
+
+	cases := []testCase{
+		{
+			name:     "categories",
+			url:      "/categories",
+			code:     http.StatusOK,
+			expected: `{"items":[{"name":"/Computers \u0026 Electronics/Software","documents":1},{"name":"/Science","documents":1}]}`,
+		},
+		{
+			name:     "documents",
+			url:      "/categories:documents?category=" + url.QueryEscape("/Computers & Electronics"),
+			code:     http.StatusOK,
+			expected: `{"items":[{"docId":"doc1","category":"/Computers \u0026 Electronics/Software","confidence":0.75}]}`,
+		},
+		{
+			name: "missing-category",
+			url:  "/categories:documents",
+			code: http.StatusBadRequest,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, c.url, nil)
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			result := resp.Result()
+			if result.StatusCode != c.code {
+				t.Fatalf("Got Code %v; want %v", result.StatusCode, c.code)
+			}
+
+			if c.expected == "" {
+				return
+			}
+
+			read, err := ioutil.ReadAll(result.Body)
+			if err != nil {
+				t.Fatalf("failed to read the response; error: %v", err)
+			}
+
+			if d := cmp.Diff(c.expected, string(read)); d != "" {
+				t.Errorf("Unexpected diff for body; Got:\n%v", d)
+			}
+		})
+	}
+}
+
+func TestServer_KeyphraseSearch(t *testing.T) {
+	log, err := logging.InitLogger("info", true)
+	if err != nil {
+		t.Fatalf("Failed to initialize the logger")
+	}
+
+	store := createDatastore(t, *log, []*datastore.DocLink{})
+	mentions := map[string][]*datastore.KeyphraseMention{
+		"doc1": {{DocID: "doc1", KeyphraseID: "feature store", StartIndex: 0, EndIndex: 13}},
+		"doc2": {
+			{DocID: "doc2", KeyphraseID: "feature store", StartIndex: 0, EndIndex: 13},
+			{DocID: "doc2", KeyphraseID: "canary rollout", StartIndex: 20, EndIndex: 34},
+		},
+	}
+	for docId, m := range mentions {
+		if err := store.ReplaceKeyphraseMentions(docId, m); err != nil {
+			t.Fatalf("Failed to add mentions; error %v", err)
+		}
+	}
+
+	if err := store.UpdateKeyphraseWeights(); err != nil {
+		t.Fatalf("Failed to update weights; error %v", err)
+	}
+
+	s := Server{
+		log:   *log,
+		store: store,
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc(keyphrasesPath, s.Keyphrases)
+	router.HandleFunc(keyphraseSearchPath, s.KeyphraseSearch)
+
+	type testCase struct {
+		name     string
+		url      string
+		code     int
+		expected string
+	}
+
+	cases := []testCase{
+		{
+			name:     "keyphrases",
+			url:      "/keyphrases?limit=1",
+			code:     http.StatusOK,
+			expected: `{"items":[{"phrase":"feature store","documents":2}]}`,
+		},
+		{
+			name:     "search",
+			url:      "/keyphrases:search?q=Feature",
+			code:     http.StatusOK,
+			expected: `{"items":[{"docId":"doc1","phrase":"feature store","mentions":1,"weight":1},{"docId":"doc2","phrase":"feature store","mentions":1,"weight":0.5}]}`,
+		},
+		{
+			name: "missing-query",
+			url:  "/keyphrases:search",
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "bad-limit",
+			url:  "/keyphrases?limit=abc",
+			code: http.StatusBadRequest,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, c.url, nil)
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			result := resp.Result()
+			if result.StatusCode != c.code {
+				t.Fatalf("Got Code %v; want %v", result.StatusCode, c.code)
+			}
+
+			if c.expected == "" {
+				return
+			}
+
+			read, err := ioutil.ReadAll(result.Body)
+			if err != nil {
+				t.Fatalf("failed to read the response; error: %v", err)
+			}
+
+			if d := cmp.Diff(c.expected, string(read)); d != "" {
+				t.Errorf("Unexpected diff for body; Got:\n%v", d)
+			}
+		})
+	}
+}
+
+func TestServer_RelatedEntities(t *testing.T) {
+	log, err := logging.InitLogger("info", true)
+	if err != nil {
+		t.Fatalf("Failed to initialize the logger")
+	}
+
+	store := createDatastore(t, *log, []*datastore.DocLink{})
+	if err := store.UpdateEntity(&datastore.Entity{ID: "kafka", Name: "Kafka", Type: "CONSUMER_GOOD"}); err != nil {
+		t.Fatalf("Failed to add entity; error %v", err)
+	}
+
+	mentions := []*datastore.EntityMention{
+		{DocID: "doc1", EntityID: "projectx", StartIndex: 0, EndIndex: 9, Sentence: 1},
+		{DocID: "doc1", EntityID: "kafka", StartIndex: 15, EndIndex: 20, Sentence: 1},
+	}
+	for _, m := range mentions {
+		if err := store.UpdateEntityMention(m); err != nil {
+			t.Fatalf("Failed to add mention; error %v", err)
+		}
+	}
+
+	if err := store.UpdateEntityCooccurrences(); err != nil {
+		t.Fatalf("Failed to update co-occurrences; error %v", err)
+	}
+
+	s := Server{
+		log:   *log,
+		store: store,
+	}
+	req := httptest.NewRequest(http.MethodGet, "/entities/projectx:related", nil)
+	resp := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	router.HandleFunc(relatedEntitiesPath, s.RelatedEntities)
+	router.ServeHTTP(resp, req)
+
+	result := resp.Result()
+	if result.StatusCode != http.StatusOK {
+		t.Fatalf("Got Code %v; want %v", result.StatusCode, http.StatusOK)
+	}
+
+	read, err := ioutil.ReadAll(result.Body)
+	if err != nil {
+		t.Fatalf("failed to read the response; error: %v", err)
+	}
+
+	expected := `{"items":[{"id":"kafka","name":"Kafka","type":"CONSUMER_GOOD","documents":1,"sentences":1}]}`
+	if d := cmp.Diff(expected, string(read)); d != "" {
+		t.Errorf("Unexpected diff for body; Got:\n%v", d)
+	}
+}
+
+func TestServer_EntityTimeline(t *testing.T) {
+	log, err := logging.InitLogger("info", true)
+	if err != nil {
+		t.Fatalf("Failed to initialize the logger")
+	}
+
+	store := createDatastore(t, *log, []*datastore.DocLink{})
+	refs := []*datastore.DocReference{
+		{DriveId: "doc1", Name: "Doc 1", ModifiedTime: time.Date(2022, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{DriveId: "doc2", Name: "Doc 2", ModifiedTime: time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, r := range refs {
+		if err := store.UpdateDocReference(r); err != nil {
+			t.Fatalf("Failed to add doc reference; error %v", err)
+		}
+	}
+
+	mentions := []*datastore.EntityMention{
+		{DocID: datastore.DriveKey("doc1"), EntityID: "kubeflow", StartIndex: 0, EndIndex: 8},
+		{DocID: datastore.DriveKey("doc2"), EntityID: "kubeflow", StartIndex: 0, EndIndex: 8},
+	}
+	for _, m := range mentions {
+		if err := store.UpdateEntityMention(m); err != nil {
+			t.Fatalf("Failed to add mention; error %v", err)
+		}
+	}
+
+	s := Server{
+		log:   *log,
+		store: store,
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc(entityTimelinePath, s.EntityTimeline)
+
+	type testCase struct {
+		name     string
+		url      string
+		code     int
+		expected string
+	}
+
+	cases := []testCase{
+		{
+			name:     "month",
+			url:      "/entities/kubeflow:timeline",
+			code:     http.StatusOK,
+			expected: `{"interval":"month","items":[{"start":"2022-01-01","mentions":1,"documents":[{"docId":"gdrive.doc1","name":"Doc 1","modifiedTime":"2022-01-05T00:00:00Z","mentions":1}]},{"start":"2022-03-01","mentions":1,"documents":[{"docId":"gdrive.doc2","name":"Doc 2","modifiedTime":"2022-03-01T00:00:00Z","mentions":1}]}]}`,
+		},
+		{
+			name: "bad-interval",
+			url:  "/entities/kubeflow:timeline?interval=year",
+			code: http.StatusBadRequest,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, c.url, nil)
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			result := resp.Result()
+			if result.StatusCode != c.code {
+				t.Fatalf("Got Code %v; want %v", result.StatusCode, c.code)
+			}
+
+			if c.expected == "" {
+				return
+			}
+
+			read, err := ioutil.ReadAll(result.Body)
+			if err != nil {
+				t.Fatalf("failed to read the response; error: %v", err)
+			}
+
+			if d := cmp.Diff(c.expected, string(read)); d != "" {
+				t.Errorf("Unexpected diff for body; Got:\n%v", d)
+			}
+		})
+	}
+}
+
+func TestServer_PersonDocuments(t *testing.T) {
+	log, err := logging.InitLogger("info", true)
+	if err != nil {
+		t.Fatalf("Failed to initialize the logger")
+	}
+
+	store := createDatastore(t, *log, []*datastore.DocLink{})
+	alice, err := store.UpdatePerson("alice@example.com", "Alice")
+	if err != nil {
+		t.Fatalf("Failed to add person; error %v", err)
+	}
+
+	rows := []*datastore.DocPerson{
+		{DocID: "doc1", EntityID: alice.ID, Role: datastore.RoleOwner},
+		{DocID: "doc1", EntityID: alice.ID, Role: "writer"},
+	}
+	if err := store.ReplaceDocPeople("doc1", rows); err != nil {
+		t.Fatalf("Failed to add doc people; error %v", err)
+	}
+
+	s := Server{
+		log:   *log,
+		store: store,
+	}
+	req := httptest.NewRequest(http.MethodGet, "/people/alice@example.com:documents?role=owner", nil)
+	resp := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	router.HandleFunc(personDocumentsPath, s.PersonDocuments)
+	router.ServeHTTP(resp, req)
+
+	result := resp.Result()
+	if result.StatusCode != http.StatusOK {
+		t.Fatalf("Got Code %v; want %v", result.StatusCode, http.StatusOK)
+	}
+
+	read, err := ioutil.ReadAll(result.Body)
+	if err != nil {
+		t.Fatalf("failed to read the response; error: %v", err)
+	}
+
+	expected := `{"entityId":"person.alice@example.com","items":[{"docId":"doc1","role":"owner"}]}`
+	if d := cmp.Diff(expected, string(read)); d != "" {
+		t.Errorf("Unexpected diff for body; Got:\n%v", d)
+	}
+}
+
+func TestServer_ACLFilter(t *testing.T) {
+	log, err := logging.InitLogger("info", true)
+	if err != nil {
+		t.Fatalf("Failed to initialize the logger")
+	}
+
+	store := createDatastore(t, *log, []*datastore.DocLink{
+		{Text: "fromDoc2", SourceID: "doc2", DestID: "doc1"},
+		{Text: "fromDoc3", SourceID: "doc3", DestID: "doc1"},
+	})
+
+	acls := map[string][]*datastore.DocPermission{
+		"doc1": {{DocID: "doc1", Type: datastore.PrincipalUser, Principal: "alice@example.com", Role: "owner"}},
+		"doc2": {{DocID: "doc2", Type: datastore.PrincipalGroup, Principal: "eng@example.com", Role: "reader"}},
+		// doc3 has no permissions so it isn't visible to anyone.
+	}
+	for docId, p := range acls {
+		if err := store.ReplaceDocPermissions(docId, p); err != nil {
+			t.Fatalf("Failed to add permissions; error %v", err)
+		}
+	}
+
+	cats := map[string][]*datastore.DocCategory{
+		"doc1": {{DocID: "doc1", Category: "/Science", Confidence: 0.5}},
+		"doc2": {{DocID: "doc2", Category: "/Science", Confidence: 0.5}},
+		"doc3": {{DocID: "doc3", Category: "/Arts", Confidence: 0.5}},
+	}
+	for docId, c := range cats {
+		if err := store.ReplaceDocCategories(docId, c); err != nil {
+			t.Fatalf("Failed to add categories; error %v", err)
+		}
+	}
+
+	s := Server{
+		log:   *log,
+		store: store,
+		authenticator: &HeaderAuthenticator{
+			Header: "X-Test-User",
+			Groups: NewStaticGroups(map[string][]string{"eng@example.com": {"alice@example.com", "carol@example.com"}}),
+		},
+		aclFilter: true,
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc(backLinksPath, s.BackLinks)
+	router.HandleFunc(categoriesPath, s.Categories)
+	router.Use(s.authenticate)
+
+	type testCase struct {
+		name     string
+		url      string
+		user     string
+		code     int
+		expected string
+	}
+
+	cases := []testCase{
+		{
+			name: "unauthenticated",
+			url:  "/categories",
+			code: http.StatusUnauthorized,
+		},
+		{
+			name:     "categories-owner",
+			url:      "/categories",
+			user:     "accounts.google.com:alice@example.com",
+			code:     http.StatusOK,
+			expected: `{"items":[{"name":"/Science","documents":2}]}`,
+		},
+		{
+			name:     "categories-group",
+			url:      "/categories",
+			user:     "carol@example.com",
+			code:     http.StatusOK,
+			expected: `{"items":[{"name":"/Science","documents":1}]}`,
+		},
+		{
+			name:     "backlinks",
+			url:      "/documents/doc1:backLinks",
+			user:     "alice@example.com",
+			code:     http.StatusOK,
+			expected: `{"items":[{"text":"fromDoc2","docId":"doc2"}]}`,
+		},
+		{
+			name: "backlinks-not-visible",
+			url:  "/documents/doc1:backLinks",
+			user: "carol@example.com",
+			code: http.StatusNotFound,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, c.url, nil)
+			if c.user != "" {
+				req.Header.Set("X-Test-User", c.user)
+			}
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			result := resp.Result()
+			if result.StatusCode != c.code {
+				t.Fatalf("Got Code %v; want %v", result.StatusCode, c.code)
+			}
+
+			if c.expected == "" {
+				return
+			}
+
+			read, err := ioutil.ReadAll(result.Body)
+			if err != nil {
+				t.Fatalf("failed to read the response; error: %v", err)
+			}
+
+			if d := cmp.Diff(c.expected, string(read)); d != "" {
+				t.Errorf("Unexpected diff for body; Got:\n%v", d)
+			}
+		})
+	}
+}
+
+// emptySearcher is a DriveSearch which finds no files.
+type emptySearcher struct{}
+
+func (s *emptySearcher) Search(query string, driveId string, corpora string, resultFunc gdocs.ResultFunc) error {
+	return nil
+}
+
+// nopClient is a glanguage.Client for tests which shouldn't call the Natural Language API.
+type nopClient struct {
+	glanguage.Client
+}
+
+func TestServer_IndexJobs(t *testing.T) {
+	log, err := logging.InitLogger("info", true)
+	if err != nil {
+		t.Fatalf("Failed to initialize the logger")
+	}
+
+	store := createDatastore(t, *log, []*datastore.DocLink{})
+	newIndexer := func(opts ...gdocs.IndexerOption) (*gdocs.Indexer, error) {
+		return gdocs.NewIndexer(&emptySearcher{}, &docs.Service{}, store, &nopClient{}, *log, opts...)
+	}
+
+	jobs, err := gdocs.NewJobManager(store, newIndexer, *log)
+	if err != nil {
+		t.Fatalf("Failed to create job manager; error %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen; error %v", err)
+	}
+	defer listener.Close()
+	if _, err := NewServer(".", listener, store, *log, ServerWithIndexJobs(jobs)); err == nil {
+		t.Errorf("NewServer served index jobs without an authenticator; want error")
+	}
+
+	s := &Server{
+		log:           *log,
+		store:         store,
+		jobs:          jobs,
+		authenticator: &HeaderAuthenticator{Header: "X-Test-User"},
+	}
+	router := s.router()
+
+	user := "alice@example.com"
+	do := func(method string, url string, body string) (int, string) {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if user != "" {
+			req.Header.Set("X-Test-User", user)
+		}
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		read, err := ioutil.ReadAll(resp.Result().Body)
+		if err != nil {
+			t.Fatalf("failed to read the response; error: %v", err)
+		}
+		return resp.Result().StatusCode, string(read)
+	}
+
+	// Anonymous callers can't start or cancel jobs.
+	user = ""
+	if code, _ := do(http.MethodPost, "/index:run", `{"drive":"d1"}`); code != http.StatusForbidden {
+		t.Errorf("Got code %v for an anonymous caller; want %v", code, http.StatusForbidden)
+	}
+	if code, _ := do(http.MethodPost, "/index/jobs/missing:cancel", ""); code != http.StatusForbidden {
+		t.Errorf("Got code %v cancelling as an anonymous caller; want %v", code, http.StatusForbidden)
+	}
+	if code, _ := do(http.MethodGet, "/index/jobs", ""); code != http.StatusForbidden {
+		t.Errorf("Got code %v listing jobs as an anonymous caller; want %v", code, http.StatusForbidden)
+	}
+	if code, _ := do(http.MethodGet, "/index/jobs/missing", ""); code != http.StatusForbidden {
+		t.Errorf("Got code %v getting a job as an anonymous caller; want %v", code, http.StatusForbidden)
+	}
+	user = "alice@example.com"
+
+	if code, _ := do(http.MethodPost, "/index:run", `{"drive":"d1","file":"f1"}`); code != http.StatusBadRequest {
+		t.Errorf("Got code %v for an invalid request; want %v", code, http.StatusBadRequest)
+	}
+
+	code, body := do(http.MethodPost, "/index:run", `{"drive":"d1"}`)
+	if code != http.StatusAccepted {
+		t.Fatalf("Got code %v; want %v; body %v", code, http.StatusAccepted, body)
+	}
+
+	job := &api.IndexJob{}
+	if err := json.Unmarshal([]byte(body), job); err != nil {
+		t.Fatalf("Failed to unmarshal job; error %v", err)
+	}
+	jobs.Wait()
+
+	code, body = do(http.MethodGet, "/index/jobs/"+job.Id, "")
+	if code != http.StatusOK {
+		t.Fatalf("Got code %v; want %v; body %v", code, http.StatusOK, body)
+	}
+
+	actual := &api.IndexJob{}
+	if err := json.Unmarshal([]byte(body), actual); err != nil {
+		t.Fatalf("Failed to unmarshal job; error %v", err)
+	}
+
+	if actual.State != datastore.JobSucceeded || actual.Drive != "d1" || actual.Caller != user || actual.EndTime == "" {
+		t.Errorf("Unexpected job %+v", actual)
+	}
+
+	if code, _ := do(http.MethodPost, "/index/jobs/"+job.Id+":cancel", ""); code != http.StatusConflict {
+		t.Errorf("Got code %v cancelling a finished job; want %v", code, http.StatusConflict)
+	}
+
+	if code, _ := do(http.MethodGet, "/index/jobs/missing", ""); code != http.StatusNotFound {
+		t.Errorf("Got code %v for a missing job; want %v", code, http.StatusNotFound)
+	}
+
+	code, body = do(http.MethodGet, "/index/jobs", "")
+	list := &api.IndexJobList{}
+	if err := json.Unmarshal([]byte(body), list); err != nil {
+		t.Fatalf("Failed to unmarshal jobs; error %v", err)
+	}
+
+	if code != http.StatusOK || len(list.Items) != 1 {
+		t.Errorf("Got code %v and %v jobs; want %v and 1", code, len(list.Items), http.StatusOK)
+	}
+
+	// With ACL filtering other callers don't see the details of jobs indexing docs they can't read.
+	s.aclFilter = true
+	code, body = do(http.MethodPost, "/index:run", `{"file":"f1"}`)
+	if code != http.StatusAccepted {
+		t.Fatalf("Got code %v; want %v; body %v", code, http.StatusAccepted, body)
+	}
+	fileJob := &api.IndexJob{}
+	if err := json.Unmarshal([]byte(body), fileJob); err != nil {
+		t.Fatalf("Failed to unmarshal job; error %v", err)
+	}
+	jobs.Wait()
+
+	get := func(caller string) *api.IndexJob {
+		user = caller
+		code, body := do(http.MethodGet, "/index/jobs/"+fileJob.Id, "")
+		if code != http.StatusOK {
+			t.Fatalf("Got code %v; want %v; body %v", code, http.StatusOK, body)
+		}
+		j := &api.IndexJob{}
+		if err := json.Unmarshal([]byte(body), j); err != nil {
+			t.Fatalf("Failed to unmarshal job; error %v", err)
+		}
+		return j
+	}
+
+	if j := get("alice@example.com"); j.Caller != "alice@example.com" || j.File != "f1" {
+		t.Errorf("The caller who started the job got %+v; want the caller and file", j)
+	}
+	if j := get("bob@example.com"); j.Caller != "" || j.File != "" || j.Error != "" {
+		t.Errorf("Another caller got %+v; want the caller, file and error removed", j)
+	}
+
+	perms := []*datastore.DocPermission{{DocID: datastore.DriveKey("f1"), Type: datastore.PrincipalUser, Principal: "bob@example.com", Role: "reader"}}
+	if err := store.ReplaceDocPermissions(datastore.DriveKey("f1"), perms); err != nil {
+		t.Fatalf("Failed to add permissions; error %v", err)
+	}
+	if j := get("bob@example.com"); j.Caller != "alice@example.com" || j.File != "f1" {
+		t.Errorf("A caller who can read the file got %+v; want the caller and file", j)
+	}
+}
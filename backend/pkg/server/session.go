@@ -0,0 +1,212 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookie = "p22h_session"
+	// loginCookie holds the state of an in progress login.
+	loginCookie = "p22h_login"
+
+	// minSessionKeyLength is the minimum number of bytes in the key used to sign cookies.
+	minSessionKeyLength = 32
+
+	loginTTL = 10 * time.Minute
+)
+
+// Sessions issues and validates session cookies.
+//
+// Sessions are stateless; the cookie contains the email of the user and its expiration signed with an HMAC.
+// Consequently sessions can't be revoked before they expire except by changing the key.
+type Sessions struct {
+	key []byte
+	ttl time.Duration
+	// secure if true sets the Secure attribute on cookies so they are only sent over https.
+	secure bool
+	now    func() time.Time
+}
+
+// signedValue is the payload of a signed cookie. Name is the name of the cookie so a cookie can't be replayed as
+// another cookie signed with the same key.
+type signedValue struct {
+	Name    string          `json:"name"`
+	Expires int64           `json:"exp"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// sessionData is the data stored in the session cookie.
+type sessionData struct {
+	Email string `json:"email"`
+}
+
+// loginState is the data stored in the login cookie while the user is redirected to the OIDC provider.
+type loginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	ReturnTo string `json:"returnTo"`
+}
+
+// NewSessions creates a new session manager. key is used to sign cookies and must be at least 32 bytes.
+// ttl is how long sessions last. secure should be true when the server is served over https.
+func NewSessions(key []byte, ttl time.Duration, secure bool) (*Sessions, error) {
+	if len(key) < minSessionKeyLength {
+		return nil, errors.Errorf("Session key must be at least %v bytes; got %v", minSessionKeyLength, len(key))
+	}
+
+	if ttl <= 0 {
+		return nil, errors.Errorf("Session ttl must be positive; got %v", ttl)
+	}
+
+	return &Sessions{
+		key:    key,
+		ttl:    ttl,
+		secure: secure,
+		now:    time.Now,
+	}, nil
+}
+
+// ReadSessionKey reads the key used to sign cookies from a file. Leading and trailing whitespace is removed.
+func ReadSessionKey(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read session key from file: %v", path)
+	}
+	return []byte(strings.TrimSpace(string(b))), nil
+}
+
+// NewSessionKey generates a random key suitable for signing cookies.
+func NewSessionKey() ([]byte, error) {
+	key := make([]byte, minSessionKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, errors.Wrapf(err, "Failed to generate session key")
+	}
+	return key, nil
+}
+
+// Start starts a session for email by setting the session cookie.
+func (s *Sessions) Start(w http.ResponseWriter, email string) error {
+	return s.setCookie(w, sessionCookie, "/", sessionData{Email: email}, s.ttl)
+}
+
+// Email returns the email of the user the session belongs to. An empty string is returned if there is no
+// session or it is invalid or expired.
+func (s *Sessions) Email(r *http.Request) string {
+	d := &sessionData{}
+	if err := s.readCookie(r, sessionCookie, d); err != nil {
+		return ""
+	}
+	return d.Email
+}
+
+// End ends the session by clearing the session cookie.
+func (s *Sessions) End(w http.ResponseWriter) {
+	s.clearCookie(w, sessionCookie, "/")
+}
+
+// setLoginState stores the state of a login in progress.
+func (s *Sessions) setLoginState(w http.ResponseWriter, state loginState) error {
+	return s.setCookie(w, loginCookie, authPathPrefix, state, loginTTL)
+}
+
+// loginState returns the state of the login in progress and clears it.
+func (s *Sessions) loginState(w http.ResponseWriter, r *http.Request) (*loginState, error) {
+	state := &loginState{}
+	if err := s.readCookie(r, loginCookie, state); err != nil {
+		return nil, err
+	}
+	s.clearCookie(w, loginCookie, authPathPrefix)
+	return state, nil
+}
+
+func (s *Sessions) setCookie(w http.ResponseWriter, name string, path string, data interface{}, ttl time.Duration) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to marshal cookie %v", name)
+	}
+
+	expires := s.now().Add(ttl)
+	payload, err := json.Marshal(signedValue{Name: name, Expires: expires.Unix(), Data: b})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to marshal cookie %v", name)
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    encoded + "." + base64.RawURLEncoding.EncodeToString(s.sign(encoded)),
+		Path:     path,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   s.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func (s *Sessions) readCookie(r *http.Request, name string, data interface{}) error {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return errors.Wrapf(err, "Missing cookie %v", name)
+	}
+
+	pieces := strings.Split(c.Value, ".")
+	if len(pieces) != 2 {
+		return errors.Errorf("Cookie %v is malformed", name)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(pieces[1])
+	if err != nil || !hmac.Equal(sig, s.sign(pieces[0])) {
+		return errors.Errorf("Cookie %v has an invalid signature", name)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(pieces[0])
+	if err != nil {
+		return errors.Wrapf(err, "Failed to decode cookie %v", name)
+	}
+
+	v := &signedValue{}
+	if err := json.Unmarshal(payload, v); err != nil {
+		return errors.Wrapf(err, "Failed to unmarshal cookie %v", name)
+	}
+
+	if v.Name != name {
+		return errors.Errorf("Cookie %v was issued as cookie %v", name, v.Name)
+	}
+
+	if s.now().Unix() >= v.Expires {
+		return errors.Errorf("Cookie %v expired", name)
+	}
+
+	if err := json.Unmarshal(v.Data, data); err != nil {
+		return errors.Wrapf(err, "Failed to unmarshal cookie %v", name)
+	}
+	return nil
+}
+
+func (s *Sessions) clearCookie(w http.ResponseWriter, name string, path string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    "",
+		Path:     path,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   s.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (s *Sessions) sign(value string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_SessionCookieReplay(t *testing.T) {
+	key, err := NewSessionKey()
+	if err != nil {
+		t.Fatalf("Failed to create session key; error %v", err)
+	}
+
+	sessions, err := NewSessions(key, time.Hour, false)
+	if err != nil {
+		t.Fatalf("Failed to create sessions; error %v", err)
+	}
+
+	// Sign session data as the login cookie.
+	w := httptest.NewRecorder()
+	if err := sessions.setCookie(w, loginCookie, authPathPrefix, sessionData{Email: "eve@example.com"}, loginTTL); err != nil {
+		t.Fatalf("Failed to set cookie; error %v", err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != loginCookie {
+		t.Fatalf("Got cookies %v; want the login cookie", cookies)
+	}
+
+	// The cookie is signed with the same key as sessions but can't be used as a session.
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: cookies[0].Value})
+	if email := sessions.Email(r); email != "" {
+		t.Errorf("Login cookie replayed as a session cookie was accepted for %q", email)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: loginCookie, Value: cookies[0].Value})
+	if _, err := sessions.loginState(httptest.NewRecorder(), r); err != nil {
+		t.Errorf("Failed to read the cookie under its own name; error %v", err)
+	}
+}
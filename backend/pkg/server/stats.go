@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jlewi/p22h/backend/api"
+	"github.com/jlewi/p22h/backend/pkg/datastore"
+	"net/http"
+)
+
+const (
+	// defaultStatsLimit is the number of items in the top lists of the stats when the request doesn't specify a
+	// limit.
+	defaultStatsLimit = 10
+)
+
+// Stats returns statistics about the index; the number of docs and links and the most mentioned entities and most
+// linked docs. The optional query parameter limit caps the number of items in each list; it defaults to
+// defaultStatsLimit.
+func (s *Server) Stats(w http.ResponseWriter, r *http.Request) {
+	limit, err := parseLimit(r)
+	if err != nil {
+		s.writeStatus(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.URL.Query().Get("limit") == "" {
+		limit = defaultStatsLimit
+	}
+
+	q := datastore.StatsQuery{Limit: limit}
+	if s.aclFilter {
+		ids, ok := s.visibleDocIds(w, r)
+		if !ok {
+			return
+		}
+		q.DocIDs = ids
+	}
+
+	stats, err := s.store.IndexStats(q)
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to compute stats; error %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	payload, err := json.Marshal(toStats(stats))
+	if err != nil {
+		s.writeStatus(w, fmt.Sprintf("Failed to encode Stats; error %v", err), http.StatusInternalServerError)
+		return
+	}
+	if _, err := w.Write(payload); err != nil {
+		s.log.Error(err, "Failed to write response")
+	}
+}
+
+func toStats(stats *datastore.IndexStats) *api.Stats {
+	result := &api.Stats{
+		Docs: api.DocStats{
+			Total:      stats.Docs.Total,
+			ByMimeType: stats.Docs.ByMimeType,
+			ByState:    stats.Docs.ByState,
+			Unlinked:   stats.Docs.NumUnlinked,
+		},
+		Links: api.LinkStats{
+			Total:    stats.Links.Total,
+			Internal: stats.Links.Internal,
+			External: stats.Links.External,
+			Resolved: stats.Links.Resolved,
+			Dangling: stats.Links.Dangling,
+		},
+		TopEntities:   make([]api.EntityCount, 0, len(stats.TopEntities)),
+		TopLinkedDocs: toLinkedDocs(stats.TopLinkedDocs),
+		Unlinked:      toLinkedDocs(stats.Unlinked),
+	}
+
+	for _, e := range stats.TopEntities {
+		result.TopEntities = append(result.TopEntities, api.EntityCount{
+			Id:        e.EntityID,
+			Name:      e.Name,
+			Type:      e.Type,
+			Mentions:  e.NumMentions,
+			Documents: e.NumDocuments,
+		})
+	}
+	return result
+}
+
+func toLinkedDocs(docs []*datastore.LinkedDoc) []api.LinkedDoc {
+	result := make([]api.LinkedDoc, 0, len(docs))
+	for _, d := range docs {
+		result = append(result, api.LinkedDoc{
+			DocId:   d.DocID,
+			Name:    d.Name,
+			Links:   d.NumLinks,
+			Sources: d.NumSources,
+		})
+	}
+	return result
+}
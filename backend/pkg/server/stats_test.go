@@ -0,0 +1,118 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/mux"
+	"github.com/jlewi/p22h/backend/api"
+	"github.com/jlewi/p22h/backend/pkg/datastore"
+	"github.com/jlewi/p22h/backend/pkg/logging"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServer_Stats(t *testing.T) {
+	log, err := logging.InitLogger("info", true)
+	if err != nil {
+		t.Fatalf("Failed to initialize the logger")
+	}
+
+	store := createDatastore(t, *log, []*datastore.DocLink{
+		{SourceID: datastore.DriveKey("doc2"), DestID: datastore.DriveKey("doc1")},
+		{SourceID: datastore.DriveKey("doc3"), DestID: datastore.DriveKey("doc1")},
+		{SourceID: datastore.DriveKey("doc3"), URI: "https://example.com"},
+	})
+	for _, id := range []string{"doc1", "doc2", "doc3"} {
+		if err := store.UpdateDocReference(&datastore.DocReference{DriveId: id, Name: id, MimeType: "text/markdown"}); err != nil {
+			t.Fatalf("Failed to create doc; error %v", err)
+		}
+	}
+	if err := store.UpdateEntity(&datastore.Entity{ID: "e1", Name: "Kubeflow", Type: "ORGANIZATION"}); err != nil {
+		t.Fatalf("Failed to create entity; error %v", err)
+	}
+	for _, id := range []string{"doc1", "doc3"} {
+		if err := store.UpdateEntityMention(&datastore.EntityMention{DocID: datastore.DriveKey(id), EntityID: "e1"}); err != nil {
+			t.Fatalf("Failed to create mention; error %v", err)
+		}
+	}
+	// doc3 isn't visible to anyone.
+	for _, id := range []string{"doc1", "doc2"} {
+		docId := datastore.DriveKey(id)
+		if err := store.ReplaceDocPermissions(docId, []*datastore.DocPermission{{DocID: docId, Type: datastore.PrincipalUser, Principal: "alice@example.com", Role: "owner"}}); err != nil {
+			t.Fatalf("Failed to add permissions; error %v", err)
+		}
+	}
+
+	s := Server{
+		log:   *log,
+		store: store,
+	}
+
+	// get fetches the stats. The status code is returned.
+	get := func(url string, user string, stats *api.Stats) int {
+		router := mux.NewRouter()
+		router.HandleFunc(statsPath, s.Stats)
+		router.Use(s.authenticate)
+
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		if user != "" {
+			req.Header.Set("X-Test-User", user)
+		}
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		if resp.Code == http.StatusOK {
+			if err := json.Unmarshal(resp.Body.Bytes(), stats); err != nil {
+				t.Fatalf("Failed to decode the response; error %v", err)
+			}
+		}
+		return resp.Code
+	}
+
+	stats := &api.Stats{}
+	if code := get("/stats?limit=1", "", stats); code != http.StatusOK {
+		t.Fatalf("Got code %v; want %v", code, http.StatusOK)
+	}
+	expected := &api.Stats{
+		Docs: api.DocStats{
+			Total:      3,
+			ByMimeType: map[string]int64{"text/markdown": 3},
+			ByState:    map[string]int64{datastore.DocStatePending: 3},
+			Unlinked:   2,
+		},
+		Links:         api.LinkStats{Total: 3, Internal: 2, External: 1, Resolved: 2},
+		TopEntities:   []api.EntityCount{{Id: "e1", Name: "Kubeflow", Type: "ORGANIZATION", Mentions: 2, Documents: 2}},
+		TopLinkedDocs: []api.LinkedDoc{{DocId: datastore.DriveKey("doc1"), Name: "doc1", Links: 2, Sources: 2}},
+		Unlinked:      []api.LinkedDoc{{DocId: datastore.DriveKey("doc2"), Name: "doc2"}},
+	}
+	if d := cmp.Diff(expected, stats); d != "" {
+		t.Errorf("Unexpected stats; diff:\n%v", d)
+	}
+
+	if code := get("/stats?limit=-1", "", &api.Stats{}); code != http.StatusBadRequest {
+		t.Errorf("Got code %v for an invalid limit; want %v", code, http.StatusBadRequest)
+	}
+
+	// With ACL filtering the stats only count the docs the caller can read.
+	s.authenticator = &HeaderAuthenticator{Header: "X-Test-User"}
+	s.aclFilter = true
+	stats = &api.Stats{}
+	if code := get("/stats", "alice@example.com", stats); code != http.StatusOK {
+		t.Fatalf("Got code %v; want %v", code, http.StatusOK)
+	}
+	expected = &api.Stats{
+		Docs: api.DocStats{
+			Total:      2,
+			ByMimeType: map[string]int64{"text/markdown": 2},
+			ByState:    map[string]int64{datastore.DocStatePending: 2},
+			Unlinked:   1,
+		},
+		Links:         api.LinkStats{Total: 1, Internal: 1, Resolved: 1},
+		TopEntities:   []api.EntityCount{{Id: "e1", Name: "Kubeflow", Type: "ORGANIZATION", Mentions: 1, Documents: 1}},
+		TopLinkedDocs: []api.LinkedDoc{{DocId: datastore.DriveKey("doc1"), Name: "doc1", Links: 1, Sources: 1}},
+		Unlinked:      []api.LinkedDoc{{DocId: datastore.DriveKey("doc2"), Name: "doc2"}},
+	}
+	if d := cmp.Diff(expected, stats); d != "" {
+		t.Errorf("Unexpected stats for alice; diff:\n%v", d)
+	}
+}